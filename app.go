@@ -100,6 +100,8 @@ func run(args options) {
 		config.BindPort = args.bindPort
 	}
 
+	applyResourceLimits()
+
 	// Load filters from the disk
 	// And if any filter has zero ID, assign a new one
 	for i := range config.Filters {
@@ -119,6 +121,11 @@ func run(args options) {
 		}
 	}
 
+	err = initAnonymizationKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Save the updated config
 	err = config.write()
 	if err != nil {
@@ -139,6 +146,16 @@ func run(args options) {
 		if err != nil {
 			log.Fatal(err)
 		}
+
+		err = startBlockPageServer()
+		if err != nil {
+			log.Printf("Couldn't start the block page server: %s", err)
+		}
+
+		err = startDNSCryptServer()
+		if err != nil {
+			log.Printf("Couldn't start the DNSCrypt server: %s", err)
+		}
 	}
 
 	// Update filters we've just loaded right away, don't wait for periodic update timer
@@ -152,6 +169,12 @@ func run(args options) {
 	}()
 	// Schedule automatic filters updates
 	go periodicallyRefreshFilters()
+	// Notify the admin if the TLS certificate is about to expire
+	go periodicallyCheckCertExpiry()
+	// Apply the time-based filtering settings
+	go runScheduler()
+	// Check for the updates if the automatic updates are enabled
+	go runAutoUpdate()
 
 	// Initialize and run the admin Web interface
 	box := packr.NewBox("build/static")
@@ -171,6 +194,9 @@ func run(args options) {
 	// for https, we have a separate goroutine loop
 	go func() {
 		for { // this is an endless loop
+			webServersHold.Lock()
+			webServersHold.Unlock()
+
 			httpsServer.cond.L.Lock()
 			// this mechanism doesn't let us through until all conditions are ment
 			for config.TLS.Enabled == false || config.TLS.PortHTTPS == 0 || config.TLS.PrivateKey == "" || config.TLS.CertificateChain == "" { // sleep until necessary data is supplied
@@ -221,6 +247,10 @@ func run(args options) {
 	for {
 		printHTTPAddresses("http")
 
+		// the port isn't taken again while the new binary is being started by the update
+		webServersHold.Lock()
+		webServersHold.Unlock()
+
 		// we need to have new instance, because after Shutdown() the Server is not usable
 		address := net.JoinHostPort(config.BindHost, strconv.Itoa(config.BindPort))
 		httpServer = &http.Server{
@@ -271,17 +301,13 @@ func configureLogger(args options) {
 		ls.LogFile = configSyslog
 	}
 
-	if ls.LogFile == "" {
-		return
-	}
-
 	if ls.LogFile == configSyslog {
 		// Use syslog where it is possible and eventlog on Windows
 		err := configureSyslog()
 		if err != nil {
 			log.Fatalf("cannot initialize syslog: %s", err)
 		}
-	} else {
+	} else if ls.LogFile != "" {
 		logFilePath := filepath.Join(config.ourWorkingDir, ls.LogFile)
 		file, err := os.OpenFile(logFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0755)
 		if err != nil {
@@ -289,6 +315,15 @@ func configureLogger(args options) {
 		}
 		stdlog.SetOutput(file)
 	}
+
+	switch ls.LogFormat {
+	case "", logFormatText:
+		// standard logger output is text already
+	case logFormatJSON:
+		enableJSONLogging()
+	default:
+		log.Printf("Unknown log format %q, using %q", ls.LogFormat, logFormatText)
+	}
 }
 
 func cleanup() {
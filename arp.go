@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hmage/golibs/log"
+)
+
+const arpLookupTimeout = 2 * time.Second
+
+// arpEntry is a neighbour from the ARP cache
+type arpEntry struct {
+	IP       string `json:"ip"`
+	MAC      string `json:"mac"`
+	Hostname string `json:"hostname"`
+}
+
+// readARPTable returns the ARP cache entries, it reads /proc/net/arp on Linux and runs "arp -a" on other OSes
+func readARPTable() ([]arpEntry, error) {
+	f, err := os.Open("/proc/net/arp")
+	if err == nil {
+		defer f.Close()
+		return parseProcNetARP(f), nil
+	}
+
+	out, err := exec.Command("arp", "-a").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseARPCommandOutput(out), nil
+}
+
+// parseProcNetARP parses /proc/net/arp:
+// IP address       HW type     Flags       HW address            Mask     Device
+// 192.168.1.1      0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0
+func parseProcNetARP(r io.Reader) []arpEntry {
+	entries := []arpEntry{}
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // skip the header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] == "0x0" {
+			// incomplete entry
+			continue
+		}
+		entries = appendARPEntry(entries, fields[0], fields[3])
+	}
+	return entries
+}
+
+// "? (192.168.1.1) at aa:bb:cc:dd:ee:ff on en0" on BSD and macOS, "  192.168.1.1  aa-bb-cc-dd-ee-ff  dynamic" on Windows
+var arpLinePattern = regexp.MustCompile(`\(?([0-9a-fA-F.:]+)\)?\s+(?:at\s+)?([0-9a-fA-F]{1,2}(?:[:-][0-9a-fA-F]{1,2}){5})`)
+
+func parseARPCommandOutput(out []byte) []arpEntry {
+	entries := []arpEntry{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		m := arpLinePattern.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		// macOS omits leading zeros: "a:b:c:d:e:f"
+		octets := strings.FieldsFunc(m[2], func(c rune) bool { return c == ':' || c == '-' })
+		for i, o := range octets {
+			if len(o) == 1 {
+				octets[i] = "0" + o
+			}
+		}
+		entries = appendARPEntry(entries, m[1], strings.Join(octets, ":"))
+	}
+	return entries
+}
+
+func appendARPEntry(entries []arpEntry, ip string, mac string) []arpEntry {
+	addr := net.ParseIP(ip)
+	hwAddr, err := net.ParseMAC(mac)
+	if addr == nil || err != nil || bytes.Equal(hwAddr, make([]byte, len(hwAddr))) {
+		return entries
+	}
+	return append(entries, arpEntry{IP: addr.String(), MAC: hwAddr.String()})
+}
+
+// lookupHostnames fills the hostnames of the entries using reverse DNS lookups
+func lookupHostnames(entries []arpEntry) {
+	wg := sync.WaitGroup{}
+	for i := range entries {
+		wg.Add(1)
+		go func(e *arpEntry) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), arpLookupTimeout)
+			defer cancel()
+			names, err := net.DefaultResolver.LookupAddr(ctx, e.IP)
+			if err != nil || len(names) == 0 {
+				log.Tracef("Couldn't find the hostname of %s: %v", e.IP, err)
+				return
+			}
+			e.Hostname = strings.TrimSuffix(names[0], ".")
+		}(&entries[i])
+	}
+	wg.Wait()
+}
+
+// handleClientsAutoDiscover returns the devices from the ARP cache that are not in the clients list yet
+func handleClientsAutoDiscover(w http.ResponseWriter, r *http.Request) {
+	entries, err := readARPTable()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't read the ARP table: %s", err)
+		return
+	}
+
+	data := []arpEntry{}
+	for _, e := range entries {
+		_, ok := findClientByIP(e.IP)
+		if !ok {
+			data = append(data, e)
+		}
+	}
+	lookupHostnames(data)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal discovered clients json: %s", err)
+		return
+	}
+}
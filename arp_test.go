@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProcNetARP(t *testing.T) {
+	// Linux
+	data := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.1      0x1         0x2         b0:4e:26:6c:2e:9a     *        wlp2s0
+192.168.1.15     0x1         0x2         3C:22:FB:0A:1B:2C     *        wlp2s0
+192.168.1.20     0x1         0x0         00:00:00:00:00:00     *        wlp2s0
+172.17.0.2       0x1         0x2         02:42:ac:11:00:02     *        docker0
+`
+	entries := parseProcNetARP(strings.NewReader(data))
+	assert.Equal(t, []arpEntry{
+		{IP: "192.168.1.1", MAC: "b0:4e:26:6c:2e:9a"},
+		{IP: "192.168.1.15", MAC: "3c:22:fb:0a:1b:2c"},
+		{IP: "172.17.0.2", MAC: "02:42:ac:11:00:02"},
+	}, entries)
+
+	assert.Len(t, parseProcNetARP(strings.NewReader("")), 0)
+	assert.Len(t, parseProcNetARP(strings.NewReader("IP address       HW type     Flags       HW address            Mask     Device\n")), 0)
+}
+
+func TestParseARPCommandOutput(t *testing.T) {
+	testCases := []struct {
+		os   string
+		out  string
+		want []arpEntry
+	}{{
+		os: "macOS",
+		out: `? (192.168.1.1) at b0:4e:26:6c:2e:9a on en0 ifscope [ethernet]
+? (192.168.1.15) at 3c:22:fb:a:1b:2c on en0 ifscope [ethernet]
+? (192.168.1.20) at (incomplete) on en0 ifscope [ethernet]
+? (224.0.0.251) at 1:0:5e:0:0:fb on en0 ifscope permanent [ethernet]
+`,
+		want: []arpEntry{
+			{IP: "192.168.1.1", MAC: "b0:4e:26:6c:2e:9a"},
+			{IP: "192.168.1.15", MAC: "3c:22:fb:0a:1b:2c"},
+			{IP: "224.0.0.251", MAC: "01:00:5e:00:00:fb"},
+		},
+	}, {
+		os: "FreeBSD",
+		out: `? (192.168.1.1) at b0:4e:26:6c:2e:9a on em0 expires in 1183 seconds [ethernet]
+router.lan (192.168.1.2) at 00:0c:29:3e:5b:7d on em0 permanent [ethernet]
+`,
+		want: []arpEntry{
+			{IP: "192.168.1.1", MAC: "b0:4e:26:6c:2e:9a"},
+			{IP: "192.168.1.2", MAC: "00:0c:29:3e:5b:7d"},
+		},
+	}, {
+		os: "Windows",
+		out: `
+Interface: 192.168.1.10 --- 0xb
+  Internet Address      Physical Address      Type
+  192.168.1.1           b0-4e-26-6c-2e-9a     dynamic
+  192.168.1.15          3c-22-fb-0a-1b-2c     dynamic
+  192.168.1.255         ff-ff-ff-ff-ff-ff     static
+  224.0.0.22            01-00-5e-00-00-16     static
+`,
+		want: []arpEntry{
+			{IP: "192.168.1.1", MAC: "b0:4e:26:6c:2e:9a"},
+			{IP: "192.168.1.15", MAC: "3c:22:fb:0a:1b:2c"},
+			{IP: "192.168.1.255", MAC: "ff:ff:ff:ff:ff:ff"},
+			{IP: "224.0.0.22", MAC: "01:00:5e:00:00:16"},
+		},
+	}, {
+		os:   "empty",
+		out:  "",
+		want: []arpEntry{},
+	}}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, parseARPCommandOutput([]byte(tc.out)), tc.os)
+	}
+}
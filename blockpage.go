@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hmage/golibs/log"
+)
+
+const blockPageDefaultPort = 80
+
+// blockPageConfig is the settings of the HTTP server that shows the block page on the sinkhole IP
+type blockPageConfig struct {
+	Enabled        bool   `yaml:"enabled" json:"enabled"`
+	Port           int    `yaml:"port" json:"port"`                         // if 0, then blockPageDefaultPort is used
+	HTTPSPort      int    `yaml:"https_port" json:"https_port"`             // if 0, then HTTPS is disabled, it uses the certificate from the encryption settings
+	CustomHTMLPath string `yaml:"custom_html_path" json:"custom_html_path"` // html/template file, if empty then the built-in template is used
+}
+
+// blockPageData is passed to the block page template
+type blockPageData struct {
+	Domain string `json:"domain"`
+	Rule   string `json:"rule"`
+	List   string `json:"list"`
+}
+
+var blockPageTemplate = template.Must(template.New("blockpage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Blocked by AdGuard Home</title>
+</head>
+<body>
+<h1>Access to {{.Domain}} has been blocked</h1>
+{{if .Rule}}<p>Rule: <code>{{.Rule}}</code></p>{{end}}
+{{if .List}}<p>List: {{.List}}</p>{{end}}
+</body>
+</html>
+`))
+
+var blockPageServer struct {
+	server      *http.Server
+	httpsServer *http.Server // nil if HTTPS is disabled
+	sync.Mutex
+}
+
+// filterName returns the name of the filter list with the specified ID
+func filterName(id int64) string {
+	if id == userFilter().ID {
+		return "Custom rules"
+	}
+	config.RLock()
+	defer config.RUnlock()
+	for _, f := range config.Filters {
+		if f.ID == id {
+			return f.Name
+		}
+	}
+	return ""
+}
+
+// handleBlockPage shows why the domain from the Host header is blocked
+func handleBlockPage(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+
+	data := blockPageData{Domain: host}
+	res, err := dnsServer.CheckHost(host, clientIP)
+	if err != nil {
+		log.Printf("Couldn't check host %s for the block page: %s", host, err)
+	} else if res.IsFiltered {
+		data.Rule = res.Rule
+		data.List = filterName(res.FilterID)
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(data)
+		if err != nil {
+			log.Printf("Unable to marshal block page json: %s", err)
+		}
+		return
+	}
+
+	tmpl := blockPageTemplate
+	if config.BlockPage.CustomHTMLPath != "" {
+		path := blockPageTemplatePath(config.BlockPage.CustomHTMLPath)
+		tmpl, err = template.ParseFiles(path)
+		if err != nil {
+			log.Printf("Couldn't parse block page template %s: %s", path, err)
+			tmpl = blockPageTemplate
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Printf("Couldn't render the block page: %s", err)
+	}
+}
+
+// blockPageTemplatePath returns the absolute path of the custom template, relative paths are relative to the working directory
+func blockPageTemplatePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(config.ourWorkingDir, path)
+}
+
+// port returns the HTTP port of the block page server
+func (c blockPageConfig) port() int {
+	if c.Port == 0 {
+		return blockPageDefaultPort
+	}
+	return c.Port
+}
+
+// blockPageAddress returns the address of the block page server on the port, it listens on the sinkhole IP
+func blockPageAddress(port int) string {
+	return net.JoinHostPort(config.DNS.SinkholeIP, strconv.Itoa(port))
+}
+
+// checkBlockPageConfig returns an error if the block page server can't listen with these settings
+// it doesn't listen on all interfaces and on the ports of the web interface
+func checkBlockPageConfig(c blockPageConfig) error {
+	ip := net.ParseIP(config.DNS.SinkholeIP)
+	if ip == nil || ip.IsUnspecified() {
+		return fmt.Errorf("the block page needs the sinkhole IP, it can't listen on all interfaces")
+	}
+	webPorts := []int{config.BindPort}
+	if config.TLS.Enabled && config.TLS.PortHTTPS != 0 {
+		webPorts = append(webPorts, config.TLS.PortHTTPS)
+	}
+	ports := []int{c.port()}
+	if c.HTTPSPort != 0 {
+		if c.HTTPSPort == c.port() {
+			return fmt.Errorf("https_port must be different from port")
+		}
+		ports = append(ports, c.HTTPSPort)
+	}
+	for _, port := range ports {
+		for _, webPort := range webPorts {
+			if port == webPort {
+				return fmt.Errorf("port %d is used by the web interface", port)
+			}
+		}
+	}
+	if c.HTTPSPort != 0 && (config.TLS.CertificateChain == "" || config.TLS.PrivateKey == "") {
+		return fmt.Errorf("HTTPS needs the certificate from the encryption settings")
+	}
+	return nil
+}
+
+// startBlockPageServer starts the block page server if it's enabled
+func startBlockPageServer() error {
+	blockPageServer.Lock()
+	defer blockPageServer.Unlock()
+	if !config.BlockPage.Enabled || blockPageServer.server != nil {
+		return nil
+	}
+
+	err := checkBlockPageConfig(config.BlockPage)
+	if err != nil {
+		return err
+	}
+
+	var tlsConfig *tls.Config
+	if config.BlockPage.HTTPSPort != 0 {
+		cert, err := tls.X509KeyPair([]byte(config.TLS.CertificateChain), []byte(config.TLS.PrivateKey))
+		if err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	address := blockPageAddress(config.BlockPage.port())
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: http.HandlerFunc(handleBlockPage)}
+	serveBlockPage(server, ln, address)
+
+	if tlsConfig != nil {
+		httpsAddress := blockPageAddress(config.BlockPage.HTTPSPort)
+		tlsLn, err := net.Listen("tcp", httpsAddress)
+		if err != nil {
+			server.Close()
+			return err
+		}
+		httpsServer := &http.Server{Handler: http.HandlerFunc(handleBlockPage), TLSConfig: tlsConfig}
+		serveBlockPage(httpsServer, tls.NewListener(tlsLn, tlsConfig), httpsAddress)
+		blockPageServer.httpsServer = httpsServer
+	}
+	blockPageServer.server = server
+	return nil
+}
+
+func serveBlockPage(server *http.Server, ln net.Listener, address string) {
+	go func() {
+		log.Printf("Block page is available on %s", address)
+		err := server.Serve(ln)
+		if err != http.ErrServerClosed {
+			log.Printf("Block page server stopped: %s", err)
+		}
+	}()
+}
+
+func stopBlockPageServer() {
+	blockPageServer.Lock()
+	defer blockPageServer.Unlock()
+	if blockPageServer.server == nil {
+		return
+	}
+	for _, server := range []*http.Server{blockPageServer.server, blockPageServer.httpsServer} {
+		if server == nil {
+			continue
+		}
+		err := server.Shutdown(context.TODO())
+		if err != nil {
+			log.Printf("Couldn't stop the block page server: %s", err)
+		}
+	}
+	blockPageServer.server = nil
+	blockPageServer.httpsServer = nil
+}
+
+// restartBlockPageServer makes the block page server listen on the current sinkhole IP with the current certificate
+func restartBlockPageServer() {
+	stopBlockPageServer()
+	err := startBlockPageServer()
+	if err != nil {
+		log.Printf("Couldn't start the block page server on %s: %s", config.DNS.SinkholeIP, err)
+	}
+}
+
+func handleBlockPageConfigure(w http.ResponseWriter, r *http.Request) {
+	data := blockPageConfig{Port: config.BlockPage.Port, HTTPSPort: config.BlockPage.HTTPSPort}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse block page json: %s", err)
+		return
+	}
+
+	if data.Port < 0 || data.Port > 65535 || data.HTTPSPort < 0 || data.HTTPSPort > 65535 {
+		httpError(w, http.StatusBadRequest, "port must be between 1 and 65535")
+		return
+	}
+	if data.Enabled {
+		err = checkBlockPageConfig(data)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+	}
+	if data.CustomHTMLPath != "" {
+		_, err = template.ParseFiles(blockPageTemplatePath(data.CustomHTMLPath))
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "Couldn't parse %s: %s", data.CustomHTMLPath, err)
+			return
+		}
+	}
+
+	stopBlockPageServer()
+	oldConf := config.BlockPage
+	config.BlockPage = data
+	err = startBlockPageServer()
+	if err != nil {
+		config.BlockPage = oldConf
+		restartBlockPageServer()
+		httpError(w, http.StatusBadRequest, "Couldn't start the block page server on %s: %s", config.DNS.SinkholeIP, err)
+		return
+	}
+
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
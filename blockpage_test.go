@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckBlockPageConfig(t *testing.T) {
+	oldDNS := config.DNS
+	oldTLS := config.TLS
+	oldPort := config.BindPort
+	defer func() {
+		config.DNS = oldDNS
+		config.TLS = oldTLS
+		config.BindPort = oldPort
+	}()
+	config.BindPort = 3000
+	config.TLS.Enabled = true
+	config.TLS.PortHTTPS = 443
+	config.TLS.CertificateChain = ""
+	config.TLS.PrivateKey = ""
+
+	// all interfaces
+	for _, ip := range []string{"", "0.0.0.0", "::"} {
+		config.DNS.SinkholeIP = ip
+		assert.NotNil(t, checkBlockPageConfig(blockPageConfig{Enabled: true}), "sinkhole IP %q", ip)
+	}
+
+	config.DNS.SinkholeIP = "192.0.2.1"
+	assert.Nil(t, checkBlockPageConfig(blockPageConfig{Enabled: true}))
+	assert.Nil(t, checkBlockPageConfig(blockPageConfig{Enabled: true, Port: 8080}))
+
+	// the ports of the web interface
+	assert.NotNil(t, checkBlockPageConfig(blockPageConfig{Enabled: true, Port: 3000}))
+	assert.NotNil(t, checkBlockPageConfig(blockPageConfig{Enabled: true, Port: 443}))
+	assert.NotNil(t, checkBlockPageConfig(blockPageConfig{Enabled: true, HTTPSPort: 443}))
+	config.TLS.Enabled = false
+	assert.Nil(t, checkBlockPageConfig(blockPageConfig{Enabled: true, Port: 443}))
+
+	// HTTPS needs the certificate
+	assert.NotNil(t, checkBlockPageConfig(blockPageConfig{Enabled: true, HTTPSPort: 443}))
+	config.TLS.CertificateChain = "chain"
+	config.TLS.PrivateKey = "key"
+	assert.Nil(t, checkBlockPageConfig(blockPageConfig{Enabled: true, HTTPSPort: 443}))
+	assert.NotNil(t, checkBlockPageConfig(blockPageConfig{Enabled: true, HTTPSPort: 80}))
+}
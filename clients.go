@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+)
+
+// clientObject is a persistent client with its own filtering settings
+// field ordering is important -- yaml fields will mirror ordering from here
+type clientObject struct {
+	Name              string   `yaml:"name" json:"name"`
+	IP                string   `yaml:"ip" json:"ip"`
+	Tags              []string `yaml:"tags" json:"tags"`
+	UseGlobalSettings bool     `yaml:"use_global_settings" json:"use_global_settings"` // if true, the settings below are ignored
+
+	ParentalEnabled     bool `yaml:"parental_enabled" json:"parental_enabled"`
+	ParentalSensitivity int  `yaml:"parental_sensitivity" json:"parental_sensitivity"` // must be either 3, 10, 13 or 17
+	SafeSearchEnabled   bool `yaml:"safesearch_enabled" json:"safe_search_enabled"`
+	SafeBrowsingEnabled bool `yaml:"safebrowsing_enabled" json:"safebrowsing_enabled"`
+}
+
+// findClient returns the index of the client with the specified name, or -1
+// config must be locked by the caller
+func findClient(name string) int {
+	for i := range config.Clients {
+		if config.Clients[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// findClientByIP returns a copy of the client with the specified IP address
+func findClientByIP(ip string) (clientObject, bool) {
+	config.RLock()
+	defer config.RUnlock()
+	for _, c := range config.Clients {
+		if c.IP == ip {
+			return c, true
+		}
+	}
+	return clientObject{}, false
+}
+
+// clientHostname returns the hostname of the client from the DHCP leases or the name of the persistent client
+// returns empty string if nothing is known about the client
+func clientHostname(ip string) string {
+	addr := net.ParseIP(ip)
+	for _, lease := range dhcpServer.Leases() {
+		if lease.IP.Equal(addr) && lease.Hostname != "" {
+			return lease.Hostname
+		}
+	}
+
+	c, ok := findClientByIP(ip)
+	if ok {
+		return c.Name
+	}
+	return ""
+}
+
+// applyClientSettings overrides the filtering settings with the settings of the client, if there is one
+// it is called by the DNS server for each request
+func applyClientSettings(clientAddr string, settings *dnsfilter.Config) {
+	c, ok := findClientByIP(clientAddr)
+	if ok && !c.UseGlobalSettings {
+		settings.ParentalEnabled = c.ParentalEnabled
+		settings.ParentalSensitivity = c.ParentalSensitivity
+		settings.SafeSearchEnabled = c.SafeSearchEnabled
+		settings.SafeBrowsingEnabled = c.SafeBrowsingEnabled
+	}
+
+	// the active schedules override both the global and the client settings
+	applySchedules(clientAddr, settings)
+}
+
+// validateClient checks the client fields and that its name and IP don't clash with other clients
+// skip is the index of the client that is being updated, or -1
+// config must be locked by the caller
+func validateClient(c clientObject, skip int) error {
+	if c.Name == "" {
+		return fmt.Errorf("client name must not be empty")
+	}
+
+	ip := net.ParseIP(c.IP)
+	if ip == nil {
+		return fmt.Errorf("%s is not a valid IP address", c.IP)
+	}
+
+	err := validateClientTags(c.Tags)
+	if err != nil {
+		return err
+	}
+
+	if !c.UseGlobalSettings && c.ParentalEnabled {
+		switch c.ParentalSensitivity {
+		case 3, 10, 13, 17:
+		default:
+			return fmt.Errorf("parental_sensitivity must be set to valid value")
+		}
+	}
+
+	for i, other := range config.Clients {
+		if i == skip {
+			continue
+		}
+		if other.Name == c.Name {
+			return fmt.Errorf("client %s already exists", c.Name)
+		}
+		if net.ParseIP(other.IP).Equal(ip) {
+			return fmt.Errorf("another client %s uses the same IP address", other.Name)
+		}
+	}
+	return nil
+}
+
+// -------
+// clients
+// -------
+func handleGetClients(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	clients := make([]clientObject, len(config.Clients))
+	copy(clients, config.Clients)
+	config.RUnlock()
+
+	data := map[string]interface{}{
+		"clients": clients,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal clients json: %s", err)
+		return
+	}
+}
+
+func handleAddClient(w http.ResponseWriter, r *http.Request) {
+	c := clientObject{}
+	err := json.NewDecoder(r.Body).Decode(&c)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse client json: %s", err)
+		return
+	}
+
+	config.Lock()
+	err = validateClient(c, -1)
+	if err == nil {
+		c.IP = net.ParseIP(c.IP).String()
+		config.Clients = append(config.Clients, c)
+	}
+	config.Unlock()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func handleDeleteClient(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name string `json:"name"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse client json: %s", err)
+		return
+	}
+
+	config.Lock()
+	i := findClient(req.Name)
+	if i >= 0 {
+		config.Clients = append(config.Clients[:i], config.Clients[i+1:]...)
+	}
+	config.Unlock()
+	if i < 0 {
+		httpError(w, http.StatusBadRequest, "Client %s not found", req.Name)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func handleUpdateClient(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name string       `json:"name"`
+		Data clientObject `json:"data"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse client json: %s", err)
+		return
+	}
+	c := req.Data
+
+	config.Lock()
+	i := findClient(req.Name)
+	if i < 0 {
+		err = fmt.Errorf("client %s not found", req.Name)
+	} else {
+		err = validateClient(c, i)
+	}
+	if err == nil {
+		c.IP = net.ParseIP(c.IP).String()
+		config.Clients[i] = c
+	}
+	config.Unlock()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxClientsImportSize = 10 * 1024 * 1024
+
+// clientsCSVColumns is the header of the clients CSV file, only ip and name columns are required on import
+var clientsCSVColumns = []string{
+	"ip",
+	"name",
+	"tags", // separated by spaces
+	"use_global_settings",
+	"parental_enabled",
+	"parental_sensitivity",
+	"safebrowsing_enabled",
+	"safe_search_enabled",
+}
+
+type invalidRow struct {
+	Row   int    `json:"row"` // number of the CSV record, the header is record 1
+	Error string `json:"error"`
+}
+
+type clientsImportResult struct {
+	Added             int          `json:"added"`
+	SkippedDuplicates int          `json:"skipped_duplicates"`
+	InvalidRows       []invalidRow `json:"invalid_rows"`
+}
+
+// parseClientRecord creates a client from a CSV record, columns maps column names to their indexes
+func parseClientRecord(record []string, columns map[string]int) (clientObject, error) {
+	get := func(name string) string {
+		i, ok := columns[name]
+		if !ok {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	getBool := func(name string) (bool, error) {
+		v := get(name)
+		if v == "" {
+			return false, nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("%s must be true or false", name)
+		}
+		return b, nil
+	}
+
+	c := clientObject{
+		Name: get("name"),
+		IP:   get("ip"),
+		Tags: strings.Fields(get("tags")),
+	}
+
+	var err error
+	if c.UseGlobalSettings, err = getBool("use_global_settings"); err != nil {
+		return c, err
+	}
+	if c.ParentalEnabled, err = getBool("parental_enabled"); err != nil {
+		return c, err
+	}
+	if c.SafeBrowsingEnabled, err = getBool("safebrowsing_enabled"); err != nil {
+		return c, err
+	}
+	if c.SafeSearchEnabled, err = getBool("safe_search_enabled"); err != nil {
+		return c, err
+	}
+
+	c.ParentalSensitivity = config.DNS.ParentalSensitivity
+	if v := get("parental_sensitivity"); v != "" {
+		c.ParentalSensitivity, err = strconv.Atoi(v)
+		if err != nil {
+			return c, fmt.Errorf("parental_sensitivity must be a number")
+		}
+	}
+	return c, nil
+}
+
+// isDuplicateClient returns true if there is a client with the same name or IP address
+// config must be locked by the caller
+func isDuplicateClient(c clientObject) bool {
+	ip := net.ParseIP(c.IP)
+	for _, other := range config.Clients {
+		if other.Name == c.Name || net.ParseIP(other.IP).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// importClients adds the clients from the CSV data, the first line must be the header
+func importClients(r io.Reader) (clientsImportResult, error) {
+	result := clientsImportResult{InvalidRows: []invalidRow{}}
+
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return result, fmt.Errorf("couldn't read the CSV header: %s", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"ip", "name"} {
+		if _, ok := columns[name]; !ok {
+			return result, fmt.Errorf("%s column is missing", name)
+		}
+	}
+
+	config.Lock()
+	defer config.Unlock()
+	row := 1
+	for {
+		record, err := reader.Read()
+		row++
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return result, err
+			}
+			result.InvalidRows = append(result.InvalidRows, invalidRow{Row: row, Error: err.Error()})
+			continue
+		}
+
+		c, err := parseClientRecord(record, columns)
+		if err == nil && isDuplicateClient(c) {
+			result.SkippedDuplicates++
+			continue
+		}
+		if err == nil {
+			err = validateClient(c, -1)
+		}
+		if err != nil {
+			result.InvalidRows = append(result.InvalidRows, invalidRow{Row: row, Error: err.Error()})
+			continue
+		}
+
+		c.IP = net.ParseIP(c.IP).String()
+		config.Clients = append(config.Clients, c)
+		result.Added++
+	}
+	return result, nil
+}
+
+// handleClientsImport adds clients from the CSV file uploaded in the "file" field of the multipart form
+func handleClientsImport(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseMultipartForm(maxClientsImportSize)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse multipart form: %s", err)
+		return
+	}
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Couldn't get the uploaded file: %s", err)
+		return
+	}
+	defer f.Close()
+
+	result, err := importClients(f)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Couldn't import clients: %s", err)
+		return
+	}
+
+	if result.Added > 0 {
+		err = writeAllConfigsAndReloadDNS()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal import result json: %s", err)
+		return
+	}
+}
+
+// clientRecord converts the client to a CSV record with clientsCSVColumns columns
+func clientRecord(c clientObject) []string {
+	return []string{
+		c.IP,
+		c.Name,
+		strings.Join(c.Tags, " "),
+		strconv.FormatBool(c.UseGlobalSettings),
+		strconv.FormatBool(c.ParentalEnabled),
+		strconv.Itoa(c.ParentalSensitivity),
+		strconv.FormatBool(c.SafeBrowsingEnabled),
+		strconv.FormatBool(c.SafeSearchEnabled),
+	}
+}
+
+// handleClientsExport returns all clients as CSV in the import format, or as JSON array if format=json
+func handleClientsExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "csv" && format != "json" {
+		httpError(w, http.StatusBadRequest, "Unknown format: %s", format)
+		return
+	}
+
+	config.RLock()
+	clients := make([]clientObject, len(config.Clients))
+	copy(clients, config.Clients)
+	config.RUnlock()
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(clients)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Unable to marshal clients json: %s", err)
+			return
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="clients.csv"`)
+	cw := csv.NewWriter(w)
+	err := cw.Write(clientsCSVColumns)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write clients csv: %s", err)
+		return
+	}
+	for _, c := range clients {
+		err = cw.Write(clientRecord(c))
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Couldn't write clients csv: %s", err)
+			return
+		}
+	}
+	cw.Flush()
+	err = cw.Error()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write clients csv: %s", err)
+		return
+	}
+}
@@ -21,8 +21,9 @@ const (
 
 // logSettings
 type logSettings struct {
-	LogFile string `yaml:"log_file"` // Path to the log file. If empty, write to stdout. If "syslog", writes to syslog
-	Verbose bool   `yaml:"verbose"`  // If true, verbose logging is enabled
+	LogFile   string `yaml:"log_file"`   // Path to the log file. If empty, write to stdout. If "syslog", writes to syslog
+	LogFormat string `yaml:"log_format"` // Either "text" or "json". If empty, "text" is used
+	Verbose   bool   `yaml:"verbose"`    // If true, verbose logging is enabled
 }
 
 // configuration is loaded from YAML
@@ -42,6 +43,24 @@ type configuration struct {
 	Filters   []filter           `yaml:"filters"`
 	UserRules []string           `yaml:"user_rules"`
 	DHCP      dhcpd.ServerConfig `yaml:"dhcp"`
+	Clients   []clientObject     `yaml:"clients"`
+	Tags      []clientTag        `yaml:"tags"` // tags that can be assigned to clients
+	Schedules []schedule         `yaml:"schedules"`
+
+	ClientSchedules  []clientSchedule `yaml:"client_schedules"`  // schedules applied only to the specific clients
+	ScheduleConflict string           `yaml:"schedule_conflict"` // either "last_wins" or "most_restrictive", if empty then "last_wins" is used
+
+	BlockPage         blockPageConfig `yaml:"block_page"`
+	DNSCrypt          dnscryptConfig  `yaml:"dnscrypt"`
+	Notify            notifyConfig    `yaml:"notify"`
+	GeoIPDatabasePath string          `yaml:"geoip_database_path"` // path to MaxMind GeoIP2 or GeoLite2 City .mmdb file, optional
+	SpeedTestURL      string          `yaml:"speed_test_url"`      // file downloaded by /control/network/speed_test, AdGuard's one if empty
+	MaxOpenFiles      uint64          `yaml:"max_open_files"`      // limit of open files set on startup, the OS default is used if 0
+	LowDiskWarningMB  uint64          `yaml:"low_disk_warning_mb"` // free disk space below which low_disk_warning is set in the status, if 0 then default is used
+
+	AutoUpdate autoUpdateConfig `yaml:"auto_update"`
+
+	DebugPprofEnabled bool `yaml:"debug_pprof_enabled"` // if true, profiling data is available at /control/debug/pprof/
 
 	logSettings `yaml:",inline"`
 
@@ -57,7 +76,9 @@ type dnsConfig struct {
 
 	dnsforward.FilteringConfig `yaml:",inline"`
 
-	UpstreamDNS []string `yaml:"upstream_dns"`
+	UpstreamDNS         []string       `yaml:"upstream_dns"`
+	UpstreamTimeout     int            `yaml:"upstream_timeout"`      // in seconds, if 0 then dnsforward.DefaultTimeout is used
+	PerUpstreamTimeouts map[string]int `yaml:"per_upstream_timeouts"` // upstream address -> timeout in seconds, overrides UpstreamTimeout
 }
 
 var defaultDNS = []string{"tls://1.1.1.1", "tls://1.0.0.1"}
@@ -108,13 +129,19 @@ var config = configuration{
 		BindHost: "0.0.0.0",
 		Port:     53,
 		FilteringConfig: dnsforward.FilteringConfig{
-			ProtectionEnabled:  true, // whether or not use any of dnsfilter features
-			FilteringEnabled:   true, // whether or not use filter lists
-			BlockedResponseTTL: 10,   // in seconds
-			QueryLogEnabled:    true,
-			Ratelimit:          20,
-			RefuseAny:          true,
-			BootstrapDNS:       "8.8.8.8:53",
+			ProtectionEnabled:   true, // whether or not use any of dnsfilter features
+			FilteringEnabled:    true, // whether or not use filter lists
+			BlockedResponseTTL:  10,   // in seconds
+			BlockedResponseCode: dnsforward.BlockedResponseNXDomain,
+			SinkholeTTL:         dnsforward.DefaultSinkholeTTL,
+			QueryLogEnabled:     true,
+			QueryLogFileEnabled: true,
+			QueryLogMaxDays:     dnsforward.DefaultQueryLogMaxDays,
+			QueryLogMaxSizeMB:   dnsforward.DefaultQueryLogMaxSizeMB,
+			Ratelimit:           20,
+			RefuseAny:           true,
+			BootstrapDNS:        "8.8.8.8:53",
+			LocalDomainSuffix:   dnsforward.DefaultLocalDomainSuffix,
 		},
 		UpstreamDNS: defaultDNS,
 	},
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/hmage/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// the host resolved via each upstream to test the connectivity
+const connectivityCheckHost = "connectivitycheck.adguardteam.github.io."
+
+// for how long the connectivity test results are returned without testing again
+const connectivityCacheTTL = 30 * time.Second
+
+type connectivityJSON struct {
+	Reachable bool  `json:"reachable"`
+	LatencyMs int64 `json:"latency_ms"`
+}
+
+// connectivityCache is the result of the last connectivity test, keyed by the upstream address
+var connectivityCache struct {
+	sync.Mutex
+	checked  time.Time
+	upstream []string // the upstreams the results were received for
+	results  map[string]connectivityJSON
+}
+
+// checkConnectivity resolves connectivityCheckHost via the upstream and measures the time it took
+func checkConnectivity(address string) connectivityJSON {
+	u, err := upstream.AddressToUpstream(address, upstream.Options{
+		Timeout:   upstreamTimeout(address),
+		Bootstrap: []string{config.DNS.BootstrapDNS},
+	})
+	if err != nil {
+		log.Printf("Couldn't get upstream %s: %s", address, err)
+		return connectivityJSON{}
+	}
+
+	req := dns.Msg{}
+	req.SetQuestion(connectivityCheckHost, dns.TypeA)
+	start := time.Now()
+	reply, err := u.Exchange(&req)
+	if err != nil {
+		log.Tracef("Connectivity check via %s failed: %s", address, err)
+		return connectivityJSON{}
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		log.Tracef("Connectivity check via %s failed: %s", address, dns.RcodeToString[reply.Rcode])
+		return connectivityJSON{}
+	}
+	return connectivityJSON{
+		Reachable: true,
+		LatencyMs: time.Since(start).Nanoseconds() / int64(time.Millisecond),
+	}
+}
+
+// stringSlicesEqual returns true if both slices have the same elements in the same order
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// getConnectivity returns the connectivity of each configured upstream, the result is cached for connectivityCacheTTL
+func getConnectivity() map[string]connectivityJSON {
+	config.RLock()
+	upstreams := append([]string{}, config.DNS.UpstreamDNS...)
+	config.RUnlock()
+
+	connectivityCache.Lock()
+	defer connectivityCache.Unlock()
+	if time.Since(connectivityCache.checked) <= connectivityCacheTTL &&
+		stringSlicesEqual(connectivityCache.upstream, upstreams) {
+		return connectivityCache.results
+	}
+
+	results := map[string]connectivityJSON{}
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, address := range upstreams {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			result := checkConnectivity(address)
+			mu.Lock()
+			results[address] = result
+			mu.Unlock()
+		}(address)
+	}
+	wg.Wait()
+
+	connectivityCache.results = results
+	connectivityCache.upstream = upstreams
+	connectivityCache.checked = time.Now()
+	return results
+}
+
+// the IPv6 address connected to in order to check the IPv6 connectivity
+const ipv6CheckAddress = "2001:4860:4860::8888"
+
+const ipv6CheckTimeout = 3 * time.Second
+
+// for how long the IPv6 check result is returned without checking again, it's shown in the status
+const ipv6CacheTTL = 5 * time.Minute
+
+type ipv6AvailableJSON struct {
+	Available   bool   `json:"ipv6_available"`
+	TestAddress string `json:"test_address"`
+}
+
+var ipv6Cache struct {
+	sync.Mutex
+	checked   time.Time
+	available bool
+}
+
+// isIPv6Available returns true if the TCP connection to ipv6CheckAddress succeeds, the result is cached for ipv6CacheTTL
+func isIPv6Available() bool {
+	ipv6Cache.Lock()
+	defer ipv6Cache.Unlock()
+	if time.Since(ipv6Cache.checked) <= ipv6CacheTTL {
+		return ipv6Cache.available
+	}
+
+	conn, err := net.DialTimeout("tcp6", net.JoinHostPort(ipv6CheckAddress, "53"), ipv6CheckTimeout)
+	if err != nil {
+		log.Tracef("IPv6 connectivity check failed: %s", err)
+	} else {
+		conn.Close()
+	}
+	ipv6Cache.available = err == nil
+	ipv6Cache.checked = time.Now()
+	return ipv6Cache.available
+}
+
+// ----------------------
+// network/ipv6_available
+// ----------------------
+func handleIPv6Available(w http.ResponseWriter, r *http.Request) {
+	data := ipv6AvailableJSON{
+		Available:   isIPv6Available(),
+		TestAddress: ipv6CheckAddress,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal IPv6 available json: %s", err)
+		return
+	}
+}
+
+// -----------------------------
+// network/internet_connectivity
+// -----------------------------
+func handleInternetConnectivity(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(getConnectivity())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal connectivity json: %s", err)
+		return
+	}
+}
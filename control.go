@@ -2,17 +2,19 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -21,11 +23,12 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/dnsproxy/upstream"
-	"github.com/hmage/golibs/log"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 	govalidator "gopkg.in/asaskevich/govalidator.v4"
@@ -36,6 +39,7 @@ const updatePeriod = time.Minute * 30
 // cached version.json to avoid hammering github.io for each page reload
 var versionCheckJSON []byte
 var versionCheckLastTime time.Time
+var versionCheckLock sync.Mutex
 
 const versionCheckURL = "https://adguardteam.github.io/AdGuardHome/version.json"
 const versionCheckPeriod = time.Hour * 8
@@ -52,14 +56,19 @@ func returnOK(w http.ResponseWriter) {
 	_, err := fmt.Fprintf(w, "OK\n")
 	if err != nil {
 		errorText := fmt.Sprintf("Couldn't write body: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 	}
 }
 
 func httpError(w http.ResponseWriter, code int, format string, args ...interface{}) {
 	text := fmt.Sprintf(format, args...)
-	log.Println(text)
+	// client errors are not the server failures, don't log them as errors
+	if code < http.StatusInternalServerError {
+		apiLog.Infof("%s", text)
+	} else {
+		apiLog.Errorf("%s", text)
+	}
 	http.Error(w, text, code)
 }
 
@@ -69,7 +78,7 @@ func httpError(w http.ResponseWriter, code int, format string, args ...interface
 func writeAllConfigsAndReloadDNS() error {
 	err := writeAllConfigs()
 	if err != nil {
-		log.Printf("Couldn't write all configs: %s", err)
+		apiLog.Errorf("Couldn't write all configs: %s", err)
 		return err
 	}
 	return reconfigureDNSServer()
@@ -96,12 +105,32 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		"upstream_dns":       config.DNS.UpstreamDNS,
 		"version":            VersionString,
 		"language":           config.Language,
+		"block_ttl":          config.DNS.BlockedResponseTTL,
+		"response_code":      config.DNS.BlockedResponseCode,
+		"sinkhole_ip":        config.DNS.SinkholeIP,
+
+		"dnssec_validation_enabled": config.DNS.EnableDNSSEC,
+		"forward_upstream_errors":   config.DNS.ForwardUpstreamErrs,
+		"cname_flattening":          config.DNS.CNAMEFlattening,
+		"cache_prefetch_on_expired": config.DNS.PrefetchOnExpired,
+		"trace_forwarded_queries":   config.DNS.TraceForwarded,
+		"allowlist_mode_enabled":    config.DNS.AllowlistMode,
+		"private_dns_enabled":       config.DNS.PrivateDNS,
+		"local_domain_suffix":       config.DNS.LocalDomainSuffix,
+		"min_response_ttl":          config.DNS.MinResponseTTL,
+		"ipv6_disabled":             config.DNS.DisableIPv6,
+		"extended_errors":           config.DNS.ExtendedErrors,
+		"qname_minimisation":        config.DNS.QNAMEMinimisation,
+		"aggressive_nsec":           config.DNS.AggressiveNSEC,
+		"low_disk_warning":          isLowDiskSpace(),
+		"time_offset_warning":       isTimeOffsetTooLarge(),
+		"ipv6_available":            isIPv6Available(),
 	}
 
 	jsonVal, err := json.Marshal(data)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to marshal status json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 500)
 		return
 	}
@@ -109,7 +138,7 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 	_, err = w.Write(jsonVal)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to write response json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 500)
 		return
 	}
@@ -123,6 +152,7 @@ func handleProtectionEnable(w http.ResponseWriter, r *http.Request) {
 func handleProtectionDisable(w http.ResponseWriter, r *http.Request) {
 	config.DNS.ProtectionEnabled = false
 	httpUpdateConfigReloadDNSReturnOK(w, r)
+	notify(notifyProtectionDisabled, "protection was disabled")
 }
 
 // -----
@@ -140,11 +170,12 @@ func handleQueryLogDisable(w http.ResponseWriter, r *http.Request) {
 
 func handleQueryLog(w http.ResponseWriter, r *http.Request) {
 	data := dnsServer.GetQueryLog()
+	addCountryCodes(data)
 
 	jsonVal, err := json.Marshal(data)
 	if err != nil {
 		errorText := fmt.Sprintf("Couldn't marshal data into json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 		return
 	}
@@ -153,11 +184,335 @@ func handleQueryLog(w http.ResponseWriter, r *http.Request) {
 	_, err = w.Write(jsonVal)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to write response json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 	}
 }
 
+type queryLogConfigJSON struct {
+	Enabled           bool `json:"enabled"`
+	FileEnabled       bool `json:"file_enabled"`
+	MaxDays           int  `json:"max_days"`
+	AnonymizeClientIP bool `json:"anonymize_client_ip"`
+}
+
+func getQueryLogConfig() queryLogConfigJSON {
+	return queryLogConfigJSON{
+		Enabled:           config.DNS.QueryLogEnabled,
+		FileEnabled:       config.DNS.QueryLogFileEnabled,
+		MaxDays:           config.DNS.QueryLogMaxDays,
+		AnonymizeClientIP: anonymizationLevel() != dnsforward.AnonymizationNone,
+	}
+}
+
+func handleGetQueryLogConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(getQueryLogConfig())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal query log config json: %s", err)
+		return
+	}
+}
+
+// handleSetQueryLogConfig updates the fields that are present in the request, the other fields are left unchanged
+func handleSetQueryLogConfig(w http.ResponseWriter, r *http.Request) {
+	data := getQueryLogConfig()
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse query log config json: %s", err)
+		return
+	}
+
+	if data.MaxDays <= 0 {
+		httpError(w, http.StatusBadRequest, "max_days must be a positive integer")
+		return
+	}
+
+	config.DNS.QueryLogEnabled = data.Enabled
+	config.DNS.QueryLogFileEnabled = data.FileEnabled
+	config.DNS.QueryLogMaxDays = data.MaxDays
+	// anonymize_client_ip is kept for compatibility, the level is changed only if it's switched
+	if !data.AnonymizeClientIP {
+		config.DNS.AnonymizationLevel = dnsforward.AnonymizationNone
+	} else if anonymizationLevel() == dnsforward.AnonymizationNone {
+		config.DNS.AnonymizationLevel = dnsforward.AnonymizationPartial
+	}
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+type queryLogRetentionJSON struct {
+	MaxDays   int `json:"max_days"`
+	MaxSizeMB int `json:"max_size_mb"`
+}
+
+func handleGetQueryLogRetention(w http.ResponseWriter, r *http.Request) {
+	data := queryLogRetentionJSON{
+		MaxDays:   config.DNS.QueryLogMaxDays,
+		MaxSizeMB: config.DNS.QueryLogMaxSizeMB,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal query log retention json: %s", err)
+		return
+	}
+}
+
+// handleSetQueryLogRetention updates the limits that are present in the request
+// the query log files are pruned according to them every day at midnight
+func handleSetQueryLogRetention(w http.ResponseWriter, r *http.Request) {
+	data := queryLogRetentionJSON{
+		MaxDays:   config.DNS.QueryLogMaxDays,
+		MaxSizeMB: config.DNS.QueryLogMaxSizeMB,
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse query log retention json: %s", err)
+		return
+	}
+
+	if data.MaxDays <= 0 || data.MaxSizeMB <= 0 {
+		httpError(w, http.StatusBadRequest, "max_days and max_size_mb must be positive integers")
+		return
+	}
+
+	config.DNS.QueryLogMaxDays = data.MaxDays
+	config.DNS.QueryLogMaxSizeMB = data.MaxSizeMB
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+type queryLogAnonymizationJSON struct {
+	Level string `json:"level"`
+}
+
+// anonymizationLevel returns the query log anonymization level, "none" if it's not set
+func anonymizationLevel() string {
+	if config.DNS.AnonymizationLevel == "" {
+		return dnsforward.AnonymizationNone
+	}
+	return config.DNS.AnonymizationLevel
+}
+
+// initAnonymizationKey generates the secret key of the full anonymization if there is none yet
+func initAnonymizationKey() error {
+	if config.DNS.AnonymizationKey != "" {
+		return nil
+	}
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return err
+	}
+	config.DNS.AnonymizationKey = hex.EncodeToString(key)
+	return nil
+}
+
+// ---------------------------
+// dns/query_log_anonymization
+// ---------------------------
+func handleGetQueryLogAnonymization(w http.ResponseWriter, r *http.Request) {
+	data := queryLogAnonymizationJSON{Level: anonymizationLevel()}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal query log anonymization json: %s", err)
+		return
+	}
+}
+
+func handleSetQueryLogAnonymization(w http.ResponseWriter, r *http.Request) {
+	data := queryLogAnonymizationJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse query log anonymization json: %s", err)
+		return
+	}
+
+	switch data.Level {
+	case dnsforward.AnonymizationNone, dnsforward.AnonymizationPartial, dnsforward.AnonymizationFull:
+	default:
+		httpError(w, http.StatusBadRequest, "level must be one of none, partial or full")
+		return
+	}
+	if data.Level == dnsforward.AnonymizationFull {
+		err = initAnonymizationKey()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Couldn't generate anonymization key: %s", err)
+			return
+		}
+	}
+
+	config.DNS.AnonymizationLevel = data.Level
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// ------------------------
+// dns/log_queries_to_syslog
+// ------------------------
+func handleGetQueryLogSyslog(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	data := config.DNS.QueryLogSyslog
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal query log syslog json: %s", err)
+		return
+	}
+}
+
+func handleSetQueryLogSyslog(w http.ResponseWriter, r *http.Request) {
+	data := dnsforward.QueryLogSyslog{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse query log syslog json: %s", err)
+		return
+	}
+
+	if data.Enabled {
+		err = dnsforward.NormalizeQueryLogSyslog(&data)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "Invalid query log syslog settings: %s", err)
+			return
+		}
+	}
+
+	config.DNS.QueryLogSyslog = data
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleQueryLogClearClient removes one client's entries from the query log in memory and on disk
+func handleQueryLogClearClient(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		ClientIP string `json:"client_ip"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse client json: %s", err)
+		return
+	}
+
+	ip := net.ParseIP(req.ClientIP)
+	if ip == nil {
+		httpError(w, http.StatusBadRequest, "client_ip must be an IP address")
+		return
+	}
+
+	removed, err := dnsServer.PurgeClientQueryLog(ip.String())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't remove query log entries of %s: %s", ip, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal json: %s", err)
+		return
+	}
+}
+
+// parseLimit returns the value of the "limit" URL parameter or def if it's not specified
+func parseLimit(r *http.Request, def int) (int, error) {
+	q := r.URL.Query().Get("limit")
+	if q == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(q)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("limit must be a positive integer")
+	}
+	return limit, nil
+}
+
+func handleQueryLogTopBlockedClients(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r, 10)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	top := dnsServer.GetStatsTop().BlockedClients
+	sorted := sortByValue(top)
+	if len(sorted) > limit {
+		sorted = sorted[:limit]
+	}
+
+	data := []map[string]interface{}{}
+	for _, ip := range sorted {
+		data = append(data, map[string]interface{}{
+			"ip":       ip,
+			"hostname": clientHostname(ip),
+			"count":    top[ip],
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal top blocked clients json: %s", err)
+		return
+	}
+}
+
+func handleQueryLogTopBlockedRules(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r, 20)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	rules := dnsServer.GetTopBlockedRules()
+	if len(rules) > limit {
+		rules = rules[:limit]
+	}
+
+	names := map[int64]string{}
+	config.RLock()
+	for _, f := range config.Filters {
+		names[f.ID] = f.Name
+	}
+	config.RUnlock()
+
+	data := []map[string]interface{}{}
+	for _, rule := range rules {
+		name := names[rule.FilterID]
+		if rule.FilterID == userFilter().ID {
+			name = "Custom rules"
+		}
+		data = append(data, map[string]interface{}{
+			"rule":        rule.Rule,
+			"filter_id":   rule.FilterID,
+			"filter_name": name,
+			"hits":        rule.Hits,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal top blocked rules json: %s", err)
+		return
+	}
+}
+
+func handleQueryLogAnomalies(w http.ResponseWriter, r *http.Request) {
+	data, err := dnsServer.GetAnomalies()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't read the query log: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal anomalies json: %s", err)
+		return
+	}
+}
+
 func handleStatsTop(w http.ResponseWriter, r *http.Request) {
 	s := dnsServer.GetStatsTop()
 
@@ -200,7 +555,7 @@ func handleStatsTop(w http.ResponseWriter, r *http.Request) {
 	_, err := w.Write(statsJSON.Bytes())
 	if err != nil {
 		errorText := fmt.Sprintf("Couldn't write body: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 	}
 }
@@ -211,11 +566,128 @@ func handleStatsReset(w http.ResponseWriter, r *http.Request) {
 	_, err := fmt.Fprintf(w, "OK\n")
 	if err != nil {
 		errorText := fmt.Sprintf("Couldn't write body: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 	}
 }
 
+// handleStatsClearClient removes one client's contribution from the stats and the top clients
+func handleStatsClearClient(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		ClientIP string `json:"client_ip"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse client json: %s", err)
+		return
+	}
+
+	ip := net.ParseIP(req.ClientIP)
+	if ip == nil {
+		httpError(w, http.StatusBadRequest, "client_ip must be an IP address")
+		return
+	}
+
+	dnsServer.PurgeClientStats(ip.String())
+	returnOK(w)
+}
+
+type topUpstreamJSON struct {
+	Upstream     string  `json:"upstream"`
+	Queries      int     `json:"queries"`
+	Errors       int     `json:"errors"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+// handleStatsTopUpstreams returns the upstreams that answered the most queries in the last 24 hours
+func handleStatsTopUpstreams(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r, 10)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	top := dnsServer.GetStatsTop()
+	data := []topUpstreamJSON{}
+	for u, n := range top.Upstreams {
+		entry := topUpstreamJSON{Upstream: u, Queries: n, Errors: top.UpstreamErrors[u]}
+		if n != 0 {
+			entry.AvgLatencyMs = float64(top.UpstreamElapsed[u]) / float64(n) / 1000
+		}
+		data = append(data, entry)
+	}
+	// the upstreams that have never answered are shown too
+	for u, n := range top.UpstreamErrors {
+		if _, ok := top.Upstreams[u]; !ok {
+			data = append(data, topUpstreamJSON{Upstream: u, Errors: n})
+		}
+	}
+	sort.Slice(data, func(i, j int) bool {
+		if data[i].Queries != data[j].Queries {
+			return data[i].Queries > data[j].Queries
+		}
+		return data[i].Upstream < data[j].Upstream
+	})
+	if len(data) > limit {
+		data = data[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal top upstreams json: %s", err)
+		return
+	}
+}
+
+// handleStatsTopQueryTypes returns the number of queries of each DNS record type for the 24 hours
+func handleStatsTopQueryTypes(w http.ResponseWriter, r *http.Request) {
+	data := dnsServer.GetQueryTypeStats()
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal top query types json: %s", err)
+		return
+	}
+}
+
+// handleStatsTopResponseCodes returns the number of responses with each DNS response code for the 24 hours
+func handleStatsTopResponseCodes(w http.ResponseWriter, r *http.Request) {
+	data := dnsServer.GetResponseCodeStats()
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal top response codes json: %s", err)
+		return
+	}
+}
+
+// handleStatsClientsCount returns the approximate number of distinct clients for the 24 hours and, unless period is 24h, for the 7 days
+func handleStatsClientsCount(w http.ResponseWriter, r *http.Request) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "7d"
+	}
+	if period != "24h" && period != "7d" {
+		httpError(w, http.StatusBadRequest, "period must be one of: 24h, 7d")
+		return
+	}
+
+	data := map[string]int64{
+		"unique_clients_24h": dnsServer.GetUniqueClientsCount(24),
+	}
+	if period == "7d" {
+		data["unique_clients_7d"] = dnsServer.GetUniqueClientsCount(7 * 24)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal clients count json: %s", err)
+		return
+	}
+}
+
 // handleStats returns aggregated stats data for the 24 hours
 func handleStats(w http.ResponseWriter, r *http.Request) {
 	summed := dnsServer.GetAggregatedStats()
@@ -223,7 +695,7 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 	statsJSON, err := json.Marshal(summed)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to marshal status json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 500)
 		return
 	}
@@ -231,13 +703,49 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 	_, err = w.Write(statsJSON)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to write response json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 500)
 		return
 	}
 }
 
 // HandleStatsHistory returns historical stats data for the 24 hours
+type hourlyStatsJSON struct {
+	Timestamp      time.Time `json:"timestamp"`
+	TotalQueries   float64   `json:"total_queries"`
+	BlockedQueries float64   `json:"blocked_queries"`
+}
+
+// handleStatsHourlyBreakdown returns the number of queries in each hour of the last 7 days, the oldest first
+func handleStatsHourlyBreakdown(w http.ResponseWriter, r *http.Request) {
+	const numHours = 7 * 24
+	now := time.Now()
+	data, err := dnsServer.GetStatsHistory(time.Hour, now.Add(-(numHours-1)*time.Hour), now)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Cannot get stats history: %s", err)
+		return
+	}
+	total, _ := data["dns_queries"].([]float64)
+	blocked, _ := data["blocked_filtering"].([]float64)
+
+	hours := []hourlyStatsJSON{}
+	start := now.Truncate(time.Hour).Add(-(numHours - 1) * time.Hour)
+	for i := 0; i < numHours && i < len(total) && i < len(blocked); i++ {
+		hours = append(hours, hourlyStatsJSON{
+			Timestamp:      start.Add(time.Duration(i) * time.Hour),
+			TotalQueries:   total[i],
+			BlockedQueries: blocked[i],
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(hours)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal hourly breakdown json: %s", err)
+		return
+	}
+}
+
 func handleStatsHistory(w http.ResponseWriter, r *http.Request) {
 	// handle time unit and prepare our time window size
 	timeUnitString := r.URL.Query().Get("time_unit")
@@ -260,14 +768,14 @@ func handleStatsHistory(w http.ResponseWriter, r *http.Request) {
 	startTime, err := time.Parse(time.RFC3339, r.URL.Query().Get("start_time"))
 	if err != nil {
 		errorText := fmt.Sprintf("Must specify valid start_time parameter: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusBadRequest)
 		return
 	}
 	endTime, err := time.Parse(time.RFC3339, r.URL.Query().Get("end_time"))
 	if err != nil {
 		errorText := fmt.Sprintf("Must specify valid end_time parameter: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusBadRequest)
 		return
 	}
@@ -282,7 +790,7 @@ func handleStatsHistory(w http.ResponseWriter, r *http.Request) {
 	statsJSON, err := json.Marshal(data)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to marshal status json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 		return
 	}
@@ -291,7 +799,7 @@ func handleStatsHistory(w http.ResponseWriter, r *http.Request) {
 	_, err = w.Write(statsJSON)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to write response json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 		return
 	}
@@ -326,37 +834,48 @@ func handleSetUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		errorText := fmt.Sprintf("Failed to read request body: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusBadRequest)
 		return
 	}
 	// if empty body -- user is asking for default servers
 	hosts := strings.Fields(string(body))
 
-	if len(hosts) == 0 {
-		config.DNS.UpstreamDNS = defaultDNS
-	} else {
-		config.DNS.UpstreamDNS = hosts
+	upstreams := hosts
+	if len(upstreams) == 0 {
+		upstreams = defaultDNS
+	}
+	if config.DNS.QNAMEMinimisation {
+		// the name servers are queried in plain text
+		for _, u := range upstreams {
+			if dnsforward.IsEncryptedUpstream(u) {
+				errorText := fmt.Sprintf("Encrypted upstream %s can't be used with QNAME minimisation", u)
+				apiLog.Infof("%s", errorText)
+				http.Error(w, errorText, http.StatusBadRequest)
+				return
+			}
+		}
 	}
+	config.DNS.UpstreamDNS = upstreams
 
 	err = writeAllConfigs()
 	if err != nil {
 		errorText := fmt.Sprintf("Couldn't write config file: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 		return
 	}
 	err = reconfigureDNSServer()
 	if err != nil {
 		errorText := fmt.Sprintf("Couldn't reconfigure the DNS server: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 		return
 	}
 	_, err = fmt.Fprintf(w, "OK %d servers\n", len(hosts))
 	if err != nil {
 		errorText := fmt.Sprintf("Couldn't write body: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 	}
 }
@@ -365,7 +884,7 @@ func handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		errorText := fmt.Sprintf("Failed to read request body: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 400)
 		return
 	}
@@ -373,7 +892,7 @@ func handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 
 	if len(hosts) == 0 {
 		errorText := fmt.Sprintf("No servers specified")
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusBadRequest)
 		return
 	}
@@ -383,7 +902,7 @@ func handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 	for _, host := range hosts {
 		err = checkDNS(host)
 		if err != nil {
-			log.Println(err)
+			apiLog.Errorf("%s", err)
 			result[host] = err.Error()
 		} else {
 			result[host] = "OK"
@@ -393,7 +912,7 @@ func handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 	jsonVal, err := json.Marshal(result)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to marshal status json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 		return
 	}
@@ -402,14 +921,14 @@ func handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 	_, err = w.Write(jsonVal)
 	if err != nil {
 		errorText := fmt.Sprintf("Couldn't write body: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 	}
 }
 
 func checkDNS(input string) error {
-	log.Printf("Checking if DNS %s works...", input)
-	u, err := upstream.AddressToUpstream(input, upstream.Options{Timeout: dnsforward.DefaultTimeout})
+	apiLog.Infof("Checking if DNS %s works...", input)
+	u, err := upstream.AddressToUpstream(input, upstream.Options{Timeout: upstreamTimeout(input)})
 	if err != nil {
 		return fmt.Errorf("failed to choose upstream for %s: %s", input, err)
 	}
@@ -433,25 +952,24 @@ func checkDNS(input string) error {
 		}
 	}
 
-	log.Printf("DNS %s works OK", input)
+	apiLog.Infof("DNS %s works OK", input)
 	return nil
 }
 
-func handleGetVersionJSON(w http.ResponseWriter, r *http.Request) {
+// getVersionJSON returns version.json, it's downloaded again if the cached copy is older than versionCheckPeriod or force is true
+func getVersionJSON(force bool) ([]byte, error) {
+	versionCheckLock.Lock()
+	defer versionCheckLock.Unlock()
+
 	now := time.Now()
-	if now.Sub(versionCheckLastTime) <= versionCheckPeriod && len(versionCheckJSON) != 0 {
+	if !force && now.Sub(versionCheckLastTime) <= versionCheckPeriod && len(versionCheckJSON) != 0 {
 		// return cached copy
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(versionCheckJSON)
-		return
+		return versionCheckJSON, nil
 	}
 
 	resp, err := client.Get(versionCheckURL)
 	if err != nil {
-		errorText := fmt.Sprintf("Couldn't get version check json from %s: %T %s\n", versionCheckURL, err, err)
-		log.Println(errorText)
-		http.Error(w, errorText, http.StatusBadGateway)
-		return
+		return nil, fmt.Errorf("Couldn't get version check json from %s: %T %s", versionCheckURL, err, err)
 	}
 	if resp != nil && resp.Body != nil {
 		defer resp.Body.Close()
@@ -460,9 +978,19 @@ func handleGetVersionJSON(w http.ResponseWriter, r *http.Request) {
 	// read the body entirely
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		errorText := fmt.Sprintf("Couldn't read response body from %s: %s", versionCheckURL, err)
-		log.Println(errorText)
-		http.Error(w, errorText, http.StatusBadGateway)
+		return nil, fmt.Errorf("Couldn't read response body from %s: %s", versionCheckURL, err)
+	}
+
+	versionCheckLastTime = now
+	versionCheckJSON = body
+	return body, nil
+}
+
+func writeVersionJSON(w http.ResponseWriter, force bool) {
+	body, err := getVersionJSON(force)
+	if err != nil {
+		apiLog.Errorf("%s", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
 
@@ -470,12 +998,21 @@ func handleGetVersionJSON(w http.ResponseWriter, r *http.Request) {
 	_, err = w.Write(body)
 	if err != nil {
 		errorText := fmt.Sprintf("Couldn't write body: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 	}
+}
 
-	versionCheckLastTime = now
-	versionCheckJSON = body
+func handleGetVersionJSON(w http.ResponseWriter, r *http.Request) {
+	writeVersionJSON(w, false)
+}
+
+// -----------------
+// updates/check_now
+// -----------------
+// handleUpdatesCheckNow downloads version.json ignoring the cached copy
+func handleUpdatesCheckNow(w http.ResponseWriter, r *http.Request) {
+	writeVersionJSON(w, true)
 }
 
 // ---------
@@ -505,7 +1042,7 @@ func handleFilteringStatus(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to marshal status json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 500)
 		return
 	}
@@ -514,12 +1051,67 @@ func handleFilteringStatus(w http.ResponseWriter, r *http.Request) {
 	_, err = w.Write(jsonVal)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to write response json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 500)
 		return
 	}
 }
 
+type filterStatusJSON struct {
+	ID          int64                      `json:"id"`
+	URL         string                     `json:"url"`
+	RulesCount  int                        `json:"rules_count"`
+	ParseErrors []dnsfilter.RuleParseError `json:"parse_errors"`
+}
+
+// handleFilteringStatusExtended returns the filters with the rules that couldn't be parsed, up to 100 for each filter
+func handleFilteringStatusExtended(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	data := []filterStatusJSON{}
+	for _, f := range config.Filters {
+		data = append(data, filterStatusJSON{ID: f.ID, URL: f.URL, RulesCount: f.RulesCount})
+	}
+	config.RUnlock()
+
+	for i := range data {
+		data[i].ParseErrors = dnsServer.GetFilterParseErrors(data[i].ID)
+		if data[i].ParseErrors == nil {
+			data[i].ParseErrors = []dnsfilter.RuleParseError{}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal filtering status json: %s", err)
+		return
+	}
+}
+
+// handleFilteringValidateURL checks the filter at the URL before it's added
+func handleFilteringValidateURL(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		URL string `json:"url"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse request body json: %s", err)
+		return
+	}
+	if !govalidator.IsRequestURL(req.URL) {
+		httpError(w, http.StatusBadRequest, "URL parameter is not valid request URL")
+		return
+	}
+
+	data := validateFilterURL(req.URL)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal filter validation json: %s", err)
+		return
+	}
+}
+
 func handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
 	f := filter{}
 	err := json.NewDecoder(r.Body).Decode(&f)
@@ -542,7 +1134,7 @@ func handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
 	for i := range config.Filters {
 		if config.Filters[i].URL == f.URL {
 			errorText := fmt.Sprintf("Filter URL already added -- %s", f.URL)
-			log.Println(errorText)
+			apiLog.Errorf("%s", errorText)
 			http.Error(w, errorText, http.StatusBadRequest)
 			return
 		}
@@ -556,19 +1148,19 @@ func handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
 	ok, err := f.update(true)
 	if err != nil {
 		errorText := fmt.Sprintf("Couldn't fetch filter from url %s: %s", f.URL, err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusBadRequest)
 		return
 	}
 	if f.RulesCount == 0 {
 		errorText := fmt.Sprintf("Filter at the url %s has no rules (maybe it points to blank page?)", f.URL)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusBadRequest)
 		return
 	}
 	if !ok {
 		errorText := fmt.Sprintf("Filter at the url %s is invalid (maybe it points to blank page?)", f.URL)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusBadRequest)
 		return
 	}
@@ -577,7 +1169,7 @@ func handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
 	err = f.save()
 	if err != nil {
 		errorText := fmt.Sprintf("Failed to save filter %d due to %s", f.ID, err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusBadRequest)
 		return
 	}
@@ -588,7 +1180,7 @@ func handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
 	err = writeAllConfigs()
 	if err != nil {
 		errorText := fmt.Sprintf("Couldn't write config file: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 		return
 	}
@@ -596,14 +1188,14 @@ func handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
 	err = reconfigureDNSServer()
 	if err != nil {
 		errorText := fmt.Sprintf("Couldn't reconfigure the DNS server: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 	}
 
 	_, err = fmt.Fprintf(w, "OK %d rules\n", f.RulesCount)
 	if err != nil {
 		errorText := fmt.Sprintf("Couldn't write body: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 	}
 }
@@ -612,7 +1204,7 @@ func handleFilteringRemoveURL(w http.ResponseWriter, r *http.Request) {
 	parameters, err := parseParametersFromBody(r.Body)
 	if err != nil {
 		errorText := fmt.Sprintf("failed to parse parameters from body: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 400)
 		return
 	}
@@ -652,7 +1244,7 @@ func handleFilteringEnableURL(w http.ResponseWriter, r *http.Request) {
 	parameters, err := parseParametersFromBody(r.Body)
 	if err != nil {
 		errorText := fmt.Sprintf("failed to parse parameters from body: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 400)
 		return
 	}
@@ -691,7 +1283,7 @@ func handleFilteringDisableURL(w http.ResponseWriter, r *http.Request) {
 	parameters, err := parseParametersFromBody(r.Body)
 	if err != nil {
 		errorText := fmt.Sprintf("failed to parse parameters from body: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 400)
 		return
 	}
@@ -728,7 +1320,7 @@ func handleFilteringSetRules(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		errorText := fmt.Sprintf("Failed to read request body: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 400)
 		return
 	}
@@ -743,6 +1335,33 @@ func handleFilteringRefresh(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "OK %d filters updated\n", updated)
 }
 
+// handleFilteringDeduplication removes the user rules that duplicate the rules of the enabled filters or each other
+// the downloaded filters aren't changed
+func handleFilteringDeduplication(w http.ResponseWriter, r *http.Request) {
+	config.Lock()
+	found, removed := deduplicateUserRules()
+	config.Unlock()
+
+	if removed != 0 {
+		err := writeAllConfigsAndReloadDNS()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+			return
+		}
+	}
+
+	data := map[string]int{
+		"duplicates_found":        found,
+		"removed_from_user_rules": removed,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal deduplication json: %s", err)
+		return
+	}
+}
+
 // ------------
 // safebrowsing
 // ------------
@@ -764,7 +1383,7 @@ func handleSafeBrowsingStatus(w http.ResponseWriter, r *http.Request) {
 	jsonVal, err := json.Marshal(data)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to marshal status json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 500)
 	}
 
@@ -772,7 +1391,7 @@ func handleSafeBrowsingStatus(w http.ResponseWriter, r *http.Request) {
 	_, err = w.Write(jsonVal)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to write response json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 500)
 		return
 	}
@@ -785,7 +1404,7 @@ func handleParentalEnable(w http.ResponseWriter, r *http.Request) {
 	parameters, err := parseParametersFromBody(r.Body)
 	if err != nil {
 		errorText := fmt.Sprintf("failed to parse parameters from body: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 400)
 		return
 	}
@@ -842,7 +1461,7 @@ func handleParentalStatus(w http.ResponseWriter, r *http.Request) {
 	jsonVal, err := json.Marshal(data)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to marshal status json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 500)
 		return
 	}
@@ -851,7 +1470,7 @@ func handleParentalStatus(w http.ResponseWriter, r *http.Request) {
 	_, err = w.Write(jsonVal)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to write response json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 500)
 		return
 	}
@@ -878,7 +1497,7 @@ func handleSafeSearchStatus(w http.ResponseWriter, r *http.Request) {
 	jsonVal, err := json.Marshal(data)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to marshal status json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 500)
 		return
 	}
@@ -887,7 +1506,7 @@ func handleSafeSearchStatus(w http.ResponseWriter, r *http.Request) {
 	_, err = w.Write(jsonVal)
 	if err != nil {
 		errorText := fmt.Sprintf("Unable to write response json: %s", err)
-		log.Println(errorText)
+		apiLog.Errorf("%s", errorText)
 		http.Error(w, errorText, 500)
 		return
 	}
@@ -942,8 +1561,19 @@ func handleInstallGetAddresses(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// installWeb is the address of the web interface set by /control/install/configure_web
+// it's applied by /control/install/configure, so that the wizard isn't disconnected in the middle
+var installWeb *ipport
+
 func handleInstallConfigure(w http.ResponseWriter, r *http.Request) {
-	newSettings := firstRunData{}
+	// the addresses that aren't in the request are the ones set by configure_web and configure_dns
+	newSettings := firstRunData{
+		Web: ipport{IP: config.BindHost, Port: config.BindPort},
+		DNS: ipport{IP: config.DNS.BindHost, Port: config.DNS.Port},
+	}
+	if installWeb != nil {
+		newSettings.Web = *installWeb
+	}
 	err := json.NewDecoder(r.Body).Decode(&newSettings)
 	if err != nil {
 		httpError(w, http.StatusBadRequest, "Failed to parse new config json: %s", err)
@@ -976,8 +1606,11 @@ func handleInstallConfigure(w http.ResponseWriter, r *http.Request) {
 	config.BindPort = newSettings.Web.Port
 	config.DNS.BindHost = newSettings.DNS.IP
 	config.DNS.Port = newSettings.DNS.Port
-	config.AuthName = newSettings.Username
-	config.AuthPass = newSettings.Password
+	// the credentials may be already set by /control/install/set_password
+	if newSettings.Username != "" || newSettings.Password != "" {
+		config.AuthName = newSettings.Username
+		config.AuthPass = newSettings.Password
+	}
 
 	if config.DNS.Port != 0 {
 		err = startDNSServer()
@@ -988,13 +1621,106 @@ func handleInstallConfigure(w http.ResponseWriter, r *http.Request) {
 	}
 
 	httpUpdateConfigReloadDNSReturnOK(w, r)
-	// this needs to be done in a goroutine because Shutdown() is a blocking call, and it will block
-	// until all requests are finished, and _we_ are inside a request right now, so it will block indefinitely
 	if restartHTTP {
-		go func() {
-			httpServer.Shutdown(context.TODO())
-		}()
+		restartHTTPServer()
+	}
+}
+
+// handleInstallConfigureDNS sets the address of the DNS server, the server is started by /control/install/configure
+func handleInstallConfigureDNS(w http.ResponseWriter, r *http.Request) {
+	data := ipport{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse DNS address json: %s", err)
+		return
+	}
+
+	if net.ParseIP(data.IP) == nil {
+		httpError(w, http.StatusBadRequest, "Invalid IP address %s", data.IP)
+		return
+	}
+	if data.Port < 0 || data.Port > 65535 {
+		httpError(w, http.StatusBadRequest, "Invalid port %d", data.Port)
+		return
+	}
+	err = checkPacketPortAvailable(data.IP, data.Port)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Impossible to listen on IP:port %s due to %s", net.JoinHostPort(data.IP, strconv.Itoa(data.Port)), err)
+		return
+	}
+
+	config.Lock()
+	config.DNS.BindHost = data.IP
+	config.DNS.Port = data.Port
+	config.Unlock()
+
+	// kept in memory only, the config file is written when the first run is finished by /control/install/configure
+	returnOK(w)
+}
+
+// handleInstallConfigureWeb sets the address of the web interface, it's applied by /control/install/configure
+func handleInstallConfigureWeb(w http.ResponseWriter, r *http.Request) {
+	data := ipport{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse web address json: %s", err)
+		return
+	}
+
+	if net.ParseIP(data.IP) == nil {
+		httpError(w, http.StatusBadRequest, "Invalid IP address %s", data.IP)
+		return
 	}
+	if data.Port <= 0 || data.Port > 65535 {
+		httpError(w, http.StatusBadRequest, "Invalid port %d", data.Port)
+		return
+	}
+	if config.BindHost != data.IP || config.BindPort != data.Port {
+		err = checkPortAvailable(data.IP, data.Port)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "Impossible to listen on IP:port %s due to %s", net.JoinHostPort(data.IP, strconv.Itoa(data.Port)), err)
+			return
+		}
+	}
+
+	config.Lock()
+	installWeb = &ipport{IP: data.IP, Port: data.Port}
+	config.Unlock()
+
+	// kept in memory only, the config file is written when the first run is finished by /control/install/configure
+	returnOK(w)
+}
+
+// minPasswordLength is the minimum length of the password set by /control/install/set_password
+const minPasswordLength = 8
+
+// handleInstallSetPassword sets the credentials before the rest of the settings are configured, nothing is restarted
+// they're saved along with the other settings by /control/install/configure
+func handleInstallSetPassword(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse credentials json: %s", err)
+		return
+	}
+
+	if req.Username == "" {
+		httpError(w, http.StatusBadRequest, "username is required")
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		httpError(w, http.StatusBadRequest, "password must be at least %d characters long", minPasswordLength)
+		return
+	}
+
+	config.Lock()
+	config.AuthName = req.Username
+	config.AuthPass = req.Password
+	config.Unlock()
+	returnOK(w)
 }
 
 // ---
@@ -1053,7 +1779,7 @@ func handleTLSConfigure(w http.ResponseWriter, r *http.Request) {
 	restartHTTPS := false
 	data = validateCertificates(data)
 	if !reflect.DeepEqual(config.TLS.tlsConfigSettings, data.tlsConfigSettings) {
-		log.Printf("tls config settings have changed, will restart HTTPS server")
+		apiLog.Infof("tls config settings have changed, will restart HTTPS server")
 		restartHTTPS = true
 	}
 	config.TLS = data
@@ -1063,18 +1789,10 @@ func handleTLSConfigure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	marshalTLS(w, data)
-	// this needs to be done in a goroutine because Shutdown() is a blocking call, and it will block
-	// until all requests are finished, and _we_ are inside a request right now, so it will block indefinitely
 	if restartHTTPS {
-		go func() {
-			time.Sleep(time.Second) // TODO: could not find a way to reliably know that data was fully sent to client by https server, so we wait a bit to let response through before closing the server
-			httpsServer.cond.L.Lock()
-			httpsServer.cond.Broadcast()
-			if httpsServer.server != nil {
-				httpsServer.server.Shutdown(context.TODO())
-			}
-			httpsServer.cond.L.Unlock()
-		}()
+		restartHTTPSServer()
+		// the block page uses the same certificate
+		restartBlockPageServer()
 	}
 }
 
@@ -1086,7 +1804,7 @@ func validateCertificates(data tlsConfig) tlsConfig {
 
 	// check only public certificate separately from the key
 	if data.CertificateChain != "" {
-		log.Tracef("got certificate: %s", data.CertificateChain)
+		apiLog.Debugf("got certificate: %s", data.CertificateChain)
 
 		// now do a more extended validation
 		var certs []*pem.Block    // PEM-encoded certificates
@@ -1130,12 +1848,12 @@ func validateCertificates(data tlsConfig) tlsConfig {
 			DNSName: data.ServerName,
 		}
 
-		log.Printf("number of certs - %d", len(parsedCerts))
+		apiLog.Infof("number of certs - %d", len(parsedCerts))
 		if len(parsedCerts) > 1 {
 			// set up an intermediate
 			pool := x509.NewCertPool()
 			for _, cert := range parsedCerts[1:] {
-				log.Printf("got an intermediate cert")
+				apiLog.Infof("got an intermediate cert")
 				pool.AddCert(cert)
 			}
 			opts.Intermediates = pool
@@ -1306,6 +2024,10 @@ func handleDOH(w http.ResponseWriter, r *http.Request) {
 func registerInstallHandlers() {
 	http.HandleFunc("/control/install/get_addresses", preInstall(ensureGET(handleInstallGetAddresses)))
 	http.HandleFunc("/control/install/configure", preInstall(ensurePOST(handleInstallConfigure)))
+	http.HandleFunc("/control/install/configure_dns", preInstall(ensurePOST(handleInstallConfigureDNS)))
+	http.HandleFunc("/control/install/configure_web", preInstall(ensurePOST(handleInstallConfigureWeb)))
+	http.HandleFunc("/control/install/set_password", preInstall(ensurePOST(handleInstallSetPassword)))
+	http.HandleFunc("/control/install/gateway", preInstall(ensureGET(handleNetworkGateway)))
 }
 
 func registerControlHandlers() {
@@ -1313,25 +2035,59 @@ func registerControlHandlers() {
 	http.HandleFunc("/control/enable_protection", postInstall(optionalAuth(ensurePOST(handleProtectionEnable))))
 	http.HandleFunc("/control/disable_protection", postInstall(optionalAuth(ensurePOST(handleProtectionDisable))))
 	http.HandleFunc("/control/querylog", postInstall(optionalAuth(ensureGET(handleQueryLog))))
+	http.HandleFunc("/control/querylog/top_blocked_clients", postInstall(optionalAuth(ensureGET(handleQueryLogTopBlockedClients))))
+	http.HandleFunc("/control/querylog/top_blocked_rules", postInstall(optionalAuth(ensureGET(handleQueryLogTopBlockedRules))))
+	http.HandleFunc("/control/querylog/false_positive", postInstall(optionalAuth(ensurePOST(handleQueryLogFalsePositive))))
+	http.HandleFunc("/control/querylog/false_positives", postInstall(optionalAuth(ensureGET(handleQueryLogFalsePositives))))
+	http.HandleFunc("/control/querylog/anomalies", postInstall(optionalAuth(ensureGET(handleQueryLogAnomalies))))
+	http.HandleFunc("/control/querylog/geo", postInstall(optionalAuth(ensureGET(handleQueryLogGeo))))
+	http.HandleFunc("/control/querylog/whois", postInstall(optionalAuth(ensureGET(handleQueryLogWhois))))
+	http.HandleFunc("/control/querylog/clear_client", postInstall(optionalAuth(ensurePOST(handleQueryLogClearClient))))
+	http.HandleFunc("/control/querylog/config", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetQueryLogConfig,
+		http.MethodPost: handleSetQueryLogConfig,
+	}))))
+	http.HandleFunc("/control/querylog/retention", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetQueryLogRetention,
+		http.MethodPost: handleSetQueryLogRetention,
+	}))))
 	http.HandleFunc("/control/querylog_enable", postInstall(optionalAuth(ensurePOST(handleQueryLogEnable))))
 	http.HandleFunc("/control/querylog_disable", postInstall(optionalAuth(ensurePOST(handleQueryLogDisable))))
 	http.HandleFunc("/control/set_upstream_dns", postInstall(optionalAuth(ensurePOST(handleSetUpstreamDNS))))
 	http.HandleFunc("/control/test_upstream_dns", postInstall(optionalAuth(ensurePOST(handleTestUpstreamDNS))))
 	http.HandleFunc("/control/i18n/change_language", postInstall(optionalAuth(ensurePOST(handleI18nChangeLanguage))))
 	http.HandleFunc("/control/i18n/current_language", postInstall(optionalAuth(ensureGET(handleI18nCurrentLanguage))))
+	// it's used by the first-run wizard too
+	http.HandleFunc("/control/i18n/detect_language", optionalAuth(ensureGET(handleI18nDetectLanguage)))
+	http.HandleFunc("/control/i18n/plurals", postInstall(optionalAuth(ensureGET(handleI18nPlurals))))
 	http.HandleFunc("/control/stats_top", postInstall(optionalAuth(ensureGET(handleStatsTop))))
 	http.HandleFunc("/control/stats", postInstall(optionalAuth(ensureGET(handleStats))))
 	http.HandleFunc("/control/stats_history", postInstall(optionalAuth(ensureGET(handleStatsHistory))))
 	http.HandleFunc("/control/stats_reset", postInstall(optionalAuth(ensurePOST(handleStatsReset))))
+	http.HandleFunc("/control/stats/clear_client", postInstall(optionalAuth(ensurePOST(handleStatsClearClient))))
+	http.HandleFunc("/control/stats/clients_count", postInstall(optionalAuth(ensureGET(handleStatsClientsCount))))
+	http.HandleFunc("/control/stats/hourly_breakdown", postInstall(optionalAuth(ensureGET(handleStatsHourlyBreakdown))))
+	http.HandleFunc("/control/stats/top_query_types", postInstall(optionalAuth(ensureGET(handleStatsTopQueryTypes))))
+	http.HandleFunc("/control/stats/top_response_codes", postInstall(optionalAuth(ensureGET(handleStatsTopResponseCodes))))
+	http.HandleFunc("/control/stats/top_upstreams", postInstall(optionalAuth(ensureGET(handleStatsTopUpstreams))))
 	http.HandleFunc("/control/version.json", postInstall(optionalAuth(handleGetVersionJSON)))
+	http.HandleFunc("/control/updates/check_now", postInstall(optionalAuth(ensurePOST(handleUpdatesCheckNow))))
+	http.HandleFunc("/control/updates/auto_update", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetAutoUpdate,
+		http.MethodPost: handleSetAutoUpdate,
+	}))))
 	http.HandleFunc("/control/filtering/enable", postInstall(optionalAuth(ensurePOST(handleFilteringEnable))))
 	http.HandleFunc("/control/filtering/disable", postInstall(optionalAuth(ensurePOST(handleFilteringDisable))))
 	http.HandleFunc("/control/filtering/add_url", postInstall(optionalAuth(ensurePUT(handleFilteringAddURL))))
+	http.HandleFunc("/control/filtering/validate_url", postInstall(optionalAuth(ensurePOST(handleFilteringValidateURL))))
 	http.HandleFunc("/control/filtering/remove_url", postInstall(optionalAuth(ensureDELETE(handleFilteringRemoveURL))))
 	http.HandleFunc("/control/filtering/enable_url", postInstall(optionalAuth(ensurePOST(handleFilteringEnableURL))))
 	http.HandleFunc("/control/filtering/disable_url", postInstall(optionalAuth(ensurePOST(handleFilteringDisableURL))))
 	http.HandleFunc("/control/filtering/refresh", postInstall(optionalAuth(ensurePOST(handleFilteringRefresh))))
+	http.HandleFunc("/control/filtering/deduplication", postInstall(optionalAuth(ensurePOST(handleFilteringDeduplication))))
+	http.HandleFunc("/control/filtering/convert_hosts", postInstall(optionalAuth(ensurePOST(handleFilteringConvertHosts))))
 	http.HandleFunc("/control/filtering/status", postInstall(optionalAuth(ensureGET(handleFilteringStatus))))
+	http.HandleFunc("/control/filtering/status_extended", postInstall(optionalAuth(ensureGET(handleFilteringStatusExtended))))
 	http.HandleFunc("/control/filtering/set_rules", postInstall(optionalAuth(ensurePUT(handleFilteringSetRules))))
 	http.HandleFunc("/control/safebrowsing/enable", postInstall(optionalAuth(ensurePOST(handleSafeBrowsingEnable))))
 	http.HandleFunc("/control/safebrowsing/disable", postInstall(optionalAuth(ensurePOST(handleSafeBrowsingDisable))))
@@ -1346,10 +2102,164 @@ func registerControlHandlers() {
 	http.HandleFunc("/control/dhcp/interfaces", postInstall(optionalAuth(ensureGET(handleDHCPInterfaces))))
 	http.HandleFunc("/control/dhcp/set_config", postInstall(optionalAuth(ensurePOST(handleDHCPSetConfig))))
 	http.HandleFunc("/control/dhcp/find_active_dhcp", postInstall(optionalAuth(ensurePOST(handleDHCPFindActiveServer))))
+	http.HandleFunc("/control/dhcp/dns_suffix", postInstall(optionalAuth(ensurePOST(handleDHCPSetDNSSuffix))))
+	http.HandleFunc("/control/dhcp/hostname_rewrite", postInstall(optionalAuth(ensurePOST(handleDHCPHostnameRewrite))))
+	http.HandleFunc("/control/dhcp/network_scan", postInstall(optionalAuth(ensurePOST(handleDHCPNetworkScan))))
+	http.HandleFunc("/control/dhcp/option_sets", postInstall(optionalAuth(ensureGET(handleGetDHCPOptions))))
+	http.HandleFunc("/control/dhcp/option_sets/add", postInstall(optionalAuth(ensurePOST(handleAddDHCPOption))))
+	http.HandleFunc("/control/dhcp/option_sets/delete", postInstall(optionalAuth(ensureDELETE(handleDeleteDHCPOption))))
+	http.HandleFunc("/control/dhcp/relay", postInstall(optionalAuth(ensureGET(handleGetDHCPRelay))))
+	http.HandleFunc("/control/dhcp/relay/configure", postInstall(optionalAuth(ensurePOST(handleDHCPRelayConfigure))))
+
+	http.HandleFunc("/control/clients", postInstall(optionalAuth(ensureGET(handleGetClients))))
+	http.HandleFunc("/control/clients/add", postInstall(optionalAuth(ensurePOST(handleAddClient))))
+	http.HandleFunc("/control/clients/delete", postInstall(optionalAuth(ensurePOST(handleDeleteClient))))
+	http.HandleFunc("/control/clients/update", postInstall(optionalAuth(ensurePOST(handleUpdateClient))))
+	http.HandleFunc("/control/clients/auto_discover", postInstall(optionalAuth(ensurePOST(handleClientsAutoDiscover))))
+	http.HandleFunc("/control/clients/import", postInstall(optionalAuth(ensurePOST(handleClientsImport))))
+	http.HandleFunc("/control/clients/export", postInstall(optionalAuth(ensureGET(handleClientsExport))))
+	http.HandleFunc("/control/tags", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetTags,
+		http.MethodPost: handleAddTag,
+	}))))
+	http.HandleFunc("/control/tags/", postInstall(optionalAuth(ensureDELETE(handleDeleteTag))))
+
+	http.HandleFunc("/control/dns/aggressivensec", postInstall(optionalAuth(ensurePOST(handleSetAggressiveNSEC))))
+	http.HandleFunc("/control/dns/allowed_query_domains/list", postInstall(optionalAuth(ensureGET(handleGetAllowedQueryDomains))))
+	http.HandleFunc("/control/dns/allowed_query_domains/add", postInstall(optionalAuth(ensurePOST(handleAddAllowedQueryDomain))))
+	http.HandleFunc("/control/dns/allowed_query_domains/delete", postInstall(optionalAuth(ensureDELETE(handleDeleteAllowedQueryDomain))))
+	http.HandleFunc("/control/dns/allowlist_mode", postInstall(optionalAuth(ensurePOST(handleSetAllowlistMode))))
+	http.HandleFunc("/control/dns/block_page/configure", postInstall(optionalAuth(ensurePOST(handleBlockPageConfigure))))
+	http.HandleFunc("/control/dns/block_response_ip", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetBlockResponseIP,
+		http.MethodPost: handleSetBlockResponseIP,
+	}))))
+	http.HandleFunc("/control/dns/block_ttl", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetBlockTTL,
+		http.MethodPost: handleSetBlockTTL,
+	}))))
+	http.HandleFunc("/control/dns/blocking_mode", postInstall(optionalAuth(ensurePOST(handleBlockingMode))))
+	http.HandleFunc("/control/dns/cache/prefetch_popular", postInstall(optionalAuth(ensurePOST(handlePrefetchPopular))))
+	http.HandleFunc("/control/dns/cache/prefetch_status", postInstall(optionalAuth(ensureGET(handlePrefetchStatus))))
+	http.HandleFunc("/control/dns/cache/prefetch_cancel", postInstall(optionalAuth(ensurePOST(handlePrefetchCancel))))
+	http.HandleFunc("/control/dns/cache/serve_stale", postInstall(optionalAuth(ensurePOST(handleSetServeStale))))
+	http.HandleFunc("/control/dns/cache_prefetch_on_expired", postInstall(optionalAuth(ensurePOST(handleSetPrefetchOnExpired))))
+	http.HandleFunc("/control/dns/client_schedule/list", postInstall(optionalAuth(ensureGET(handleGetClientSchedules))))
+	http.HandleFunc("/control/dns/client_schedule/add", postInstall(optionalAuth(ensurePOST(handleAddClientSchedule))))
+	http.HandleFunc("/control/dns/client_schedule/delete", postInstall(optionalAuth(ensureDELETE(handleDeleteClientSchedule))))
+	http.HandleFunc("/control/dns/cname_flattening", postInstall(optionalAuth(ensurePOST(handleSetCNAMEFlattening))))
+	http.HandleFunc("/control/dns/dnscrypt/configure", postInstall(optionalAuth(ensurePOST(handleDNSCryptConfigure))))
+	http.HandleFunc("/control/dns/dnscrypt/status", postInstall(optionalAuth(ensureGET(handleDNSCryptStatus))))
+	http.HandleFunc("/control/dns/dnssec", postInstall(optionalAuth(ensurePOST(handleSetDNSSEC))))
+	http.HandleFunc("/control/dns/ecs_blocking/status", postInstall(optionalAuth(ensureGET(handleECSBlockingStatus))))
+	http.HandleFunc("/control/dns/ecs_blocking/configure", postInstall(optionalAuth(ensurePOST(handleECSBlockingConfigure))))
+	http.HandleFunc("/control/dns/extended_errors", postInstall(optionalAuth(ensurePOST(handleSetExtendedErrors))))
+	http.HandleFunc("/control/dns/forward_upstream_errors", postInstall(optionalAuth(ensurePOST(handleSetForwardUpstreamErrors))))
+	http.HandleFunc("/control/dns/forwarded_queries_log", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleForwardedQueriesLog,
+		http.MethodPost: handleSetTraceForwarded,
+	}))))
+	http.HandleFunc("/control/dns/ip_version", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetIPVersion,
+		http.MethodPost: handleSetIPVersion,
+	}))))
+	http.HandleFunc("/control/dns/ipv6_disabled", postInstall(optionalAuth(ensurePOST(handleSetIPv6Disabled))))
+	http.HandleFunc("/control/dns/log_queries_to_syslog", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetQueryLogSyslog,
+		http.MethodPost: handleSetQueryLogSyslog,
+	}))))
+	http.HandleFunc("/control/dns/max_goroutines", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetMaxGoroutines,
+		http.MethodPost: handleSetMaxGoroutines,
+	}))))
+	http.HandleFunc("/control/dns/max_ttl_per_domain/list", postInstall(optionalAuth(ensureGET(handleGetDomainMaxTTLs))))
+	http.HandleFunc("/control/dns/max_ttl_per_domain/add", postInstall(optionalAuth(ensurePOST(handleAddDomainMaxTTL))))
+	http.HandleFunc("/control/dns/max_ttl_per_domain/delete", postInstall(optionalAuth(ensureDELETE(handleDeleteDomainMaxTTL))))
+	http.HandleFunc("/control/dns/min_response_ttl", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetMinResponseTTL,
+		http.MethodPost: handleSetMinResponseTTL,
+	}))))
+	http.HandleFunc("/control/dns/nxdomain_redirect", postInstall(optionalAuth(ensurePOST(handleSetNXDomainRedirect))))
+	http.HandleFunc("/control/dns/prefetch", postInstall(optionalAuth(ensurePOST(handleSetPrefetch))))
+	http.HandleFunc("/control/dns/private_dns", postInstall(optionalAuth(ensurePOST(handleSetPrivateDNS))))
+	http.HandleFunc("/control/dns/qname_minimisation", postInstall(optionalAuth(ensurePOST(handleSetQNAMEMinimisation))))
+	http.HandleFunc("/control/dns/query_log_anonymization", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetQueryLogAnonymization,
+		http.MethodPost: handleSetQueryLogAnonymization,
+	}))))
+	http.HandleFunc("/control/dns/query_types_block", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:    handleGetQueryTypesBlock,
+		http.MethodPost:   handleAddQueryTypesBlock,
+		http.MethodDelete: handleDeleteQueryTypesBlock,
+	}))))
+	http.HandleFunc("/control/dns/rate_limit", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetRateLimit,
+		http.MethodPost: handleSetRateLimit,
+	}))))
+	http.HandleFunc("/control/dns/response_code", postInstall(optionalAuth(ensurePOST(handleSetResponseCode))))
+	http.HandleFunc("/control/dns/response_filter/list", postInstall(optionalAuth(ensureGET(handleGetResponseFilters))))
+	http.HandleFunc("/control/dns/response_filter/add", postInstall(optionalAuth(ensurePOST(handleAddResponseFilter))))
+	http.HandleFunc("/control/dns/response_filter/delete", postInstall(optionalAuth(ensureDELETE(handleDeleteResponseFilter))))
+	http.HandleFunc("/control/dns/response_rewrite/list", postInstall(optionalAuth(ensureGET(handleGetResponseRewrites))))
+	http.HandleFunc("/control/dns/response_rewrite/add", postInstall(optionalAuth(ensurePOST(handleAddResponseRewrite))))
+	http.HandleFunc("/control/dns/response_rewrite/delete", postInstall(optionalAuth(ensureDELETE(handleDeleteResponseRewrite))))
+	http.HandleFunc("/control/dns/schedule/list", postInstall(optionalAuth(ensureGET(handleGetSchedules))))
+	http.HandleFunc("/control/dns/schedule/add", postInstall(optionalAuth(ensurePOST(handleAddSchedule))))
+	http.HandleFunc("/control/dns/schedule/delete", postInstall(optionalAuth(ensureDELETE(handleDeleteSchedule))))
+	http.HandleFunc("/control/dns/schedule/conflict_resolution", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetScheduleConflict,
+		http.MethodPost: handleSetScheduleConflict,
+	}))))
+	http.HandleFunc("/control/dns/trusted_clients", postInstall(optionalAuth(ensureGET(handleGetTrustedClients))))
+	http.HandleFunc("/control/dns/trusted_clients/add", postInstall(optionalAuth(ensurePOST(handleAddTrustedClient))))
+	http.HandleFunc("/control/dns/trusted_clients/delete", postInstall(optionalAuth(ensureDELETE(handleDeleteTrustedClient))))
+	http.HandleFunc("/control/dns/upstream_cache_size", postInstall(optionalAuth(ensurePOST(handleSetUpstreamCacheSize))))
+	http.HandleFunc("/control/dns/upstream_group_latency", postInstall(optionalAuth(ensureGET(handleUpstreamGroupLatency))))
+	http.HandleFunc("/control/dns/upstream_info", postInstall(optionalAuth(ensureGET(handleUpstreamInfo))))
+	http.HandleFunc("/control/dns/upstream_protocols", postInstall(optionalAuth(ensureGET(handleUpstreamProtocols))))
+	http.HandleFunc("/control/dns/upstream_retries", postInstall(optionalAuth(ensurePOST(handleSetUpstreamRetries))))
+	http.HandleFunc("/control/dns/upstream_selector_policy", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetUpstreamPolicy,
+		http.MethodPost: handleSetUpstreamPolicy,
+	}))))
+	http.HandleFunc("/control/dns/upstream_test_extended", postInstall(optionalAuth(ensurePOST(handleUpstreamTestExtended))))
+	http.HandleFunc("/control/dns/upstream_timeout", postInstall(optionalAuth(ensurePOST(handleSetUpstreamTimeout))))
+	http.HandleFunc("/control/dns/zone_transfer/", postInstall(optionalAuth(ensureGET(handleZoneTransfer))))
+	http.HandleFunc("/control/dns/zones", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetZones,
+		http.MethodPost: handleAddZone,
+	}))))
+	http.HandleFunc("/control/dns/zones/", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodPut:    handleUpdateZone,
+		http.MethodDelete: handleDeleteZone,
+	}))))
+
+	http.HandleFunc("/control/network/gateway", postInstall(optionalAuth(ensureGET(handleNetworkGateway))))
+	http.HandleFunc("/control/network/internet_connectivity", postInstall(optionalAuth(ensureGET(handleInternetConnectivity))))
+	http.HandleFunc("/control/network/ipv6_available", postInstall(optionalAuth(ensureGET(handleIPv6Available))))
+	http.HandleFunc("/control/network/listen_interfaces", postInstall(optionalAuth(ensurePOST(handleSetListenInterfaces))))
+	http.HandleFunc("/control/network/listen_ports", postInstall(optionalAuth(ensurePOST(handleSetListenPorts))))
+	http.HandleFunc("/control/network/speed_test", postInstall(optionalAuth(ensurePOST(handleSpeedTest))))
+
+	http.HandleFunc("/control/notify/configure", postInstall(optionalAuth(ensurePOST(handleNotifyConfigure))))
+
+	http.HandleFunc("/control/system/disk_usage", postInstall(optionalAuth(ensureGET(handleDiskUsage))))
+	// health probes don't require authentication, they are used by Docker and Kubernetes
+	http.HandleFunc("/control/system/health", postInstall(ensureGET(handleHealth)))
+	http.HandleFunc("/control/system/ready", postInstall(ensureGET(handleReady)))
+	http.HandleFunc("/control/system/resource_limits", postInstall(optionalAuth(ensureMethods(map[string]func(http.ResponseWriter, *http.Request){
+		http.MethodGet:  handleGetResourceLimits,
+		http.MethodPost: handleSetResourceLimits,
+	}))))
+	http.HandleFunc("/control/system/time", postInstall(optionalAuth(ensureGET(handleSystemTime))))
 
 	http.HandleFunc("/control/tls/status", postInstall(optionalAuth(ensureGET(handleTLSStatus))))
 	http.HandleFunc("/control/tls/configure", postInstall(optionalAuth(ensurePOST(handleTLSConfigure))))
 	http.HandleFunc("/control/tls/validate", postInstall(optionalAuth(ensurePOST(handleTLSValidate))))
+	http.HandleFunc("/control/tls/download_chain", postInstall(optionalAuth(ensurePOST(handleTLSDownloadChain))))
+	http.HandleFunc("/control/tls/check_expiry", postInstall(optionalAuth(ensureGET(handleTLSCheckExpiry))))
 
 	http.HandleFunc("/dns-query", postInstall(handleDOH))
+
+	registerDebugHandlers()
 }
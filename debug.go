@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hmage/golibs/log"
+)
+
+const debugPprofPrefix = "/control/debug/pprof/"
+
+// registerDebugHandlers adds the debugging endpoints if they are enabled in the config
+// we don't import net/http/pprof because it registers unprotected handlers in http.DefaultServeMux
+func registerDebugHandlers() {
+	if !config.DebugPprofEnabled {
+		return
+	}
+	log.Printf("WARNING: pprof profiling data is exposed at %s", debugPprofPrefix)
+	http.HandleFunc(debugPprofPrefix, postInstall(optionalAuth(ensureGET(handleDebugPprof))))
+	http.HandleFunc("/control/debug/gc", postInstall(optionalAuth(ensurePOST(handleDebugGC))))
+	http.HandleFunc("/control/dns/cache_dump", postInstall(optionalAuth(ensureGET(handleDNSCacheDump))))
+	http.HandleFunc("/control/system/cpu_profile", postInstall(optionalAuth(ensurePOST(handleSystemCPUProfile))))
+	http.HandleFunc("/control/system/heap_profile", postInstall(optionalAuth(ensurePOST(handleSystemHeapProfile))))
+}
+
+func handleDebugPprof(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, debugPprofPrefix)
+	switch name {
+	case "":
+		handleDebugPprofIndex(w, r)
+	case "cmdline":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+	case "profile":
+		handleDebugPprofCPU(w, r)
+	case "trace":
+		handleDebugPprofTrace(w, r)
+	default:
+		p := pprof.Lookup(name)
+		if p == nil {
+			httpError(w, http.StatusNotFound, "Unknown profile: %s", name)
+			return
+		}
+		debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+		if debug != 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		}
+		err := p.WriteTo(w, debug)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Couldn't write %s profile: %s", name, err)
+			return
+		}
+	}
+}
+
+func handleDebugPprofIndex(w http.ResponseWriter, r *http.Request) {
+	names := []string{"cmdline", "profile", "trace"}
+	for _, p := range pprof.Profiles() {
+		names = append(names, p.Name())
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s%s\n", debugPprofPrefix, name)
+	}
+}
+
+// maximum value of the "seconds" URL parameter, the request is kept open for this long
+const maxProfilingSeconds = 300
+
+// profilingDuration returns the value of the "seconds" URL parameter, 30 seconds by default
+// an error is returned if it's more than maxProfilingSeconds
+func profilingDuration(r *http.Request) (time.Duration, error) {
+	sec, err := strconv.Atoi(r.URL.Query().Get("seconds"))
+	if err != nil || sec <= 0 {
+		sec = 30
+	}
+	if sec > maxProfilingSeconds {
+		return 0, fmt.Errorf("seconds must not be more than %d", maxProfilingSeconds)
+	}
+	return time.Duration(sec) * time.Second, nil
+}
+
+func handleDebugPprofCPU(w http.ResponseWriter, r *http.Request) {
+	duration, err := profilingDuration(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	err = pprof.StartCPUProfile(w)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't start CPU profiling: %s", err)
+		return
+	}
+	time.Sleep(duration)
+	pprof.StopCPUProfile()
+}
+
+func handleDebugPprofTrace(w http.ResponseWriter, r *http.Request) {
+	duration, err := profilingDuration(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	err = trace.Start(w)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't start tracing: %s", err)
+		return
+	}
+	time.Sleep(duration)
+	trace.Stop()
+}
+
+// ------------------
+// system/cpu_profile
+// ------------------
+// the profile is collected into a buffer, so an error can still be returned instead of a partial file
+func handleSystemCPUProfile(w http.ResponseWriter, r *http.Request) {
+	duration, err := profilingDuration(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	buf := bytes.Buffer{}
+	err = pprof.StartCPUProfile(&buf)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't start CPU profiling: %s", err)
+		return
+	}
+	time.Sleep(duration)
+	pprof.StopCPUProfile()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="cpu.pprof"`)
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Printf("Couldn't write CPU profile: %s", err)
+	}
+}
+
+// -------------------
+// system/heap_profile
+// -------------------
+// garbage collection is forced first, so the profile shows only the live objects
+func handleSystemHeapProfile(w http.ResponseWriter, r *http.Request) {
+	runtime.GC()
+	buf := bytes.Buffer{}
+	err := pprof.WriteHeapProfile(&buf)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write heap profile: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="heap.pprof"`)
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Printf("Couldn't write heap profile: %s", err)
+	}
+}
+
+type gcResultJSON struct {
+	BeforeAllocBytes uint64 `json:"before_alloc_bytes"`
+	AfterAllocBytes  uint64 `json:"after_alloc_bytes"`
+	FreedBytes       uint64 `json:"freed_bytes"`
+	NumGC            uint32 `json:"num_gc"`
+}
+
+// handleDebugGC forces garbage collection and returns the heap size before and after it
+func handleDebugGC(w http.ResponseWriter, r *http.Request) {
+	before := runtime.MemStats{}
+	runtime.ReadMemStats(&before)
+	runtime.GC()
+	after := runtime.MemStats{}
+	runtime.ReadMemStats(&after)
+
+	data := gcResultJSON{
+		BeforeAllocBytes: before.Alloc,
+		AfterAllocBytes:  after.Alloc,
+		NumGC:            after.NumGC,
+	}
+	if before.Alloc > after.Alloc {
+		data.FreedBytes = before.Alloc - after.Alloc
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal gc result json: %s", err)
+		return
+	}
+}
+
+const defaultCacheDumpLimit = 100
+
+const maxCacheDumpLimit = 1000
+
+// --------------
+// dns/cache_dump
+// --------------
+func handleDNSCacheDump(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := defaultCacheDumpLimit
+	if v := q.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxCacheDumpLimit {
+			httpError(w, http.StatusBadRequest, "limit must be in range 1-%d", maxCacheDumpLimit)
+			return
+		}
+	}
+	offset := 0
+	if v := q.Get("offset"); v != "" {
+		var err error
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			httpError(w, http.StatusBadRequest, "offset must not be negative")
+			return
+		}
+	}
+
+	entries := dnsServer.GetCacheEntries()
+	if offset > len(entries) {
+		offset = len(entries)
+	}
+	entries = entries[offset:]
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(entries)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal cache dump json: %s", err)
+		return
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfilingDuration(t *testing.T) {
+	for query, want := range map[string]time.Duration{
+		"":             30 * time.Second,
+		"?seconds=abc": 30 * time.Second,
+		"?seconds=-1":  30 * time.Second,
+		"?seconds=5":   5 * time.Second,
+		"?seconds=300": 300 * time.Second,
+	} {
+		d, err := profilingDuration(httptest.NewRequest(http.MethodPost, "/control/system/cpu_profile"+query, nil))
+		assert.Nil(t, err, query)
+		assert.Equal(t, want, d, query)
+	}
+
+	_, err := profilingDuration(httptest.NewRequest(http.MethodPost, "/control/system/cpu_profile?seconds=301", nil))
+	assert.NotNil(t, err)
+
+	w := httptest.NewRecorder()
+	handleSystemCPUProfile(w, httptest.NewRequest(http.MethodPost, "/control/system/cpu_profile?seconds=86400", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
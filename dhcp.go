@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/hmage/golibs/log"
 	"github.com/joomcode/errorx"
 )
@@ -49,6 +50,11 @@ func handleDHCPSetConfig(w http.ResponseWriter, r *http.Request) {
 		httpError(w, http.StatusBadRequest, "Failed to parse new DHCP config json: %s", err)
 		return
 	}
+	// the custom options, the relay, the DNS suffix and the host names rewriting are set by their own handlers
+	newconfig.Options = config.DHCP.Options
+	newconfig.Relay = config.DHCP.Relay
+	newconfig.DNSSuffix = config.DHCP.DNSSuffix
+	newconfig.HostnameRewrite = config.DHCP.HostnameRewrite
 
 	if newconfig.Enabled {
 		err := dhcpServer.Start(&newconfig)
@@ -158,6 +164,217 @@ func handleDHCPFindActiveServer(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// -----------------
+// dhcp/option_sets*
+// -----------------
+func handleGetDHCPOptions(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	data := make([]dhcpd.Option, len(config.DHCP.Options))
+	copy(data, config.DHCP.Options)
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal DHCP options json: %s", err)
+		return
+	}
+}
+
+// findDHCPOption returns the index of the option with the code or -1
+// config must be locked by the caller
+func findDHCPOption(code int) int {
+	for i, o := range config.DHCP.Options {
+		if o.Code == code {
+			return i
+		}
+	}
+	return -1
+}
+
+// handleAddDHCPOption adds the option or replaces the one with the same code
+func handleAddDHCPOption(w http.ResponseWriter, r *http.Request) {
+	o := dhcpd.Option{}
+	err := json.NewDecoder(r.Body).Decode(&o)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse DHCP option json: %s", err)
+		return
+	}
+	err = dhcpd.NormalizeOption(&o)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	options := append([]dhcpd.Option{}, config.DHCP.Options...)
+	i := findDHCPOption(o.Code)
+	if i >= 0 {
+		options[i] = o
+	} else {
+		options = append(options, o)
+	}
+	config.DHCP.Options = options
+	config.Unlock()
+
+	applyDHCPConfig(w)
+}
+
+func handleDeleteDHCPOption(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Code int `json:"code"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse DHCP option json: %s", err)
+		return
+	}
+
+	config.Lock()
+	i := findDHCPOption(req.Code)
+	if i >= 0 {
+		options := append([]dhcpd.Option{}, config.DHCP.Options[:i]...)
+		config.DHCP.Options = append(options, config.DHCP.Options[i+1:]...)
+	}
+	config.Unlock()
+	if i < 0 {
+		httpError(w, http.StatusNotFound, "DHCP option %d not found", req.Code)
+		return
+	}
+
+	applyDHCPConfig(w)
+}
+
+// applyDHCPConfig restarts the running DHCP server with the new settings and saves the config
+func applyDHCPConfig(w http.ResponseWriter) {
+	if config.DHCP.Enabled && dhcpServer.IsRunning() {
+		err := dhcpServer.Start(&config.DHCP)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Failed to restart DHCP server: %s", err)
+			return
+		}
+	}
+
+	err := writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
+
+// -----------
+// dhcp/relay*
+// -----------
+func handleGetDHCPRelay(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	data := config.DHCP.Relay
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal DHCP relay json: %s", err)
+		return
+	}
+}
+
+func handleDHCPRelayConfigure(w http.ResponseWriter, r *http.Request) {
+	data := dhcpd.RelayConfig{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse DHCP relay json: %s", err)
+		return
+	}
+
+	if data.Enabled {
+		ip := net.ParseIP(strings.TrimSpace(data.RelayAgentIP)).To4()
+		if ip == nil {
+			httpError(w, http.StatusBadRequest, "relay_agent_ip must be an IPv4 address")
+			return
+		}
+		data.RelayAgentIP = ip.String()
+
+		config.RLock()
+		err = dhcpd.CheckRelayPool(config.DHCP, ip)
+		config.RUnlock()
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		if !pingHost(data.RelayAgentIP) {
+			httpError(w, http.StatusBadRequest, "Relay agent %s is unreachable", data.RelayAgentIP)
+			return
+		}
+	}
+
+	config.Lock()
+	config.DHCP.Relay = data
+	config.Unlock()
+
+	applyDHCPConfig(w)
+}
+
+// ---------------
+// dhcp/dns_suffix
+// ---------------
+// handleDHCPSetDNSSuffix sets the DNS search domain of the DHCP clients, empty domain removes it
+// it must be the suffix of the local host names so that the clients can resolve each other
+func handleDHCPSetDNSSuffix(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Domain string `json:"domain"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse DNS suffix json: %s", err)
+		return
+	}
+	domain, err := dhcpd.NormalizeDNSSuffix(req.Domain)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	localSuffix := config.DNS.LocalDomainSuffix
+	if localSuffix == "" {
+		localSuffix = dnsforward.DefaultLocalDomainSuffix
+	}
+	localSuffix = strings.ToLower(strings.Trim(localSuffix, "."))
+	if domain != "" && config.DNS.PrivateDNS && domain != localSuffix {
+		config.Unlock()
+		httpError(w, http.StatusBadRequest, "domain must be the same as the local domain suffix %s, otherwise the clients' names can't be resolved", localSuffix)
+		return
+	}
+	config.DHCP.DNSSuffix = domain
+	config.Unlock()
+
+	applyDHCPConfig(w)
+}
+
+// ---------------------
+// dhcp/hostname_rewrite
+// ---------------------
+// handleDHCPHostnameRewrite sets how the host names of the new leases are changed, the existing leases are kept as is
+func handleDHCPHostnameRewrite(w http.ResponseWriter, r *http.Request) {
+	data := dhcpd.HostnameRewrite{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse hostname rewrite json: %s", err)
+		return
+	}
+	if strings.ContainsAny(data.ReplaceSpacesWith, " .") {
+		httpError(w, http.StatusBadRequest, "replace_spaces_with must not contain spaces or dots")
+		return
+	}
+
+	config.Lock()
+	config.DHCP.HostnameRewrite = data
+	config.Unlock()
+
+	applyDHCPConfig(w)
+}
+
 func startDHCPServer() error {
 	if !config.DHCP.Enabled {
 		// not enabled, don't do anything
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hmage/golibs/log"
+)
+
+const defaultNetworkScanTimeout = 2 * time.Second
+
+const maxNetworkScanTimeout = 10 * time.Second
+
+// the smallest prefix length of the subnet that can be scanned, i.e. 4096 addresses at most
+const minNetworkScanPrefix = 20
+
+// ouiVendors are the manufacturers of the common network devices by the first 3 bytes of the MAC address
+var ouiVendors = map[string]string{
+	"00:00:0c": "Cisco",
+	"00:03:93": "Apple",
+	"00:0a:95": "Apple",
+	"00:04:4b": "NVIDIA",
+	"00:0c:29": "VMware",
+	"00:50:56": "VMware",
+	"00:0c:42": "MikroTik",
+	"4c:5e:0c": "MikroTik",
+	"00:0d:b9": "PC Engines",
+	"00:11:32": "Synology",
+	"00:13:10": "Linksys",
+	"00:14:22": "Dell",
+	"00:14:6c": "Netgear",
+	"00:15:5d": "Microsoft Hyper-V",
+	"00:16:3e": "Xen",
+	"00:17:88": "Philips Lighting",
+	"00:1a:11": "Google",
+	"00:1b:21": "Intel",
+	"00:1c:42": "Parallels",
+	"00:1d:0f": "TP-Link",
+	"00:27:22": "Ubiquiti",
+	"24:a4:3c": "Ubiquiti",
+	"00:90:a9": "Western Digital",
+	"00:e0:4c": "Realtek",
+	"08:00:27": "VirtualBox",
+	"b8:27:eb": "Raspberry Pi",
+	"dc:a6:32": "Raspberry Pi",
+	"e4:5f:01": "Raspberry Pi",
+}
+
+type networkScanJSON struct {
+	Subnet    string `json:"subnet"`
+	TimeoutMs int    `json:"timeout_ms"`
+}
+
+type networkHostJSON struct {
+	IP     string `json:"ip"`
+	MAC    string `json:"mac"`
+	Vendor string `json:"vendor"` // empty if unknown
+}
+
+// macVendor returns the manufacturer of the device with the MAC address
+func macVendor(hwAddr net.HardwareAddr) string {
+	if len(hwAddr) < 3 {
+		return ""
+	}
+	// the phones and the laptops use random addresses for privacy
+	if hwAddr[0]&0x02 != 0 {
+		return "Locally administered"
+	}
+	return ouiVendors[strings.ToLower(hwAddr[:3].String())]
+}
+
+// inDHCPPool returns true if the address is in the DHCP range from the configuration
+func inDHCPPool(ip net.IP) bool {
+	start := net.ParseIP(config.DHCP.RangeStart).To4()
+	end := net.ParseIP(config.DHCP.RangeEnd).To4()
+	ip = ip.To4()
+	if start == nil || end == nil || ip == nil {
+		return false
+	}
+	return bytes.Compare(ip, start) >= 0 && bytes.Compare(ip, end) <= 0
+}
+
+// scanNetwork makes the OS send ARP requests for each host address of the subnet by sending a UDP datagram to it
+// the hosts that replied are read from the ARP table after the timeout
+func scanNetwork(subnet *net.IPNet, timeout time.Duration) ([]arpEntry, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ones, bits := subnet.Mask.Size()
+	first := binary.BigEndian.Uint32(subnet.IP.To4())
+	size := uint32(1) << uint(bits-ones)
+	for i := uint32(0); i < size; i++ {
+		// skip the network and the broadcast addresses
+		if size > 2 && (i == 0 || i == size-1) {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, first+i)
+		// the discard port, the datagram is only needed to resolve the address
+		_, err = conn.WriteTo([]byte{0}, &net.UDPAddr{IP: ip, Port: 9})
+		if err != nil {
+			log.Tracef("Couldn't send a datagram to %s: %s", ip, err)
+		}
+	}
+
+	time.Sleep(timeout)
+	entries, err := readARPTable()
+	if err != nil {
+		return nil, err
+	}
+	hosts := []arpEntry{}
+	for _, e := range entries {
+		if subnet.Contains(net.ParseIP(e.IP)) {
+			hosts = append(hosts, e)
+		}
+	}
+	return hosts, nil
+}
+
+// handleDHCPNetworkScan returns the hosts found in the subnet, except the addresses of the DHCP pool
+func handleDHCPNetworkScan(w http.ResponseWriter, r *http.Request) {
+	req := networkScanJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse network scan json: %s", err)
+		return
+	}
+
+	_, subnet, err := net.ParseCIDR(strings.TrimSpace(req.Subnet))
+	if err != nil || subnet.IP.To4() == nil {
+		httpError(w, http.StatusBadRequest, "Invalid subnet %s: must be IPv4 CIDR", req.Subnet)
+		return
+	}
+	ones, _ := subnet.Mask.Size()
+	if ones < minNetworkScanPrefix {
+		httpError(w, http.StatusBadRequest, "Subnet %s is too large: the prefix must be at least /%d", req.Subnet, minNetworkScanPrefix)
+		return
+	}
+	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+	if req.TimeoutMs == 0 {
+		timeout = defaultNetworkScanTimeout
+	}
+	if timeout < 0 || timeout > maxNetworkScanTimeout {
+		httpError(w, http.StatusBadRequest, "timeout_ms must be in range 0-%d", maxNetworkScanTimeout/time.Millisecond)
+		return
+	}
+
+	entries, err := scanNetwork(subnet, timeout)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't scan the network: %s", err)
+		return
+	}
+
+	config.RLock()
+	data := []networkHostJSON{}
+	for _, e := range entries {
+		if inDHCPPool(net.ParseIP(e.IP)) {
+			continue
+		}
+		hwAddr, _ := net.ParseMAC(e.MAC)
+		data = append(data, networkHostJSON{IP: e.IP, MAC: e.MAC, Vendor: macVendor(hwAddr)})
+	}
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal network scan json: %s", err)
+		return
+	}
+}
@@ -32,6 +32,11 @@ type ServerConfig struct {
 	RangeStart    string `json:"range_start" yaml:"range_start"`
 	RangeEnd      string `json:"range_end" yaml:"range_end"`
 	LeaseDuration uint   `json:"lease_duration" yaml:"lease_duration"` // in seconds
+	DNSSuffix     string `json:"dns_suffix" yaml:"dns_suffix"`         // DNS search domain sent in options 15 and 119, set by /control/dhcp/dns_suffix
+
+	Options         []Option        `json:"-" yaml:"options"`                         // custom options, they're managed by /control/dhcp/option_sets
+	Relay           RelayConfig     `json:"-" yaml:"relay"`                           // managed by /control/dhcp/relay/configure
+	HostnameRewrite HostnameRewrite `json:"hostname_rewrite" yaml:"hostname_rewrite"` // managed by /control/dhcp/hostname_rewrite
 }
 
 // Server - the current state of the DHCP server
@@ -47,6 +52,9 @@ type Server struct {
 	leaseTime    time.Duration // parsed from config LeaseDuration
 	leaseOptions dhcp4.Options // parsed from config GatewayIP and SubnetMask
 
+	customOptions []dhcp4.OptionCode // codes of the config Options, they're sent even if the client didn't request them
+	relayIP       net.IP             // parsed from config Relay, nil if it's disabled
+
 	// IP address pool -- if entry is in the pool, then it's attached to a lease
 	IPpool map[[4]byte]net.HardwareAddr
 
@@ -116,13 +124,37 @@ func (s *Server) Start(config *ServerConfig) error {
 		dhcp4.OptionRouter:           router,
 		dhcp4.OptionDomainNameServer: s.ipnet.IP,
 	}
+	if s.DNSSuffix != "" {
+		s.leaseOptions[dhcp4.OptionDomainName] = []byte(s.DNSSuffix)
+		s.leaseOptions[dhcp4.OptionDomainSearch] = encodeDomainSearch(s.DNSSuffix)
+	}
+	s.customOptions = nil
+	for _, o := range s.Options {
+		value, err := o.encode()
+		if err != nil {
+			s.closeConn() // in case it was already started
+			return wrapErrPrint(err, "Invalid DHCP option %d", o.Code)
+		}
+		code := dhcp4.OptionCode(o.Code)
+		s.leaseOptions[code] = value
+		s.customOptions = append(s.customOptions, code)
+	}
+
+	s.relayIP = nil
+	if s.Relay.Enabled {
+		s.relayIP, err = parseIPv4(s.Relay.RelayAgentIP)
+		if err != nil {
+			s.closeConn() // in case it was already started
+			return wrapErrPrint(err, "Failed to parse relay agent IP %s", s.Relay.RelayAgentIP)
+		}
+	}
 
 	// TODO: don't close if interface and addresses are the same
 	if s.conn != nil {
 		s.closeConn()
 	}
 
-	c, err := newFilterConn(*iface, ":67") // it has to be bound to 0.0.0.0:67, otherwise it won't see DHCP discover/request packets
+	c, err := newFilterConn(*iface, ":67", s.relayIP) // it has to be bound to 0.0.0.0:67, otherwise it won't see DHCP discover/request packets
 	if err != nil {
 		return wrapErrPrint(err, "Couldn't start listening socket on 0.0.0.0:67")
 	}
@@ -155,6 +187,11 @@ func (s *Server) Stop() error {
 	return nil
 }
 
+// IsRunning returns true if the server is listening for DHCP requests
+func (s *Server) IsRunning() bool {
+	return s.conn != nil
+}
+
 // closeConn will close the connection and set it to zero
 func (s *Server) closeConn() error {
 	if s.conn == nil {
@@ -184,8 +221,11 @@ func (s *Server) reserveLease(p dhcp4.Packet) (*Lease, error) {
 		return nil, wrapErrPrint(err, "Couldn't find free IP for the lease %s", hwaddr.String())
 	}
 	log.Tracef("Assigning to %s IP address %s", hwaddr, ip.String())
-	hostname := p.ParseOptions()[dhcp4.OptionHostName]
-	lease := &Lease{HWAddr: hwaddr, IP: ip, Hostname: string(hostname)}
+	hostname := string(p.ParseOptions()[dhcp4.OptionHostName])
+	if s.HostnameRewrite.enabled() {
+		hostname = rewriteHostname(hostname, s.HostnameRewrite)
+	}
+	lease := &Lease{HWAddr: hwaddr, IP: ip, Hostname: hostname}
 	s.Lock()
 	s.leases = append(s.leases, lease)
 	s.Unlock()
@@ -266,6 +306,11 @@ func (s *Server) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dh
 		log.Tracef("IP pool entry %s -> %s", net.IPv4(ip[0], ip[1], ip[2], ip[3]), hwaddr)
 	}
 
+	if !s.acceptRelay(p, options) {
+		log.Tracef("Ignoring %v message: it's not relayed by %s", msgType, s.relayIP)
+		return nil
+	}
+
 	switch msgType {
 	case dhcp4.Discover: // Broadcast Packet From Client - Can I have an IP?
 		// find a lease, but don't update lease time
@@ -276,7 +321,7 @@ func (s *Server) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dh
 			// couldn't find lease, don't respond
 			return nil
 		}
-		reply := dhcp4.ReplyPacket(p, dhcp4.Offer, s.ipnet.IP, lease.IP, s.leaseTime, s.leaseOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList]))
+		reply := dhcp4.ReplyPacket(p, dhcp4.Offer, s.ipnet.IP, lease.IP, s.leaseTime, s.replyOptions(options, lease))
 		log.Tracef("Replying with offer: offered IP %v for %v with options %+v", lease.IP, s.leaseTime, reply.ParseOptions())
 		return reply
 	case dhcp4.Request: // Broadcast From Client - I'll take that IP (Also start for renewals)
@@ -321,12 +366,12 @@ func (s *Server) handleDHCP4Request(p dhcp4.Packet, options dhcp4.Options) dhcp4
 
 	if reqIP.To4() == nil {
 		log.Tracef("Replying with NAK: request IP isn't valid IPv4: %s", reqIP)
-		return dhcp4.ReplyPacket(p, dhcp4.NAK, s.ipnet.IP, nil, 0, nil)
+		return dhcp4.ReplyPacket(p, dhcp4.NAK, s.ipnet.IP, nil, 0, relayOptions(options))
 	}
 
 	if reqIP.Equal(net.IPv4zero) {
 		log.Tracef("Replying with NAK: request IP is 0.0.0.0")
-		return dhcp4.ReplyPacket(p, dhcp4.NAK, s.ipnet.IP, nil, 0, nil)
+		return dhcp4.ReplyPacket(p, dhcp4.NAK, s.ipnet.IP, nil, 0, relayOptions(options))
 	}
 
 	log.Tracef("requested IP is %s", reqIP)
@@ -341,7 +386,7 @@ func (s *Server) handleDHCP4Request(p dhcp4.Packet, options dhcp4.Options) dhcp4
 		// IP matches lease IP, nothing else to do
 		lease.Expiry = time.Now().Add(s.leaseTime)
 		log.Tracef("Replying with ACK: request IP matches lease IP, nothing else to do. IP %v for %v", lease.IP, p.CHAddr())
-		return dhcp4.ReplyPacket(p, dhcp4.ACK, s.ipnet.IP, lease.IP, s.leaseTime, s.leaseOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList]))
+		return dhcp4.ReplyPacket(p, dhcp4.ACK, s.ipnet.IP, lease.IP, s.leaseTime, s.replyOptions(options, lease))
 	}
 
 	//
@@ -360,7 +405,7 @@ func (s *Server) handleDHCP4Request(p dhcp4.Packet, options dhcp4.Options) dhcp4
 			lease.IP = reqIP
 			s.reserveIP(reqIP, p.CHAddr())
 			lease.Expiry = time.Now().Add(s.leaseTime)
-			return dhcp4.ReplyPacket(p, dhcp4.ACK, s.ipnet.IP, lease.IP, s.leaseTime, s.leaseOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList]))
+			return dhcp4.ReplyPacket(p, dhcp4.ACK, s.ipnet.IP, lease.IP, s.leaseTime, s.replyOptions(options, lease))
 		}
 	}
 
@@ -371,12 +416,12 @@ func (s *Server) handleDHCP4Request(p dhcp4.Packet, options dhcp4.Options) dhcp4
 	// requsted IP is not sufficient, reply with NAK
 	if hwaddr != nil {
 		log.Tracef("Replying with NAK: request IP %s is taken, asked by %v", reqIP, p.CHAddr())
-		return dhcp4.ReplyPacket(p, dhcp4.NAK, s.ipnet.IP, nil, 0, nil)
+		return dhcp4.ReplyPacket(p, dhcp4.NAK, s.ipnet.IP, nil, 0, relayOptions(options))
 	}
 
 	// requested IP is outside of DHCP range
 	log.Tracef("Replying with NAK: request IP %s is outside of DHCP range [%s, %s], asked by %v", reqIP, s.leaseStart, s.leaseStop, p.CHAddr())
-	return dhcp4.ReplyPacket(p, dhcp4.NAK, s.ipnet.IP, nil, 0, nil)
+	return dhcp4.ReplyPacket(p, dhcp4.NAK, s.ipnet.IP, nil, 0, relayOptions(options))
 }
 
 // Leases returns the list of current DHCP leases
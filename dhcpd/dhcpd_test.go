@@ -0,0 +1,53 @@
+package dhcpd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeDNSSuffix(t *testing.T) {
+	testCases := []struct {
+		domain string
+		want   string
+		fails  bool
+	}{
+		{"", "", false},
+		{"  ", "", false},
+		{".", "", false},
+		{"home.lan", "home.lan", false},
+		{" Home.LAN. ", "home.lan", false},
+		{".home.arpa.", "home.arpa", false},
+		{"my-net1.lan", "my-net1.lan", false},
+		{"home..lan", "", true},
+		{"home_lan", "", true},
+		{"home lan", "", true},
+		{"дом.lan", "", true},
+		{strings.Repeat("a", 64) + ".lan", "", true},
+		{strings.Repeat("a", 63) + ".lan", strings.Repeat("a", 63) + ".lan", false},
+		{strings.Repeat("abc.", 64) + "lan", "", true},
+	}
+	for _, tc := range testCases {
+		got, err := NormalizeDNSSuffix(tc.domain)
+		if tc.fails {
+			assert.NotNil(t, err, "domain %q", tc.domain)
+			continue
+		}
+		assert.Nil(t, err, "domain %q", tc.domain)
+		assert.Equal(t, tc.want, got, "domain %q", tc.domain)
+	}
+}
+
+func TestEncodeDomainSearch(t *testing.T) {
+	// RFC 3397: the domain names are encoded as in RFC 1035, the labels with their length and the terminating zero
+	assert.Equal(t, []byte{3, 'l', 'a', 'n', 0}, encodeDomainSearch("lan"))
+	assert.Equal(t, []byte{4, 'h', 'o', 'm', 'e', 4, 'a', 'r', 'p', 'a', 0}, encodeDomainSearch("home.arpa"))
+
+	label := strings.Repeat("a", 63)
+	data := encodeDomainSearch(label + ".lan")
+	assert.Equal(t, 1+63+1+3+1, len(data))
+	assert.Equal(t, byte(63), data[0])
+	assert.Equal(t, byte(3), data[64])
+	assert.Equal(t, byte(0), data[len(data)-1])
+}
@@ -13,12 +13,16 @@ import (
 //
 // TODO: on windows, controlmessage does not work, try to find out another way
 // https://github.com/golang/net/blob/master/ipv4/payload.go#L13
+//
+// If relayIP is set, the packets relayed by it are accepted from any interface
+// and the replies to them are sent to the relay agent
 type filterConn struct {
-	iface net.Interface
-	conn  *ipv4.PacketConn
+	iface   net.Interface
+	conn    *ipv4.PacketConn
+	relayIP net.IP
 }
 
-func newFilterConn(iface net.Interface, address string) (*filterConn, error) {
+func newFilterConn(iface net.Interface, address string, relayIP net.IP) (*filterConn, error) {
 	c, err := net.ListenPacket("udp4", address)
 	if err != nil {
 		return nil, errorx.Decorate(err, "Couldn't listen to %s on UDP4", address)
@@ -31,7 +35,7 @@ func newFilterConn(iface net.Interface, address string) (*filterConn, error) {
 		return nil, errorx.Decorate(err, "Couldn't set control message FlagInterface on connection")
 	}
 
-	return &filterConn{iface: iface, conn: p}, nil
+	return &filterConn{iface: iface, conn: p, relayIP: relayIP}, nil
 }
 
 func (f *filterConn) ReadFrom(b []byte) (int, net.Addr, error) {
@@ -47,11 +51,18 @@ func (f *filterConn) ReadFrom(b []byte) (int, net.Addr, error) {
 		if cm.IfIndex == f.iface.Index {
 			return n, addr, nil
 		}
+		if f.relayIP != nil && f.relayIP.Equal(packetGIAddr(b[:n])) {
+			return n, addr, nil
+		}
 		// packet doesn't match criteria, drop it
 	}
 }
 
 func (f *filterConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if giaddr := packetGIAddr(b); f.relayIP != nil && giaddr != nil {
+		// the relay agent may be behind a router, so the interface is chosen by the routing table
+		return f.conn.WriteTo(b, nil, &net.UDPAddr{IP: giaddr, Port: 67})
+	}
 	cm := ipv4.ControlMessage{
 		IfIndex: f.iface.Index,
 	}
@@ -0,0 +1,51 @@
+package dhcpd
+
+import (
+	"strings"
+)
+
+// HostnameRewrite is the settings of changing the host names sent by the clients before they're stored in the leases
+// the leases' names are answered by the DNS server, so they must be valid DNS labels
+type HostnameRewrite struct {
+	Sanitize          bool   `json:"sanitize" yaml:"sanitize"`                       // replace the dots with "-" and remove the characters not allowed in DNS labels
+	ReplaceSpacesWith string `json:"replace_spaces_with" yaml:"replace_spaces_with"` // the spaces are kept if it's empty and Sanitize is false
+	ForceLowercase    bool   `json:"force_lowercase" yaml:"force_lowercase"`
+}
+
+// enabled returns true if the host names are changed
+func (c HostnameRewrite) enabled() bool {
+	return c.Sanitize || c.ReplaceSpacesWith != "" || c.ForceLowercase
+}
+
+// rewriteHostname returns the host name changed according to the settings
+func rewriteHostname(name string, c HostnameRewrite) string {
+	if c.ReplaceSpacesWith != "" {
+		name = strings.Join(strings.Fields(name), c.ReplaceSpacesWith)
+	}
+	if c.ForceLowercase {
+		name = strings.ToLower(name)
+	}
+	if !c.Sanitize {
+		return name
+	}
+
+	b := strings.Builder{}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			b.WriteRune(r)
+		case r == '.' || r == '_' || r == ' ':
+			b.WriteByte('-')
+		}
+	}
+	name = b.String()
+	for strings.Contains(name, "--") {
+		name = strings.Replace(name, "--", "-", -1)
+	}
+	name = strings.Trim(name, "-")
+	// the maximum length of a DNS label
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return name
+}
@@ -0,0 +1,153 @@
+package dhcpd
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// types of the custom DHCP option values
+const (
+	OptionTypeText   = "text"   // the string as is
+	OptionTypeIP     = "ip"     // comma-separated list of IPv4 addresses
+	OptionTypeHex    = "hex"    // raw bytes, e.g. "0A0B0C"
+	OptionTypeUint8  = "uint8"  // one byte
+	OptionTypeUint32 = "uint32" // four bytes in the network byte order
+)
+
+// Option is a custom DHCP option sent in the offers and the acknowledgements
+// it replaces the option of the same code set by the server, e.g. the DNS servers
+type Option struct {
+	Code  int    `json:"code" yaml:"code"`
+	Type  string `json:"type" yaml:"type"`
+	Value string `json:"value" yaml:"value"`
+}
+
+// NormalizeOption validates the option and converts the value to the canonical form
+func NormalizeOption(o *Option) error {
+	if o.Code < 1 || o.Code > 254 {
+		return fmt.Errorf("invalid code %d: must be in range 1-254", o.Code)
+	}
+	o.Type = strings.ToLower(strings.TrimSpace(o.Type))
+	if o.Type != OptionTypeText {
+		o.Value = strings.TrimSpace(o.Value)
+	}
+	if o.Type == OptionTypeHex {
+		o.Value = strings.ToUpper(o.Value)
+	}
+
+	data, err := o.encode()
+	if err != nil {
+		return err
+	}
+	// the length of an option is stored in one byte
+	if len(data) == 0 || len(data) > 255 {
+		return fmt.Errorf("invalid value length %d: must be in range 1-255 bytes", len(data))
+	}
+	return nil
+}
+
+// encode returns the value of the option as it's sent to the clients
+func (o *Option) encode() ([]byte, error) {
+	switch o.Type {
+	case OptionTypeText:
+		return []byte(o.Value), nil
+	case OptionTypeIP:
+		data := []byte{}
+		for _, s := range strings.Split(o.Value, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s)).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IPv4 address: %s", s)
+			}
+			data = append(data, ip...)
+		}
+		return data, nil
+	case OptionTypeHex:
+		data, err := hex.DecodeString(o.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex value: %s", err)
+		}
+		return data, nil
+	case OptionTypeUint8:
+		v, err := strconv.ParseUint(o.Value, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uint8 value: %s", o.Value)
+		}
+		return []byte{byte(v)}, nil
+	case OptionTypeUint32:
+		v, err := strconv.ParseUint(o.Value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uint32 value: %s", o.Value)
+		}
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(v))
+		return data, nil
+	}
+	return nil, fmt.Errorf("invalid type %s: must be one of text, ip, hex, uint8, uint32", o.Type)
+}
+
+// replyOptions returns the options for the offer or the acknowledgement
+// the options requested by the client go first in its order, then the custom options it didn't ask for
+// Option 82 of the relay agent is copied from the request
+// if the host names are rewritten, the client is told its new name
+func (s *Server) replyOptions(options dhcp4.Options, lease *Lease) []dhcp4.Option {
+	requested := options[dhcp4.OptionParameterRequestList]
+	opts := s.leaseOptions.SelectOrderOrAll(requested)
+	if requested != nil {
+		for _, code := range s.customOptions {
+			if !containsByte(requested, byte(code)) {
+				opts = append(opts, dhcp4.Option{Code: code, Value: s.leaseOptions[code]})
+			}
+		}
+	}
+	if s.HostnameRewrite.enabled() && lease.Hostname != "" {
+		opts = append(opts, dhcp4.Option{Code: dhcp4.OptionHostName, Value: []byte(lease.Hostname)})
+	}
+	return append(opts, relayOptions(options)...)
+}
+
+// NormalizeDNSSuffix validates the DNS search domain and converts it to the lowercase name without the trailing dot
+func NormalizeDNSSuffix(domain string) (string, error) {
+	domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+	if domain == "" {
+		return "", nil
+	}
+	if len(domain) > 253 {
+		return "", fmt.Errorf("domain is too long")
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return "", fmt.Errorf("invalid domain %s", domain)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "", fmt.Errorf("invalid domain %s", domain)
+			}
+		}
+	}
+	return domain, nil
+}
+
+// encodeDomainSearch returns the value of the domain search option (RFC 3397) with a single domain
+func encodeDomainSearch(domain string) []byte {
+	data := []byte{}
+	for _, label := range strings.Split(domain, ".") {
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	return append(data, 0)
+}
+
+func containsByte(list []byte, b byte) bool {
+	for _, v := range list {
+		if v == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package dhcpd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// optionRelayAgentInfo is the relay agent information option (RFC 3046)
+const optionRelayAgentInfo = dhcp4.OptionCode(82)
+
+// the link selection sub-option of the relay agent information (RFC 3527)
+const relaySubOptionLinkSelection = 5
+
+// RelayConfig is the settings of serving the clients behind a DHCP relay agent
+// when enabled, the address pool belongs to the relay subnet and only the requests relayed from it are served
+type RelayConfig struct {
+	Enabled      bool   `json:"enabled" yaml:"enabled"`
+	RelayAgentIP string `json:"relay_agent_ip" yaml:"relay_agent_ip"`
+}
+
+// CheckRelayPool returns an error if the pool, the gateway and the relay agent aren't in the same subnet
+func CheckRelayPool(c ServerConfig, relayIP net.IP) error {
+	mask, err := parseIPv4(c.SubnetMask)
+	if err != nil {
+		return fmt.Errorf("invalid subnet mask %q, configure the DHCP server first", c.SubnetMask)
+	}
+	subnet := net.IPNet{IP: relayIP.To4().Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}
+
+	for _, v := range []struct{ name, ip string }{
+		{"range start", c.RangeStart},
+		{"range end", c.RangeEnd},
+		{"gateway", c.GatewayIP},
+	} {
+		ip, err := parseIPv4(v.ip)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q, configure the DHCP server first", v.name, v.ip)
+		}
+		if !subnet.Contains(ip) {
+			return fmt.Errorf("%s %s is not in the relay subnet %s", v.name, ip, subnet.String())
+		}
+	}
+	return nil
+}
+
+// relayAddr returns the address of the relay agent subnet the request came from, or nil if it wasn't relayed
+// the link selection sub-option of Option 82 takes precedence over giaddr
+func relayAddr(p dhcp4.Packet, options dhcp4.Options) net.IP {
+	info := options[optionRelayAgentInfo]
+	for len(info) >= 2 {
+		code, n := info[0], int(info[1])
+		if len(info) < 2+n {
+			break
+		}
+		if code == relaySubOptionLinkSelection && n == 4 {
+			return net.IP(info[2:6])
+		}
+		info = info[2+n:]
+	}
+
+	giaddr := p.GIAddr()
+	if giaddr.Equal(net.IPv4zero) {
+		return nil
+	}
+	return giaddr
+}
+
+// acceptRelay returns false if the request must be ignored because it's not from the configured relay agent
+func (s *Server) acceptRelay(p dhcp4.Packet, options dhcp4.Options) bool {
+	if !s.Relay.Enabled {
+		return true
+	}
+	addr := relayAddr(p, options)
+	if addr == nil || !addr.Equal(s.relayIP) {
+		return false
+	}
+	return true
+}
+
+// relayOptions returns Option 82 of the request which must be copied to the reply
+func relayOptions(options dhcp4.Options) []dhcp4.Option {
+	info, ok := options[optionRelayAgentInfo]
+	if !ok {
+		return nil
+	}
+	return []dhcp4.Option{{Code: optionRelayAgentInfo, Value: info}}
+}
+
+// packetGIAddr returns the relay agent address of the raw DHCP packet or nil
+func packetGIAddr(b []byte) net.IP {
+	if len(b) < 28 || binary.BigEndian.Uint32(b[24:28]) == 0 {
+		return nil
+	}
+	return net.IP(b[24:28])
+}
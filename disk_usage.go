@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/hmage/golibs/log"
+)
+
+// free space of the data directory disk below which low_disk_warning is set if LowDiskWarningMB is 0
+const defaultLowDiskWarningMB = 100
+
+type diskUsageJSON struct {
+	DataDir             string `json:"data_dir"`
+	TotalBytes          uint64 `json:"total_bytes"`
+	FreeBytes           uint64 `json:"free_bytes"`
+	UsedByFiltersBytes  int64  `json:"used_by_filters_bytes"`
+	UsedByQueryLogBytes int64  `json:"used_by_querylog_bytes"`
+	UsedByStatsBytes    int64  `json:"used_by_stats_bytes"`
+}
+
+// dirSize returns the total size of the files in the directory and its subdirectories
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// skip the files we can't access, the directory may not exist yet too
+			return nil
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// globSize returns the total size of the files matching the pattern
+func globSize(pattern string) int64 {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err == nil && !fi.IsDir() {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// dataDirDiskSpace returns the total and free space of the data directory disk
+// the data directory is created when the first filter is saved, so the working directory is used until then
+func dataDirDiskSpace() (uint64, uint64, error) {
+	total, free, err := diskSpace(filepath.Join(config.ourWorkingDir, dataDir))
+	if os.IsNotExist(err) {
+		return diskSpace(config.ourWorkingDir)
+	}
+	return total, free, err
+}
+
+// isLowDiskSpace returns true if the free space of the data directory disk is below the configured threshold
+func isLowDiskSpace() bool {
+	_, free, err := dataDirDiskSpace()
+	if err != nil {
+		log.Tracef("Couldn't get free disk space: %s", err)
+		return false
+	}
+	threshold := config.LowDiskWarningMB
+	if threshold == 0 {
+		threshold = defaultLowDiskWarningMB
+	}
+	return free < threshold*1024*1024
+}
+
+// -----------------
+// system/disk_usage
+// -----------------
+func handleDiskUsage(w http.ResponseWriter, r *http.Request) {
+	dir := filepath.Join(config.ourWorkingDir, dataDir)
+	total, free, err := dataDirDiskSpace()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't get disk space of %s: %s", dir, err)
+		return
+	}
+
+	data := diskUsageJSON{
+		DataDir:             dir,
+		TotalBytes:          total,
+		FreeBytes:           free,
+		UsedByFiltersBytes:  dirSize(filepath.Join(dir, filterDir)),
+		UsedByQueryLogBytes: globSize(filepath.Join(dir, "querylog.json*")), // including rotated and compressed files
+		UsedByStatsBytes:    globSize(filepath.Join(dir, "stats*")),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal disk usage json: %s", err)
+		return
+	}
+}
@@ -0,0 +1,12 @@
+// +build !linux,!darwin,!freebsd,!windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func diskSpace(path string) (uint64, uint64, error) {
+	return 0, 0, fmt.Errorf("disk space is not supported on %s", runtime.GOOS)
+}
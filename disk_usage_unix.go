@@ -0,0 +1,17 @@
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"syscall"
+)
+
+// diskSpace returns the total and available to unprivileged users space of the disk with the path
+func diskSpace(path string) (uint64, uint64, error) {
+	st := syscall.Statfs_t{}
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Blocks) * uint64(st.Bsize), uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/hmage/golibs/log"
 	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
 )
 
 var dnsServer *dnsforward.Server
@@ -49,6 +54,12 @@ func generateServerConfig() dnsforward.ServerConfig {
 		TCPListenAddr:   &net.TCPAddr{IP: net.ParseIP(config.DNS.BindHost), Port: config.DNS.Port},
 		FilteringConfig: config.DNS.FilteringConfig,
 		Filters:         filters,
+		FilterHandler:   applyClientSettings,
+	}
+	newconfig.UpstreamErrorHandler = onUpstreamError
+
+	if config.DNS.PrivateDNS {
+		newconfig.LocalHostHandler = resolveLocalHost
 	}
 
 	if config.TLS.Enabled {
@@ -59,8 +70,13 @@ func generateServerConfig() dnsforward.ServerConfig {
 	}
 
 	for _, u := range config.DNS.UpstreamDNS {
+		if newconfig.QNAMEMinimisation && dnsforward.IsEncryptedUpstream(u) {
+			// the name servers are queried in plain text, that would leak the queries meant to be encrypted
+			log.Printf("QNAME minimisation is disabled because of the encrypted upstream %s", u)
+			newconfig.QNAMEMinimisation = false
+		}
 		opts := upstream.Options{
-			Timeout:   dnsforward.DefaultTimeout,
+			Timeout:   upstreamTimeout(u),
 			Bootstrap: []string{config.DNS.BootstrapDNS},
 		}
 		dnsUpstream, err := upstream.AddressToUpstream(u, opts)
@@ -114,3 +130,1308 @@ func stopDNSServer() error {
 
 	return nil
 }
+
+// ------------
+// DNS settings
+// ------------
+
+type blockTTLJSON struct {
+	TTLSeconds uint32 `json:"ttl_seconds"`
+}
+
+func handleGetBlockTTL(w http.ResponseWriter, r *http.Request) {
+	data := blockTTLJSON{TTLSeconds: config.DNS.BlockedResponseTTL}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal block TTL json: %s", err)
+		return
+	}
+}
+
+func handleSetBlockTTL(w http.ResponseWriter, r *http.Request) {
+	data := blockTTLJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse block TTL json: %s", err)
+		return
+	}
+
+	if data.TTLSeconds == 0 {
+		httpError(w, http.StatusBadRequest, "ttl_seconds must be greater than zero")
+		return
+	}
+
+	config.DNS.BlockedResponseTTL = data.TTLSeconds
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+type minResponseTTLJSON struct {
+	TTLSeconds uint32 `json:"ttl_seconds"`
+}
+
+func handleGetMinResponseTTL(w http.ResponseWriter, r *http.Request) {
+	data := minResponseTTLJSON{TTLSeconds: config.DNS.MinResponseTTL}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal min response TTL json: %s", err)
+		return
+	}
+}
+
+func handleSetMinResponseTTL(w http.ResponseWriter, r *http.Request) {
+	data := minResponseTTLJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse min response TTL json: %s", err)
+		return
+	}
+
+	config.DNS.MinResponseTTL = data.TTLSeconds
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+type ipVersionJSON struct {
+	PreferIPv6  bool `json:"prefer_ipv6"`
+	IPv4Enabled bool `json:"ipv4_enabled"`
+	IPv6Enabled bool `json:"ipv6_enabled"`
+}
+
+func handleGetIPVersion(w http.ResponseWriter, r *http.Request) {
+	data := ipVersionJSON{
+		PreferIPv6:  config.DNS.PreferIPv6,
+		IPv4Enabled: !config.DNS.DisableIPv4,
+		IPv6Enabled: !config.DNS.DisableIPv6,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal IP version json: %s", err)
+		return
+	}
+}
+
+func handleSetIPVersion(w http.ResponseWriter, r *http.Request) {
+	data := ipVersionJSON{IPv4Enabled: true, IPv6Enabled: true}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse IP version json: %s", err)
+		return
+	}
+
+	if !data.IPv4Enabled && !data.IPv6Enabled {
+		httpError(w, http.StatusBadRequest, "At least one of ipv4_enabled and ipv6_enabled must be true")
+		return
+	}
+
+	config.DNS.PreferIPv6 = data.PreferIPv6
+	config.DNS.DisableIPv4 = !data.IPv4Enabled
+	config.DNS.DisableIPv6 = !data.IPv6Enabled
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+type blockingModeJSON struct {
+	ProtectionEnabled   bool `json:"protection_enabled"`
+	FilteringEnabled    bool `json:"filtering_enabled"`
+	SafeBrowsingEnabled bool `json:"safebrowsing_enabled"`
+	ParentalEnabled     bool `json:"parental_enabled"`
+	SafeSearchEnabled   bool `json:"safe_search_enabled"`
+}
+
+// handleBlockingMode sets all protection toggles at once so that the DNS server is reloaded only once
+func handleBlockingMode(w http.ResponseWriter, r *http.Request) {
+	data := blockingModeJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse blocking mode json: %s", err)
+		return
+	}
+
+	config.Lock()
+	switch config.DNS.ParentalSensitivity {
+	case 3, 10, 13, 17:
+	default:
+		if data.ParentalEnabled {
+			config.Unlock()
+			httpError(w, http.StatusBadRequest, "Parental sensitivity is not set, enable parental control with /control/parental/enable first")
+			return
+		}
+	}
+	protectionDisabled := config.DNS.ProtectionEnabled && !data.ProtectionEnabled
+	config.DNS.ProtectionEnabled = data.ProtectionEnabled
+	config.DNS.FilteringEnabled = data.FilteringEnabled
+	config.DNS.SafeBrowsingEnabled = data.SafeBrowsingEnabled
+	config.DNS.ParentalEnabled = data.ParentalEnabled
+	config.DNS.SafeSearchEnabled = data.SafeSearchEnabled
+	config.Unlock()
+
+	if protectionDisabled {
+		notify(notifyProtectionDisabled, "protection was disabled")
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+type responseCodeJSON struct {
+	Code       string `json:"code"`
+	SinkholeIP string `json:"sinkhole_ip"`
+}
+
+func handleSetResponseCode(w http.ResponseWriter, r *http.Request) {
+	data := responseCodeJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse response code json: %s", err)
+		return
+	}
+
+	switch data.Code {
+	case dnsforward.BlockedResponseNXDomain, dnsforward.BlockedResponseRefused:
+		data.SinkholeIP = ""
+	case dnsforward.BlockedResponseSinkholeIP:
+		if data.SinkholeIP == "" {
+			data.SinkholeIP = net.IPv4zero.String()
+		}
+		if net.ParseIP(data.SinkholeIP) == nil {
+			httpError(w, http.StatusBadRequest, "%s is not a valid IP address", data.SinkholeIP)
+			return
+		}
+	default:
+		httpError(w, http.StatusBadRequest, "Unknown response code: %s", data.Code)
+		return
+	}
+
+	config.DNS.BlockedResponseCode = data.Code
+	config.DNS.SinkholeIP = data.SinkholeIP
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+	restartBlockPageServer()
+}
+
+type blockResponseIPJSON struct {
+	IPv4 string `json:"ipv4"`
+	IPv6 string `json:"ipv6"`
+	TTL  uint32 `json:"ttl"` // in seconds
+}
+
+func handleGetBlockResponseIP(w http.ResponseWriter, r *http.Request) {
+	data := blockResponseIPJSON{
+		IPv4: config.DNS.SinkholeIP,
+		IPv6: config.DNS.SinkholeIPv6,
+		TTL:  config.DNS.SinkholeTTL,
+	}
+	if data.IPv4 == "" {
+		data.IPv4 = net.IPv4zero.String()
+	}
+	if data.IPv6 == "" {
+		data.IPv6 = net.IPv6unspecified.String()
+	}
+	if data.TTL == 0 {
+		data.TTL = dnsforward.DefaultSinkholeTTL
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal block response IP json: %s", err)
+		return
+	}
+}
+
+func handleSetBlockResponseIP(w http.ResponseWriter, r *http.Request) {
+	data := blockResponseIPJSON{TTL: config.DNS.SinkholeTTL}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse block response IP json: %s", err)
+		return
+	}
+
+	ip4 := net.ParseIP(data.IPv4)
+	if ip4 == nil || ip4.To4() == nil {
+		httpError(w, http.StatusBadRequest, "%s is not a valid IPv4 address", data.IPv4)
+		return
+	}
+	ip6 := net.ParseIP(data.IPv6)
+	if ip6 == nil || ip6.To4() != nil {
+		httpError(w, http.StatusBadRequest, "%s is not a valid IPv6 address", data.IPv6)
+		return
+	}
+
+	config.DNS.SinkholeIP = ip4.String()
+	config.DNS.SinkholeIPv6 = ip6.String()
+	config.DNS.SinkholeTTL = data.TTL
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+	restartBlockPageServer()
+}
+
+func handleSetDNSSEC(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Enabled bool `json:"enabled"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse DNSSEC json: %s", err)
+		return
+	}
+
+	config.DNS.EnableDNSSEC = req.Enabled
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+type ecsBlockingJSON struct {
+	UseECSIPForBlocking bool `json:"use_ecs_ip_for_blocking"`
+}
+
+func handleECSBlockingStatus(w http.ResponseWriter, r *http.Request) {
+	data := ecsBlockingJSON{UseECSIPForBlocking: config.DNS.UseECSIPForBlocking}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal ECS blocking json: %s", err)
+		return
+	}
+}
+
+func handleECSBlockingConfigure(w http.ResponseWriter, r *http.Request) {
+	data := ecsBlockingJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse ECS blocking json: %s", err)
+		return
+	}
+
+	config.DNS.UseECSIPForBlocking = data.UseECSIPForBlocking
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+type maxGoroutinesJSON struct {
+	Max int `json:"max"`
+}
+
+func handleGetMaxGoroutines(w http.ResponseWriter, r *http.Request) {
+	data := maxGoroutinesJSON{Max: config.DNS.MaxGoroutines}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal max goroutines json: %s", err)
+		return
+	}
+}
+
+func handleSetMaxGoroutines(w http.ResponseWriter, r *http.Request) {
+	data := maxGoroutinesJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse max goroutines json: %s", err)
+		return
+	}
+
+	if data.Max < 0 {
+		httpError(w, http.StatusBadRequest, "max must not be negative")
+		return
+	}
+
+	config.DNS.MaxGoroutines = data.Max
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+type upstreamCacheJSON struct {
+	PerUpstream     bool `json:"per_upstream"`
+	SizePerUpstream int  `json:"size_per_upstream"`
+}
+
+func handleSetUpstreamCacheSize(w http.ResponseWriter, r *http.Request) {
+	data := upstreamCacheJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse upstream cache json: %s", err)
+		return
+	}
+
+	if data.SizePerUpstream < 0 {
+		httpError(w, http.StatusBadRequest, "size_per_upstream must not be negative")
+		return
+	}
+
+	config.DNS.PerUpstreamCache = data.PerUpstream
+	config.DNS.UpstreamCacheSize = data.SizePerUpstream
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+type serveStaleJSON struct {
+	Enabled             bool   `json:"enabled"`
+	MaxStalenessSeconds uint32 `json:"max_staleness_seconds"` // if 0, then default is used
+}
+
+func handleSetServeStale(w http.ResponseWriter, r *http.Request) {
+	data := serveStaleJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse serve stale json: %s", err)
+		return
+	}
+
+	config.DNS.ServeStale = data.Enabled
+	config.DNS.ServeStaleMaxAge = data.MaxStalenessSeconds
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+type prefetchJSON struct {
+	Enabled          bool `json:"enabled"`
+	ThresholdPercent int  `json:"threshold_percent"` // if 0, then default is used
+}
+
+func handleSetPrefetch(w http.ResponseWriter, r *http.Request) {
+	data := prefetchJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse prefetch json: %s", err)
+		return
+	}
+
+	if data.ThresholdPercent < 0 || data.ThresholdPercent >= 100 {
+		httpError(w, http.StatusBadRequest, "threshold_percent must be between 1 and 99")
+		return
+	}
+
+	config.DNS.Prefetch = data.Enabled
+	config.DNS.PrefetchThreshold = data.ThresholdPercent
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+type prefetchOnExpiredJSON struct {
+	Enabled bool `json:"enabled"`
+}
+
+// handleSetPrefetchOnExpired enables serving the expired responses while they are refreshed in the background
+// they are served for up to max_staleness_seconds of /control/dns/cache/serve_stale after expiration
+func handleSetPrefetchOnExpired(w http.ResponseWriter, r *http.Request) {
+	data := prefetchOnExpiredJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse prefetch on expired json: %s", err)
+		return
+	}
+
+	config.DNS.PrefetchOnExpired = data.Enabled
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// -------------------------
+// dns/forwarded_queries_log
+// -------------------------
+type traceForwardedJSON struct {
+	Enabled bool `json:"enabled"`
+}
+
+// handleSetTraceForwarded enables keeping the last queries sent to the upstreams, they're returned by the GET request
+func handleSetTraceForwarded(w http.ResponseWriter, r *http.Request) {
+	data := traceForwardedJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse trace forwarded queries json: %s", err)
+		return
+	}
+
+	config.DNS.TraceForwarded = data.Enabled
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func handleForwardedQueriesLog(w http.ResponseWriter, r *http.Request) {
+	data := dnsServer.GetForwardedQueries()
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal forwarded queries json: %s", err)
+		return
+	}
+}
+
+// --------------------------
+// dns/upstream_group_latency
+// --------------------------
+func handleUpstreamGroupLatency(w http.ResponseWriter, r *http.Request) {
+	data := dnsServer.GetUpstreamLatencyHistograms()
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal upstream latency json: %s", err)
+		return
+	}
+}
+
+// upstreamTimeout returns the query timeout for the upstream with the specified address
+func upstreamTimeout(address string) time.Duration {
+	if t, ok := config.DNS.PerUpstreamTimeouts[address]; ok && t > 0 {
+		return time.Duration(t) * time.Second
+	}
+	if config.DNS.UpstreamTimeout > 0 {
+		return time.Duration(config.DNS.UpstreamTimeout) * time.Second
+	}
+	return dnsforward.DefaultTimeout
+}
+
+type upstreamTimeoutJSON struct {
+	TimeoutSeconds      int            `json:"timeout_seconds"`
+	PerUpstreamTimeouts map[string]int `json:"per_upstream_timeouts,omitempty"` // if not specified, the current values are kept
+}
+
+func handleSetUpstreamTimeout(w http.ResponseWriter, r *http.Request) {
+	data := upstreamTimeoutJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse upstream timeout json: %s", err)
+		return
+	}
+
+	if data.TimeoutSeconds <= 0 {
+		httpError(w, http.StatusBadRequest, "timeout_seconds must be a positive integer")
+		return
+	}
+	for address, t := range data.PerUpstreamTimeouts {
+		if t <= 0 {
+			httpError(w, http.StatusBadRequest, "timeout of %s must be a positive integer", address)
+			return
+		}
+	}
+
+	config.DNS.UpstreamTimeout = data.TimeoutSeconds
+	if data.PerUpstreamTimeouts != nil {
+		config.DNS.PerUpstreamTimeouts = data.PerUpstreamTimeouts
+	}
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+type upstreamRetriesJSON struct {
+	MaxRetries     int `json:"max_retries"`
+	RetryBackoffMs int `json:"retry_backoff_ms"`
+}
+
+func handleSetUpstreamRetries(w http.ResponseWriter, r *http.Request) {
+	data := upstreamRetriesJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse upstream retries json: %s", err)
+		return
+	}
+
+	if data.MaxRetries < 0 || data.RetryBackoffMs < 0 {
+		httpError(w, http.StatusBadRequest, "max_retries and retry_backoff_ms must not be negative")
+		return
+	}
+
+	config.DNS.UpstreamMaxRetries = data.MaxRetries
+	config.DNS.UpstreamBackoff = data.RetryBackoffMs
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+type upstreamPolicyJSON struct {
+	Policy    string             `json:"policy"`
+	LatencyMs map[string]float64 `json:"latency_ms,omitempty"` // average latency of each upstream, only for latency_weighted
+}
+
+func handleGetUpstreamPolicy(w http.ResponseWriter, r *http.Request) {
+	data := upstreamPolicyJSON{Policy: config.DNS.UpstreamPolicy}
+	if data.Policy == "" {
+		data.Policy = dnsforward.UpstreamPolicyFastest
+	}
+	if data.Policy == dnsforward.UpstreamPolicyLatencyWeighted {
+		data.LatencyMs = dnsServer.GetUpstreamLatencies()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal upstream selector policy json: %s", err)
+		return
+	}
+}
+
+func handleSetUpstreamPolicy(w http.ResponseWriter, r *http.Request) {
+	data := upstreamPolicyJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse upstream selector policy json: %s", err)
+		return
+	}
+
+	switch data.Policy {
+	case dnsforward.UpstreamPolicyFastest, dnsforward.UpstreamPolicyParallel, dnsforward.UpstreamPolicyLatencyWeighted:
+	default:
+		httpError(w, http.StatusBadRequest, "policy must be one of fastest, parallel or latency_weighted")
+		return
+	}
+
+	config.DNS.UpstreamPolicy = data.Policy
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func handleSetNXDomainRedirect(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Enabled    bool   `json:"enabled"`
+		RedirectIP string `json:"redirect_ip"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse nxdomain redirect json: %s", err)
+		return
+	}
+
+	if req.Enabled || req.RedirectIP != "" {
+		ip := net.ParseIP(req.RedirectIP)
+		if ip == nil || ip.To4() == nil {
+			httpError(w, http.StatusBadRequest, "redirect_ip must be an IPv4 address")
+			return
+		}
+	}
+
+	config.DNS.NXDomainRedirect = req.Enabled
+	if req.RedirectIP != "" {
+		config.DNS.NXDomainRedirectIP = req.RedirectIP
+	}
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func handleSetCNAMEFlattening(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Enabled bool `json:"enabled"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse cname flattening json: %s", err)
+		return
+	}
+
+	config.DNS.CNAMEFlattening = req.Enabled
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func handleSetAllowlistMode(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Enabled bool `json:"enabled"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse allowlist mode json: %s", err)
+		return
+	}
+
+	config.DNS.AllowlistMode = req.Enabled
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func handleSetPrivateDNS(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Enabled           bool   `json:"enabled"`
+		LocalDomainSuffix string `json:"local_domain_suffix"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse private DNS json: %s", err)
+		return
+	}
+
+	suffix := strings.ToLower(strings.Trim(strings.TrimSpace(req.LocalDomainSuffix), "."))
+	if suffix == "" {
+		suffix = dnsforward.DefaultLocalDomainSuffix
+	}
+	if _, ok := dns.IsDomainName(suffix); !ok {
+		httpError(w, http.StatusBadRequest, "Invalid local_domain_suffix: %s", req.LocalDomainSuffix)
+		return
+	}
+
+	config.DNS.PrivateDNS = req.Enabled
+	config.DNS.LocalDomainSuffix = suffix
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func handleSetForwardUpstreamErrors(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Enabled bool `json:"enabled"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse forward upstream errors json: %s", err)
+		return
+	}
+
+	config.DNS.ForwardUpstreamErrs = req.Enabled
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleSetIPv6Disabled turns on answering AAAA queries with an empty answer instead of resolving them
+// it's the same setting as ipv6_enabled of /control/dns/ip_version
+func handleSetIPv6Disabled(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Enabled bool `json:"enabled"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse IPv6 disabled json: %s", err)
+		return
+	}
+
+	if req.Enabled && config.DNS.DisableIPv4 {
+		httpError(w, http.StatusBadRequest, "IPv6 can't be disabled when IPv4 is disabled")
+		return
+	}
+
+	config.DNS.DisableIPv6 = req.Enabled
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func handleSetExtendedErrors(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Enabled bool `json:"enabled"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse extended errors json: %s", err)
+		return
+	}
+
+	config.DNS.ExtendedErrors = req.Enabled
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleSetQNAMEMinimisation turns on the iterative resolution with QNAME minimisation instead of forwarding the queries to the upstreams
+func handleSetQNAMEMinimisation(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Enabled bool `json:"enabled"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse QNAME minimisation json: %s", err)
+		return
+	}
+	if req.Enabled {
+		// the name servers are queried in plain text
+		for _, u := range config.DNS.UpstreamDNS {
+			if dnsforward.IsEncryptedUpstream(u) {
+				httpError(w, http.StatusBadRequest, "QNAME minimisation can't be used with the encrypted upstream %s", u)
+				return
+			}
+		}
+	}
+
+	config.DNS.QNAMEMinimisation = req.Enabled
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleSetAggressiveNSEC turns on synthesising the negative responses from the cached NSEC records, it needs DNSSEC validation enabled
+func handleSetAggressiveNSEC(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Enabled bool `json:"enabled"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse aggressive NSEC json: %s", err)
+		return
+	}
+
+	config.DNS.AggressiveNSEC = req.Enabled
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// ----------------------
+// dns/response_rewrite/*
+// ----------------------
+func handleGetResponseRewrites(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	rewrites := make([]dnsforward.ResponseRewrite, len(config.DNS.ResponseRewrites))
+	copy(rewrites, config.DNS.ResponseRewrites)
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(rewrites)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal response rewrites json: %s", err)
+		return
+	}
+}
+
+// findResponseRewrite returns the index of the rule for the same domain and original IP, or -1
+// config must be locked by the caller
+func findResponseRewrite(rw dnsforward.ResponseRewrite) int {
+	for i, r := range config.DNS.ResponseRewrites {
+		if r.Domain == rw.Domain && r.OriginalIP == rw.OriginalIP {
+			return i
+		}
+	}
+	return -1
+}
+
+func handleAddResponseRewrite(w http.ResponseWriter, r *http.Request) {
+	rw := dnsforward.ResponseRewrite{}
+	err := json.NewDecoder(r.Body).Decode(&rw)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse response rewrite json: %s", err)
+		return
+	}
+
+	err = dnsforward.NormalizeResponseRewrite(&rw)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Invalid response rewrite: %s", err)
+		return
+	}
+
+	config.Lock()
+	exists := findResponseRewrite(rw) >= 0
+	if !exists {
+		config.DNS.ResponseRewrites = append(config.DNS.ResponseRewrites, rw)
+	}
+	config.Unlock()
+	if exists {
+		httpError(w, http.StatusBadRequest, "Rewrite of %s for %s already exists", rw.OriginalIP, rw.Domain)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleDeleteResponseRewrite removes the rule with the domain and original_ip from the request body
+func handleDeleteResponseRewrite(w http.ResponseWriter, r *http.Request) {
+	rw := dnsforward.ResponseRewrite{}
+	err := json.NewDecoder(r.Body).Decode(&rw)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse response rewrite json: %s", err)
+		return
+	}
+
+	// replacement_ip isn't needed to find the rule
+	rw.ReplacementIP = rw.OriginalIP
+	err = dnsforward.NormalizeResponseRewrite(&rw)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Invalid response rewrite: %s", err)
+		return
+	}
+
+	config.Lock()
+	i := findResponseRewrite(rw)
+	if i >= 0 {
+		config.DNS.ResponseRewrites = append(config.DNS.ResponseRewrites[:i], config.DNS.ResponseRewrites[i+1:]...)
+	}
+	config.Unlock()
+	if i < 0 {
+		httpError(w, http.StatusNotFound, "Rewrite of %s for %s not found", rw.OriginalIP, rw.Domain)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// -----------------------
+// dns/response_filter/*
+// -----------------------
+func handleGetResponseFilters(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	filters := make([]dnsforward.ResponseFilter, len(config.DNS.ResponseFilters))
+	copy(filters, config.DNS.ResponseFilters)
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(filters)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal response filters json: %s", err)
+		return
+	}
+}
+
+// findResponseFilter returns the index of the filter with the name, or -1
+// config must be locked by the caller
+func findResponseFilter(name string) int {
+	for i, f := range config.DNS.ResponseFilters {
+		if f.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func handleAddResponseFilter(w http.ResponseWriter, r *http.Request) {
+	f := dnsforward.ResponseFilter{}
+	err := json.NewDecoder(r.Body).Decode(&f)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse response filter json: %s", err)
+		return
+	}
+
+	err = dnsforward.NormalizeResponseFilter(&f)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Invalid response filter: %s", err)
+		return
+	}
+
+	config.Lock()
+	exists := findResponseFilter(f.Name) >= 0
+	if !exists {
+		config.DNS.ResponseFilters = append(config.DNS.ResponseFilters, f)
+	}
+	config.Unlock()
+	if exists {
+		httpError(w, http.StatusBadRequest, "Response filter %s already exists", f.Name)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleDeleteResponseFilter removes the filter with the name from the request body
+func handleDeleteResponseFilter(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name string `json:"name"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse response filter json: %s", err)
+		return
+	}
+
+	config.Lock()
+	i := findResponseFilter(strings.TrimSpace(req.Name))
+	if i >= 0 {
+		config.DNS.ResponseFilters = append(config.DNS.ResponseFilters[:i], config.DNS.ResponseFilters[i+1:]...)
+	}
+	config.Unlock()
+	if i < 0 {
+		httpError(w, http.StatusNotFound, "Response filter %s not found", req.Name)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// ------------------------
+// dns/max_ttl_per_domain/*
+// ------------------------
+func handleGetDomainMaxTTLs(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	rules := make([]dnsforward.DomainMaxTTL, len(config.DNS.DomainMaxTTLs))
+	copy(rules, config.DNS.DomainMaxTTLs)
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(rules)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal max TTL per domain json: %s", err)
+		return
+	}
+}
+
+// findDomainMaxTTL returns the index of the rule for the domain, or -1
+// config must be locked by the caller
+func findDomainMaxTTL(domain string) int {
+	for i, rule := range config.DNS.DomainMaxTTLs {
+		if rule.Domain == domain {
+			return i
+		}
+	}
+	return -1
+}
+
+// handleAddDomainMaxTTL adds the rule or replaces the limit of the existing rule for the same domain
+func handleAddDomainMaxTTL(w http.ResponseWriter, r *http.Request) {
+	rule := dnsforward.DomainMaxTTL{}
+	err := json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse max TTL per domain json: %s", err)
+		return
+	}
+
+	if _, err = dnsforward.NormalizeDomainTTLName(rule.Domain); err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	rule.Domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(rule.Domain), "."))
+
+	config.Lock()
+	i := findDomainMaxTTL(rule.Domain)
+	if i >= 0 {
+		config.DNS.DomainMaxTTLs[i] = rule
+	} else {
+		config.DNS.DomainMaxTTLs = append(config.DNS.DomainMaxTTLs, rule)
+	}
+	config.Unlock()
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleDeleteDomainMaxTTL removes the rule for the domain from the request body
+func handleDeleteDomainMaxTTL(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Domain string `json:"domain"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse max TTL per domain json: %s", err)
+		return
+	}
+	domain := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(req.Domain), "."))
+
+	config.Lock()
+	i := findDomainMaxTTL(domain)
+	if i >= 0 {
+		config.DNS.DomainMaxTTLs = append(config.DNS.DomainMaxTTLs[:i], config.DNS.DomainMaxTTLs[i+1:]...)
+	}
+	config.Unlock()
+	if i < 0 {
+		httpError(w, http.StatusNotFound, "Max TTL for %s not found", req.Domain)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// -------------------------
+// dns/allowed_query_domains/*
+// -------------------------
+type allowedQueryDomainJSON struct {
+	Domain string `json:"domain"`
+}
+
+func handleGetAllowedQueryDomains(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	domains := append([]string{}, config.DNS.AllowedQueryDomains...)
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(domains)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal allowed query domains json: %s", err)
+		return
+	}
+}
+
+// findAllowedQueryDomain returns the index of the domain in the allowed query domains, or -1
+// config must be locked by the caller
+func findAllowedQueryDomain(domain string) int {
+	for i, d := range config.DNS.AllowedQueryDomains {
+		if d == domain {
+			return i
+		}
+	}
+	return -1
+}
+
+// handleAddAllowedQueryDomain adds the domain, once the list isn't empty the queries for the other domains are refused
+func handleAddAllowedQueryDomain(w http.ResponseWriter, r *http.Request) {
+	data := allowedQueryDomainJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse allowed query domain json: %s", err)
+		return
+	}
+	domain, err := dnsforward.NormalizeAllowedQueryDomain(data.Domain)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	exists := findAllowedQueryDomain(domain) >= 0
+	if !exists {
+		config.DNS.AllowedQueryDomains = append(config.DNS.AllowedQueryDomains, domain)
+	}
+	config.Unlock()
+	if exists {
+		httpError(w, http.StatusBadRequest, "Domain %s is already allowed", domain)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func handleDeleteAllowedQueryDomain(w http.ResponseWriter, r *http.Request) {
+	data := allowedQueryDomainJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse allowed query domain json: %s", err)
+		return
+	}
+	domain := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(data.Domain), "."))
+
+	config.Lock()
+	i := findAllowedQueryDomain(domain)
+	if i >= 0 {
+		config.DNS.AllowedQueryDomains = append(config.DNS.AllowedQueryDomains[:i], config.DNS.AllowedQueryDomains[i+1:]...)
+	}
+	config.Unlock()
+	if i < 0 {
+		httpError(w, http.StatusNotFound, "Domain %s not found", data.Domain)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// ---------------------
+// dns/query_types_block
+// ---------------------
+type queryTypesBlockJSON struct {
+	BlockedTypes []string `json:"blocked_types"`
+}
+
+// parseQueryTypes returns the uppercase record types or an error if any of them is unknown
+func parseQueryTypes(types []string) ([]string, error) {
+	result := []string{}
+	for _, t := range types {
+		t = strings.ToUpper(strings.TrimSpace(t))
+		if _, ok := dns.StringToType[t]; !ok {
+			return nil, fmt.Errorf("unknown record type: %s", t)
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+func handleGetQueryTypesBlock(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	data := queryTypesBlockJSON{BlockedTypes: append([]string{}, config.DNS.BlockedQueryTypes...)}
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal blocked query types json: %s", err)
+		return
+	}
+}
+
+// handleAddQueryTypesBlock adds the types to the block list
+func handleAddQueryTypesBlock(w http.ResponseWriter, r *http.Request) {
+	data := queryTypesBlockJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse blocked query types json: %s", err)
+		return
+	}
+	types, err := parseQueryTypes(data.BlockedTypes)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	for _, t := range types {
+		found := false
+		for _, blocked := range config.DNS.BlockedQueryTypes {
+			if blocked == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			config.DNS.BlockedQueryTypes = append(config.DNS.BlockedQueryTypes, t)
+		}
+	}
+	config.Unlock()
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleDeleteQueryTypesBlock removes the types from the block list
+func handleDeleteQueryTypesBlock(w http.ResponseWriter, r *http.Request) {
+	data := queryTypesBlockJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse blocked query types json: %s", err)
+		return
+	}
+	types, err := parseQueryTypes(data.BlockedTypes)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	blocked := []string{}
+	for _, b := range config.DNS.BlockedQueryTypes {
+		remove := false
+		for _, t := range types {
+			if b == t {
+				remove = true
+				break
+			}
+		}
+		if !remove {
+			blocked = append(blocked, b)
+		}
+	}
+	config.DNS.BlockedQueryTypes = blocked
+	config.Unlock()
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// --------------
+// dns/rate_limit
+// --------------
+type rateLimitJSON struct {
+	Enabled       bool     `json:"enabled"`
+	RatePerSecond int      `json:"rate_per_second"`
+	Whitelist     []string `json:"whitelist"`
+}
+
+func handleGetRateLimit(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	data := rateLimitJSON{
+		Enabled:       config.DNS.Ratelimit > 0,
+		RatePerSecond: config.DNS.Ratelimit,
+		Whitelist:     append([]string{}, config.DNS.RatelimitWhitelist...),
+	}
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal rate limit json: %s", err)
+		return
+	}
+}
+
+// handleSetRateLimit sets the number of queries per second allowed from one client, 0 disables the limit
+func handleSetRateLimit(w http.ResponseWriter, r *http.Request) {
+	data := rateLimitJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse rate limit json: %s", err)
+		return
+	}
+
+	if data.Enabled && data.RatePerSecond <= 0 {
+		httpError(w, http.StatusBadRequest, "rate_per_second must be positive")
+		return
+	}
+	whitelist := []string{}
+	for _, s := range data.Whitelist {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			httpError(w, http.StatusBadRequest, "Invalid whitelist IP address: %s", s)
+			return
+		}
+		whitelist = append(whitelist, ip.String())
+	}
+
+	config.Lock()
+	config.DNS.Ratelimit = 0
+	if data.Enabled {
+		config.DNS.Ratelimit = data.RatePerSecond
+	}
+	config.DNS.RatelimitWhitelist = whitelist
+	config.Unlock()
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// ---------------------
+// dns/trusted_clients/*
+// ---------------------
+// trustedClientJSON is either an IP address or a CIDR
+type trustedClientJSON struct {
+	IP   string `json:"ip,omitempty"`
+	CIDR string `json:"cidr,omitempty"`
+}
+
+// parseTrustedClientJSON returns the TrustedClients entry from the request body
+func parseTrustedClientJSON(r *http.Request) (string, error) {
+	data := trustedClientJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse trusted client json: %s", err)
+	}
+
+	switch {
+	case data.IP != "" && data.CIDR != "":
+		return "", fmt.Errorf("only one of ip and cidr must be set")
+	case data.IP != "":
+		if strings.Contains(data.IP, "/") {
+			return "", fmt.Errorf("invalid IP address: %s", data.IP)
+		}
+		return dnsforward.NormalizeTrustedClient(data.IP)
+	case data.CIDR != "":
+		if !strings.Contains(data.CIDR, "/") {
+			return "", fmt.Errorf("invalid CIDR: %s", data.CIDR)
+		}
+		return dnsforward.NormalizeTrustedClient(data.CIDR)
+	}
+	return "", fmt.Errorf("ip or cidr is required")
+}
+
+// findTrustedClient returns the index of the entry in the trusted clients, or -1
+// config must be locked by the caller
+func findTrustedClient(client string) int {
+	for i, c := range config.DNS.TrustedClients {
+		if c == client {
+			return i
+		}
+	}
+	return -1
+}
+
+func handleGetTrustedClients(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	data := []trustedClientJSON{}
+	for _, c := range config.DNS.TrustedClients {
+		if strings.Contains(c, "/") {
+			data = append(data, trustedClientJSON{CIDR: c})
+		} else {
+			data = append(data, trustedClientJSON{IP: c})
+		}
+	}
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal trusted clients json: %s", err)
+		return
+	}
+}
+
+// handleAddTrustedClient adds the IP address or the network to the clients that are never rate limited or refused
+func handleAddTrustedClient(w http.ResponseWriter, r *http.Request) {
+	client, err := parseTrustedClientJSON(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	exists := findTrustedClient(client) >= 0
+	if !exists {
+		config.DNS.TrustedClients = append(config.DNS.TrustedClients, client)
+	}
+	config.Unlock()
+	if exists {
+		httpError(w, http.StatusBadRequest, "Client %s is already trusted", client)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func handleDeleteTrustedClient(w http.ResponseWriter, r *http.Request) {
+	client, err := parseTrustedClientJSON(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	i := findTrustedClient(client)
+	if i >= 0 {
+		config.DNS.TrustedClients = append(config.DNS.TrustedClients[:i], config.DNS.TrustedClients[i+1:]...)
+	}
+	config.Unlock()
+	if i < 0 {
+		httpError(w, http.StatusNotFound, "Client %s not found", client)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/hmage/golibs/log"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	govalidator "gopkg.in/asaskevich/govalidator.v4"
+)
+
+const (
+	dnscryptDefaultPort   = 5443
+	dnscryptStampFileName = "dnscrypt_stamp.txt" // it's under dataDir
+	dnscryptCertValidity  = time.Hour * 24 * 365
+
+	dnscryptClientMagicLen = 8
+	dnscryptNonceSize      = 24
+	dnscryptHalfNonceSize  = dnscryptNonceSize / 2
+	dnscryptQueryHeaderLen = dnscryptClientMagicLen + 32 + dnscryptHalfNonceSize
+	dnscryptRespHeaderLen  = 8 + dnscryptNonceSize
+	dnscryptMinQuerySize   = dnscryptQueryHeaderLen + secretbox.Overhead + 12 + 1
+	dnscryptMaxPacketSize  = 4096
+)
+
+var (
+	dnscryptCertMagic   = []byte{0x44, 0x4e, 0x53, 0x43}
+	dnscryptServerMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+)
+
+// dnscryptConfig is the settings of the DNSCrypt v2 server
+type dnscryptConfig struct {
+	Enabled           bool   `yaml:"enabled" json:"enabled"`
+	Port              int    `yaml:"port" json:"port"`                   // if 0, then dnscryptDefaultPort is used
+	ProviderName      string `yaml:"provider_name" json:"provider_name"` // e.g. 2.dnscrypt-cert.example.com
+	ProviderSecretKey string `yaml:"provider_secret_key" json:"-"`       // hex-encoded Ed25519 key that signs the certificates
+	ResolverSecretKey string `yaml:"resolver_secret_key" json:"-"`       // hex-encoded X25519 key that encrypts the queries
+}
+
+// dnscryptServer serves DNSCrypt queries on UDP and TCP
+// the decrypted queries are processed by handler, dnsServer.HandleRequest filters and logs them as usual
+type dnscryptServer struct {
+	providerName string // FQDN
+	cert         []byte // signed certificate that is returned in response to a TXT query for providerName
+	clientMagic  [dnscryptClientMagicLen]byte
+	resolverSk   [32]byte
+	handler      func(req *dns.Msg, addr net.Addr) (*dns.Msg, error)
+
+	udpConn     *net.UDPConn
+	tcpListener net.Listener
+}
+
+var dnscrypt struct {
+	server *dnscryptServer
+	sync.Mutex
+}
+
+func dnscryptStampPath() string {
+	return filepath.Join(config.ourWorkingDir, dataDir, dnscryptStampFileName)
+}
+
+// port returns the port of the server, dnscryptDefaultPort if it's not set
+func (c dnscryptConfig) port() int {
+	if c.Port == 0 {
+		return dnscryptDefaultPort
+	}
+	return c.Port
+}
+
+// providerKey decodes the provider key
+func (c dnscryptConfig) providerKey() (ed25519.PrivateKey, error) {
+	key, err := hex.DecodeString(c.ProviderSecretKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("provider secret key must be %d bytes long", ed25519.PrivateKeySize)
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// resolverKey decodes the resolver key
+func (c dnscryptConfig) resolverKey() ([32]byte, error) {
+	sk := [32]byte{}
+	key, err := hex.DecodeString(c.ResolverSecretKey)
+	if err != nil {
+		return sk, err
+	}
+	if len(key) != len(sk) {
+		return sk, fmt.Errorf("resolver secret key must be %d bytes long", len(sk))
+	}
+	copy(sk[:], key)
+	return sk, nil
+}
+
+// generateKeys generates the keys that aren't set yet
+// the existing keys are kept, so that the stamps that are already published stay valid
+func (c *dnscryptConfig) generateKeys() error {
+	if _, err := c.providerKey(); err != nil {
+		_, providerSk, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		c.ProviderSecretKey = hex.EncodeToString(providerSk)
+	}
+
+	if _, err := c.resolverKey(); err != nil {
+		resolverSk := make([]byte, 32)
+		_, err = io.ReadFull(rand.Reader, resolverSk)
+		if err != nil {
+			return err
+		}
+		c.ResolverSecretKey = hex.EncodeToString(resolverSk)
+	}
+	return nil
+}
+
+// dnscryptServerAddress returns the address that's written into the stamp
+// if DNS server listens on all interfaces, the first address of a valid interface is used
+func dnscryptServerAddress(port int) string {
+	host := config.DNS.BindHost
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		host = ""
+		ifaces, err := getValidNetInterfacesForWeb()
+		if err == nil {
+			for _, iface := range ifaces {
+				for _, addr := range iface.Addresses {
+					if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil && !ip.IsLoopback() {
+						host = addr
+						break
+					}
+				}
+				if host != "" {
+					break
+				}
+			}
+		}
+		if host == "" {
+			host = "127.0.0.1"
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// dnscryptStamp returns the sdns:// stamp that clients use to connect to our server
+func dnscryptStamp(conf dnscryptConfig) (string, error) {
+	providerSk, err := conf.providerKey()
+	if err != nil {
+		return "", err
+	}
+	stamp := dnsstamps.ServerStamp{
+		Proto:         dnsstamps.StampProtoTypeDNSCrypt,
+		ServerAddrStr: dnscryptServerAddress(conf.port()),
+		ServerPk:      providerSk.Public().(ed25519.PublicKey),
+		ProviderName:  conf.ProviderName,
+	}
+	return stamp.String(), nil
+}
+
+func writeDNSCryptStamp(conf dnscryptConfig) error {
+	stamp, err := dnscryptStamp(conf)
+	if err != nil {
+		return err
+	}
+	path := dnscryptStampPath()
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return safeWriteFile(path, []byte(stamp+"\n"))
+}
+
+// newDNSCryptCert makes a certificate for the resolver key signed with the provider key
+// we only support the XSalsa20Poly1305 construction
+func newDNSCryptCert(providerSk ed25519.PrivateKey, resolverPk [32]byte) []byte {
+	now := time.Now()
+	signed := make([]byte, 0, 52)
+	signed = append(signed, resolverPk[:]...)
+	signed = append(signed, resolverPk[:dnscryptClientMagicLen]...) // client magic
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(now.Unix())) // serial
+	signed = append(signed, b...)
+	binary.BigEndian.PutUint32(b, uint32(now.Unix())) // ts-start
+	signed = append(signed, b...)
+	binary.BigEndian.PutUint32(b, uint32(now.Add(dnscryptCertValidity).Unix())) // ts-end
+	signed = append(signed, b...)
+
+	cert := make([]byte, 0, 124)
+	cert = append(cert, dnscryptCertMagic...)
+	cert = append(cert, 0x00, 0x01) // es-version: XSalsa20Poly1305
+	cert = append(cert, 0x00, 0x00) // protocol-minor-version
+	cert = append(cert, ed25519.Sign(providerSk, signed)...)
+	cert = append(cert, signed...)
+	return cert
+}
+
+// txtEscape escapes the binary data so that it can be put into a TXT record
+func txtEscape(data []byte) string {
+	sb := strings.Builder{}
+	for _, b := range data {
+		if b < ' ' || b > '~' || b == '"' || b == '\\' {
+			fmt.Fprintf(&sb, "\\%03d", b)
+		} else {
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
+
+func dnscryptPad(packet []byte, size int) []byte {
+	packet = append(packet, 0x80)
+	for len(packet) < size {
+		packet = append(packet, 0)
+	}
+	return packet
+}
+
+func dnscryptUnpad(packet []byte) ([]byte, error) {
+	for i := len(packet) - 1; i >= 0; i-- {
+		if packet[i] == 0x80 {
+			return packet[:i], nil
+		}
+		if packet[i] != 0x00 {
+			return nil, errors.New("invalid padding")
+		}
+	}
+	return nil, errors.New("invalid padding")
+}
+
+// handlePacket processes one DNSCrypt packet and returns the response, nil means that there's no response
+func (s *dnscryptServer) handlePacket(packet []byte, addr net.Addr, udp bool) []byte {
+	if len(packet) >= dnscryptMinQuerySize && bytes.Equal(packet[:dnscryptClientMagicLen], s.clientMagic[:]) {
+		return s.handleEncrypted(packet, addr, udp)
+	}
+	return s.handleCertRequest(packet)
+}
+
+// handleCertRequest answers the unencrypted TXT query for the provider name with our certificate
+func (s *dnscryptServer) handleCertRequest(packet []byte) []byte {
+	req := dns.Msg{}
+	err := req.Unpack(packet)
+	if err != nil || len(req.Question) != 1 {
+		return nil
+	}
+
+	resp := dns.Msg{}
+	resp.SetReply(&req)
+	q := req.Question[0]
+	if q.Qtype != dns.TypeTXT || !strings.EqualFold(q.Name, s.providerName) {
+		resp.SetRcode(&req, dns.RcodeRefused)
+	} else {
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 3600},
+			Txt: []string{txtEscape(s.cert)},
+		})
+	}
+
+	data, err := resp.Pack()
+	if err != nil {
+		log.Printf("Couldn't pack DNSCrypt certificate response: %s", err)
+		return nil
+	}
+	return data
+}
+
+// handleEncrypted decrypts the query, resolves it and returns the encrypted response
+func (s *dnscryptServer) handleEncrypted(packet []byte, addr net.Addr, udp bool) []byte {
+	clientPk := [32]byte{}
+	copy(clientPk[:], packet[dnscryptClientMagicLen:dnscryptClientMagicLen+32])
+	nonce := [dnscryptNonceSize]byte{}
+	copy(nonce[:], packet[dnscryptClientMagicLen+32:dnscryptQueryHeaderLen])
+
+	sharedKey := [32]byte{}
+	box.Precompute(&sharedKey, &clientPk, &s.resolverSk)
+
+	decrypted, ok := secretbox.Open(nil, packet[dnscryptQueryHeaderLen:], &nonce, &sharedKey)
+	if !ok {
+		log.Tracef("Couldn't decrypt DNSCrypt query from %s", addr)
+		return nil
+	}
+	decrypted, err := dnscryptUnpad(decrypted)
+	if err != nil {
+		log.Tracef("Couldn't unpad DNSCrypt query from %s: %s", addr, err)
+		return nil
+	}
+
+	req := &dns.Msg{}
+	err = req.Unpack(decrypted)
+	if err != nil || len(req.Question) != 1 {
+		log.Tracef("Got invalid DNSCrypt query from %s", addr)
+		return nil
+	}
+
+	resp, err := s.handler(req, addr)
+	if err != nil || resp == nil {
+		log.Tracef("Couldn't process DNSCrypt query from %s: %s", addr, err)
+		resp = &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeServerFailure)
+	}
+
+	data, err := resp.Pack()
+	if err != nil {
+		log.Printf("Couldn't pack DNSCrypt response: %s", err)
+		return nil
+	}
+
+	// over UDP the response must not be larger than the query
+	maxSize := dnscryptMaxPacketSize
+	if udp {
+		maxSize = len(packet)
+	}
+	size := (len(data) + 1 + 63) &^ 63
+	if dnscryptRespHeaderLen+secretbox.Overhead+size > maxSize {
+		truncated := &dns.Msg{}
+		truncated.SetReply(req)
+		truncated.Truncated = true
+		data, err = truncated.Pack()
+		if err != nil {
+			return nil
+		}
+		size = len(data) + 1
+	}
+
+	_, err = io.ReadFull(rand.Reader, nonce[dnscryptHalfNonceSize:])
+	if err != nil {
+		return nil
+	}
+	result := make([]byte, 0, dnscryptRespHeaderLen+secretbox.Overhead+size)
+	result = append(result, dnscryptServerMagic...)
+	result = append(result, nonce[:]...)
+	return secretbox.Seal(result, dnscryptPad(data, size), &nonce, &sharedKey)
+}
+
+func (s *dnscryptServer) serveUDP() {
+	buf := make([]byte, dnscryptMaxPacketSize)
+	for {
+		n, addr, err := s.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			if !isConnClosed(err) {
+				log.Printf("DNSCrypt UDP listener stopped: %s", err)
+			}
+			return
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		go func() {
+			resp := s.handlePacket(packet, addr, true)
+			if resp != nil {
+				_, err := s.udpConn.WriteToUDP(resp, addr)
+				if err != nil {
+					log.Tracef("Couldn't write DNSCrypt response to %s: %s", addr, err)
+				}
+			}
+		}()
+	}
+}
+
+func (s *dnscryptServer) serveTCP() {
+	for {
+		conn, err := s.tcpListener.Accept()
+		if err != nil {
+			if !isConnClosed(err) {
+				log.Printf("DNSCrypt TCP listener stopped: %s", err)
+			}
+			return
+		}
+		go s.handleTCPConn(conn)
+	}
+}
+
+// handleTCPConn processes the queries sent over the TCP connection, each packet is prefixed with its length
+func (s *dnscryptServer) handleTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		_ = conn.SetDeadline(time.Now().Add(time.Second * 10))
+		l := make([]byte, 2)
+		_, err := io.ReadFull(conn, l)
+		if err != nil {
+			return
+		}
+		packet := make([]byte, binary.BigEndian.Uint16(l))
+		_, err = io.ReadFull(conn, packet)
+		if err != nil {
+			return
+		}
+
+		resp := s.handlePacket(packet, conn.RemoteAddr(), false)
+		if resp == nil {
+			return
+		}
+		binary.BigEndian.PutUint16(l, uint16(len(resp)))
+		_, err = conn.Write(append(l, resp...))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func isConnClosed(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// newDNSCryptServer starts the DNSCrypt server with the settings, it listens on bindHost
+func newDNSCryptServer(conf dnscryptConfig, bindHost string, handler func(req *dns.Msg, addr net.Addr) (*dns.Msg, error)) (*dnscryptServer, error) {
+	providerSk, err := conf.providerKey()
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNSCrypt provider key: %s", err)
+	}
+	resolverSk, err := conf.resolverKey()
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNSCrypt resolver key: %s", err)
+	}
+	resolverPk := [32]byte{}
+	curve25519.ScalarBaseMult(&resolverPk, &resolverSk)
+
+	s := &dnscryptServer{
+		providerName: dns.Fqdn(conf.ProviderName),
+		cert:         newDNSCryptCert(providerSk, resolverPk),
+		resolverSk:   resolverSk,
+		handler:      handler,
+	}
+	copy(s.clientMagic[:], resolverPk[:dnscryptClientMagicLen])
+
+	address := net.JoinHostPort(bindHost, strconv.Itoa(conf.port()))
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	s.udpConn, err = net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	s.tcpListener, err = net.Listen("tcp", address)
+	if err != nil {
+		s.udpConn.Close()
+		return nil, err
+	}
+
+	log.Printf("DNSCrypt server is listening on %s", address)
+	go s.serveUDP()
+	go s.serveTCP()
+	return s, nil
+}
+
+func (s *dnscryptServer) close() {
+	s.udpConn.Close()
+	s.tcpListener.Close()
+}
+
+// startDNSCryptServer starts the DNSCrypt server if it's enabled
+func startDNSCryptServer() error {
+	dnscrypt.Lock()
+	defer dnscrypt.Unlock()
+	if !config.DNSCrypt.Enabled || dnscrypt.server != nil {
+		return nil
+	}
+
+	s, err := newDNSCryptServer(config.DNSCrypt, config.DNS.BindHost, dnsServer.HandleRequest)
+	if err != nil {
+		return err
+	}
+	dnscrypt.server = s
+	return nil
+}
+
+func stopDNSCryptServer() {
+	dnscrypt.Lock()
+	defer dnscrypt.Unlock()
+	if dnscrypt.server == nil {
+		return
+	}
+	dnscrypt.server.close()
+	dnscrypt.server = nil
+}
+
+// handleDNSCryptConfigure applies the settings only if the server with them is started successfully
+// otherwise the running server and the config are kept as they are
+func handleDNSCryptConfigure(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	oldConf := config.DNSCrypt
+	config.RUnlock()
+	newConf := oldConf
+
+	req := struct {
+		Enabled      bool   `json:"enabled"`
+		Port         int    `json:"port"`
+		ProviderName string `json:"provider_name"`
+	}{
+		Port:         newConf.Port,
+		ProviderName: newConf.ProviderName,
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse dnscrypt json: %s", err)
+		return
+	}
+
+	if req.Port < 0 || req.Port > 65535 {
+		httpError(w, http.StatusBadRequest, "port must be between 1 and 65535")
+		return
+	}
+	req.ProviderName = strings.TrimSuffix(strings.TrimSpace(req.ProviderName), ".")
+	if req.Enabled && (!strings.HasPrefix(req.ProviderName, "2.dnscrypt-cert.") || !govalidator.IsDNSName(req.ProviderName)) {
+		httpError(w, http.StatusBadRequest, "provider_name must be a domain name starting with 2.dnscrypt-cert.")
+		return
+	}
+
+	newConf.Enabled = req.Enabled
+	newConf.Port = req.Port
+	newConf.ProviderName = req.ProviderName
+	if req.Enabled {
+		err = newConf.generateKeys()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Couldn't generate DNSCrypt keys: %s", err)
+			return
+		}
+	}
+
+	dnscrypt.Lock()
+	old := dnscrypt.server
+	if old != nil {
+		// the new server may need the same port
+		old.close()
+		dnscrypt.server = nil
+	}
+	if req.Enabled {
+		dnscrypt.server, err = newDNSCryptServer(newConf, config.DNS.BindHost, dnsServer.HandleRequest)
+		if err != nil && old != nil {
+			var restartErr error
+			dnscrypt.server, restartErr = newDNSCryptServer(oldConf, config.DNS.BindHost, dnsServer.HandleRequest)
+			if restartErr != nil {
+				log.Printf("Couldn't restart the DNSCrypt server with the previous settings: %s", restartErr)
+			}
+		}
+	}
+	dnscrypt.Unlock()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Couldn't start the DNSCrypt server on port %d: %s", newConf.port(), err)
+		return
+	}
+
+	config.Lock()
+	config.DNSCrypt = newConf
+	config.Unlock()
+
+	if req.Enabled {
+		err = writeDNSCryptStamp(newConf)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Couldn't write DNSCrypt stamp: %s", err)
+			return
+		}
+	}
+
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
+
+type dnscryptStatusJSON struct {
+	Enabled      bool   `json:"enabled"`
+	Running      bool   `json:"running"`
+	Port         int    `json:"port"`
+	ProviderName string `json:"provider_name"`
+	PublicKey    string `json:"public_key,omitempty"` // hex-encoded provider public key
+	Stamp        string `json:"stamp,omitempty"`
+}
+
+func handleDNSCryptStatus(w http.ResponseWriter, r *http.Request) {
+	dnscrypt.Lock()
+	running := dnscrypt.server != nil
+	dnscrypt.Unlock()
+
+	config.RLock()
+	conf := config.DNSCrypt
+	config.RUnlock()
+
+	data := dnscryptStatusJSON{
+		Enabled:      conf.Enabled,
+		Running:      running,
+		Port:         conf.port(),
+		ProviderName: conf.ProviderName,
+	}
+	if providerSk, err := conf.providerKey(); err == nil {
+		data.PublicKey = hex.EncodeToString(providerSk.Public().(ed25519.PublicKey))
+		stamp, err := ioutil.ReadFile(dnscryptStampPath())
+		if err == nil {
+			data.Stamp = strings.TrimSpace(string(stamp))
+		} else {
+			data.Stamp, _ = dnscryptStamp(conf)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal dnscrypt status json: %s", err)
+		return
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	dnscryptclient "github.com/ameshkov/dnscrypt"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+// freeDNSCryptPort returns the port that is free for both UDP and TCP
+func freeDNSCryptPort(t *testing.T) int {
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Cannot listen: %s", err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: port})
+		if err == nil {
+			c.Close()
+			return port
+		}
+	}
+	t.Fatalf("Cannot find a free port")
+	return 0
+}
+
+func startTestDNSCryptServer(t *testing.T, answers int) (*dnscryptServer, string) {
+	conf := dnscryptConfig{Enabled: true, Port: freeDNSCryptPort(t), ProviderName: "2.dnscrypt-cert.example.org"}
+	err := conf.generateKeys()
+	if err != nil {
+		t.Fatalf("Cannot generate keys: %s", err)
+	}
+	handler := func(req *dns.Msg, addr net.Addr) (*dns.Msg, error) {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		for i := 0; i < answers; i++ {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IP{192, 0, 2, byte(i)},
+			})
+		}
+		return resp, nil
+	}
+	s, err := newDNSCryptServer(conf, "127.0.0.1", handler)
+	if err != nil {
+		t.Fatalf("Cannot start DNSCrypt server: %s", err)
+	}
+
+	providerSk, _ := conf.providerKey()
+	stamp := dnsstamps.ServerStamp{
+		Proto:         dnsstamps.StampProtoTypeDNSCrypt,
+		ServerAddrStr: net.JoinHostPort("127.0.0.1", strconv.Itoa(conf.Port)),
+		ServerPk:      providerSk.Public().(ed25519.PublicKey),
+		ProviderName:  conf.ProviderName,
+	}
+	return s, stamp.String()
+}
+
+func TestDNSCryptServer(t *testing.T) {
+	s, stamp := startTestDNSCryptServer(t, 1)
+	defer s.close()
+
+	for _, proto := range []string{"udp", "tcp"} {
+		client := dnscryptclient.Client{Proto: proto, Timeout: time.Second * 2}
+		info, _, err := client.Dial(stamp)
+		if err != nil {
+			t.Fatalf("%s: cannot fetch the certificate: %s", proto, err)
+		}
+
+		req := &dns.Msg{}
+		req.SetQuestion("example.org.", dns.TypeA)
+		resp, _, err := client.Exchange(req, info)
+		if err != nil {
+			t.Fatalf("%s: cannot exchange: %s", proto, err)
+		}
+		assert.Equal(t, req.Id, resp.Id, proto)
+		if assert.Len(t, resp.Answer, 1, proto) {
+			assert.Equal(t, "192.0.2.0", resp.Answer[0].(*dns.A).A.String(), proto)
+		}
+	}
+}
+
+func TestDNSCryptServerTruncated(t *testing.T) {
+	s, stamp := startTestDNSCryptServer(t, 100)
+	defer s.close()
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+
+	// over UDP the response can't be larger than the query
+	client := dnscryptclient.Client{Proto: "udp", Timeout: time.Second * 2}
+	info, _, err := client.Dial(stamp)
+	if err != nil {
+		t.Fatalf("Cannot fetch the certificate: %s", err)
+	}
+	resp, _, err := client.Exchange(req, info)
+	if err != nil {
+		t.Fatalf("Cannot exchange: %s", err)
+	}
+	assert.True(t, resp.Truncated)
+	assert.Len(t, resp.Answer, 0)
+
+	client = dnscryptclient.Client{Proto: "tcp", Timeout: time.Second * 2}
+	info, _, err = client.Dial(stamp)
+	if err != nil {
+		t.Fatalf("Cannot fetch the certificate: %s", err)
+	}
+	resp, _, err = client.Exchange(req, info)
+	if err != nil {
+		t.Fatalf("Cannot exchange: %s", err)
+	}
+	assert.False(t, resp.Truncated)
+	assert.Len(t, resp.Answer, 100)
+}
+
+func TestDNSCryptPadding(t *testing.T) {
+	packet := dnscryptPad([]byte{1, 2, 3}, 64)
+	assert.Len(t, packet, 64)
+	unpadded, err := dnscryptUnpad(packet)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, unpadded)
+
+	_, err = dnscryptUnpad([]byte{1, 2, 3, 0, 0})
+	assert.NotNil(t, err)
+	_, err = dnscryptUnpad([]byte{1, 0x80, 3, 0})
+	assert.NotNil(t, err)
+}
+
+func TestDNSCryptGenerateKeys(t *testing.T) {
+	conf := dnscryptConfig{}
+	assert.Nil(t, conf.generateKeys())
+	_, err := conf.providerKey()
+	assert.Nil(t, err)
+	_, err = conf.resolverKey()
+	assert.Nil(t, err)
+
+	// the existing keys are kept
+	keys := conf
+	assert.Nil(t, conf.generateKeys())
+	assert.Equal(t, keys, conf)
+
+	conf.ResolverSecretKey = "invalid"
+	assert.Nil(t, conf.generateKeys())
+	assert.Equal(t, keys.ProviderSecretKey, conf.ProviderSecretKey)
+	assert.NotEqual(t, keys.ResolverSecretKey, conf.ResolverSecretKey)
+}
@@ -40,6 +40,8 @@ var ErrAlreadyExists = errors.New("dnsfilter: rule was already added")
 
 const shortcutLength = 6 // used for rule search optimization, 6 hits the sweet spot
 
+const maxParseErrors = 100 // number of the rule parsing errors kept for each filter
+
 const enableFastLookup = true         // flag for debugging, must be true in production for faster performance
 const enableDelayedCompilation = true // flag for debugging, must be true in production for faster performance
 
@@ -103,6 +105,8 @@ type Dnsfilter struct {
 	storage      map[string]bool // rule storage, not used for matching, just for filtering out duplicates
 	storageMutex sync.RWMutex
 
+	parseErrors map[int64][]RuleParseError // the rules that couldn't be added by AddRules, by filter ID
+
 	// rules are checked against these lists in the order defined here
 	important *rulesTable // more important than whitelist and is checked first
 	whiteList *rulesTable // more important than blacklist
@@ -122,6 +126,13 @@ type Filter struct {
 	Rules []string `json:"-" yaml:"-"` // not in yaml or json
 }
 
+// RuleParseError describes the rule of a filter list that couldn't be parsed
+type RuleParseError struct {
+	Line  int    `json:"line"` // starts with 1
+	Rule  string `json:"rule"`
+	Error string `json:"error"`
+}
+
 //go:generate stringer -type=Reason
 
 // Reason holds an enum detailing why it was filtered or not filtered
@@ -175,6 +186,12 @@ func (r Reason) Matched() bool {
 
 // CheckHost tries to match host against rules, then safebrowsing and parental if they are enabled
 func (d *Dnsfilter) CheckHost(host string) (Result, error) {
+	return d.CheckHostWithConfig(host, &d.Config)
+}
+
+// CheckHostWithConfig is the same as CheckHost, but safesearch, safebrowsing and parental settings are taken from setts
+// this allows overriding these settings per client
+func (d *Dnsfilter) CheckHostWithConfig(host string, setts *Config) (Result, error) {
 	// sometimes DNS clients will try to resolve ".", which is a request to get root servers
 	if host == "" {
 		return Result{Reason: NotFilteredNotFound}, nil
@@ -191,7 +208,7 @@ func (d *Dnsfilter) CheckHost(host string) (Result, error) {
 	}
 
 	// check safeSearch if no match
-	if d.SafeSearchEnabled {
+	if setts.SafeSearchEnabled {
 		result, err = d.checkSafeSearch(host)
 		if err != nil {
 			log.Printf("Failed to safesearch HTTP lookup, ignoring check: %v", err)
@@ -204,7 +221,7 @@ func (d *Dnsfilter) CheckHost(host string) (Result, error) {
 	}
 
 	// check safebrowsing if no match
-	if d.SafeBrowsingEnabled {
+	if setts.SafeBrowsingEnabled {
 		result, err = d.checkSafeBrowsing(host)
 		if err != nil {
 			// failed to do HTTP lookup -- treat it as if we got empty response, but don't save cache
@@ -217,8 +234,8 @@ func (d *Dnsfilter) CheckHost(host string) (Result, error) {
 	}
 
 	// check parental if no match
-	if d.ParentalEnabled {
-		result, err = d.checkParental(host)
+	if setts.ParentalEnabled {
+		result, err = d.checkParental(host, setts.ParentalSensitivity)
 		if err != nil {
 			// failed to do HTTP lookup -- treat it as if we got empty response, but don't save cache
 			log.Printf("Failed to do parental HTTP lookup, ignoring check: %v", err)
@@ -615,7 +632,7 @@ func (d *Dnsfilter) checkSafeSearch(host string) (Result, error) {
 		return Result{}, err
 	}
 
-	safeHost, ok := d.SafeSearchDomain(host)
+	safeHost, ok := safeSearchDomains[host]
 	if !ok {
 		return Result{}, nil
 	}
@@ -692,17 +709,17 @@ func (d *Dnsfilter) checkSafeBrowsing(host string) (Result, error) {
 	if safebrowsingCache == nil {
 		safebrowsingCache = gcache.New(defaultCacheSize).LRU().Expiration(defaultCacheTime).Build()
 	}
-	result, err := d.lookupCommon(host, &stats.Safebrowsing, safebrowsingCache, true, format, handleBody)
+	result, err := d.lookupCommon(host, &stats.Safebrowsing, safebrowsingCache, "", true, format, handleBody)
 	return result, err
 }
 
-func (d *Dnsfilter) checkParental(host string) (Result, error) {
+func (d *Dnsfilter) checkParental(host string, sensitivity int) (Result, error) {
 	// prevent recursion -- checking the host of parental safety server makes no sense
 	if host == d.parentalServer {
 		return Result{}, nil
 	}
 	format := func(hashparam string) string {
-		url := fmt.Sprintf(defaultParentalURL, d.parentalServer, hashparam, d.ParentalSensitivity)
+		url := fmt.Sprintf(defaultParentalURL, d.parentalServer, hashparam, sensitivity)
 		return url
 	}
 	handleBody := func(body []byte, hashes map[string]bool) (Result, error) {
@@ -738,7 +755,9 @@ func (d *Dnsfilter) checkParental(host string) (Result, error) {
 	if parentalCache == nil {
 		parentalCache = gcache.New(defaultCacheSize).LRU().Expiration(defaultCacheTime).Build()
 	}
-	result, err := d.lookupCommon(host, &stats.Parental, parentalCache, false, format, handleBody)
+	// the verdict depends on the sensitivity, so clients with different sensitivities must not share the cached results
+	cacheKeyPrefix := fmt.Sprintf("%d/", sensitivity)
+	result, err := d.lookupCommon(host, &stats.Parental, parentalCache, cacheKeyPrefix, false, format, handleBody)
 	return result, err
 }
 
@@ -746,12 +765,14 @@ type formatHandler func(hashparam string) string
 type bodyHandler func(body []byte, hashes map[string]bool) (Result, error)
 
 // real implementation of lookup/check
-func (d *Dnsfilter) lookupCommon(host string, lookupstats *LookupStats, cache gcache.Cache, hashparamNeedSlash bool, format formatHandler, handleBody bodyHandler) (Result, error) {
+// cacheKeyPrefix is prepended to the host in the cache key, it separates the results that depend on the request parameters
+func (d *Dnsfilter) lookupCommon(host string, lookupstats *LookupStats, cache gcache.Cache, cacheKeyPrefix string, hashparamNeedSlash bool, format formatHandler, handleBody bodyHandler) (Result, error) {
 	// if host ends with a dot, trim it
 	host = strings.ToLower(strings.Trim(host, "."))
+	cacheKey := cacheKeyPrefix + host
 
 	// check cache
-	cachedValue, isFound, err := getCachedReason(cache, host)
+	cachedValue, isFound, err := getCachedReason(cache, cacheKey)
 	if isFound {
 		atomic.AddUint64(&lookupstats.CacheHits, 1)
 		return cachedValue, nil
@@ -791,7 +812,7 @@ func (d *Dnsfilter) lookupCommon(host string, lookupstats *LookupStats, cache gc
 	switch {
 	case resp.StatusCode == 204:
 		// empty result, save cache
-		err = cache.Set(host, Result{})
+		err = cache.Set(cacheKey, Result{})
 		if err != nil {
 			return Result{}, err
 		}
@@ -807,7 +828,7 @@ func (d *Dnsfilter) lookupCommon(host string, lookupstats *LookupStats, cache gc
 		return Result{}, err
 	}
 
-	err = cache.Set(host, result)
+	err = cache.Set(cacheKey, result)
 	if err != nil {
 		return Result{}, err
 	}
@@ -819,23 +840,46 @@ func (d *Dnsfilter) lookupCommon(host string, lookupstats *LookupStats, cache gc
 //
 
 // AddRules is a convinience function to add an array of filters in one call
+// Invalid rules are skipped, the first maxParseErrors of them are kept for ParseErrors
 func (d *Dnsfilter) AddRules(filters []Filter) error {
 	for _, f := range filters {
-		for _, rule := range f.Rules {
+		for i, rule := range f.Rules {
 			err := d.AddRule(rule, f.ID)
-			if err == ErrAlreadyExists || err == ErrInvalidSyntax {
+			if err == nil || err == ErrAlreadyExists {
 				continue
 			}
-			if err != nil {
-				log.Printf("Cannot add rule %s: %s", rule, err)
-				// Just ignore invalid rules
+			rule = strings.TrimSpace(rule)
+			if err == ErrInvalidSyntax && !isValidRule(rule) {
+				// comments, cosmetic rules and empty lines
 				continue
 			}
+			if err != ErrInvalidSyntax {
+				log.Printf("Cannot add rule %s: %s", rule, err)
+			}
+			d.addParseError(f.ID, RuleParseError{Line: i + 1, Rule: rule, Error: err.Error()})
 		}
 	}
 	return nil
 }
 
+func (d *Dnsfilter) addParseError(filterListID int64, e RuleParseError) {
+	d.storageMutex.Lock()
+	defer d.storageMutex.Unlock()
+	if d.parseErrors == nil {
+		d.parseErrors = map[int64][]RuleParseError{}
+	}
+	if len(d.parseErrors[filterListID]) < maxParseErrors {
+		d.parseErrors[filterListID] = append(d.parseErrors[filterListID], e)
+	}
+}
+
+// ParseErrors returns the rules of the filter that couldn't be added by AddRules
+func (d *Dnsfilter) ParseErrors(filterListID int64) []RuleParseError {
+	d.storageMutex.RLock()
+	defer d.storageMutex.RUnlock()
+	return append([]RuleParseError{}, d.parseErrors[filterListID]...)
+}
+
 // AddRule adds a rule, checking if it is a valid rule first and if it wasn't added already
 func (d *Dnsfilter) AddRule(input string, filterListID int64) error {
 	input = strings.TrimSpace(input)
@@ -882,6 +926,15 @@ func (d *Dnsfilter) AddRule(input string, filterListID int64) error {
 		if err != nil {
 			return err
 		}
+	} else if isRegexpRule(r.text) {
+		// compilation is still delayed, but the invalid regexps are rejected instead of failing the matching
+		expr, err := ruleToRegexp(r.text)
+		if err == nil {
+			_, err = regexp.Compile(expr)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
 	destination := d.blackList
@@ -3,6 +3,7 @@ package dnsfilter
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -536,6 +537,28 @@ func TestAddRuleFail(t *testing.T) {
 	d := NewForTest()
 	defer d.Destroy()
 	d.checkAddRuleFail(t, "lkfaojewhoawehfwacoefawr$@#$@3413841384")
+	if err := d.AddRule("/example(org/", 0); err == nil {
+		t.Errorf("Adding the invalid regexp rule should have failed")
+	}
+}
+
+func TestRegexpRuleDelayedCompilation(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "/example\\.(org|com)/")
+	for _, r := range d.blackList.rulesByShortcut {
+		for _, rule := range r {
+			if rule.compiled != nil {
+				t.Errorf("Rule %s was compiled when added", rule.originalText)
+			}
+		}
+	}
+	for _, rule := range d.blackList.rulesLeftovers {
+		if rule.compiled != nil {
+			t.Errorf("Rule %s was compiled when added", rule.originalText)
+		}
+	}
+	d.checkMatch(t, "example.org")
 }
 
 func TestSafeBrowsing(t *testing.T) {
@@ -785,6 +808,42 @@ func TestParentalControl(t *testing.T) {
 	d.checkMatchEmpty(t, "api.jquery.com")
 }
 
+func TestParentalControlSensitivityCache(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	host := "example.org"
+	sum := sha256.Sum256([]byte(host))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// block the host only for the youngest clients
+		blocked := r.URL.Query().Get("sensitivity") == "3"
+		fmt.Fprintf(w, `[{"blocked":%t,"clientTtl":3600,"reason":"test","hash":"%X"}]`, blocked, sum)
+	}))
+	defer ts.Close()
+	d.parentalServer = ts.Listener.Addr().String()
+	d.SetHTTPTimeout(time.Second * 5)
+
+	strict := d.Config
+	strict.ParentalEnabled = true
+	strict.ParentalSensitivity = 3
+	loose := strict
+	loose.ParentalSensitivity = 18
+
+	requests := stats.Parental.Requests
+	for i := 0; i < 2; i++ {
+		ret, err := d.CheckHostWithConfig(host, &strict)
+		if err != nil || !ret.IsFiltered {
+			t.Fatalf("Expected %s to be blocked for sensitivity 3, got %v, %v", host, ret, err)
+		}
+		ret, err = d.CheckHostWithConfig(host, &loose)
+		if err != nil || ret.IsFiltered {
+			t.Fatalf("Expected %s not to be blocked for sensitivity 18, got %v, %v", host, ret, err)
+		}
+	}
+	if stats.Parental.Requests-requests != 2 {
+		t.Errorf("Expected one parental lookup per sensitivity, got %d", stats.Parental.Requests-requests)
+	}
+}
+
 func TestSafeSearch(t *testing.T) {
 	d := NewForTest()
 	defer d.Destroy()
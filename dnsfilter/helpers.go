@@ -44,6 +44,11 @@ func isValidRule(rule string) bool {
 	return true
 }
 
+// isRegexpRule returns true if the rule text is a regexp like /example\.(org|com)/
+func isRegexpRule(text string) bool {
+	return len(text) >= 2 && text[0] == '/' && text[len(text)-1] == '/'
+}
+
 func updateMax(valuePtr *int64, maxPtr *int64) {
 	for {
 		current := atomic.LoadInt64(valuePtr)
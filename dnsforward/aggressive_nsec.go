@@ -0,0 +1,418 @@
+package dnsforward
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maximum number of the NSEC and NSEC3 records in the cache
+// the expired ones are removed when it's full, the new ones are ignored if it's still full
+const maxNSECRecords = 10000
+
+// maximum number of the NSEC3 hash iterations, the records with more iterations are too expensive to check (RFC 9276)
+const maxNSEC3Iterations = 150
+
+// nsecCache keeps the NSEC and NSEC3 records from the validated negative responses
+// they're used to answer the queries for the names they deny without asking the upstreams (aggressive negative caching, RFC 8198)
+type nsecCache struct {
+	zones map[string]*nsecZone // zone name -> its records
+	count int                  // number of the NSEC and NSEC3 records in all zones
+	sync.Mutex
+}
+
+// nsecZone is the part of the zone known from the negative responses
+type nsecZone struct {
+	soa       []dns.RR              // SOA with its signatures, it goes to the authority section of the synthesised responses
+	soaExpire time.Time             // the records can't be used when the SOA expires
+	nsec      map[string]*nsecEntry // lowercase owner name -> NSEC
+	nsec3     map[string]*nsecEntry // uppercase owner hash -> NSEC3
+}
+
+// nsecEntry is an NSEC or NSEC3 record with its signatures
+type nsecEntry struct {
+	rrs    []dns.RR // the record goes first
+	expire time.Time
+}
+
+func newNSECCache() *nsecCache {
+	return &nsecCache{zones: map[string]*nsecZone{}}
+}
+
+// add stores the NSEC and NSEC3 records of the negative response validated by the upstream
+func (c *nsecCache) add(resp *dns.Msg, now time.Time) {
+	if resp == nil || !resp.AuthenticatedData || len(resp.Answer) != 0 ||
+		resp.Rcode != dns.RcodeNameError && resp.Rcode != dns.RcodeSuccess {
+		return
+	}
+
+	var soa *dns.SOA
+	for _, rr := range resp.Ns {
+		if rec, ok := rr.(*dns.SOA); ok {
+			soa = rec
+			break
+		}
+	}
+	if soa == nil {
+		return
+	}
+	zoneName := strings.ToLower(soa.Hdr.Name)
+	ttl := soa.Hdr.Ttl
+	if soa.Minttl < ttl {
+		ttl = soa.Minttl
+	}
+	if ttl == 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	zone := c.zones[zoneName]
+	if zone == nil {
+		zone = &nsecZone{nsec: map[string]*nsecEntry{}, nsec3: map[string]*nsecEntry{}}
+		c.zones[zoneName] = zone
+	}
+	zone.soa = signedRRs(resp.Ns, soa)
+	zone.soaExpire = now.Add(time.Duration(ttl) * time.Second)
+
+	cleaned := false
+	full := func() bool {
+		if c.count >= maxNSECRecords && !cleaned {
+			c.removeExpired(now)
+			cleaned = true
+		}
+		return c.count >= maxNSECRecords
+	}
+	for _, rr := range resp.Ns {
+		recTTL := rr.Header().Ttl
+		if recTTL > ttl {
+			recTTL = ttl
+		}
+		entry := &nsecEntry{rrs: signedRRs(resp.Ns, rr), expire: now.Add(time.Duration(recTTL) * time.Second)}
+		switch rec := rr.(type) {
+		case *dns.NSEC:
+			owner := strings.ToLower(rec.Hdr.Name)
+			if !dns.IsSubDomain(zoneName, owner) {
+				continue
+			}
+			if zone.nsec[owner] == nil {
+				if full() {
+					continue
+				}
+				c.count++
+			}
+			zone.nsec[owner] = entry
+		case *dns.NSEC3:
+			labels := dns.SplitDomainName(rec.Hdr.Name)
+			if len(labels) < 2 || rec.Hash != dns.SHA1 || rec.Iterations > maxNSEC3Iterations ||
+				!strings.EqualFold(dns.Fqdn(strings.Join(labels[1:], ".")), zoneName) {
+				continue
+			}
+			hash := strings.ToUpper(labels[0])
+			if zone.nsec3[hash] == nil {
+				if full() {
+					continue
+				}
+				c.count++
+			}
+			zone.nsec3[hash] = entry
+		}
+	}
+}
+
+// removeExpired removes the expired zones and records from the cache, it must be called with the lock held
+func (c *nsecCache) removeExpired(now time.Time) {
+	for name, zone := range c.zones {
+		if now.After(zone.soaExpire) {
+			c.count -= len(zone.nsec) + len(zone.nsec3)
+			delete(c.zones, name)
+			continue
+		}
+		for owner, entry := range zone.nsec {
+			if now.After(entry.expire) {
+				delete(zone.nsec, owner)
+				c.count--
+			}
+		}
+		for hash, entry := range zone.nsec3 {
+			if now.After(entry.expire) {
+				delete(zone.nsec3, hash)
+				c.count--
+			}
+		}
+	}
+}
+
+// synthesise returns NXDOMAIN or NODATA response if the cached records prove that the name or the type doesn't exist
+// nil is returned if there are no such records
+func (c *nsecCache) synthesise(req *dns.Msg, now time.Time) *dns.Msg {
+	if len(req.Question) != 1 || req.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	q := req.Question[0]
+	// DS records are in the parent zone, the records of the child zone can't deny them
+	if q.Qtype == dns.TypeDS || q.Qtype == dns.TypeANY {
+		return nil
+	}
+	qname := strings.ToLower(dns.Fqdn(q.Name))
+
+	c.Lock()
+	defer c.Unlock()
+
+	zoneName, zone := c.findZone(qname)
+	if zone == nil {
+		return nil
+	}
+	if now.After(zone.soaExpire) {
+		c.count -= len(zone.nsec) + len(zone.nsec3)
+		delete(c.zones, zoneName)
+		return nil
+	}
+
+	var rcode int
+	var proof []*nsecEntry
+	if len(zone.nsec) != 0 {
+		rcode, proof = zone.denyNSEC(qname, q.Qtype, now)
+	} else {
+		rcode, proof = zone.denyNSEC3(zoneName, qname, q.Qtype, now)
+	}
+	if proof == nil {
+		return nil
+	}
+
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	resp.RecursionAvailable = true
+	resp.AuthenticatedData = true
+	resp.Ns = append(resp.Ns, copyWithTTL(zone.soa, zone.soaExpire, now)...)
+	added := map[*nsecEntry]bool{}
+	for _, entry := range proof {
+		if added[entry] {
+			continue
+		}
+		added[entry] = true
+		resp.Ns = append(resp.Ns, copyWithTTL(entry.rrs, entry.expire, now)...)
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	return resp
+}
+
+// findZone returns the closest cached zone the name belongs to
+func (c *nsecCache) findZone(qname string) (string, *nsecZone) {
+	for name := qname; ; {
+		if zone := c.zones[name]; zone != nil {
+			return name, zone
+		}
+		next, end := dns.NextLabel(name, 0)
+		if end {
+			return "", nil
+		}
+		name = name[next:]
+		if name == "" {
+			name = "."
+		}
+	}
+}
+
+// denyNSEC looks for the NSEC records proving that the name or the type doesn't exist
+func (z *nsecZone) denyNSEC(qname string, qtype uint16, now time.Time) (int, []*nsecEntry) {
+	if entry := z.nsec[qname]; entry != nil && now.Before(entry.expire) {
+		rec := entry.rrs[0].(*dns.NSEC)
+		if hasBitmapType(rec.TypeBitMap, qtype) || hasBitmapType(rec.TypeBitMap, dns.TypeCNAME) {
+			return 0, nil
+		}
+		return dns.RcodeSuccess, []*nsecEntry{entry}
+	}
+
+	covering := z.coveringNSEC(qname, now)
+	if covering == nil {
+		return 0, nil
+	}
+	// the closest encloser is the longest ancestor of the name the covering record proves to exist
+	rec := covering.rrs[0].(*dns.NSEC)
+	common := dns.CompareDomainName(qname, rec.Hdr.Name)
+	if n := dns.CompareDomainName(qname, rec.NextDomain); n > common {
+		common = n
+	}
+	labels := dns.SplitDomainName(qname)
+	wildcard := dns.Fqdn("*." + strings.Join(labels[len(labels)-common:], "."))
+	if common == 0 {
+		wildcard = "*."
+	}
+	wildcardCovering := z.coveringNSEC(wildcard, now)
+	if wildcardCovering == nil {
+		return 0, nil
+	}
+	return dns.RcodeNameError, []*nsecEntry{covering, wildcardCovering}
+}
+
+// coveringNSEC returns the NSEC record proving that the name doesn't exist
+func (z *nsecZone) coveringNSEC(name string, now time.Time) *nsecEntry {
+	for owner, entry := range z.nsec {
+		if now.After(entry.expire) {
+			continue
+		}
+		rec := entry.rrs[0].(*dns.NSEC)
+		// the names below a delegation or DNAME aren't in this zone
+		if dns.IsSubDomain(owner, name) && owner != name &&
+			(hasBitmapType(rec.TypeBitMap, dns.TypeDNAME) ||
+				hasBitmapType(rec.TypeBitMap, dns.TypeNS) && !hasBitmapType(rec.TypeBitMap, dns.TypeSOA)) {
+			continue
+		}
+		if canonicalCompare(owner, name) >= 0 {
+			continue
+		}
+		next := rec.NextDomain
+		// the empty non-terminals exist, e.g. b.example between a.example and x.b.example
+		if dns.IsSubDomain(name, next) {
+			continue
+		}
+		// the last record of the zone points to the apex
+		if canonicalCompare(next, owner) <= 0 || canonicalCompare(name, next) < 0 {
+			return entry
+		}
+	}
+	return nil
+}
+
+// denyNSEC3 looks for the closest encloser proof (RFC 5155 section 8.4) or the NSEC3 record matching the name
+func (z *nsecZone) denyNSEC3(zoneName string, qname string, qtype uint16, now time.Time) (int, []*nsecEntry) {
+	var params *dns.NSEC3
+	for _, entry := range z.nsec3 {
+		params = entry.rrs[0].(*dns.NSEC3)
+		break
+	}
+	if params == nil {
+		return 0, nil
+	}
+	hash := func(name string) string {
+		return dns.HashName(name, params.Hash, params.Iterations, params.Salt)
+	}
+
+	if entry := z.matchingNSEC3(hash(qname), now); entry != nil {
+		rec := entry.rrs[0].(*dns.NSEC3)
+		if hasBitmapType(rec.TypeBitMap, qtype) || hasBitmapType(rec.TypeBitMap, dns.TypeCNAME) {
+			return 0, nil
+		}
+		return dns.RcodeSuccess, []*nsecEntry{entry}
+	}
+
+	// the closest encloser is the longest ancestor matching a record, its child on the path to the name is the next closer name
+	for name := qname; name != zoneName; {
+		next, end := dns.NextLabel(name, 0)
+		if end {
+			return 0, nil
+		}
+		encloser := name[next:]
+		if encloser == "" {
+			encloser = "."
+		}
+		if entry := z.matchingNSEC3(hash(encloser), now); entry != nil {
+			rec := entry.rrs[0].(*dns.NSEC3)
+			if hasBitmapType(rec.TypeBitMap, dns.TypeDNAME) ||
+				hasBitmapType(rec.TypeBitMap, dns.TypeNS) && !hasBitmapType(rec.TypeBitMap, dns.TypeSOA) {
+				return 0, nil
+			}
+			covering := z.coveringNSEC3(hash(name), now)
+			if covering == nil {
+				return 0, nil
+			}
+			// with the opt-out flag the unsigned delegations may exist in the covered range
+			if covering.rrs[0].(*dns.NSEC3).Flags&1 != 0 {
+				return 0, nil
+			}
+			wildcard := "*." + encloser
+			if encloser == "." {
+				wildcard = "*."
+			}
+			wildcardCovering := z.coveringNSEC3(hash(wildcard), now)
+			if wildcardCovering == nil {
+				return 0, nil
+			}
+			return dns.RcodeNameError, []*nsecEntry{entry, covering, wildcardCovering}
+		}
+		name = encloser
+	}
+	return 0, nil
+}
+
+func (z *nsecZone) matchingNSEC3(hash string, now time.Time) *nsecEntry {
+	entry := z.nsec3[hash]
+	if entry == nil || now.After(entry.expire) {
+		return nil
+	}
+	return entry
+}
+
+// coveringNSEC3 returns the NSEC3 record whose hash range contains the hash
+func (z *nsecZone) coveringNSEC3(hash string, now time.Time) *nsecEntry {
+	if hash == "" {
+		return nil
+	}
+	for owner, entry := range z.nsec3 {
+		if now.After(entry.expire) {
+			continue
+		}
+		next := strings.ToUpper(entry.rrs[0].(*dns.NSEC3).NextDomain)
+		if owner < next && owner < hash && hash < next {
+			return entry
+		}
+		// the last record of the zone wraps around
+		if owner >= next && (hash > owner || hash < next) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// signedRRs returns the record and its RRSIGs from the section
+func signedRRs(section []dns.RR, rr dns.RR) []dns.RR {
+	result := []dns.RR{rr}
+	for _, sig := range section {
+		if rec, ok := sig.(*dns.RRSIG); ok && rec.TypeCovered == rr.Header().Rrtype &&
+			strings.EqualFold(rec.Hdr.Name, rr.Header().Name) {
+			result = append(result, sig)
+		}
+	}
+	return result
+}
+
+// copyWithTTL returns the copies of the records with TTL set to the time left until they expire
+func copyWithTTL(rrs []dns.RR, expire time.Time, now time.Time) []dns.RR {
+	ttl := uint32(expire.Sub(now) / time.Second)
+	result := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		if rr.Header().Ttl > ttl {
+			rr.Header().Ttl = ttl
+		}
+		result = append(result, rr)
+	}
+	return result
+}
+
+func hasBitmapType(bitmap []uint16, t uint16) bool {
+	for _, v := range bitmap {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalCompare compares the names in the canonical DNS order (RFC 4034 section 6.1)
+func canonicalCompare(a string, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
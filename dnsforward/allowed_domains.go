@@ -0,0 +1,38 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// NormalizeAllowedQueryDomain validates the AllowedQueryDomains entry and returns it in the lowercase without the trailing dot
+func NormalizeAllowedQueryDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	name := strings.TrimPrefix(domain, "*.")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return "", fmt.Errorf("invalid domain: %s", domain)
+	}
+	return domain, nil
+}
+
+// isAllowedQueryDomain returns true if AllowedQueryDomains is empty or the queried name matches one of its entries
+// "example.org" matches only this name, "*.example.org" matches its subdomains
+func (s *Server) isAllowedQueryDomain(req *dns.Msg) bool {
+	if len(s.AllowedQueryDomains) == 0 || len(req.Question) == 0 {
+		return true
+	}
+
+	qname := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+	for _, domain := range s.AllowedQueryDomains {
+		if strings.HasPrefix(domain, "*.") {
+			if strings.HasSuffix(qname, domain[1:]) {
+				return true
+			}
+		} else if qname == domain {
+			return true
+		}
+	}
+	return false
+}
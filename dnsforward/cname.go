@@ -0,0 +1,91 @@
+package dnsforward
+
+import (
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/hmage/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// how many CNAME records are followed before giving up
+const maxCNAMEChain = 8
+
+// flattenCNAME replaces the CNAME chain in the response to A or AAAA query with the final records
+// if the upstream didn't resolve the chain to the end, the rest of it is resolved here
+// the final records get the queried name and the smallest TTL of the chain
+func (s *Server) flattenCNAME(p *proxy.Proxy, d *proxy.DNSContext) {
+	if d.Res == nil || d.Res.Rcode != dns.RcodeSuccess || len(d.Req.Question) != 1 {
+		return
+	}
+	q := d.Req.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return
+	}
+
+	answer := d.Res.Answer
+	target := q.Name
+	var ttl uint32
+	hasCNAME := false
+	var final []dns.RR
+	for i := 0; i <= maxCNAMEChain; i++ {
+		// follow the chain as far as the answer allows
+		for j := 0; j <= maxCNAMEChain; j++ {
+			next := ""
+			for _, rr := range answer {
+				if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, target) {
+					next = cname.Target
+					ttl = minTTL(ttl, hasCNAME, cname.Hdr.Ttl)
+					hasCNAME = true
+					break
+				}
+			}
+			if next == "" {
+				break
+			}
+			target = next
+		}
+
+		for _, rr := range answer {
+			if rr.Header().Rrtype == q.Qtype && strings.EqualFold(rr.Header().Name, target) {
+				final = append(final, rr)
+			}
+		}
+		if len(final) != 0 || !hasCNAME {
+			break
+		}
+
+		// the chain isn't resolved to the end, resolve its last name
+		req := &dns.Msg{}
+		req.SetQuestion(target, q.Qtype)
+		req.RecursionDesired = true
+		ctx := &proxy.DNSContext{Proto: d.Proto, Addr: d.Addr, Req: req, StartTime: d.StartTime}
+		err := s.resolve(p, ctx)
+		if err != nil || ctx.Res == nil || ctx.Res.Rcode != dns.RcodeSuccess {
+			log.Tracef("Couldn't resolve %s while flattening CNAME chain of %s: %s", target, q.Name, err)
+			return
+		}
+		answer = ctx.Res.Answer
+	}
+
+	if !hasCNAME || len(final) == 0 {
+		return
+	}
+
+	flattened := []dns.RR{}
+	for _, rr := range final {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		rr.Header().Ttl = minTTL(ttl, true, rr.Header().Ttl)
+		flattened = append(flattened, rr)
+	}
+	d.Res.Answer = flattened
+}
+
+// minTTL returns the smaller of the TTLs, if there's no current TTL yet, the new one is returned
+func minTTL(current uint32, hasCurrent bool, ttl uint32) uint32 {
+	if !hasCurrent || ttl < current {
+		return ttl
+	}
+	return current
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
@@ -21,11 +22,27 @@ import (
 // DefaultTimeout is the default upstream timeout
 const DefaultTimeout = 10 * time.Second
 
+// DefaultSinkholeTTL is the default TTL of the sinkhole records in seconds
+const DefaultSinkholeTTL = 60
+
+// ID of the filter with the user rules
+const userFilterID = 0
+
+// how long a request waits for a free DNS handler before it's dropped
+const handlerQueueTimeout = 100 * time.Millisecond
+
 const (
 	safeBrowsingBlockHost = "standard-block.dns.adguard.com"
 	parentalBlockHost     = "family-block.dns.adguard.com"
 )
 
+// Possible values of FilteringConfig.BlockedResponseCode
+const (
+	BlockedResponseNXDomain   = "nxdomain"    // respond with NXDOMAIN (default)
+	BlockedResponseRefused    = "refused"     // respond with REFUSED
+	BlockedResponseSinkholeIP = "sinkhole_ip" // respond with FilteringConfig.SinkholeIP
+)
+
 // Server is the main way to start a DNS server.
 //
 // Example:
@@ -43,6 +60,36 @@ type Server struct {
 	stats     *stats               // General server statistics
 	once      sync.Once
 
+	handlersSem     chan struct{} // limits the number of concurrent DNS handlers, nil if unlimited
+	handlersCurrent int64         // number of DNS handlers running right now, accessed atomically
+
+	zones      []*compiledZone // authoritative zones from ServerConfig.Zones
+	staleCache *upstreamCache  // responses served when they expire, nil if both ServeStale and PrefetchOnExpired are disabled
+	cache      *upstreamCache  // shared by all upstreams, it's used instead of the proxy cache so that it can be listed, nil if PerUpstreamCache is enabled
+	prefetcher *prefetcher     // nil if Prefetch is disabled
+	syslog     *querySyslog    // nil if QueryLogSyslog is disabled
+
+	forwardTrace *forwardTrace      // the last forwarded queries, it's kept when TraceForwarded is disabled
+	weighted     *weightedUpstreams // nil unless UpstreamPolicy is UpstreamPolicyLatencyWeighted
+	rateLimiter  *rateLimiter       // nil if Ratelimit is 0
+	trusted      *trustedClients    // nil if TrustedClients is empty
+	nsec         *nsecCache         // nil unless both AggressiveNSEC and EnableDNSSEC are enabled
+
+	// the last response times of each upstream, they're kept across the restarts
+	upstreamLatency *upstreamLatencies
+
+	// keys of the expired responses being refreshed by PrefetchOnExpired
+	revalidating struct {
+		keys map[string]bool
+		sync.Mutex
+	}
+
+	// addresses of the upstreams that returned signed responses without the AD bit
+	unvalidating struct {
+		upstreams map[string]bool
+		sync.Mutex
+	}
+
 	sync.RWMutex
 	ServerConfig
 }
@@ -59,14 +106,60 @@ func NewServer(baseDir string) *Server {
 // FilteringConfig represents the DNS filtering configuration of AdGuard Home
 // The zero FilteringConfig is empty and ready for use.
 type FilteringConfig struct {
-	ProtectionEnabled  bool     `yaml:"protection_enabled"`   // whether or not use any of dnsfilter features
-	FilteringEnabled   bool     `yaml:"filtering_enabled"`    // whether or not use filter lists
-	BlockedResponseTTL uint32   `yaml:"blocked_response_ttl"` // if 0, then default is used (3600)
-	QueryLogEnabled    bool     `yaml:"querylog_enabled"`
-	Ratelimit          int      `yaml:"ratelimit"`
-	RatelimitWhitelist []string `yaml:"ratelimit_whitelist"`
-	RefuseAny          bool     `yaml:"refuse_any"`
-	BootstrapDNS       string   `yaml:"bootstrap_dns"`
+	ProtectionEnabled   bool     `yaml:"protection_enabled"`    // whether or not use any of dnsfilter features
+	FilteringEnabled    bool     `yaml:"filtering_enabled"`     // whether or not use filter lists
+	AllowlistMode       bool     `yaml:"allowlist_mode"`        // block all hosts except the ones allowed by @@ rules of the user filter
+	BlockedResponseTTL  uint32   `yaml:"blocked_response_ttl"`  // if 0, then default is used (3600)
+	BlockedResponseCode string   `yaml:"blocked_response_code"` // one of the BlockedResponse* values, if empty then NXDOMAIN is used
+	SinkholeIP          string   `yaml:"sinkhole_ip"`           // IPv4 address used in responses to blocked queries if BlockedResponseCode is sinkhole_ip
+	SinkholeIPv6        string   `yaml:"sinkhole_ipv6"`         // IPv6 address used in responses to blocked AAAA queries if BlockedResponseCode is sinkhole_ip
+	SinkholeTTL         uint32   `yaml:"sinkhole_ttl"`          // TTL of the sinkhole records, if 0 then DefaultSinkholeTTL is used
+	QueryLogEnabled     bool     `yaml:"querylog_enabled"`
+	QueryLogFileEnabled bool     `yaml:"querylog_file_enabled"` // if false, the query log is kept only in memory
+	QueryLogMaxDays     int      `yaml:"querylog_max_days"`     // number of days the query log files are kept, if 0 then default is used
+	QueryLogMaxSizeMB   int      `yaml:"querylog_max_size_mb"`  // maximum total size of the query log files, if 0 then default is used
+	AnonymizationLevel  string   `yaml:"anonymization_level"`   // one of the Anonymization* values for the client addresses in the query log
+	AnonymizationKey    string   `yaml:"anonymization_key"`     // HMAC key of AnonymizationFull, random for each installation
+	Ratelimit           int      `yaml:"ratelimit"`
+	RatelimitWhitelist  []string `yaml:"ratelimit_whitelist"`
+	TrustedClients      []string `yaml:"trusted_clients"` // IPs and CIDRs that bypass the rate limit, AllowedQueryDomains, BlockedQueryTypes and AllowlistMode
+	RefuseAny           bool     `yaml:"refuse_any"`
+	BlockedQueryTypes   []string `yaml:"blocked_query_types"`       // queries of these types (e.g. "HINFO") are answered with REFUSED
+	AllowedQueryDomains []string `yaml:"allowed_query_domains"`     // if not empty, queries for the other domains are answered with REFUSED
+	EnableDNSSEC        bool     `yaml:"enable_dnssec"`             // set DNSSEC OK bit in the upstream requests
+	UseECSIPForBlocking bool     `yaml:"use_ecs_ip_for_blocking"`   // use the EDNS Client Subnet address as the client IP
+	MaxGoroutines       int      `yaml:"max_goroutines"`            // maximum number of concurrent DNS handlers, 0 means unlimited
+	PerUpstreamCache    bool     `yaml:"per_upstream_cache"`        // use a separate cache for each upstream instead of the shared one
+	UpstreamCacheSize   int      `yaml:"upstream_cache_size"`       // number of responses cached for each upstream, if 0 then default is used
+	ServeStale          bool     `yaml:"serve_stale"`               // respond with the expired cached responses if the upstreams are unreachable
+	ServeStaleMaxAge    uint32   `yaml:"serve_stale_max_staleness"` // how long after expiration the responses may be served in seconds, if 0 then default is used
+	Prefetch            bool     `yaml:"prefetch"`                  // refresh the popular responses before they expire
+	PrefetchThreshold   int      `yaml:"prefetch_threshold"`        // percentage of the original TTL left when the response is refreshed, if 0 then default is used
+	PrefetchOnExpired   bool     `yaml:"cache_prefetch_on_expired"` // serve the expired response and refresh it in the background (stale-while-revalidate)
+	UpstreamMaxRetries  int      `yaml:"upstream_max_retries"`      // number of additional attempts if all upstreams failed
+	UpstreamBackoff     int      `yaml:"upstream_retry_backoff_ms"` // delay before the first retry in milliseconds, it's doubled for each next retry
+	UpstreamPolicy      string   `yaml:"upstream_selector_policy"`  // one of the UpstreamPolicy* values, if empty then UpstreamPolicyFastest is used
+	TraceForwarded      bool     `yaml:"trace_forwarded_queries"`   // keep the last queries sent to the upstreams for /control/dns/forwarded_queries_log
+	ForwardUpstreamErrs bool     `yaml:"forward_upstream_errors"`   // pass SERVFAIL from the upstream to the client as is, including EDNS options
+	CNAMEFlattening     bool     `yaml:"cname_flattening"`          // respond to A and AAAA queries with the final records of the CNAME chain only
+	MinResponseTTL      uint32   `yaml:"min_response_ttl"`          // TTLs of the records sent to the clients are raised to this value, 0 means no minimum
+	PreferIPv6          bool     `yaml:"prefer_ipv6"`               // put AAAA records before A records in the answers
+	DisableIPv4         bool     `yaml:"disable_ipv4"`              // remove A records from the answers
+	DisableIPv6         bool     `yaml:"disable_ipv6"`              // respond to AAAA queries with an empty answer instead of forwarding them and remove AAAA records from the other answers
+	ExtendedErrors      bool     `yaml:"extended_errors"`           // add Extended DNS Errors (RFC 8914) to the responses to blocked queries and DNSSEC failures
+	QNAMEMinimisation   bool     `yaml:"qname_minimisation"`        // resolve the names iteratively from the root servers sending only the labels each of them needs (RFC 7816), must not be used with encrypted upstreams
+	AggressiveNSEC      bool     `yaml:"aggressive_nsec"`           // answer from the cached NSEC and NSEC3 records of the validated responses (RFC 8198), works only with EnableDNSSEC
+	NXDomainRedirect    bool     `yaml:"nxdomain_redirect"`         // respond to blocked A queries with NXDomainRedirectIP instead of NXDOMAIN
+	NXDomainRedirectIP  string   `yaml:"nxdomain_redirect_ip"`      // IPv4 address of the search page
+	PrivateDNS          bool     `yaml:"private_dns"`               // answer the queries for the local host names instead of forwarding them
+	LocalDomainSuffix   string   `yaml:"local_domain_suffix"`       // suffix of the local host names, if empty then DefaultLocalDomainSuffix is used
+	BootstrapDNS        string   `yaml:"bootstrap_dns"`
+	Zones               []Zone   `yaml:"zones"` // authoritative zones that are answered without consulting the upstreams
+
+	ResponseRewrites []ResponseRewrite `yaml:"response_rewrites"`  // addresses replaced in the answers before they're sent to the clients
+	DomainMaxTTLs    []DomainMaxTTL    `yaml:"max_ttl_per_domain"` // TTL limits for the responses to the queries for specific domains
+	QueryLogSyslog   QueryLogSyslog    `yaml:"querylog_syslog"`    // send the query log entries to syslog
+	ResponseFilters  []ResponseFilter  `yaml:"response_filters"`   // records removed from the upstream answers before they're cached
 
 	dnsfilter.Config `yaml:",inline"`
 }
@@ -86,6 +179,16 @@ type ServerConfig struct {
 	Upstreams     []upstream.Upstream // Configured upstreams
 	Filters       []dnsfilter.Filter  // A list of filters to use
 
+	// Called before filtering each request, it can override the filtering settings for the specific client
+	FilterHandler func(clientAddr string, settings *dnsfilter.Config)
+
+	// Returns the addresses of the local host (e.g. from the DHCP leases) if PrivateDNS is enabled
+	// host is the lowercase name without LocalDomainSuffix
+	LocalHostHandler func(host string) []net.IP
+
+	// Called when the request couldn't be resolved by any of the upstreams
+	UpstreamErrorHandler func(err error)
+
 	FilteringConfig
 	TLSConfig
 }
@@ -130,6 +233,13 @@ func (s *Server) startInternal(config *ServerConfig) error {
 	if s.queryLog == nil {
 		s.queryLog = newQueryLog(".")
 	}
+	s.queryLog.configure(queryLogConfig{
+		fileEnabled:      s.QueryLogFileEnabled,
+		maxDays:          s.QueryLogMaxDays,
+		maxSizeMB:        s.QueryLogMaxSizeMB,
+		anonymization:    s.AnonymizationLevel,
+		anonymizationKey: []byte(s.AnonymizationKey),
+	})
 
 	if s.stats == nil {
 		s.stats = newStats()
@@ -140,6 +250,35 @@ func (s *Server) startInternal(config *ServerConfig) error {
 		return err
 	}
 
+	s.zones, err = compileZones(s.Zones)
+	if err != nil {
+		return errorx.Decorate(err, "failed to load authoritative zones")
+	}
+
+	// keep the stale responses across restarts, they're served as long as the same upstreams are used
+	if !s.ServeStale && !s.PrefetchOnExpired {
+		s.staleCache = nil
+	} else if s.staleCache == nil {
+		s.staleCache = newUpstreamCache(staleCacheSize)
+	}
+	if !s.Prefetch {
+		s.prefetcher = nil
+	} else if s.prefetcher == nil {
+		s.prefetcher = newPrefetcher()
+	}
+
+	if s.QueryLogSyslog.Enabled {
+		s.syslog, err = newQuerySyslog(s.QueryLogSyslog)
+		if err != nil {
+			return errorx.Decorate(err, "failed to configure the query log syslog")
+		}
+	}
+
+	s.handlersSem = nil
+	if s.MaxGoroutines > 0 {
+		s.handlersSem = make(chan struct{}, s.MaxGoroutines)
+	}
+
 	log.Tracef("Loading stats from querylog")
 	err = s.queryLog.fillStatsFromQueryLog(s.stats)
 	if err != nil {
@@ -150,19 +289,32 @@ func (s *Server) startInternal(config *ServerConfig) error {
 	s.once.Do(func() {
 		log.Printf("Start DNS server periodic jobs")
 		go s.queryLog.periodicQueryLogRotate()
+		go s.queryLog.periodicQueryLogPrune()
 		go s.queryLog.runningTop.periodicHourlyTopRotate()
 		go s.stats.statsRotator()
 	})
 
 	proxyConfig := proxy.Config{
-		UDPListenAddr:      s.UDPListenAddr,
-		TCPListenAddr:      s.TCPListenAddr,
-		Ratelimit:          s.Ratelimit,
-		RatelimitWhitelist: s.RatelimitWhitelist,
-		RefuseAny:          s.RefuseAny,
-		CacheEnabled:       true,
-		Upstreams:          s.Upstreams,
-		Handler:            s.handleDNSRequest,
+		UDPListenAddr: s.UDPListenAddr,
+		TCPListenAddr: s.TCPListenAddr,
+		RefuseAny:     s.RefuseAny,
+		CacheEnabled:  false, // s.cache is used instead
+		Upstreams:     s.Upstreams,
+		Handler:       s.handleDNSRequest,
+	}
+
+	// the rate limit is checked in handleDNSRequest, so that the queries are refused and counted instead of being dropped
+	s.rateLimiter = nil
+	if s.Ratelimit > 0 {
+		s.rateLimiter = newRateLimiter(s.Ratelimit, s.RatelimitWhitelist)
+	}
+	s.trusted = nil
+	if len(s.TrustedClients) != 0 {
+		s.trusted = newTrustedClients(s.TrustedClients)
+	}
+	s.nsec = nil
+	if s.AggressiveNSEC && s.EnableDNSSEC {
+		s.nsec = newNSECCache()
 	}
 
 	if s.TLSListenAddr != nil && s.CertificateChain != "" && s.PrivateKey != "" {
@@ -186,6 +338,66 @@ func (s *Server) startInternal(config *ServerConfig) error {
 		proxyConfig.Upstreams = defaultValues.Upstreams
 	}
 
+	if s.QNAMEMinimisation {
+		// the upstreams are only used to look up the name servers without glue
+		proxyConfig.Upstreams = []upstream.Upstream{newMinimisingResolver(proxyConfig.Upstreams)}
+	}
+
+	if s.upstreamLatency == nil {
+		s.upstreamLatency = newUpstreamLatencies()
+	}
+	s.upstreamLatency.retain(proxyConfig.Upstreams)
+	measured := make([]upstream.Upstream, 0, len(proxyConfig.Upstreams))
+	for _, u := range proxyConfig.Upstreams {
+		measured = append(measured, &measuredUpstream{Upstream: u, latency: s.upstreamLatency.get(u.Address())})
+	}
+	proxyConfig.Upstreams = measured
+
+	if s.TraceForwarded {
+		if s.forwardTrace == nil {
+			s.forwardTrace = &forwardTrace{}
+		}
+		upstreams := make([]upstream.Upstream, 0, len(proxyConfig.Upstreams))
+		for _, u := range proxyConfig.Upstreams {
+			upstreams = append(upstreams, &tracingUpstream{Upstream: u, trace: s.forwardTrace})
+		}
+		proxyConfig.Upstreams = upstreams
+	}
+
+	if len(s.ResponseFilters) != 0 {
+		filters := make([]ResponseFilter, len(s.ResponseFilters))
+		copy(filters, s.ResponseFilters)
+		upstreams := make([]upstream.Upstream, 0, len(proxyConfig.Upstreams))
+		for _, u := range proxyConfig.Upstreams {
+			upstreams = append(upstreams, &filteredUpstream{Upstream: u, filters: filters})
+		}
+		proxyConfig.Upstreams = upstreams
+	}
+
+	if s.PerUpstreamCache {
+		size := s.UpstreamCacheSize
+		if size == 0 {
+			size = DefaultUpstreamCacheSize
+		}
+		upstreams := make([]upstream.Upstream, 0, len(proxyConfig.Upstreams))
+		for _, u := range proxyConfig.Upstreams {
+			upstreams = append(upstreams, newCachedUpstream(u, size))
+		}
+		proxyConfig.Upstreams = upstreams
+		s.cache = nil
+	} else {
+		s.cache = newUpstreamCache(sharedCacheSize)
+	}
+
+	s.weighted = nil
+	switch s.UpstreamPolicy {
+	case UpstreamPolicyParallel:
+		proxyConfig.AllServers = true
+	case UpstreamPolicyLatencyWeighted:
+		s.weighted = newWeightedUpstreams(proxyConfig.Upstreams)
+		proxyConfig.Upstreams = []upstream.Upstream{s.weighted}
+	}
+
 	// Initialize and start the DNS proxy
 	s.dnsProxy = &proxy.Proxy{Config: proxyConfig}
 	return s.dnsProxy.Start()
@@ -227,6 +439,11 @@ func (s *Server) stopInternal() error {
 		s.dnsFilter = nil
 	}
 
+	if s.syslog != nil {
+		s.syslog.close()
+		s.syslog = nil
+	}
+
 	// flush remainder to file
 	return s.queryLog.flushLogBuffer()
 }
@@ -281,6 +498,48 @@ func (s *Server) GetStatsTop() *StatsTop {
 	return s.queryLog.runningTop.getStatsTop()
 }
 
+// GetTopBlockedRules returns the rules that blocked queries in the recent query log, sorted by hits descending
+func (s *Server) GetTopBlockedRules() []RuleHits {
+	s.RLock()
+	defer s.RUnlock()
+	return s.queryLog.getTopBlockedRules()
+}
+
+// GetAnomalies scans the query log for the last 24 hours and returns unusual DNS patterns
+func (s *Server) GetAnomalies() ([]Anomaly, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.queryLog.getAnomalies()
+}
+
+// CheckHost checks the host with the filtering settings of the specified client
+func (s *Server) CheckHost(host string, clientIP string) (dnsfilter.Result, error) {
+	s.RLock()
+	dnsFilter := s.dnsFilter
+	filterHandler := s.FilterHandler
+	s.RUnlock()
+	if dnsFilter == nil {
+		return dnsfilter.Result{}, errors.New("DNS server is not running")
+	}
+
+	setts := dnsFilter.Config
+	if filterHandler != nil {
+		filterHandler(clientIP, &setts)
+	}
+	return dnsFilter.CheckHostWithConfig(host, &setts)
+}
+
+// GetFilterParseErrors returns the rules of the filter that couldn't be parsed, nil if the server isn't running
+func (s *Server) GetFilterParseErrors(filterID int64) []dnsfilter.RuleParseError {
+	s.RLock()
+	dnsFilter := s.dnsFilter
+	s.RUnlock()
+	if dnsFilter == nil {
+		return nil
+	}
+	return dnsFilter.ParseErrors(filterID)
+}
+
 // PurgeStats purges current server stats
 func (s *Server) PurgeStats() {
 	s.Lock()
@@ -288,11 +547,53 @@ func (s *Server) PurgeStats() {
 	s.stats.purgeStats()
 }
 
+// PurgeClientStats removes the client's contribution from the stats and the top clients
+// it returns false if there were no stats for the client
+func (s *Server) PurgeClientStats(ip string) bool {
+	s.Lock()
+	defer s.Unlock()
+	s.queryLog.runningTop.removeClient(ip)
+	return s.stats.removeClient(ip)
+}
+
+// PurgeClientQueryLog removes the client's entries from the query log, it returns the number of removed entries
+func (s *Server) PurgeClientQueryLog(ip string) (int, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.queryLog.removeClient(ip)
+}
+
 // GetAggregatedStats returns aggregated stats data for the 24 hours
 func (s *Server) GetAggregatedStats() map[string]interface{} {
 	s.RLock()
 	defer s.RUnlock()
-	return s.stats.getAggregatedStats()
+	summed := s.stats.getAggregatedStats()
+	summed["dns_goroutines_current"] = atomic.LoadInt64(&s.handlersCurrent)
+	return summed
+}
+
+// GetQueryTypeStats returns the number of queries of each DNS record type for the 24 hours
+func (s *Server) GetQueryTypeStats() map[string]int64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.stats.getAggregatedByPrefix(statsQueryTypePrefix)
+}
+
+// GetResponseCodeStats returns the number of responses with each DNS response code for the 24 hours
+func (s *Server) GetResponseCodeStats() map[string]int64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.stats.getAggregatedByPrefix(statsResponseCodePrefix)
+}
+
+// GetUniqueClientsCount returns the approximate number of distinct clients in the last hours, up to 7 days
+func (s *Server) GetUniqueClientsCount(hours int) int64 {
+	s.RLock()
+	defer s.RUnlock()
+	s.stats.clientsLock.Lock()
+	unique := s.stats.uniqueClients
+	s.stats.clientsLock.Unlock()
+	return unique.count(hours)
 }
 
 // GetStatsHistory gets stats history aggregated by the specified time unit
@@ -306,24 +607,240 @@ func (s *Server) GetStatsHistory(timeUnit time.Duration, startTime time.Time, en
 	return s.stats.getStatsHistory(timeUnit, startTime, endTime)
 }
 
+// Resolve sends the request to the upstream servers bypassing the filtering
+// the response is saved in the cache, so it can be used to prefetch popular domains
+func (s *Server) Resolve(req *dns.Msg) (*dns.Msg, error) {
+	s.RLock()
+	p := s.dnsProxy
+	s.RUnlock()
+	if p == nil {
+		return nil, errors.New("DNS server is not running")
+	}
+
+	d := &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       req,
+		StartTime: time.Now(),
+	}
+	err := s.resolve(p, d)
+	if err != nil {
+		return nil, err
+	}
+	return d.Res, nil
+}
+
+// resolve resolves the request with the proxy, the response is taken from the shared cache if there is one
+func (s *Server) resolve(p *proxy.Proxy, d *proxy.DNSContext) error {
+	s.RLock()
+	cache := s.cache
+	s.RUnlock()
+	if cache != nil {
+		if res := cache.get(d.Req); res != nil {
+			log.Tracef("Serving cached response")
+			d.Res = res
+			return nil
+		}
+	}
+
+	err := p.Resolve(d)
+	if err == nil && cache != nil && d.Res != nil {
+		cache.set(d.Req, d.Res)
+	}
+	return err
+}
+
+// HandleRequest processes the request received by another listener (e.g. DNSCrypt) the same way as the requests to our own listeners
+// it's filtered, written to the query log and counted in the stats
+func (s *Server) HandleRequest(req *dns.Msg, addr net.Addr) (*dns.Msg, error) {
+	s.RLock()
+	p := s.dnsProxy
+	s.RUnlock()
+	if p == nil {
+		return nil, errors.New("DNS server is not running")
+	}
+
+	d := &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       req,
+		Addr:      addr,
+		StartTime: time.Now(),
+	}
+	err := s.handleDNSRequest(p, d)
+	if err != nil {
+		return nil, err
+	}
+	return d.Res, nil
+}
+
+// acquireHandler waits for a free DNS handler slot, returns false if it couldn't get one in time
+func (s *Server) acquireHandler(sem chan struct{}) bool {
+	if sem == nil {
+		return true
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(handlerQueueTimeout)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
 // handleDNSRequest filters the incoming DNS requests and writes them to the query log
 func (s *Server) handleDNSRequest(p *proxy.Proxy, d *proxy.DNSContext) error {
 	start := time.Now()
 
-	// use dnsfilter before cache -- changed settings or filters would require cache invalidation otherwise
-	res, err := s.filterDNSRequest(d)
-	if err != nil {
-		return err
+	s.RLock()
+	sem := s.handlersSem
+	limiter := s.rateLimiter
+	trusted := s.trusted.contains(getIPString(d.Addr))
+	nsec := s.nsec
+	s.RUnlock()
+	if limiter != nil && !trusted && !limiter.allow(getIPString(d.Addr), start) {
+		log.Tracef("Refusing request from %s, it exceeds the rate limit", d.Addr)
+		s.stats.incWithTime(s.stats.rateLimited, start)
+		d.Res = s.genRefused(d.Req)
+		return nil
+	}
+	if !s.acquireHandler(sem) {
+		log.Tracef("Too many concurrent DNS requests, dropping request from %s", d.Addr)
+		s.stats.incWithTime(s.stats.droppedRequests, start)
+		d.Res = s.genServerFailure(d.Req)
+		return nil
 	}
+	atomic.AddInt64(&s.handlersCurrent, 1)
+	defer func() {
+		atomic.AddInt64(&s.handlersCurrent, -1)
+		if sem != nil {
+			<-sem
+		}
+	}()
 
-	if d.Res == nil {
-		// request was not filtered so let it be processed further
-		err = p.Resolve(d)
+	var res *dnsfilter.Result
+	var err error
+	switch {
+	case !trusted && !s.isAllowedQueryDomain(d.Req):
+		log.Tracef("Refusing query for %s, it's not in the allowed query domains", d.Req.Question[0].Name)
+		d.Res = s.genRefused(d.Req)
+	case !trusted && s.isBlockedQueryType(d.Req):
+		log.Tracef("Refusing %s query for %s", dns.TypeToString[d.Req.Question[0].Qtype], d.Req.Question[0].Name)
+		d.Res = s.genRefused(d.Req)
+	default:
+		// use dnsfilter before cache -- changed settings or filters would require cache invalidation otherwise
+		res, err = s.filterDNSRequest(d, trusted)
 		if err != nil {
 			return err
 		}
 	}
 
+	// the safe search AAAA rewrites are answered the same way, so that the clients use the A rewrites
+	if s.DisableIPv6 && d.Req.Question[0].Qtype == dns.TypeAAAA &&
+		(d.Res == nil || res != nil && res.Reason == dnsfilter.FilteredSafeSearch) {
+		d.Res = s.genEmptyAnswer(d.Req)
+	}
+
+	if d.Res == nil {
+		d.Res = s.answerFromZones(d.Req)
+	}
+
+	if d.Res == nil {
+		d.Res = s.answerLocal(d.Req)
+	}
+
+	if d.Res == nil {
+		// request was not filtered and doesn't belong to our zones so let it be processed further
+		origReq := d.Req
+		var dnssec dnssecState
+		if s.EnableDNSSEC {
+			// the upstreams get the copy with DO bit, the client's request is answered and logged as it is
+			d.Req = d.Req.Copy()
+			dnssec = enableDNSSEC(d.Req)
+		}
+
+		if nsec != nil {
+			d.Res = nsec.synthesise(d.Req, start)
+			if d.Res != nil {
+				log.Tracef("Synthesised %s response for %s from the cached NSEC records", dns.RcodeToString[d.Res.Rcode], d.Req.Question[0].Name)
+				s.stats.incWithTime(s.stats.nsecSynthesised, start)
+			}
+		}
+
+		if d.Res == nil && !s.serveCachedAndRevalidate(p, d) {
+			err = s.resolveWithRetries(p, d)
+			if err != nil {
+				if s.UpstreamErrorHandler != nil {
+					s.UpstreamErrorHandler(err)
+				}
+				if s.QueryLogEnabled {
+					s.queryLog.runningTop.addUpstreamErrors(upstreamAddresses(p.Upstreams))
+				}
+				if !s.serveStale(p, d) {
+					d.Req = origReq
+					return err
+				}
+			} else {
+				s.saveStale(p, d)
+				s.checkPrefetch(p, d)
+				if nsec != nil {
+					nsec.add(d.Res, time.Now())
+				}
+			}
+		}
+
+		bogus := false
+		if s.EnableDNSSEC {
+			bogus = s.checkDNSSECFailure(d)
+			s.checkAuthenticatedData(d)
+		}
+
+		upstreamError := d.Upstream != nil && d.Res != nil && d.Res.Rcode == dns.RcodeServerFailure
+		if upstreamError && !s.ForwardUpstreamErrs {
+			// replace it with our own response so that the upstream EDNS options don't get to the client
+			d.Res = s.genServerFailure(d.Req)
+			// the OPT record of the request may be added by enableDNSSEC
+			if bogus && s.ExtendedErrors && dnssec.hadOPT {
+				addExtendedError(d.Req, d.Res, edeDNSSECBogus)
+			}
+		} else if s.EnableDNSSEC && !upstreamError {
+			dnssec.restore(d)
+		}
+
+		// the response may be the one stored in the proxy cache, so it's changed below as a copy only
+		if d.Res != nil {
+			d.Res = d.Res.Copy()
+		}
+
+		if s.CNAMEFlattening && !upstreamError {
+			s.flattenCNAME(p, d)
+		}
+		d.Req = origReq
+	}
+
+	if len(s.ResponseRewrites) != 0 && d.Res != nil {
+		s.applyResponseRewrites(d.Res)
+	}
+
+	if (s.PreferIPv6 || s.DisableIPv4 || s.DisableIPv6) && d.Res != nil {
+		s.applyIPVersion(d.Res)
+	}
+
+	if s.MinResponseTTL != 0 && d.Res != nil {
+		applyMinTTL(d.Res, s.MinResponseTTL)
+	}
+
+	// the per-domain limits go last so that they win over the global minimum
+	if len(s.DomainMaxTTLs) != 0 && d.Res != nil {
+		s.applyDomainMaxTTL(d.Res)
+	}
+
 	shouldLog := true
 	msg := d.Req
 
@@ -338,39 +855,130 @@ func (s *Server) handleDNSRequest(p *proxy.Proxy, d *proxy.DNSContext) error {
 		if d.Upstream != nil {
 			upstreamAddr = d.Upstream.Address()
 		}
-		entry := s.queryLog.logRequest(msg, d.Res, res, elapsed, d.Addr, upstreamAddr)
+		entry := s.queryLog.logRequest(msg, d.Res, res, elapsed, s.clientIP(d), upstreamAddr)
 		if entry != nil {
 			s.stats.incrementCounters(entry)
+
+			s.RLock()
+			syslog := s.syslog
+			s.RUnlock()
+			if syslog != nil {
+				syslog.send(entry, msg, d.Res)
+			}
 		}
 	}
 
 	return nil
 }
 
+// resolveWithRetries resolves the request, if it fails, it's repeated up to UpstreamMaxRetries times with exponential backoff
+// the response refreshed by the prefetching is used if there is one
+func (s *Server) resolveWithRetries(p *proxy.Proxy, d *proxy.DNSContext) error {
+	if res := s.getPrefetched(d.Req); res != nil {
+		d.Res = res
+		return nil
+	}
+
+	backoff := time.Duration(s.UpstreamBackoff) * time.Millisecond
+	err := s.resolve(p, d)
+	for i := 0; err != nil && i < s.UpstreamMaxRetries; i++ {
+		log.Tracef("Retrying the request after %v: %s", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+
+		s.stats.incWithTime(s.stats.upstreamRetries, time.Now())
+		err = s.resolve(p, d)
+	}
+
+	// the query log shows the upstream that actually responded
+	if w, ok := d.Upstream.(*weightedUpstreams); ok {
+		d.Upstream = w.takeAnswered(d.Req)
+	}
+	return err
+}
+
+// upstreamAddresses returns the addresses of the upstreams, the latency-weighted set is expanded to its members
+func upstreamAddresses(upstreams []upstream.Upstream) []string {
+	res := []string{}
+	for _, u := range upstreams {
+		if w, ok := u.(*weightedUpstreams); ok {
+			res = append(res, upstreamAddresses(w.upstreams)...)
+			continue
+		}
+		res = append(res, u.Address())
+	}
+	return res
+}
+
+// isBlockedQueryType returns true if the type of the query is in BlockedQueryTypes
+func (s *Server) isBlockedQueryType(req *dns.Msg) bool {
+	if len(req.Question) == 0 {
+		return false
+	}
+	qtype := dns.TypeToString[req.Question[0].Qtype]
+	for _, t := range s.BlockedQueryTypes {
+		if strings.EqualFold(t, qtype) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client that is used for per-client settings and the query log
+// if UseECSIPForBlocking is enabled and the request has EDNS Client Subnet option, its address is used
+func (s *Server) clientIP(d *proxy.DNSContext) string {
+	if s.UseECSIPForBlocking {
+		if opt := d.Req.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if ecs, ok := o.(*dns.EDNS0_SUBNET); ok && ecs.Address != nil && !ecs.Address.IsUnspecified() {
+					return ecs.Address.String()
+				}
+			}
+		}
+	}
+	return getIPString(d.Addr)
+}
+
 // filterDNSRequest applies the dnsFilter and sets d.Res if the request was filtered
-func (s *Server) filterDNSRequest(d *proxy.DNSContext) (*dnsfilter.Result, error) {
+// AllowlistMode isn't applied to the trusted clients
+func (s *Server) filterDNSRequest(d *proxy.DNSContext, trusted bool) (*dnsfilter.Result, error) {
 	msg := d.Req
 	host := strings.TrimSuffix(msg.Question[0].Name, ".")
 
 	s.RLock()
 	protectionEnabled := s.ProtectionEnabled
 	dnsFilter := s.dnsFilter
+	filterHandler := s.FilterHandler
 	s.RUnlock()
 
 	if !protectionEnabled {
 		return nil, nil
 	}
 
+	setts := dnsFilter.Config
+	if filterHandler != nil {
+		filterHandler(s.clientIP(d), &setts)
+	}
+
 	var res dnsfilter.Result
 	var err error
 
-	res, err = dnsFilter.CheckHost(host)
+	res, err = dnsFilter.CheckHostWithConfig(host, &setts)
 	if err != nil {
 		// Return immediately if there's an error
 		return nil, errorx.Decorate(err, "dnsfilter failed to check host '%s'", host)
-	} else if res.IsFiltered {
+	}
+
+	if s.AllowlistMode && !trusted && !res.IsFiltered && !(res.Reason == dnsfilter.NotFilteredWhiteList && res.FilterID == userFilterID) {
+		res = dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList}
+	}
+
+	if res.IsFiltered {
 		// log.Tracef("Host %s is filtered, reason - '%s', matched rule: '%s'", host, res.Reason, res.Rule)
 		d.Res = s.genDNSFilterMessage(d, &res)
+		if s.ExtendedErrors {
+			addExtendedError(msg, d.Res, edeCodeForReason(res.Reason))
+		}
 	}
 
 	return &res, err
@@ -381,7 +989,7 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 	m := d.Req
 
 	if m.Question[0].Qtype != dns.TypeA {
-		return s.genNXDomain(m)
+		return s.genBlockedResponse(m)
 	}
 
 	switch result.Reason {
@@ -394,10 +1002,64 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 			return s.genARecord(m, result.IP)
 		}
 
-		return s.genNXDomain(m)
+		return s.genBlockedResponse(m)
 	}
 }
 
+// genBlockedResponse generates a response to a blocked query according to the configured BlockedResponseCode
+func (s *Server) genBlockedResponse(request *dns.Msg) *dns.Msg {
+	switch s.BlockedResponseCode {
+	case BlockedResponseRefused:
+		return s.genRefused(request)
+	case BlockedResponseSinkholeIP:
+		qtype := request.Question[0].Qtype
+		if qtype == dns.TypeA || qtype == dns.TypeAAAA {
+			return s.genSinkhole(request)
+		}
+	default:
+		// only our own NXDOMAIN is redirected, upstream NXDOMAIN responses are passed as is
+		if s.NXDomainRedirect && request.Question[0].Qtype == dns.TypeA {
+			ip := net.ParseIP(s.NXDomainRedirectIP)
+			if ip != nil && ip.To4() != nil {
+				return s.genARecord(request, ip)
+			}
+		}
+	}
+	return s.genNXDomain(request)
+}
+
+// genSinkhole responds to A and AAAA queries with the configured sinkhole IPs
+// if there is no sinkhole IP of the query's family, the unspecified address of that family is used
+func (s *Server) genSinkhole(request *dns.Msg) *dns.Msg {
+	var resp *dns.Msg
+	if request.Question[0].Qtype == dns.TypeAAAA {
+		ip := net.ParseIP(s.SinkholeIPv6)
+		if ip == nil {
+			// SinkholeIP may be IPv6 in the configs written before SinkholeIPv6 was added
+			ip = net.ParseIP(s.SinkholeIP)
+		}
+		if ip == nil || ip.To4() != nil {
+			ip = net.IPv6unspecified
+		}
+		resp = s.genAAAARecord(request, ip)
+	} else {
+		ip := net.ParseIP(s.SinkholeIP)
+		if ip == nil || ip.To4() == nil {
+			ip = net.IPv4zero
+		}
+		resp = s.genARecord(request, ip)
+	}
+
+	ttl := s.SinkholeTTL
+	if ttl == 0 {
+		ttl = DefaultSinkholeTTL
+	}
+	for _, rr := range resp.Answer {
+		rr.Header().Ttl = ttl
+	}
+	return resp
+}
+
 func (s *Server) genServerFailure(request *dns.Msg) *dns.Msg {
 	resp := dns.Msg{}
 	resp.SetRcode(request, dns.RcodeServerFailure)
@@ -405,6 +1067,60 @@ func (s *Server) genServerFailure(request *dns.Msg) *dns.Msg {
 	return &resp
 }
 
+// applyMinTTL raises TTLs of all records in the response to at least ttl
+func applyMinTTL(resp *dns.Msg, ttl uint32) {
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype != dns.TypeOPT && hdr.Ttl < ttl {
+				hdr.Ttl = ttl
+			}
+		}
+	}
+}
+
+// applyIPVersion removes the records of the disabled address families from the answer
+// if IPv6 is preferred, AAAA records are moved before A records, the other records keep their places
+func (s *Server) applyIPVersion(resp *dns.Msg) {
+	answer := []dns.RR{}
+	positions := []int{}
+	ipv4 := []dns.RR{}
+	ipv6 := []dns.RR{}
+	for _, rr := range resp.Answer {
+		switch rr.Header().Rrtype {
+		case dns.TypeA:
+			if s.DisableIPv4 {
+				continue
+			}
+			ipv4 = append(ipv4, rr)
+		case dns.TypeAAAA:
+			if s.DisableIPv6 {
+				continue
+			}
+			ipv6 = append(ipv6, rr)
+		default:
+			answer = append(answer, rr)
+			continue
+		}
+		positions = append(positions, len(answer))
+		answer = append(answer, rr)
+	}
+
+	if s.PreferIPv6 && len(ipv4) != 0 && len(ipv6) != 0 {
+		for i, rr := range append(ipv6, ipv4...) {
+			answer[positions[i]] = rr
+		}
+	}
+	resp.Answer = answer
+}
+
+func (s *Server) genRefused(request *dns.Msg) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetRcode(request, dns.RcodeRefused)
+	resp.RecursionAvailable = true
+	return &resp
+}
+
 func (s *Server) genARecord(request *dns.Msg, ip net.IP) *dns.Msg {
 	resp := dns.Msg{}
 	resp.SetReply(request)
@@ -417,6 +1133,18 @@ func (s *Server) genARecord(request *dns.Msg, ip net.IP) *dns.Msg {
 	return &resp
 }
 
+func (s *Server) genAAAARecord(request *dns.Msg, ip net.IP) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetReply(request)
+	answer, err := dns.NewRR(fmt.Sprintf("%s %d AAAA %s", request.Question[0].Name, s.BlockedResponseTTL, ip.String()))
+	if err != nil {
+		log.Printf("Couldn't generate AAAA record for replacement host '%s': %s", ip.String(), err)
+		return s.genServerFailure(request)
+	}
+	resp.Answer = append(resp.Answer, answer)
+	return &resp
+}
+
 func (s *Server) genBlockedHost(request *dns.Msg, newAddr string, d *proxy.DNSContext) *dns.Msg {
 	// look up the hostname, TODO: cache
 	replReq := dns.Msg{}
@@ -430,7 +1158,7 @@ func (s *Server) genBlockedHost(request *dns.Msg, newAddr string, d *proxy.DNSCo
 		Req:       &replReq,
 	}
 
-	err := s.dnsProxy.Resolve(newContext)
+	err := s.resolve(s.dnsProxy, newContext)
 	if err != nil {
 		log.Printf("Couldn't look up replacement host '%s': %s", newAddr, err)
 		return s.genServerFailure(request)
@@ -457,6 +1185,15 @@ func (s *Server) genNXDomain(request *dns.Msg) *dns.Msg {
 	return &resp
 }
 
+// genEmptyAnswer generates NOERROR response without the answers (NODATA)
+func (s *Server) genEmptyAnswer(request *dns.Msg) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetReply(request)
+	resp.RecursionAvailable = true
+	resp.Ns = s.genSOA(request)
+	return &resp
+}
+
 func (s *Server) genSOA(request *dns.Msg) []dns.RR {
 	zone := ""
 	if len(request.Question) > 0 {
@@ -8,14 +8,17 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"math/big"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
 
 	"github.com/stretchr/testify/assert"
 
@@ -564,6 +567,738 @@ func assertResponse(t *testing.T, reply *dns.Msg, ip string) {
 	}
 }
 
+// startFakeNameServer serves the root, org. and example.org. zones on one address and records the questions
+// the referrals have glue pointing back to the same server, so the resolver is redirected by rootServers and nameServerPort
+// the returned function stops the server and restores the root servers
+func startFakeNameServer(t *testing.T) (func(), *[]dns.Question, *sync.Mutex) {
+	questions := []dns.Question{}
+	mu := &sync.Mutex{}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	referral := func(resp *dns.Msg, zone string) {
+		ns := "ns." + zone
+		resp.Ns = append(resp.Ns, &dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: ns})
+		resp.Extra = append(resp.Extra, &dns.A{Hdr: dns.RR_Header{Name: ns, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.IP{127, 0, 0, 1}})
+	}
+	srv := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		mu.Lock()
+		questions = append(questions, q)
+		mu.Unlock()
+
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		switch {
+		case q.Name == "org." || q.Name == "example.org.":
+			referral(resp, q.Name)
+		case dns.IsSubDomain("example.org.", q.Name) && q.Qtype == dns.TypeA:
+			resp.Authoritative = true
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IP{192, 0, 2, 1}})
+		default:
+			resp.SetRcode(req, dns.RcodeNameError)
+		}
+		_ = w.WriteMsg(resp)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+
+	oldRootServers, oldPort := rootServers, nameServerPort
+	rootServers = []string{conn.LocalAddr().String()}
+	_, nameServerPort, _ = net.SplitHostPort(conn.LocalAddr().String())
+	stop := func() {
+		_ = srv.Shutdown()
+		rootServers, nameServerPort = oldRootServers, oldPort
+	}
+	return stop, &questions, mu
+}
+
+func TestQNAMEMinimisation(t *testing.T) {
+	stop, questions, mu := startFakeNameServer(t)
+	defer stop()
+	r := newMinimisingResolver(nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	resp, err := r.Exchange(req)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %s", err)
+	}
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, req.Id, resp.Id)
+	assert.Len(t, resp.Answer, 1)
+
+	mu.Lock()
+	// each level must see only the labels it needs to refer to the next zone
+	expected := []dns.Question{
+		{Name: "org.", Qtype: dns.TypeNS, Qclass: dns.ClassINET},
+		{Name: "example.org.", Qtype: dns.TypeNS, Qclass: dns.ClassINET},
+		{Name: "www.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	}
+	assert.Equal(t, expected, *questions)
+	*questions = nil
+	mu.Unlock()
+
+	// the delegation of example.org. is cached, the next name is sent straight to its servers
+	req = new(dns.Msg)
+	req.SetQuestion("mail.example.org.", dns.TypeA)
+	_, err = r.Exchange(req)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %s", err)
+	}
+	mu.Lock()
+	assert.Equal(t, []dns.Question{{Name: "mail.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}, *questions)
+	*questions = nil
+	mu.Unlock()
+
+	// the cached delegation expires with the TTL of the NS records
+	zone, _ := r.closestDelegation([]string{"mail", "example", "org"}, time.Now().Add(2*time.Hour))
+	assert.Equal(t, ".", zone)
+
+	// the root server must see only the top-level domain of a name that doesn't exist
+	req = new(dns.Msg)
+	req.SetQuestion("www.example.net.", dns.TypeA)
+	resp, err = r.Exchange(req)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %s", err)
+	}
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	mu.Lock()
+	assert.Equal(t, []dns.Question{{Name: "net.", Qtype: dns.TypeNS, Qclass: dns.ClassINET}}, *questions)
+	mu.Unlock()
+}
+
+func TestIsEncryptedUpstream(t *testing.T) {
+	for _, tc := range []struct {
+		upstream  string
+		encrypted bool
+	}{
+		{"8.8.8.8", false},
+		{"8.8.8.8:53", false},
+		{"tcp://8.8.8.8", false},
+		{"tls://1.1.1.1", true},
+		{"TLS://1.1.1.1", true},
+		{"https://dns.example.org/dns-query", true},
+		{"quic://dns.example.org", true},
+		{"sdns://AQIAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQz", true},
+	} {
+		assert.Equal(t, tc.encrypted, IsEncryptedUpstream(tc.upstream), tc.upstream)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Unix(1000000, 0)
+	l := newRateLimiter(3, []string{"192.0.2.9"})
+	for _, tc := range []struct {
+		name    string
+		ip      string
+		elapsed time.Duration // since start
+		allowed bool
+	}{
+		{"burst 1", "192.0.2.1", 0, true},
+		{"burst 2", "192.0.2.1", 0, true},
+		{"burst 3", "192.0.2.1", 0, true},
+		{"over the rate", "192.0.2.1", 0, false},
+		{"other client", "192.0.2.2", 0, true},
+		{"not refilled yet", "192.0.2.1", 300 * time.Millisecond, false},
+		{"one token refilled", "192.0.2.1", 400 * time.Millisecond, true},
+		{"refilled token taken", "192.0.2.1", 400 * time.Millisecond, false},
+		{"whitelist 1", "192.0.2.9", 0, true},
+		{"whitelist 2", "192.0.2.9", 0, true},
+		{"whitelist 3", "192.0.2.9", 0, true},
+		{"whitelist 4", "192.0.2.9", 0, true},
+		{"full after a second", "192.0.2.1", 1400 * time.Millisecond, true},
+		{"full bucket holds only the rate", "192.0.2.1", 1400 * time.Millisecond, true},
+		{"full bucket holds only the rate 2", "192.0.2.1", 1400 * time.Millisecond, true},
+		{"full bucket holds only the rate 3", "192.0.2.1", 1400 * time.Millisecond, false},
+	} {
+		assert.Equal(t, tc.allowed, l.allow(tc.ip, start.Add(tc.elapsed)), tc.name)
+	}
+	_, ok := l.buckets["192.0.2.9"]
+	assert.False(t, ok, "whitelisted clients must not have buckets")
+
+	// 192.0.2.2 is full again after a second, 192.0.2.1 isn't
+	l.purge(start.Add(1500 * time.Millisecond))
+	_, ok = l.buckets["192.0.2.1"]
+	assert.True(t, ok, "the bucket that isn't full must be kept")
+	_, ok = l.buckets["192.0.2.2"]
+	assert.False(t, ok, "the full bucket must be removed")
+
+	// purge runs by itself once a minute
+	l.allow("192.0.2.3", start.Add(2*time.Minute))
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestRateLimitedRequest(t *testing.T) {
+	s := createTestServer(t)
+	defer removeDataDir(t)
+	s.Ratelimit = 1
+	err := s.Start(nil)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	// the host is answered from the filter rules, so only the rate limit decides
+	req := new(dns.Msg)
+	req.SetQuestion("host.example.org.", dns.TypeA)
+	reply, err := dns.Exchange(req, addr.String())
+	if err != nil {
+		t.Fatalf("Couldn't talk to server %s: %s", addr, err)
+	}
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+
+	req.Id = dns.Id()
+	reply, err = dns.Exchange(req, addr.String())
+	if err != nil {
+		t.Fatalf("Couldn't talk to server %s: %s", addr, err)
+	}
+	assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+	assert.Equal(t, req.Id, reply.Id)
+
+	s.stats.rateLimited.Lock()
+	assert.Equal(t, int64(1), s.stats.rateLimited.value)
+	s.stats.rateLimited.Unlock()
+
+	err = s.Stop()
+	if err != nil {
+		t.Fatalf("Failed to stop server: %s", err)
+	}
+}
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 10, 100, 1000, 10000, 100000} {
+		h := hyperLogLog{}
+		for i := 0; i < n; i++ {
+			ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).String()
+			h.add(ip)
+			// the duplicates aren't counted
+			h.add(ip)
+		}
+		// 5% is more than three standard errors
+		maxError := 0.05*float64(n) + 1
+		assert.InDelta(t, n, h.count(), maxError, "%d distinct strings", n)
+	}
+
+	a, b := hyperLogLog{}, hyperLogLog{}
+	for i := 0; i < 2000; i++ {
+		a.add(fmt.Sprintf("192.0.2.%d", i))
+		b.add(fmt.Sprintf("192.0.2.%d", i+1000))
+	}
+	a.merge(&b)
+	assert.InDelta(t, 3000, a.count(), 0.05*3000, "merged overlapping sets")
+}
+
+func TestUniqueClients(t *testing.T) {
+	u := newUniqueClients()
+	now := u.lastRotate
+	for i := 0; i < 100; i++ {
+		u.add(fmt.Sprintf("192.0.2.%d", i), now)
+	}
+	u.rotate(now.Add(time.Hour))
+	for i := 50; i < 250; i++ {
+		u.add(fmt.Sprintf("192.0.2.%d", i), now.Add(time.Hour))
+	}
+	assert.InDelta(t, 200, u.count(1), 0.05*200+1, "the current hour")
+	assert.InDelta(t, 250, u.count(2), 0.05*250+1, "the last two hours")
+
+	// the first hour is outside of the timeframe now
+	u.rotate(now.Add(uniqueClientsHours * time.Hour))
+	assert.InDelta(t, 200, u.count(uniqueClientsHours), 0.05*200+1, "the whole timeframe")
+}
+
+func TestZones(t *testing.T) {
+	zones, err := compileZones([]Zone{{
+		Name: "Local.LAN.",
+		Records: []ZoneRecord{
+			{Name: "@", Type: "A", Value: "192.168.0.1"},
+			{Name: "host", Type: "A", Value: "192.168.0.2"},
+			{Name: "alias", Type: "cname", Value: "host"},
+			{Name: "a.b", Type: "TXT", Value: `"text"`},
+		},
+	}, {
+		Name:    "sub.local.lan",
+		SOA:     ZoneSOA{Minimum: 30},
+		Records: []ZoneRecord{{Name: "www.sub.local.lan.", Type: "AAAA", TTL: 10, Value: "fd00::1"}},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to compile zones: %s", err)
+	}
+	s := &Server{zones: zones}
+
+	for _, tc := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string // the first answer record
+		soa    string // owner of the SOA record in the authority section
+	}{
+		{"local.lan.", dns.TypeA, dns.RcodeSuccess, "local.lan.\t3600\tIN\tA\t192.168.0.1", ""},
+		{"HOST.local.lan.", dns.TypeA, dns.RcodeSuccess, "host.local.lan.\t3600\tIN\tA\t192.168.0.2", ""},
+		{"host.local.lan.", dns.TypeAAAA, dns.RcodeSuccess, "", "local.lan."},
+		{"alias.local.lan.", dns.TypeA, dns.RcodeSuccess, "alias.local.lan.\t3600\tIN\tCNAME\thost.local.lan.", ""},
+		{"b.local.lan.", dns.TypeA, dns.RcodeSuccess, "", "local.lan."},
+		{"missing.local.lan.", dns.TypeA, dns.RcodeNameError, "", "local.lan."},
+		{"www.sub.local.lan.", dns.TypeAAAA, dns.RcodeSuccess, "www.sub.local.lan.\t10\tIN\tAAAA\tfd00::1", ""},
+		{"missing.sub.local.lan.", dns.TypeA, dns.RcodeNameError, "", "sub.local.lan."},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, tc.qtype)
+		resp := s.answerFromZones(req)
+		if !assert.NotNil(t, resp, tc.name) {
+			continue
+		}
+		assert.True(t, resp.Authoritative, tc.name)
+		assert.Equal(t, tc.rcode, resp.Rcode, tc.name)
+		if tc.answer != "" && assert.NotEmpty(t, resp.Answer, tc.name) {
+			assert.Equal(t, tc.answer, resp.Answer[0].String(), tc.name)
+		}
+		if tc.soa != "" && assert.Len(t, resp.Ns, 1, tc.name) {
+			soa := resp.Ns[0].(*dns.SOA)
+			assert.Equal(t, tc.soa, soa.Hdr.Name, tc.name)
+			// the negative responses are cached for the SOA minimum
+			assert.Equal(t, soa.Minttl, soa.Hdr.Ttl, tc.name)
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	assert.Nil(t, s.answerFromZones(req), "the names outside of the zones are forwarded")
+
+	for _, z := range []Zone{
+		{Name: "local.lan", Records: []ZoneRecord{{Name: "host.example.org.", Type: "A", Value: "192.168.0.1"}}},
+		{Name: "local.lan", Records: []ZoneRecord{{Name: "@", Type: "SOA", Value: "ns1 hostmaster 1 2 3 4 5"}}},
+		{Name: "local.lan", Records: []ZoneRecord{{Name: "host", Type: "BOGUS", Value: "1"}}},
+		{Name: "local.lan", Records: []ZoneRecord{{Name: "host", Type: "A", Value: "not an IP"}}},
+		{Name: "", Records: nil},
+	} {
+		_, err = z.RRs()
+		assert.NotNil(t, err, "%+v", z)
+	}
+}
+
+// negativeResponse returns the validated response to the query with the authority section of the SOA of "example." and the records
+func negativeResponse(name string, rcode int, ns ...dns.RR) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	resp.AuthenticatedData = true
+	resp.Ns = append(resp.Ns, &dns.SOA{
+		Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:  "ns1.example.", Mbox: "hostmaster.example.", Serial: 1, Minttl: 300,
+	})
+	resp.Ns = append(resp.Ns, ns...)
+	return resp
+}
+
+func TestAggressiveNSEC(t *testing.T) {
+	now := time.Now()
+	nsec := func(owner, next string, types ...uint16) dns.RR {
+		return &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+			NextDomain: next,
+			TypeBitMap: types,
+		}
+	}
+	c := newNSECCache()
+	// the unvalidated responses are ignored
+	unsigned := negativeResponse("b.example.", dns.RcodeNameError, nsec("a.example.", "d.example.", dns.TypeA))
+	unsigned.AuthenticatedData = false
+	c.add(unsigned, now)
+	assert.Equal(t, 0, c.count)
+
+	c.add(negativeResponse("b.example.", dns.RcodeNameError,
+		nsec("example.", "a.example.", dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC),
+		nsec("a.example.", "d.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC),
+	), now)
+	assert.Equal(t, 2, c.count)
+
+	for _, tc := range []struct {
+		name  string
+		qtype uint16
+		rcode int // -1 if the response can't be synthesised
+	}{
+		{"c.example.", dns.TypeA, dns.RcodeNameError},
+		{"x.b.example.", dns.TypeA, dns.RcodeNameError},
+		{"a.example.", dns.TypeAAAA, dns.RcodeSuccess},
+		{"a.example.", dns.TypeA, -1},
+		{"e.example.", dns.TypeA, -1},
+		{"c.example.", dns.TypeDS, -1},
+		{"c.example.org.", dns.TypeA, -1},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, tc.qtype)
+		resp := c.synthesise(req, now.Add(time.Minute))
+		if tc.rcode == -1 {
+			assert.Nil(t, resp, "%s %s", tc.name, dns.TypeToString[tc.qtype])
+			continue
+		}
+		if !assert.NotNil(t, resp, "%s %s", tc.name, dns.TypeToString[tc.qtype]) {
+			continue
+		}
+		assert.Equal(t, tc.rcode, resp.Rcode, tc.name)
+		assert.True(t, resp.AuthenticatedData, tc.name)
+		assert.IsType(t, &dns.SOA{}, resp.Ns[0], tc.name)
+		// the TTLs are reduced by the time spent in the cache
+		assert.Equal(t, uint32(240), resp.Ns[0].Header().Ttl, tc.name)
+	}
+
+	// the records live no longer than the SOA minimum
+	req := new(dns.Msg)
+	req.SetQuestion("c.example.", dns.TypeA)
+	assert.Nil(t, c.synthesise(req, now.Add(301*time.Second)))
+	assert.Equal(t, 0, c.count)
+}
+
+func TestAggressiveNSEC3(t *testing.T) {
+	now := time.Now()
+	hash := func(name string) string {
+		return dns.HashName(name, dns.SHA1, 0, "")
+	}
+	apex, host := hash("example."), hash("a.example.")
+	nsec3 := func(owner, next string, types ...uint16) dns.RR {
+		return &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: owner + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 3600},
+			Hash:       dns.SHA1,
+			NextDomain: next,
+			TypeBitMap: types,
+		}
+	}
+	c := newNSECCache()
+	// the two records cover all the hashes of the names that don't exist
+	c.add(negativeResponse("b.example.", dns.RcodeNameError,
+		nsec3(apex, host, dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC3PARAM),
+		nsec3(host, apex, dns.TypeA, dns.TypeRRSIG),
+	), now)
+	assert.Equal(t, 2, c.count)
+
+	for _, tc := range []struct {
+		name  string
+		qtype uint16
+		rcode int // -1 if the response can't be synthesised
+	}{
+		{"b.example.", dns.TypeA, dns.RcodeNameError},
+		{"x.y.example.", dns.TypeA, dns.RcodeNameError},
+		{"a.example.", dns.TypeTXT, dns.RcodeSuccess},
+		{"a.example.", dns.TypeA, -1},
+		{"example.", dns.TypeSOA, -1},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, tc.qtype)
+		resp := c.synthesise(req, now)
+		if tc.rcode == -1 {
+			assert.Nil(t, resp, "%s %s", tc.name, dns.TypeToString[tc.qtype])
+			continue
+		}
+		if assert.NotNil(t, resp, "%s %s", tc.name, dns.TypeToString[tc.qtype]) {
+			assert.Equal(t, tc.rcode, resp.Rcode, tc.name)
+		}
+	}
+
+	// with the opt-out flag the names in the covered range may exist as unsigned delegations
+	optOut := newNSECCache()
+	resp := negativeResponse("b.example.", dns.RcodeNameError,
+		nsec3(apex, host, dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC3PARAM),
+		nsec3(host, apex, dns.TypeA, dns.TypeRRSIG),
+	)
+	for _, rr := range resp.Ns[1:] {
+		rr.(*dns.NSEC3).Flags = 1
+	}
+	optOut.add(resp, now)
+	req := new(dns.Msg)
+	req.SetQuestion("b.example.", dns.TypeA)
+	assert.Nil(t, optOut.synthesise(req, now))
+}
+
+func TestAggressiveNSECFull(t *testing.T) {
+	now := time.Now()
+	c := newNSECCache()
+	nsecs := make([]dns.RR, 0, maxNSECRecords)
+	for i := 0; i < maxNSECRecords; i++ {
+		nsecs = append(nsecs, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: fmt.Sprintf("a%d.example.", i), Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+			NextDomain: fmt.Sprintf("a%d0.example.", i),
+			TypeBitMap: []uint16{dns.TypeA},
+		})
+	}
+	c.add(negativeResponse("b.example.", dns.RcodeNameError, nsecs...), now)
+	assert.Equal(t, maxNSECRecords, c.count)
+
+	next := negativeResponse("c.example.", dns.RcodeNameError, &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "c.example.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: "d.example.",
+		TypeBitMap: []uint16{dns.TypeA},
+	})
+	// the cache is full of the valid records
+	c.add(next, now.Add(time.Minute))
+	assert.Equal(t, maxNSECRecords, c.count)
+	assert.Nil(t, c.zones["example."].nsec["c.example."])
+
+	// the expired records are removed to make room for the new ones
+	c.add(next, now.Add(301*time.Second))
+	assert.Equal(t, 1, c.count)
+	assert.NotNil(t, c.zones["example."].nsec["c.example."])
+}
+
+func TestUpstreamCache(t *testing.T) {
+	c := newUpstreamCache(2)
+	query := func(name string, do bool, cd bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		req.CheckingDisabled = cd
+		if do {
+			req.SetEdns0(4096, true)
+		}
+		return req
+	}
+	answer := func(req *dns.Msg, ip net.IP) *dns.Msg {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = append(res.Answer, &dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: ip})
+		return res
+	}
+
+	req := query("example.org.", false, false)
+	c.set(req, answer(req, net.IP{192, 0, 2, 1}))
+	res := c.get(query("EXAMPLE.org.", false, false))
+	if assert.NotNil(t, res) {
+		assert.Equal(t, "192.0.2.1", res.Answer[0].(*dns.A).A.String())
+	}
+	// the responses without the DNSSEC records must not be served to the DO and CD requests
+	assert.Nil(t, c.get(query("example.org.", true, false)))
+	assert.Nil(t, c.get(query("example.org.", false, true)))
+
+	doReq := query("example.org.", true, false)
+	c.set(doReq, answer(doReq, net.IP{192, 0, 2, 2}))
+	res = c.get(query("example.org.", true, false))
+	if assert.NotNil(t, res) {
+		assert.Equal(t, "192.0.2.2", res.Answer[0].(*dns.A).A.String())
+	}
+	res = c.get(query("example.org.", false, false))
+	if assert.NotNil(t, res) {
+		assert.Equal(t, "192.0.2.1", res.Answer[0].(*dns.A).A.String())
+	}
+
+	// the least recently used response is evicted
+	other := query("example.com.", false, false)
+	c.set(other, answer(other, net.IP{192, 0, 2, 3}))
+	assert.Nil(t, c.get(query("example.org.", true, false)))
+	assert.NotNil(t, c.get(query("example.org.", false, false)))
+
+	// the expired responses are removed
+	key, _ := upstreamCacheKey(other)
+	c.items[key].Value.(*upstreamCacheItem).when = time.Now().Add(-time.Minute)
+	assert.Nil(t, c.get(other))
+	assert.Len(t, c.items, 1)
+
+	// SERVFAIL and the responses without records aren't cached
+	failed := query("fail.example.org.", false, false)
+	res = new(dns.Msg)
+	res.SetRcode(failed, dns.RcodeServerFailure)
+	c.set(failed, res)
+	res = new(dns.Msg)
+	res.SetReply(failed)
+	c.set(failed, res)
+	assert.Nil(t, c.get(failed))
+}
+
+// testUpstream answers all A queries with its IP address and counts them
+type testUpstream struct {
+	address string
+	ip      net.IP
+	queries int32 // accessed atomically
+}
+
+func (u *testUpstream) Address() string {
+	return u.address
+}
+
+func (u *testUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.queries, 1)
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Answer = append(res.Answer, &dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: u.ip})
+	return res, nil
+}
+
+func TestServeStale(t *testing.T) {
+	s := &Server{stats: newStats(), staleCache: newUpstreamCache(staleCacheSize)}
+	s.ServeStale = true
+	u := &testUpstream{address: "192.0.2.53:53", ip: net.IP{192, 0, 2, 1}}
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{u}
+	other := &proxy.Proxy{}
+	other.Upstreams = []upstream.Upstream{&testUpstream{address: "192.0.2.54:53", ip: net.IP{192, 0, 2, 2}}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	res, _ := u.Exchange(req)
+	s.saveStale(p, &proxy.DNSContext{Req: req, Res: res})
+
+	expire := func() {
+		key, _ := staleCacheKey(req, p.Upstreams)
+		s.staleCache.items[key].Value.(*upstreamCacheItem).when = time.Now().Add(-2 * time.Minute)
+	}
+	expire()
+
+	d := &proxy.DNSContext{Req: req}
+	if assert.True(t, s.serveStale(p, d)) {
+		assert.Equal(t, uint32(staleResponseTTL), d.Res.Answer[0].Header().Ttl)
+		assert.Equal(t, req.Id, d.Res.Id)
+	}
+	assert.Equal(t, int64(1), s.stats.staleServed.value)
+
+	// the responses of the other upstreams aren't served
+	assert.False(t, s.serveStale(other, &proxy.DNSContext{Req: req}))
+
+	// neither are the responses without the DNSSEC records to the DO requests
+	doReq := req.Copy()
+	doReq.SetEdns0(4096, true)
+	assert.False(t, s.serveStale(p, &proxy.DNSContext{Req: doReq}))
+
+	// the response is dropped once it's older than the maximum staleness
+	s.ServeStaleMaxAge = 30
+	assert.False(t, s.serveStale(p, &proxy.DNSContext{Req: req}))
+	assert.Len(t, s.staleCache.items, 0)
+}
+
+func TestServeCachedAndRevalidate(t *testing.T) {
+	s := &Server{stats: newStats(), staleCache: newUpstreamCache(staleCacheSize)}
+	s.PrefetchOnExpired = true
+	u := &testUpstream{address: "192.0.2.53:53", ip: net.IP{192, 0, 2, 1}}
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{u}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	assert.False(t, s.serveCachedAndRevalidate(p, &proxy.DNSContext{Req: req}), "nothing is cached yet")
+
+	res, _ := u.Exchange(req)
+	s.saveStale(p, &proxy.DNSContext{Req: req, Res: res})
+	key, _ := staleCacheKey(req, p.Upstreams)
+
+	// the fresh response is served without asking the upstream
+	d := &proxy.DNSContext{Req: req}
+	assert.True(t, s.serveCachedAndRevalidate(p, d))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.queries))
+
+	// the expired one is served and refreshed in the background
+	s.staleCache.items[key].Value.(*upstreamCacheItem).when = time.Now().Add(-2 * time.Minute)
+	d = &proxy.DNSContext{Req: req}
+	if assert.True(t, s.serveCachedAndRevalidate(p, d)) {
+		assert.Equal(t, uint32(staleResponseTTL), d.Res.Answer[0].Header().Ttl)
+	}
+	for i := 0; i < 100; i++ {
+		s.revalidating.Lock()
+		done := !s.revalidating.keys[key]
+		s.revalidating.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.queries))
+
+	res, expired := s.staleCache.getStale(key, req, s.maxStaleness())
+	assert.False(t, expired)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, uint32(60), res.Answer[0].Header().Ttl)
+	}
+}
+
+func TestCheckDNSSECFailure(t *testing.T) {
+	s := &Server{stats: newStats()}
+	u := &testUpstream{address: "192.0.2.53:53", ip: net.IP{192, 0, 2, 1}}
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	enableDNSSEC(req)
+	servfail := func(ede uint16) *dns.Msg {
+		res := new(dns.Msg)
+		res.SetRcode(req, dns.RcodeServerFailure)
+		if ede != 0 {
+			res.SetEdns0(4096, true)
+			addExtendedError(req, res, ede)
+		}
+		return res
+	}
+
+	// the other failures aren't checked
+	assert.False(t, s.checkDNSSECFailure(&proxy.DNSContext{Req: req, Res: servfail(0), Upstream: u}))
+	assert.False(t, s.checkDNSSECFailure(&proxy.DNSContext{Req: req, Res: servfail(22), Upstream: u}))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.queries))
+
+	// the response with the Checking Disabled bit proves the validation failure
+	assert.True(t, s.checkDNSSECFailure(&proxy.DNSContext{Req: req, Res: servfail(edeDNSSECBogus), Upstream: u}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.queries))
+	assert.Equal(t, int64(1), s.stats.dnssecFailures.value)
+	assert.False(t, req.CheckingDisabled, "the request must not be changed")
+}
+
+func TestCheckAuthenticatedData(t *testing.T) {
+	s := &Server{stats: newStats()}
+	u := &testUpstream{address: "192.0.2.53:53", ip: net.IP{192, 0, 2, 1}}
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	enableDNSSEC(req)
+	response := func(signed, ad bool) *dns.Msg {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.AuthenticatedData = ad
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IP{192, 0, 2, 1},
+		})
+		if signed {
+			res.Answer = append(res.Answer, &dns.RRSIG{
+				Hdr:         dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60},
+				TypeCovered: dns.TypeA,
+			})
+		}
+		return res
+	}
+
+	assert.True(t, s.checkAuthenticatedData(&proxy.DNSContext{Req: req, Res: response(false, false), Upstream: u}))
+	assert.True(t, s.checkAuthenticatedData(&proxy.DNSContext{Req: req, Res: response(true, true), Upstream: u}))
+	// the synthesised responses don't have the upstream
+	assert.True(t, s.checkAuthenticatedData(&proxy.DNSContext{Req: req, Res: response(true, false)}))
+	assert.Equal(t, int64(0), s.stats.dnssecUnvalidated.value)
+
+	assert.False(t, s.checkAuthenticatedData(&proxy.DNSContext{Req: req, Res: response(true, false), Upstream: u}))
+	assert.False(t, s.checkAuthenticatedData(&proxy.DNSContext{Req: req, Res: response(true, false), Upstream: u}))
+	assert.Equal(t, int64(2), s.stats.dnssecUnvalidated.value)
+	assert.True(t, s.unvalidating.upstreams[u.address])
+}
+
+func TestDNSSECRestoreAuthenticatedData(t *testing.T) {
+	testCases := []struct {
+		do, ad bool
+		want   bool
+	}{
+		{false, false, false},
+		{false, true, true},
+		{true, false, true},
+		{true, true, true},
+	}
+	for _, tc := range testCases {
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		req.AuthenticatedData = tc.ad
+		if tc.do {
+			req.SetEdns0(4096, true)
+		}
+		state := enableDNSSEC(req)
+
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.AuthenticatedData = true
+		d := &proxy.DNSContext{Req: req, Res: res}
+		state.restore(d)
+		assert.Equal(t, tc.want, d.Res.AuthenticatedData, "DO %t, AD %t", tc.do, tc.ad)
+		assert.True(t, res.AuthenticatedData, "the response must not be changed")
+	}
+}
+
 func publicKey(priv interface{}) interface{} {
 	switch k := priv.(type) {
 	case *rsa.PrivateKey:
@@ -574,3 +1309,411 @@ func publicKey(priv interface{}) interface{} {
 		return nil
 	}
 }
+
+// lastResponseUpstream keeps the last response it returned, the proxy cache stores the same message
+type lastResponseUpstream struct {
+	testUpstream
+	last *dns.Msg
+	sync.Mutex
+}
+
+func (u *lastResponseUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	res, err := u.testUpstream.Exchange(req)
+	u.Lock()
+	u.last = res
+	u.Unlock()
+	return res, err
+}
+
+func TestResponseChangesDontAffectCache(t *testing.T) {
+	s := createTestServer(t)
+	defer removeDataDir(t)
+	s.SafeBrowsingEnabled = false
+	u := &lastResponseUpstream{testUpstream: testUpstream{address: "192.0.2.53:53", ip: net.IP{192, 0, 2, 1}}}
+	s.Upstreams = []upstream.Upstream{u}
+	s.MinResponseTTL = 3600
+	s.ResponseRewrites = []ResponseRewrite{{Domain: "example.org", OriginalIP: "192.0.2.1", ReplacementIP: "192.0.2.2"}}
+	err := s.Start(nil)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	defer s.Stop()
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+	client := dns.Client{Net: "udp", Timeout: time.Second}
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		reply, _, err := client.Exchange(req, addr.String())
+		if err != nil {
+			t.Fatalf("Couldn't talk to server %s: %s", addr, err)
+		}
+		if assert.Len(t, reply.Answer, 1) {
+			assert.Equal(t, "192.0.2.2", reply.Answer[0].(*dns.A).A.String())
+			assert.Equal(t, uint32(3600), reply.Answer[0].Header().Ttl)
+		}
+	}
+
+	// the second response is served from the cache, the cached one has the upstream values
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.queries))
+	entries := s.GetCacheEntries()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, CacheNameShared, entries[0].Cache)
+		assert.Equal(t, "example.org.", entries[0].QName)
+		assert.Equal(t, []string{"example.org.\t60\tIN\tA\t192.0.2.1"}, entries[0].Answers)
+	}
+	u.Lock()
+	defer u.Unlock()
+	if assert.NotNil(t, u.last) && assert.Len(t, u.last.Answer, 1) {
+		assert.Equal(t, "192.0.2.1", u.last.Answer[0].(*dns.A).A.String())
+		assert.Equal(t, uint32(60), u.last.Answer[0].Header().Ttl)
+	}
+}
+
+func TestApplyMinTTL(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.org.", dns.TypeA)
+	resp.Answer = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10}, A: net.IP{192, 0, 2, 1}},
+		&dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 7200}, A: net.IP{192, 0, 2, 2}},
+	}
+	resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 0}, Ns: "ns.example.org."}}
+	resp.SetEdns0(4096, false)
+
+	applyMinTTL(resp, 300)
+	assert.Equal(t, uint32(300), resp.Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(7200), resp.Answer[1].Header().Ttl)
+	assert.Equal(t, uint32(300), resp.Ns[0].Header().Ttl)
+	// the TTL field of OPT holds the extended rcode and flags
+	assert.Equal(t, uint32(0), resp.Extra[0].Header().Ttl)
+}
+
+func TestFlattenCNAME(t *testing.T) {
+	s := &Server{}
+	cname := func(name, target string, ttl uint32) dns.RR {
+		return &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl}, Target: target}
+	}
+	a := func(name string, ip net.IP, ttl uint32) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: ip}
+	}
+	context := func(qtype uint16, answer ...dns.RR) *proxy.DNSContext {
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", qtype)
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = answer
+		return &proxy.DNSContext{Req: req, Res: res}
+	}
+
+	// the whole chain is in the answer, the lowest TTL of the chain is used
+	d := context(dns.TypeA,
+		cname("example.org.", "a.example.net.", 300),
+		cname("a.example.net.", "b.example.net.", 100),
+		a("b.example.net.", net.IP{192, 0, 2, 1}, 200))
+	s.flattenCNAME(nil, d)
+	if assert.Len(t, d.Res.Answer, 1) {
+		assert.Equal(t, "example.org.", d.Res.Answer[0].Header().Name)
+		assert.Equal(t, uint32(100), d.Res.Answer[0].Header().Ttl)
+		assert.Equal(t, "192.0.2.1", d.Res.Answer[0].(*dns.A).A.String())
+	}
+
+	// the last name of the chain is resolved
+	u := &testUpstream{address: "192.0.2.53:53", ip: net.IP{192, 0, 2, 2}}
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{u}
+	p.AllServers = true // the upstreams of the proxy that isn't started are used only by the parallel exchange
+	d = context(dns.TypeA, cname("example.org.", "c.example.net.", 30))
+	s.flattenCNAME(p, d)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.queries))
+	if assert.Len(t, d.Res.Answer, 1) {
+		assert.Equal(t, "example.org.", d.Res.Answer[0].Header().Name)
+		assert.Equal(t, uint32(30), d.Res.Answer[0].Header().Ttl)
+		assert.Equal(t, "192.0.2.2", d.Res.Answer[0].(*dns.A).A.String())
+	}
+
+	// the answers without CNAME and the other query types aren't changed
+	d = context(dns.TypeA, a("example.org.", net.IP{192, 0, 2, 1}, 200))
+	s.flattenCNAME(nil, d)
+	assert.Len(t, d.Res.Answer, 1)
+	d = context(dns.TypeTXT, cname("example.org.", "a.example.net.", 300))
+	s.flattenCNAME(nil, d)
+	if assert.Len(t, d.Res.Answer, 1) {
+		assert.Equal(t, dns.TypeCNAME, d.Res.Answer[0].Header().Rrtype)
+	}
+}
+
+func TestResponseRewrites(t *testing.T) {
+	rw := ResponseRewrite{Domain: " *.Example.org. ", OriginalIP: "192.0.2.1", ReplacementIP: " 192.0.2.100"}
+	assert.Nil(t, NormalizeResponseRewrite(&rw))
+	assert.Equal(t, "*.example.org", rw.Domain)
+	assert.Equal(t, "192.0.2.100", rw.ReplacementIP)
+	assert.NotNil(t, NormalizeResponseRewrite(&ResponseRewrite{Domain: "", OriginalIP: "192.0.2.1", ReplacementIP: "192.0.2.2"}))
+	assert.NotNil(t, NormalizeResponseRewrite(&ResponseRewrite{Domain: "example.org", OriginalIP: "192.0.2", ReplacementIP: "192.0.2.2"}))
+	assert.NotNil(t, NormalizeResponseRewrite(&ResponseRewrite{Domain: "example.org", OriginalIP: "192.0.2.1", ReplacementIP: "2001:db8::1"}))
+
+	s := &Server{}
+	s.ResponseRewrites = []ResponseRewrite{
+		rw,
+		{Domain: "example.net", OriginalIP: "2001:db8::1", ReplacementIP: "2001:db8::2"},
+	}
+	response := func(name string, answer ...dns.RR) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetQuestion(name, dns.TypeA)
+		resp.Answer = answer
+		return resp
+	}
+	a := func(name string, ip net.IP) *dns.A {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: ip}
+	}
+
+	orig := a("www.example.org.", net.IP{192, 0, 2, 1})
+	resp := response("www.example.org.", orig, a("www.example.org.", net.IP{192, 0, 2, 3}))
+	s.applyResponseRewrites(resp)
+	assert.Equal(t, "192.0.2.100", resp.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, "192.0.2.3", resp.Answer[1].(*dns.A).A.String())
+	// the record is replaced, not changed
+	assert.Equal(t, "192.0.2.1", orig.A.String())
+
+	// the wildcard doesn't match the domain itself
+	resp = response("example.org.", a("example.org.", net.IP{192, 0, 2, 1}))
+	s.applyResponseRewrites(resp)
+	assert.Equal(t, "192.0.2.1", resp.Answer[0].(*dns.A).A.String())
+
+	resp = response("example.net.", &dns.AAAA{Hdr: dns.RR_Header{Name: "example.net.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::1")})
+	s.applyResponseRewrites(resp)
+	assert.Equal(t, "2001:db8::2", resp.Answer[0].(*dns.AAAA).AAAA.String())
+}
+
+func TestApplyIPVersion(t *testing.T) {
+	answer := func() []dns.RR {
+		return []dns.RR{
+			&dns.CNAME{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "a.example.org."},
+			&dns.A{Hdr: dns.RR_Header{Name: "a.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IP{192, 0, 2, 1}},
+			&dns.AAAA{Hdr: dns.RR_Header{Name: "a.example.org.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::1")},
+			&dns.A{Hdr: dns.RR_Header{Name: "a.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IP{192, 0, 2, 2}},
+		}
+	}
+	types := func(rrs []dns.RR) []uint16 {
+		result := []uint16{}
+		for _, rr := range rrs {
+			result = append(result, rr.Header().Rrtype)
+		}
+		return result
+	}
+
+	s := &Server{}
+	resp := &dns.Msg{Answer: answer()}
+	s.DisableIPv4 = true
+	s.applyIPVersion(resp)
+	assert.Equal(t, []uint16{dns.TypeCNAME, dns.TypeAAAA}, types(resp.Answer))
+
+	s = &Server{}
+	resp = &dns.Msg{Answer: answer()}
+	s.DisableIPv6 = true
+	s.applyIPVersion(resp)
+	assert.Equal(t, []uint16{dns.TypeCNAME, dns.TypeA, dns.TypeA}, types(resp.Answer))
+
+	// the addresses take the places of the address records, the CNAME stays first
+	s = &Server{}
+	resp = &dns.Msg{Answer: answer()}
+	s.PreferIPv6 = true
+	s.applyIPVersion(resp)
+	assert.Equal(t, []uint16{dns.TypeCNAME, dns.TypeAAAA, dns.TypeA, dns.TypeA}, types(resp.Answer))
+	assert.Equal(t, "192.0.2.1", resp.Answer[2].(*dns.A).A.String())
+	assert.Equal(t, "192.0.2.2", resp.Answer[3].(*dns.A).A.String())
+}
+
+func TestDisableIPv6(t *testing.T) {
+	s := createTestServer(t)
+	defer removeDataDir(t)
+	s.SafeBrowsingEnabled = false
+	u := &testUpstream{address: "192.0.2.53:53", ip: net.IP{192, 0, 2, 1}}
+	s.Upstreams = []upstream.Upstream{u}
+	s.DisableIPv6 = true
+	err := s.Start(nil)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	defer s.Stop()
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeAAAA)
+	reply, err := dns.Exchange(req, addr.String())
+	if err != nil {
+		t.Fatalf("Couldn't talk to server %s: %s", addr, err)
+	}
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 0)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.queries), "AAAA queries must not be forwarded")
+
+	req.SetQuestion("example.org.", dns.TypeA)
+	reply, err = dns.Exchange(req, addr.String())
+	if err != nil {
+		t.Fatalf("Couldn't talk to server %s: %s", addr, err)
+	}
+	assert.Len(t, reply.Answer, 1)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.queries))
+}
+
+func TestHighRateClients(t *testing.T) {
+	// with the average of all clients, a single client can't exceed 10 times the average unless there are more than 10 clients
+	clients := map[string]int{"192.168.1.2": 1000, "192.168.1.3": 10, "192.168.1.4": 20}
+	result := highRateClients(clients)
+	if assert.Len(t, result, 1) {
+		assert.Equal(t, "high_rate", result[0].Type)
+		assert.Equal(t, "192.168.1.2", result[0].Client)
+		assert.Equal(t, 1000, result[0].Details["queries"])
+		assert.Equal(t, 15.0, result[0].Details["average"])
+	}
+
+	clients["192.168.1.2"] = 150
+	assert.Len(t, highRateClients(clients), 0)
+	assert.Len(t, highRateClients(map[string]int{"192.168.1.2": 1000}), 0)
+	assert.Len(t, highRateClients(map[string]int{}), 0)
+}
+
+func TestNormalizeResponseFilter(t *testing.T) {
+	f := ResponseFilter{Name: " tracker ", Action: ResponseFilterRemoveRecord, MatchIP: " 2001:DB8:0::1 "}
+	assert.Nil(t, NormalizeResponseFilter(&f))
+	assert.Equal(t, ResponseFilter{Name: "tracker", Action: ResponseFilterRemoveRecord, MatchIP: "2001:db8::1"}, f)
+
+	for _, f := range []ResponseFilter{
+		{Name: " ", Action: ResponseFilterRemoveRecord, MatchIP: "192.0.2.1"},
+		{Name: "tracker", Action: "replace_record", MatchIP: "192.0.2.1"},
+		{Name: "tracker", Action: ResponseFilterRemoveRecord, MatchIP: "192.0.2"},
+		{Name: "tracker", Action: ResponseFilterRemoveRecord, MatchIP: "tracker.example.org"},
+	} {
+		assert.NotNil(t, NormalizeResponseFilter(&f), "%+v", f)
+	}
+}
+
+func TestResponseFilterUpstream(t *testing.T) {
+	u := &filteredUpstream{
+		Upstream: &testUpstream{address: "192.0.2.53:53", ip: net.IP{192, 0, 2, 1}},
+		filters: []ResponseFilter{
+			{Name: "tracker", Action: ResponseFilterRemoveRecord, MatchIP: "192.0.2.1"},
+			{Name: "v6", Action: ResponseFilterRemoveRecord, MatchIP: "2001:db8::1"},
+		},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	res, err := u.Exchange(req)
+	assert.Nil(t, err)
+	assert.Len(t, res.Answer, 0)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+
+	resp := &dns.Msg{Answer: []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "a.example.org."},
+		&dns.A{Hdr: dns.RR_Header{Name: "a.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IP{192, 0, 2, 1}},
+		&dns.A{Hdr: dns.RR_Header{Name: "a.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IP{192, 0, 2, 2}},
+		&dns.AAAA{Hdr: dns.RR_Header{Name: "a.example.org.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::1")},
+		&dns.AAAA{Hdr: dns.RR_Header{Name: "a.example.org.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::2")},
+	}}
+	answer := resp.Answer
+	applyResponseFilters(u.filters, resp)
+	if assert.Len(t, resp.Answer, 3) {
+		assert.Equal(t, dns.TypeCNAME, resp.Answer[0].Header().Rrtype)
+		assert.Equal(t, "192.0.2.2", resp.Answer[1].(*dns.A).A.String())
+		assert.Equal(t, "2001:db8::2", resp.Answer[2].(*dns.AAAA).AAAA.String())
+	}
+	// the answer slice of the response isn't changed in place
+	assert.Len(t, answer, 5)
+	assert.Equal(t, "192.0.2.1", answer[1].(*dns.A).A.String())
+
+	// the invalid filters are ignored
+	resp = &dns.Msg{Answer: answer}
+	applyResponseFilters([]ResponseFilter{{Name: "bad", Action: ResponseFilterRemoveRecord, MatchIP: "bad"}}, resp)
+	assert.Len(t, resp.Answer, 5)
+}
+
+func TestDomainMaxTTL(t *testing.T) {
+	name, err := NormalizeDomainTTLName(" *.CloudFront.net. ")
+	assert.Nil(t, err)
+	assert.Equal(t, "cloudfront.net", name)
+	_, err = NormalizeDomainTTLName("example..org")
+	assert.NotNil(t, err)
+
+	s := &Server{}
+	s.DomainMaxTTLs = []DomainMaxTTL{
+		{Domain: "*.cloudfront.net", MaxTTL: 60},
+		{Domain: "static.cloudfront.net", MaxTTL: 600},
+	}
+	ttl, ok := s.domainMaxTTL("d1.cloudfront.net.")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(60), ttl)
+	// the most specific rule wins
+	ttl, ok = s.domainMaxTTL("a.static.cloudfront.NET.")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(600), ttl)
+	_, ok = s.domainMaxTTL("notcloudfront.net.")
+	assert.False(t, ok)
+
+	resp := new(dns.Msg)
+	resp.SetQuestion("d1.cloudfront.net.", dns.TypeA)
+	resp.Answer = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "d1.cloudfront.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.IP{192, 0, 2, 1}},
+		&dns.A{Hdr: dns.RR_Header{Name: "d1.cloudfront.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}, A: net.IP{192, 0, 2, 2}},
+	}
+	resp.SetEdns0(4096, true)
+	s.applyDomainMaxTTL(resp)
+	assert.Equal(t, uint32(60), resp.Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(30), resp.Answer[1].Header().Ttl)
+	assert.True(t, resp.IsEdns0().Do())
+}
+
+func TestQueryLogAnonymizationRace(t *testing.T) {
+	l := newQueryLog(createDataDir(t))
+	defer removeDataDir(t)
+	l.configure(queryLogConfig{fileEnabled: true})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	for i := 0; i < 10; i++ {
+		l.logRequest(req, nil, nil, 0, fmt.Sprintf("192.0.2.%d", i), "")
+	}
+
+	// the entries are read while they're anonymized
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				l.getQueryLog()
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				l.logRequest(req, nil, nil, 0, "198.51.100.1", "")
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		l.configure(queryLogConfig{fileEnabled: true, anonymization: AnonymizationPartial})
+	}
+	close(done)
+	wg.Wait()
+
+	for _, entry := range l.getQueryLog() {
+		client := entry["client"].(string)
+		assert.True(t, client == "192.0.2.0" || client == "198.51.100.0" || client == "198.51.100.1", client)
+	}
+	l.logBufferLock.RLock()
+	defer l.logBufferLock.RUnlock()
+	l.queryLogLock.RLock()
+	defer l.queryLogLock.RUnlock()
+	// the lists share the anonymized entries
+	assert.True(t, l.logBuffer[0] == l.queryLogCache[0])
+	assert.Equal(t, "192.0.2.0", l.logBuffer[0].IP)
+}
@@ -0,0 +1,153 @@
+package dnsforward
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/hmage/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// dnssecState remembers what the client originally asked for before we enabled DNSSEC in its request
+type dnssecState struct {
+	hadOPT bool // client sent EDNS0 OPT record
+	hadDO  bool // client set the DNSSEC OK bit
+	hadAD  bool // client set the AD bit, it understands it without the DNSSEC records (RFC 6840 section 5.7)
+}
+
+// enableDNSSEC sets the DNSSEC OK bit in the request
+// the request is changed, so it must be a copy of the client's request
+func enableDNSSEC(req *dns.Msg) dnssecState {
+	state := dnssecState{hadAD: req.AuthenticatedData}
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(4096, true)
+		return state
+	}
+	state.hadOPT = true
+	state.hadDO = opt.Do()
+	opt.SetDo()
+	return state
+}
+
+// restore removes DNSSEC records and OPT from the response if the client didn't ask for them
+// the AD bit is cleared too unless the client set it in the request
+// the response is copied since it may be shared with the cache
+func (st dnssecState) restore(d *proxy.DNSContext) {
+	if d.Res == nil || st.hadDO {
+		return
+	}
+
+	res := d.Res.Copy()
+	if !st.hadAD {
+		res.AuthenticatedData = false
+	}
+	res.Answer = stripDNSSECRecords(res.Answer)
+	res.Ns = stripDNSSECRecords(res.Ns)
+	extra := []dns.RR{}
+	for _, rr := range res.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			if !st.hadOPT {
+				continue
+			}
+			rr.(*dns.OPT).SetDo(false)
+		}
+		extra = append(extra, rr)
+	}
+	res.Extra = stripDNSSECRecords(extra)
+	d.Res = res
+}
+
+func stripDNSSECRecords(rrs []dns.RR) []dns.RR {
+	result := []dns.RR{}
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			continue
+		}
+		result = append(result, rr)
+	}
+	return result
+}
+
+// hasDNSSECError returns true if the response has an Extended DNS Error of a DNSSEC validation failure (RFC 8914 section 4)
+func hasDNSSECError(res *dns.Msg) bool {
+	opt := res.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		local, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok || local.Code != edeOptionCode || len(local.Data) < 2 {
+			continue
+		}
+		switch binary.BigEndian.Uint16(local.Data) {
+		case 1, 2, 5, 6, 7, 8, 9, 10, 11, 12: // from Unsupported DNSKEY Algorithm to NSEC Missing, except the stale answers
+			return true
+		}
+	}
+	return false
+}
+
+// checkDNSSECFailure checks if SERVFAIL from the upstream was caused by DNSSEC validation failure
+// only the SERVFAIL responses with a DNSSEC Extended DNS Error are checked, the other failures aren't related to DNSSEC
+// it repeats the request with the Checking Disabled bit set, if it succeeds, validation has failed and true is returned
+func (s *Server) checkDNSSECFailure(d *proxy.DNSContext) bool {
+	if d.Res == nil || len(d.Req.Question) == 0 || d.Upstream == nil {
+		return false
+	}
+	if d.Res.Rcode != dns.RcodeServerFailure || !hasDNSSECError(d.Res) {
+		return false
+	}
+
+	req := d.Req.Copy()
+	req.CheckingDisabled = true
+	// exchange directly with the upstream so that the unvalidated response doesn't get into the cache
+	res, err := d.Upstream.Exchange(req)
+	if err != nil || res.Rcode == dns.RcodeServerFailure {
+		return false
+	}
+
+	host := strings.TrimSuffix(d.Req.Question[0].Name, ".")
+	log.Printf("DNSSEC validation failed for %s", host)
+	s.stats.incWithTime(s.stats.dnssecFailures, time.Now())
+	return true
+}
+
+// isSigned returns true if the answer has the signatures of the records
+func isSigned(res *dns.Msg) bool {
+	for _, rr := range res.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAuthenticatedData checks the AD bit of the signed successful responses
+// the upstream that returns the signatures without the AD bit doesn't validate them, it's logged once for each upstream
+// returns false if the response is signed, but isn't validated
+func (s *Server) checkAuthenticatedData(d *proxy.DNSContext) bool {
+	if d.Res == nil || d.Upstream == nil || d.Res.Rcode != dns.RcodeSuccess {
+		return true
+	}
+	if d.Res.AuthenticatedData || !isSigned(d.Res) {
+		return true
+	}
+
+	s.stats.incWithTime(s.stats.dnssecUnvalidated, time.Now())
+	addr := d.Upstream.Address()
+	s.unvalidating.Lock()
+	if s.unvalidating.upstreams == nil {
+		s.unvalidating.upstreams = map[string]bool{}
+	}
+	logged := s.unvalidating.upstreams[addr]
+	s.unvalidating.upstreams[addr] = true
+	s.unvalidating.Unlock()
+	if !logged {
+		log.Printf("Upstream %s returns DNSSEC signatures without the AD bit, it doesn't validate them", addr)
+	}
+	return false
+}
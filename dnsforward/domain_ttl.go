@@ -0,0 +1,64 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DomainMaxTTL limits TTLs of the records in the responses to the queries for the domain and its subdomains
+type DomainMaxTTL struct {
+	Domain string `yaml:"domain" json:"domain"` // e.g. "cloudfront.net" or "*.cloudfront.net"
+	MaxTTL uint32 `yaml:"max_ttl" json:"max_ttl_seconds"`
+}
+
+// NormalizeDomainTTLName returns the lowercase domain name without the wildcard and the trailing dot
+func NormalizeDomainTTLName(domain string) (string, error) {
+	name := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	name = strings.TrimPrefix(name, "*.")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return "", fmt.Errorf("invalid domain: %s", domain)
+	}
+	return name, nil
+}
+
+// domainMaxTTL returns the limit of the most specific rule for the queried name, false if there is none
+func (s *Server) domainMaxTTL(qname string) (uint32, bool) {
+	qname = strings.ToLower(strings.TrimSuffix(qname, "."))
+	found := ""
+	var ttl uint32
+	for _, rule := range s.DomainMaxTTLs {
+		domain, err := NormalizeDomainTTLName(rule.Domain)
+		if err != nil {
+			continue
+		}
+		if qname != domain && !strings.HasSuffix(qname, "."+domain) {
+			continue
+		}
+		if len(domain) > len(found) {
+			found = domain
+			ttl = rule.MaxTTL
+		}
+	}
+	return ttl, found != ""
+}
+
+// applyDomainMaxTTL lowers TTLs of all records in the response to the limit for the queried domain
+func (s *Server) applyDomainMaxTTL(resp *dns.Msg) {
+	if len(resp.Question) != 1 {
+		return
+	}
+	ttl, ok := s.domainMaxTTL(resp.Question[0].Name)
+	if !ok {
+		return
+	}
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype != dns.TypeOPT && hdr.Ttl > ttl {
+				hdr.Ttl = ttl
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package dnsforward
+
+import (
+	"encoding/binary"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/miekg/dns"
+)
+
+// the option code of Extended DNS Errors (RFC 8914)
+const edeOptionCode = 15
+
+// the info codes of Extended DNS Errors
+const (
+	edeDNSSECBogus = 6
+	edeBlocked     = 15 // blocked by the filter lists
+	edeFiltered    = 17 // blocked by the filtering the client asked for, e.g. parental control
+)
+
+var edeTexts = map[uint16]string{
+	edeDNSSECBogus: "DNSSEC Bogus",
+	edeBlocked:     "Blocked",
+	edeFiltered:    "Filtered",
+}
+
+// edeCodeForReason returns the info code for the filtering reason, 0 if the host wasn't blocked
+func edeCodeForReason(reason dnsfilter.Reason) uint16 {
+	switch reason {
+	case dnsfilter.FilteredBlackList:
+		return edeBlocked
+	case dnsfilter.FilteredSafeBrowsing, dnsfilter.FilteredParental:
+		return edeFiltered
+	}
+	return 0
+}
+
+// addExtendedError adds the Extended DNS Error option to our own response
+// nothing is added if the client didn't send EDNS0 OPT record, since it can't accept the options then
+func addExtendedError(req *dns.Msg, resp *dns.Msg, code uint16) {
+	reqOPT := req.IsEdns0()
+	if reqOPT == nil || resp == nil || code == 0 {
+		return
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(reqOPT.UDPSize(), reqOPT.Do())
+		opt = resp.IsEdns0()
+	}
+	data := make([]byte, 2, 2+len(edeTexts[code]))
+	binary.BigEndian.PutUint16(data, code)
+	data = append(data, edeTexts[code]...)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: edeOptionCode, Data: data})
+}
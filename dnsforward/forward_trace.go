@@ -0,0 +1,96 @@
+package dnsforward
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// number of the last forwarded queries kept when TraceForwarded is enabled
+const forwardTraceSize = 500
+
+// ForwardedQuery is a DNS message sent to an upstream
+type ForwardedQuery struct {
+	Time         time.Time `json:"timestamp"`
+	Upstream     string    `json:"upstream"`
+	QueryID      uint16    `json:"query_id"`
+	Question     string    `json:"question"`        // e.g. "example.org. IN A"
+	ResponseCode string    `json:"response_code"`   // empty if there was no response
+	Error        string    `json:"error,omitempty"` // why there was no response
+	ElapsedMs    float64   `json:"elapsed_ms"`
+}
+
+// forwardTrace is a circular buffer of the last forwarded queries
+type forwardTrace struct {
+	entries []ForwardedQuery
+	next    int // index of the slot for the next entry
+	sync.Mutex
+}
+
+func (t *forwardTrace) add(q ForwardedQuery) {
+	t.Lock()
+	if len(t.entries) < forwardTraceSize {
+		t.entries = append(t.entries, q)
+	} else {
+		t.entries[t.next] = q
+	}
+	t.next = (t.next + 1) % forwardTraceSize
+	t.Unlock()
+}
+
+// list returns the entries, the most recent first
+func (t *forwardTrace) list() []ForwardedQuery {
+	t.Lock()
+	defer t.Unlock()
+
+	n := len(t.entries)
+	res := make([]ForwardedQuery, 0, n)
+	for i := 0; i < n; i++ {
+		res = append(res, t.entries[(t.next-1-i+forwardTraceSize)%forwardTraceSize])
+	}
+	return res
+}
+
+// tracingUpstream records each query sent to the upstream in the trace
+type tracingUpstream struct {
+	upstream.Upstream
+	trace *forwardTrace
+}
+
+// Exchange queries the upstream and adds the query and the result to the trace
+func (u *tracingUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	res, err := u.Upstream.Exchange(req)
+
+	q := ForwardedQuery{
+		Time:      start,
+		Upstream:  u.Address(),
+		QueryID:   req.Id,
+		ElapsedMs: float64(time.Since(start).Nanoseconds()) / float64(time.Millisecond),
+	}
+	if len(req.Question) != 0 {
+		qq := req.Question[0]
+		q.Question = qq.Name + " " + dns.ClassToString[qq.Qclass] + " " + dns.TypeToString[qq.Qtype]
+	}
+	if err != nil {
+		q.Error = err.Error()
+	} else if res != nil {
+		q.ResponseCode = dns.RcodeToString[res.Rcode]
+	}
+	u.trace.add(q)
+
+	return res, err
+}
+
+// GetForwardedQueries returns the last queries sent to the upstreams while TraceForwarded was enabled
+func (s *Server) GetForwardedQueries() []ForwardedQuery {
+	s.RLock()
+	trace := s.forwardTrace
+	s.RUnlock()
+	if trace == nil {
+		return []ForwardedQuery{}
+	}
+	return trace.list()
+}
@@ -0,0 +1,134 @@
+package dnsforward
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// 2^hllPrecision registers are used, the standard error is 1.04/sqrt(2^hllPrecision), about 1.6%
+const hllPrecision = 12
+
+const hllRegisters = 1 << hllPrecision
+
+// number of the hourly buckets of the unique clients counter, 7 days
+const uniqueClientsHours = 7 * 24
+
+// hyperLogLog is the approximate distinct count of strings
+type hyperLogLog [hllRegisters]uint8
+
+func hllHash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	// fnv doesn't spread the short similar strings well enough, finish it with the splitmix64 mixer
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (h *hyperLogLog) add(s string) {
+	x := hllHash(s)
+	i := x >> (64 - hllPrecision)
+	rho := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rho > h[i] {
+		h[i] = rho
+	}
+}
+
+// merge adds the values counted by o
+func (h *hyperLogLog) merge(o *hyperLogLog) {
+	for i, v := range o {
+		if v > h[i] {
+			h[i] = v
+		}
+	}
+}
+
+// count returns the estimated number of distinct strings
+func (h *hyperLogLog) count() int64 {
+	const m = float64(hllRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	sum := 0.0
+	zeros := 0
+	for _, v := range h {
+		sum += 1 / float64(uint64(1)<<v)
+		if v == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha * m * m / sum
+	// linear counting is more precise for the small numbers
+	if estimate <= 2.5*m && zeros != 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// uniqueClients counts the distinct client IPs in the hourly buckets
+type uniqueClients struct {
+	hours      []*hyperLogLog // hours[0] is the current hour, nil if there were no clients
+	lastRotate time.Time
+
+	sync.Mutex
+}
+
+func newUniqueClients() *uniqueClients {
+	return &uniqueClients{
+		hours:      make([]*hyperLogLog, uniqueClientsHours),
+		lastRotate: time.Now(),
+	}
+}
+
+func (u *uniqueClients) add(ip string, when time.Time) {
+	u.Lock()
+	defer u.Unlock()
+	hour := int(u.lastRotate.Sub(when) / time.Hour)
+	if when.After(u.lastRotate) {
+		hour = 0
+	}
+	if hour >= uniqueClientsHours {
+		return // outside of our timeframe
+	}
+	if u.hours[hour] == nil {
+		u.hours[hour] = &hyperLogLog{}
+	}
+	u.hours[hour].add(ip)
+}
+
+func (u *uniqueClients) rotate(now time.Time) {
+	u.Lock()
+	rotations := int(now.Sub(u.lastRotate) / time.Hour)
+	if rotations > uniqueClientsHours {
+		rotations = uniqueClientsHours
+	}
+	if rotations > 0 {
+		hours := make([]*hyperLogLog, uniqueClientsHours)
+		copy(hours[rotations:], u.hours)
+		u.hours = hours
+		u.lastRotate = now
+	}
+	u.Unlock()
+}
+
+// count returns the approximate number of distinct clients in the last n hours
+func (u *uniqueClients) count(n int) int64 {
+	u.Lock()
+	defer u.Unlock()
+	if n > uniqueClientsHours {
+		n = uniqueClientsHours
+	}
+	total := hyperLogLog{}
+	for _, h := range u.hours[:n] {
+		if h != nil {
+			total.merge(h)
+		}
+	}
+	return total.count()
+}
@@ -0,0 +1,168 @@
+package dnsforward
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/hmage/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// DefaultPrefetchThreshold is the percentage of the original TTL left when the response is refreshed if PrefetchThreshold is 0
+const DefaultPrefetchThreshold = 10
+
+// maximum number of responses whose TTLs are tracked for prefetching
+const prefetchMaxItems = 10000
+
+type prefetchItem struct {
+	ttl        uint32    // TTL of the response when it was received
+	expire     time.Time // when the response expires
+	hits       int       // number of requests answered with the response
+	refreshing bool
+}
+
+// prefetcher refreshes the popular responses before they expire
+type prefetcher struct {
+	items map[string]*prefetchItem // upstreamCacheKey -> item
+	cache *upstreamCache           // refreshed responses, they're served instead of the older ones from the proxy cache
+
+	sync.Mutex
+}
+
+func newPrefetcher() *prefetcher {
+	return &prefetcher{
+		items: map[string]*prefetchItem{},
+		cache: newUpstreamCache(prefetchMaxItems),
+	}
+}
+
+// getPrefetched returns the refreshed response to the request, or nil if there is none
+func (s *Server) getPrefetched(req *dns.Msg) *dns.Msg {
+	s.RLock()
+	pf := s.prefetcher
+	s.RUnlock()
+	if pf == nil {
+		return nil
+	}
+	return pf.cache.get(req)
+}
+
+// checkPrefetch counts the request and starts refreshing the response in the background
+// if it was requested more than once and less than PrefetchThreshold percent of its TTL is left
+func (s *Server) checkPrefetch(p *proxy.Proxy, d *proxy.DNSContext) {
+	s.RLock()
+	pf := s.prefetcher
+	s.RUnlock()
+	if pf == nil || d.Res == nil || d.Res.Rcode != dns.RcodeSuccess {
+		return
+	}
+	key, ok := upstreamCacheKey(d.Req)
+	if !ok {
+		return
+	}
+	ttl := lowestTTL(d.Res)
+	if ttl == 0 {
+		return
+	}
+
+	threshold := s.PrefetchThreshold
+	if threshold == 0 {
+		threshold = DefaultPrefetchThreshold
+	}
+
+	now := time.Now()
+	pf.Lock()
+	item, ok := pf.items[key]
+	if !ok || (!item.refreshing && now.After(item.expire)) {
+		if !ok && len(pf.items) >= prefetchMaxItems {
+			pf.removeExpired(now)
+			if len(pf.items) >= prefetchMaxItems {
+				pf.Unlock()
+				return
+			}
+		}
+		item = &prefetchItem{ttl: ttl, expire: now.Add(time.Duration(ttl) * time.Second)}
+		pf.items[key] = item
+	}
+	item.hits++
+	refresh := !item.refreshing && item.hits > 1 &&
+		item.expire.Sub(now) < time.Duration(item.ttl)*time.Second*time.Duration(threshold)/100
+	if refresh {
+		item.refreshing = true
+	}
+	pf.Unlock()
+
+	if refresh {
+		go s.prefetchRefresh(p, pf, key, d.Req.Copy())
+	}
+}
+
+// removeExpired removes the items that weren't refreshed in time
+// prefetcher must be locked by the caller
+func (pf *prefetcher) removeExpired(now time.Time) {
+	for key, item := range pf.items {
+		if !item.refreshing && now.After(item.expire) {
+			delete(pf.items, key)
+		}
+	}
+}
+
+// prefetchRefresh sends the request directly to the upstreams so that the cached response isn't returned
+func (s *Server) prefetchRefresh(p *proxy.Proxy, pf *prefetcher, key string, req *dns.Msg) {
+	req.Id = dns.Id()
+	res, err := exchangeUncached(p.Upstreams, req)
+	if err == nil && res.Rcode != dns.RcodeSuccess {
+		err = fmt.Errorf("upstream returned %s", dns.RcodeToString[res.Rcode])
+	}
+	if err == nil {
+		pf.cache.set(req, res)
+	}
+
+	pf.Lock()
+	item := pf.items[key]
+	if err != nil || lowestTTL(res) == 0 {
+		delete(pf.items, key)
+	} else if item != nil {
+		item.ttl = lowestTTL(res)
+		item.expire = time.Now().Add(time.Duration(item.ttl) * time.Second)
+		item.hits = 0
+		item.refreshing = false
+	}
+	pf.Unlock()
+
+	if err != nil {
+		log.Tracef("Couldn't prefetch %s: %s", req.Question[0].Name, err)
+		return
+	}
+	log.Tracef("Prefetched %s", req.Question[0].Name)
+	s.stats.incWithTime(s.stats.prefetchRefreshed, time.Now())
+}
+
+// exchangeUncached tries the upstreams one by one bypassing their caches
+func exchangeUncached(upstreams []upstream.Upstream, req *dns.Msg) (*dns.Msg, error) {
+	err := errors.New("no upstreams")
+	for _, u := range upstreams {
+		if w, ok := u.(*weightedUpstreams); ok {
+			return exchangeUncached(w.upstreams, req)
+		}
+		cached, ok := u.(*cachedUpstream)
+		if ok {
+			u = cached.Upstream
+		}
+
+		var res *dns.Msg
+		res, err = u.Exchange(req)
+		if err != nil {
+			continue
+		}
+		if ok {
+			cached.cache.set(req, res)
+		}
+		return res, nil
+	}
+	return nil, err
+}
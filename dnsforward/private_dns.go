@@ -0,0 +1,71 @@
+package dnsforward
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultLocalDomainSuffix is the suffix of the local host names if LocalDomainSuffix is empty (RFC 8375)
+const DefaultLocalDomainSuffix = "home.arpa"
+
+// TTL of the records of the local hosts, it's short since the DHCP leases may change
+const localHostTTL = 60
+
+// answerLocal returns the response to the query for a local host name, or nil if the name isn't local
+// local names are never forwarded to the upstreams, unknown ones get NXDOMAIN
+func (s *Server) answerLocal(req *dns.Msg) *dns.Msg {
+	s.RLock()
+	enabled := s.PrivateDNS
+	suffix := s.LocalDomainSuffix
+	resolve := s.LocalHostHandler
+	s.RUnlock()
+	if !enabled || len(req.Question) != 1 {
+		return nil
+	}
+	if suffix == "" {
+		suffix = DefaultLocalDomainSuffix
+	}
+	suffix = dns.Fqdn(strings.ToLower(strings.Trim(suffix, ".")))
+
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(suffix, name) {
+		return nil
+	}
+
+	resp := dns.Msg{}
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+
+	host := strings.TrimSuffix(strings.TrimSuffix(name, suffix), ".")
+	if host == "" {
+		// the suffix itself exists, but has no records
+		return &resp
+	}
+
+	var ips []net.IP
+	if resolve != nil {
+		ips = resolve(host)
+	}
+	if len(ips) == 0 {
+		resp.Rcode = dns.RcodeNameError
+		return &resp
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: localHostTTL}
+	for _, ip := range ips {
+		ip4 := ip.To4()
+		switch {
+		case q.Qtype == dns.TypeA && ip4 != nil:
+			hdr.Rrtype = dns.TypeA
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip4})
+		case q.Qtype == dns.TypeAAAA && ip4 == nil:
+			hdr.Rrtype = dns.TypeAAAA
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return &resp
+}
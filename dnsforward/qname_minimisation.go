@@ -0,0 +1,365 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/hmage/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// rootServers are the name servers the iterative resolution starts with
+var rootServers = []string{
+	"198.41.0.4:53",     // a.root-servers.net
+	"199.9.14.201:53",   // b.root-servers.net
+	"192.33.4.12:53",    // c.root-servers.net
+	"199.7.91.13:53",    // d.root-servers.net
+	"192.203.230.10:53", // e.root-servers.net
+	"192.5.5.241:53",    // f.root-servers.net
+	"192.112.36.4:53",   // g.root-servers.net
+	"198.97.190.53:53",  // h.root-servers.net
+	"192.36.148.17:53",  // i.root-servers.net
+	"192.58.128.30:53",  // j.root-servers.net
+	"193.0.14.129:53",   // k.root-servers.net
+	"199.7.83.42:53",    // l.root-servers.net
+	"202.12.27.33:53",   // m.root-servers.net
+}
+
+// maximum number of the queries sent to the name servers while resolving one name
+const maxMinimisedQueries = 64
+
+// maximum length of the CNAME chain followed by the resolver
+const maxMinimisedCNAMEs = 8
+
+// timeout of each query sent to the name servers
+const minimisedQueryTimeout = 3 * time.Second
+
+// maximum number of the zones in the delegation cache
+const maxCachedDelegations = 10000
+
+// port of the name servers found in the referrals, it's changed by the tests
+var nameServerPort = "53"
+
+// encryptedUpstreamPrefixes are the schemes of DNS-over-TLS, DNS-over-HTTPS, DNS-over-QUIC and DNSCrypt upstreams
+var encryptedUpstreamPrefixes = []string{"tls://", "https://", "quic://", "sdns://"}
+
+// IsEncryptedUpstream returns true if the queries to the upstream are encrypted
+// QNAME minimisation can't be used with such upstreams: the name servers are always queried in plain text
+func IsEncryptedUpstream(address string) bool {
+	for _, prefix := range encryptedUpstreamPrefixes {
+		if strings.HasPrefix(strings.ToLower(address), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// minimisingResolver resolves the names iteratively starting from the root servers
+// each server gets only the labels it needs to refer to the next zone (QNAME minimisation, RFC 7816)
+// it's used instead of the upstreams, they're only asked for the addresses of the name servers without glue
+type minimisingResolver struct {
+	upstreams   []upstream.Upstream
+	delegations map[string]delegation // by zone name in lower case
+	sync.Mutex                        // protects delegations
+}
+
+// delegation is the name server addresses of a zone learned from a referral
+type delegation struct {
+	servers []string
+	expire  time.Time
+}
+
+func newMinimisingResolver(upstreams []upstream.Upstream) *minimisingResolver {
+	return &minimisingResolver{upstreams: upstreams, delegations: map[string]delegation{}}
+}
+
+// Address returns the name shown in the query log instead of the upstream address
+func (r *minimisingResolver) Address() string {
+	return "qname-minimisation"
+}
+
+// Exchange resolves the query and follows the CNAME chain of the answer
+func (r *minimisingResolver) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) == 0 {
+		return nil, fmt.Errorf("no question in the request")
+	}
+
+	resp, err := r.resolve(req)
+	if err != nil {
+		return nil, err
+	}
+
+	q := req.Question[0]
+	target := q.Name
+	for i := 0; i < maxMinimisedCNAMEs && q.Qtype != dns.TypeCNAME; i++ {
+		target = cnameTarget(resp.Answer, target, q.Qtype)
+		if target == "" {
+			break
+		}
+		next := new(dns.Msg)
+		next.SetQuestion(target, q.Qtype)
+		res, err := r.resolve(next)
+		if err != nil {
+			return nil, err
+		}
+		resp.Answer = append(resp.Answer, res.Answer...)
+		resp.Rcode = res.Rcode
+	}
+
+	resp.Id = req.Id
+	resp.Authoritative = false
+	resp.RecursionDesired = req.RecursionDesired
+	resp.RecursionAvailable = true
+	return resp, nil
+}
+
+// resolve sends the query to the servers of the zone the name belongs to
+// the zones are found by asking each level for the NS records of the name cut to one more label
+func (r *minimisingResolver) resolve(req *dns.Msg) (*dns.Msg, error) {
+	qname := req.Question[0].Name
+	labels := dns.SplitDomainName(qname)
+	zone, servers := r.closestDelegation(labels, time.Now())
+	n := dns.CountLabel(zone) // number of the labels of qname sent to the servers of the zone
+	for i := 0; i < maxMinimisedQueries; i++ {
+		n++
+		final := n >= len(labels)
+
+		var m *dns.Msg
+		if final {
+			m = req.Copy()
+			m.Id = dns.Id()
+		} else {
+			m = new(dns.Msg)
+			m.SetQuestion(dns.Fqdn(strings.Join(labels[len(labels)-n:], ".")), dns.TypeNS)
+		}
+		m.RecursionDesired = false
+		name := m.Question[0].Name
+
+		resp, err := r.exchange(m, servers)
+		if err != nil {
+			return nil, err
+		}
+
+		child, ns := referral(resp, zone, qname)
+		if child != "" {
+			addrs := r.nameServerAddresses(resp, ns)
+			if len(addrs) == 0 {
+				return nil, fmt.Errorf("no addresses of the name servers of %s", child)
+			}
+			log.Tracef("%s is delegated to %s", child, strings.Join(ns, ", "))
+			r.addDelegation(child, addrs, nsTTL(resp.Ns, child), time.Now())
+			zone, servers = child, addrs
+			n = dns.CountLabel(child)
+			continue
+		}
+		if final {
+			return resp, nil
+		}
+
+		if resp.Rcode == dns.RcodeNameError {
+			// there is nothing below a name that doesn't exist (RFC 8020)
+			res := new(dns.Msg)
+			res.SetRcode(req, dns.RcodeNameError)
+			res.Ns = resp.Ns
+			return res, nil
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return nil, fmt.Errorf("%s for %s from the servers of %s", dns.RcodeToString[resp.Rcode], name, zone)
+		}
+		if hasNS(resp.Answer, name) {
+			// the same servers are authoritative for the child zone
+			zone = name
+			r.addDelegation(zone, servers, nsTTL(resp.Answer, zone), time.Now())
+		}
+	}
+	return nil, fmt.Errorf("too many queries resolving %s", qname)
+}
+
+// closestDelegation returns the cached zone closest to the name and its servers, the root zone if there's none
+func (r *minimisingResolver) closestDelegation(labels []string, now time.Time) (string, []string) {
+	r.Lock()
+	defer r.Unlock()
+	for i := range labels {
+		zone := strings.ToLower(dns.Fqdn(strings.Join(labels[i:], ".")))
+		d, ok := r.delegations[zone]
+		if !ok {
+			continue
+		}
+		if now.After(d.expire) {
+			delete(r.delegations, zone)
+			continue
+		}
+		return zone, d.servers
+	}
+	return ".", rootServers
+}
+
+// addDelegation caches the servers of the zone for the TTL of its NS records
+func (r *minimisingResolver) addDelegation(zone string, servers []string, ttl uint32, now time.Time) {
+	if ttl == 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if len(r.delegations) >= maxCachedDelegations {
+		for z, d := range r.delegations {
+			if now.After(d.expire) {
+				delete(r.delegations, z)
+			}
+		}
+		if len(r.delegations) >= maxCachedDelegations {
+			r.delegations = map[string]delegation{}
+		}
+	}
+	r.delegations[strings.ToLower(zone)] = delegation{
+		servers: servers,
+		expire:  now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// exchange sends the query to the servers one by one until one of them responds
+func (r *minimisingResolver) exchange(m *dns.Msg, servers []string) (*dns.Msg, error) {
+	var lastErr error
+	for _, addr := range servers {
+		client := dns.Client{Net: "udp", Timeout: minimisedQueryTimeout}
+		resp, _, err := client.Exchange(m, addr)
+		if err == nil && resp.Truncated {
+			client.Net = "tcp"
+			resp, _, err = client.Exchange(m, addr)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+			lastErr = fmt.Errorf("%s from %s", dns.RcodeToString[resp.Rcode], addr)
+			continue
+		}
+		return resp, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no name servers")
+	}
+	return nil, lastErr
+}
+
+// nameServerAddresses returns the addresses of the name servers from the glue records
+// the names without glue are looked up with the upstreams
+func (r *minimisingResolver) nameServerAddresses(resp *dns.Msg, ns []string) []string {
+	addrs := []string{}
+	for _, rr := range resp.Extra {
+		if a, ok := rr.(*dns.A); ok && containsFold(ns, a.Hdr.Name) {
+			addrs = append(addrs, net.JoinHostPort(a.A.String(), nameServerPort))
+		}
+	}
+	if len(addrs) != 0 {
+		return addrs
+	}
+
+	for _, name := range ns {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		for _, u := range r.upstreams {
+			res, err := u.Exchange(m)
+			if err != nil {
+				continue
+			}
+			for _, rr := range res.Answer {
+				if a, ok := rr.(*dns.A); ok {
+					addrs = append(addrs, net.JoinHostPort(a.A.String(), nameServerPort))
+				}
+			}
+			break
+		}
+		if len(addrs) != 0 {
+			break
+		}
+	}
+	return addrs
+}
+
+// referral returns the child zone and its name servers if the response delegates a zone below the current one
+// the zone must contain qname, the other referrals are ignored
+func referral(resp *dns.Msg, zone string, qname string) (string, []string) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		return "", nil
+	}
+	child := ""
+	ns := []string{}
+	for _, rr := range resp.Ns {
+		rec, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		name := strings.ToLower(rec.Hdr.Name)
+		if child == "" {
+			if !dns.IsSubDomain(zone, name) || dns.CountLabel(name) <= dns.CountLabel(zone) || !dns.IsSubDomain(name, qname) {
+				return "", nil
+			}
+			child = name
+		}
+		if name == child {
+			ns = append(ns, rec.Ns)
+		}
+	}
+	return child, ns
+}
+
+// cnameTarget returns the target of the CNAME of the name if the answer has no records of the type for it
+func cnameTarget(answer []dns.RR, name string, qtype uint16) string {
+	target := ""
+	for _, rr := range answer {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		if rr.Header().Rrtype == qtype {
+			return ""
+		}
+		if c, ok := rr.(*dns.CNAME); ok {
+			target = c.Target
+		}
+	}
+	if target != "" && cnameTarget(answer, target, qtype) == "" && hasType(answer, target, qtype) {
+		// the upstream already included the rest of the chain
+		return ""
+	}
+	return target
+}
+
+func hasType(answer []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range answer {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsTTL returns the lowest TTL of the NS records of the name, 0 if there are none
+func nsTTL(rrs []dns.RR, name string) uint32 {
+	ttl := uint32(0)
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeNS && strings.EqualFold(h.Name, name) && (ttl == 0 || h.Ttl < ttl) {
+			ttl = h.Ttl
+		}
+	}
+	return ttl
+}
+
+func hasNS(answer []dns.RR, name string) bool {
+	return hasType(answer, name, dns.TypeNS)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,9 +1,13 @@
 package dnsforward
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,6 +25,19 @@ const (
 	queryLogFileName       = "querylog.json" // .gz added during compression
 	queryLogSize           = 5000            // maximum API response for /querylog
 	queryLogTopSize        = 500             // Keep in memory only top N values
+
+	// DefaultQueryLogMaxDays is the number of days the query log files are kept if QueryLogMaxDays is 0
+	DefaultQueryLogMaxDays = 7
+
+	// DefaultQueryLogMaxSizeMB is the maximum total size of the query log files if QueryLogMaxSizeMB is 0
+	DefaultQueryLogMaxSizeMB = 100
+)
+
+// query log client IP anonymization levels
+const (
+	AnonymizationNone    = "none"
+	AnonymizationPartial = "partial" // the last octet of IPv4 or the last 80 bits of IPv6 addresses are zeroed
+	AnonymizationFull    = "full"    // the addresses are replaced with HMAC-SHA256 pseudonyms
 )
 
 // queryLog is a structure that writes and reads the DNS query log
@@ -33,6 +50,18 @@ type queryLog struct {
 
 	queryLogCache []*logEntry
 	queryLogLock  sync.RWMutex
+
+	conf     queryLogConfig
+	confLock sync.RWMutex
+}
+
+// queryLogConfig is the part of the query log settings that can be changed without restarting the query log
+type queryLogConfig struct {
+	fileEnabled      bool   // if false, the query log is kept only in memory
+	maxDays          int    // number of days the query log files are kept
+	maxSizeMB        int    // maximum total size of the query log files in megabytes
+	anonymization    string // one of the Anonymization* values, the client IP addresses are anonymized with anonymize()
+	anonymizationKey []byte // HMAC key of AnonymizationFull
 }
 
 // newQueryLog creates a new instance of the query log
@@ -40,11 +69,96 @@ func newQueryLog(baseDir string) *queryLog {
 	l := &queryLog{
 		logFile:    filepath.Join(baseDir, queryLogFileName),
 		runningTop: &dayTop{},
+		conf:       queryLogConfig{fileEnabled: true, maxDays: DefaultQueryLogMaxDays, maxSizeMB: DefaultQueryLogMaxSizeMB},
 	}
 	l.runningTop.init()
 	return l
 }
 
+// configure applies the settings, if the client IP addresses must be anonymized, it's done for the entries in memory too
+func (l *queryLog) configure(conf queryLogConfig) {
+	if conf.maxDays <= 0 {
+		conf.maxDays = DefaultQueryLogMaxDays
+	}
+	if conf.maxSizeMB <= 0 {
+		conf.maxSizeMB = DefaultQueryLogMaxSizeMB
+	}
+	l.confLock.Lock()
+	l.conf = conf
+	l.confLock.Unlock()
+
+	if conf.anonymization == AnonymizationNone || conf.anonymization == "" {
+		return
+	}
+
+	// the entries are read without locks once they're taken from the lists, so they're replaced, not changed
+	// both lists share the same entries, the copies are shared too
+	copies := map[*logEntry]*logEntry{}
+	anonymized := func(entry *logEntry) *logEntry {
+		c, ok := copies[entry]
+		if !ok {
+			e := *entry
+			e.IP = conf.anonymize(entry.IP)
+			c = &e
+			copies[entry] = c
+		}
+		return c
+	}
+
+	l.logBufferLock.Lock()
+	for i, entry := range l.logBuffer {
+		l.logBuffer[i] = anonymized(entry)
+	}
+	l.logBufferLock.Unlock()
+
+	l.queryLogLock.Lock()
+	for i, entry := range l.queryLogCache {
+		l.queryLogCache[i] = anonymized(entry)
+	}
+	l.queryLogLock.Unlock()
+}
+
+func (l *queryLog) getConfig() queryLogConfig {
+	l.confLock.RLock()
+	defer l.confLock.RUnlock()
+	return l.conf
+}
+
+// anonymizeIP zeroes the last octet of IPv4 address or the last 80 bits of IPv6 address
+func anonymizeIP(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if ip4 := addr.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return addr.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// pseudonymizeIP replaces the IP address with its keyed hash, so the same client always gets the same pseudonym
+// the values which are not IP addresses are returned as is, since they are pseudonyms already
+func pseudonymizeIP(ip string, key []byte) string {
+	if net.ParseIP(ip) == nil {
+		return ip
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// anonymize returns the client IP address anonymized according to the settings
+func (c queryLogConfig) anonymize(ip string) string {
+	switch c.anonymization {
+	case AnonymizationPartial:
+		return anonymizeIP(ip)
+	case AnonymizationFull:
+		return pseudonymizeIP(ip, c.anonymizationKey)
+	default:
+		return ip
+	}
+}
+
 type logEntry struct {
 	Question []byte
 	Answer   []byte `json:",omitempty"` // sometimes empty answers happen like binerdunt.top or rev2.globalrootservers.net
@@ -55,11 +169,10 @@ type logEntry struct {
 	Upstream string `json:",omitempty"` // if empty, means it was cached
 }
 
-func (l *queryLog) logRequest(question *dns.Msg, answer *dns.Msg, result *dnsfilter.Result, elapsed time.Duration, addr net.Addr, upstream string) *logEntry {
+func (l *queryLog) logRequest(question *dns.Msg, answer *dns.Msg, result *dnsfilter.Result, elapsed time.Duration, ip string, upstream string) *logEntry {
 	var q []byte
 	var a []byte
 	var err error
-	ip := getIPString(addr)
 
 	if question != nil {
 		q, err = question.Pack()
@@ -81,6 +194,9 @@ func (l *queryLog) logRequest(question *dns.Msg, answer *dns.Msg, result *dnsfil
 		result = &dnsfilter.Result{}
 	}
 
+	conf := l.getConfig()
+	ip = conf.anonymize(ip)
+
 	now := time.Now()
 	entry := logEntry{
 		Question: q,
@@ -93,13 +209,15 @@ func (l *queryLog) logRequest(question *dns.Msg, answer *dns.Msg, result *dnsfil
 	}
 	var flushBuffer []*logEntry
 
-	l.logBufferLock.Lock()
-	l.logBuffer = append(l.logBuffer, &entry)
-	if len(l.logBuffer) >= logBufferCap {
-		flushBuffer = l.logBuffer
-		l.logBuffer = nil
+	if conf.fileEnabled {
+		l.logBufferLock.Lock()
+		l.logBuffer = append(l.logBuffer, &entry)
+		if len(l.logBuffer) >= logBufferCap {
+			flushBuffer = l.logBuffer
+			l.logBuffer = nil
+		}
+		l.logBufferLock.Unlock()
 	}
-	l.logBufferLock.Unlock()
 	l.queryLogLock.Lock()
 	l.queryLogCache = append(l.queryLogCache, &entry)
 	if len(l.queryLogCache) > queryLogSize {
@@ -130,6 +248,39 @@ func (l *queryLog) logRequest(question *dns.Msg, answer *dns.Msg, result *dnsfil
 	return &entry
 }
 
+// removeClient removes the client's entries from memory and, if they're saved to disk, from the query log files
+// it returns the number of removed entries
+func (l *queryLog) removeClient(ip string) (int, error) {
+	keep := func(entries []*logEntry) ([]*logEntry, int) {
+		result := []*logEntry{}
+		for _, entry := range entries {
+			if entry.IP != ip {
+				result = append(result, entry)
+			}
+		}
+		return result, len(entries) - len(result)
+	}
+
+	l.logBufferLock.Lock()
+	var removedBuffer int
+	l.logBuffer, removedBuffer = keep(l.logBuffer)
+	l.logBufferLock.Unlock()
+
+	l.queryLogLock.Lock()
+	var removedCache int
+	l.queryLogCache, removedCache = keep(l.queryLogCache)
+	l.queryLogLock.Unlock()
+
+	if !l.getConfig().fileEnabled {
+		// the entries are kept only in memory
+		return removedCache, nil
+	}
+
+	// each entry is either in the buffer or already in the file, the cache has the same entries
+	removedFiles, err := l.removeClientFromFiles(ip)
+	return removedBuffer + removedFiles, err
+}
+
 // getQueryLogJson returns a map with the current query log ready to be converted to a JSON
 func (l *queryLog) getQueryLog() []map[string]interface{} {
 	l.queryLogLock.RLock()
@@ -198,6 +349,43 @@ func (l *queryLog) getQueryLog() []map[string]interface{} {
 	return data
 }
 
+// RuleHits is the number of queries blocked by the filtering rule
+type RuleHits struct {
+	Rule     string
+	FilterID int64
+	Hits     int
+}
+
+// getTopBlockedRules returns the rules that blocked queries in the recent query log, sorted by hits descending
+func (l *queryLog) getTopBlockedRules() []RuleHits {
+	type ruleKey struct {
+		rule     string
+		filterID int64
+	}
+	hits := map[ruleKey]int{}
+
+	l.queryLogLock.RLock()
+	for _, entry := range l.queryLogCache {
+		if !entry.Result.IsFiltered || entry.Result.Rule == "" {
+			continue
+		}
+		hits[ruleKey{entry.Result.Rule, entry.Result.FilterID}]++
+	}
+	l.queryLogLock.RUnlock()
+
+	result := make([]RuleHits, 0, len(hits))
+	for k, v := range hits {
+		result = append(result, RuleHits{Rule: k.rule, FilterID: k.filterID, Hits: v})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Hits != result[j].Hits {
+			return result[i].Hits > result[j].Hits
+		}
+		return result[i].Rule < result[j].Rule
+	})
+	return result
+}
+
 func answerToMap(a *dns.Msg) []map[string]interface{} {
 	if a == nil || len(a.Answer) == 0 {
 		return nil
@@ -0,0 +1,137 @@
+package dnsforward
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hmage/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	anomalyHighRateFactor     = 10        // client is suspicious if it makes this many times more queries than the average of the other clients
+	anomalyBeaconingQueries   = 50        // single-client domain is suspicious if it's queried more than this
+	anomalyNewDomainThreshold = time.Hour // domain is new if it was first seen within this period
+)
+
+// Anomaly is an unusual pattern found in the query log
+type Anomaly struct {
+	Type    string                 `json:"type"` // one of high_rate, beaconing or new_domain
+	Client  string                 `json:"client"`
+	Details map[string]interface{} `json:"details"`
+}
+
+type domainActivity struct {
+	queries   int
+	clients   map[string]int
+	firstSeen time.Time
+	firstBy   string
+}
+
+// getAnomalies scans the query log for the last 24 hours and returns the found anomalies
+func (l *queryLog) getAnomalies() ([]Anomaly, error) {
+	clients := map[string]int{}
+	domains := map[string]*domainActivity{}
+
+	onEntry := func(entry *logEntry) error {
+		if len(entry.Question) == 0 {
+			return nil
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(entry.Question); err != nil {
+			log.Tracef("failed to unpack dns message question: %s", err)
+			return nil
+		}
+		if len(q.Question) != 1 {
+			return nil
+		}
+		host := strings.ToLower(strings.TrimSuffix(q.Question[0].Name, "."))
+
+		clients[entry.IP]++
+		d, ok := domains[host]
+		if !ok {
+			d = &domainActivity{clients: map[string]int{}, firstSeen: entry.Time, firstBy: entry.IP}
+			domains[host] = d
+		}
+		d.queries++
+		d.clients[entry.IP]++
+		if entry.Time.Before(d.firstSeen) {
+			d.firstSeen = entry.Time
+			d.firstBy = entry.IP
+		}
+		return nil
+	}
+
+	needMore := func() bool { return true }
+	err := l.genericLoader(onEntry, needMore, queryLogTimeLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	// entries that are not flushed to the file yet
+	l.logBufferLock.RLock()
+	buffer := make([]*logEntry, len(l.logBuffer))
+	copy(buffer, l.logBuffer)
+	l.logBufferLock.RUnlock()
+	for _, entry := range buffer {
+		_ = onEntry(entry)
+	}
+
+	result := highRateClients(clients)
+
+	now := time.Now()
+	for host, d := range domains {
+		if len(d.clients) == 1 && d.queries > anomalyBeaconingQueries {
+			result = append(result, Anomaly{
+				Type:    "beaconing",
+				Client:  d.firstBy,
+				Details: map[string]interface{}{"domain": host, "queries": d.queries},
+			})
+		}
+		if now.Sub(d.firstSeen) < anomalyNewDomainThreshold {
+			result = append(result, Anomaly{
+				Type:    "new_domain",
+				Client:  d.firstBy,
+				Details: map[string]interface{}{"domain": host, "first_seen": d.firstSeen.Format(time.RFC3339)},
+			})
+		}
+	}
+
+	sortAnomalies(result)
+	return result, nil
+}
+
+// highRateClients returns the clients that make many more queries than the others
+// each client is compared with the average of the other clients, so that its own queries don't raise the average
+// clients is the number of queries of each client
+func highRateClients(clients map[string]int) []Anomaly {
+	result := []Anomaly{}
+	if len(clients) < 2 {
+		return result
+	}
+	total := 0
+	for _, n := range clients {
+		total += n
+	}
+	for ip, n := range clients {
+		avg := float64(total-n) / float64(len(clients)-1)
+		if float64(n) > avg*anomalyHighRateFactor {
+			result = append(result, Anomaly{
+				Type:    "high_rate",
+				Client:  ip,
+				Details: map[string]interface{}{"queries": n, "average": avg},
+			})
+		}
+	}
+	return result
+}
+
+func sortAnomalies(result []Anomaly) {
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Type != result[j].Type {
+			return result[i].Type < result[j].Type
+		}
+		return result[i].Client < result[j].Client
+	})
+}
@@ -1,10 +1,13 @@
 package dnsforward
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"time"
@@ -36,7 +39,7 @@ func (l *queryLog) flushLogBuffer() error {
 
 // flushToFile saves the specified log entries to the query log file
 func (l *queryLog) flushToFile(buffer []*logEntry) error {
-	if len(buffer) == 0 {
+	if len(buffer) == 0 || !l.getConfig().fileEnabled {
 		return nil
 	}
 	start := time.Now()
@@ -134,27 +137,51 @@ func checkBuffer(buffer []*logEntry, b bytes.Buffer) error {
 	return nil
 }
 
-func (l *queryLog) rotateQueryLog() error {
-	from := l.logFile
-	to := l.logFile + ".1"
-
+// rotatedFileName returns the name of the query log file rotated n times, n is 0 for the current file
+func (l *queryLog) rotatedFileName(n int) string {
+	name := l.logFile
 	if enableGzip {
-		from = l.logFile + ".gz"
-		to = l.logFile + ".gz.1"
+		name += ".gz"
 	}
-
-	if _, err := os.Stat(from); os.IsNotExist(err) {
-		// do nothing, file doesn't exist
-		return nil
+	if n > 0 {
+		name += fmt.Sprintf(".%d", n)
 	}
+	return name
+}
 
-	err := os.Rename(from, to)
-	if err != nil {
-		log.Printf("Failed to rename querylog: %s", err)
-		return err
-	}
+// rotateQueryLog renames the current file to .1, .1 to .2 and so on
+// the files older than maxDays are removed
+func (l *queryLog) rotateQueryLog() error {
+	maxDays := l.getConfig().maxDays
+
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
 
-	log.Printf("Rotated from %s to %s successfully", from, to)
+	for n := maxDays - 1; n >= 0; n-- {
+		from := l.rotatedFileName(n)
+		if _, err := os.Stat(from); os.IsNotExist(err) {
+			// do nothing, file doesn't exist
+			continue
+		}
+
+		if n+1 >= maxDays {
+			err := os.Remove(from)
+			if err != nil {
+				log.Printf("Failed to remove old querylog: %s", err)
+				return err
+			}
+			log.Printf("Removed old querylog %s", from)
+			continue
+		}
+
+		to := l.rotatedFileName(n + 1)
+		err := os.Rename(from, to)
+		if err != nil {
+			log.Printf("Failed to rename querylog: %s", err)
+			return err
+		}
+		log.Printf("Rotated from %s to %s successfully", from, to)
+	}
 
 	return nil
 }
@@ -172,19 +199,11 @@ func (l *queryLog) periodicQueryLogRotate() {
 func (l *queryLog) genericLoader(onEntry func(entry *logEntry) error, needMore func() bool, timeWindow time.Duration) error {
 	now := time.Now()
 	// read from querylog files, try newest file first
-	var files []string
-
-	if enableGzip {
-		files = []string{
-			l.logFile + ".gz",
-			l.logFile + ".gz.1",
-		}
-	} else {
-		files = []string{
-			l.logFile,
-			l.logFile + ".1",
-		}
+	files := []string{
+		l.rotatedFileName(0),
+		l.rotatedFileName(1),
 	}
+	conf := l.getConfig()
 
 	// read from all files
 	for _, file := range files {
@@ -241,6 +260,8 @@ func (l *queryLog) genericLoader(onEntry func(entry *logEntry) error, needMore f
 				continue
 			}
 
+			entry.IP = conf.anonymize(entry.IP)
+
 			if entry.Elapsed > max {
 				over++
 			} else {
@@ -264,3 +285,175 @@ func (l *queryLog) genericLoader(onEntry func(entry *logEntry) error, needMore f
 	}
 	return nil
 }
+
+// removeClientFromFiles removes the client's entries from all query log files
+func (l *queryLog) removeClientFromFiles(ip string) (int, error) {
+	if enableGzip {
+		return 0, errors.New("removing entries from compressed query log files is not supported")
+	}
+
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
+
+	removed := 0
+	for _, file := range l.existingFiles() {
+		r, err := filterFile(file, func(entry *logEntry, size int) bool {
+			return entry.IP == ip
+		})
+		if err != nil {
+			return removed, err
+		}
+		if r > 0 {
+			log.Printf("Removed %d entries of %s from %s", r, ip, file)
+		}
+		removed += r
+	}
+	return removed, nil
+}
+
+// existingFiles returns the query log files that exist, oldest first
+func (l *queryLog) existingFiles() []string {
+	files := []string{}
+	for n := l.getConfig().maxDays - 1; n >= 0; n-- {
+		file := l.rotatedFileName(n)
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// filterFile removes the entries for which remove returns true from the query log file
+// the file is copied to a temporary file without these entries and then renamed back
+// remove gets the decoded entry and its size in bytes, the lines that can't be decoded are kept
+func filterFile(file string, remove func(entry *logEntry, size int) bool) (int, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	tmpFile := file + ".tmp"
+	out, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	r := bufio.NewReader(in)
+	w := bufio.NewWriter(out)
+	for {
+		var line []byte
+		line, err = r.ReadBytes('\n')
+		if len(line) > 0 {
+			entry := logEntry{}
+			if json.Unmarshal(line, &entry) == nil && remove(&entry, len(line)) {
+				removed++
+			} else if _, werr := w.Write(line); werr != nil {
+				err = werr
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = w.Flush()
+	}
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil && removed > 0 {
+		err = os.Rename(tmpFile, file)
+	}
+	if err != nil || removed == 0 {
+		_ = os.Remove(tmpFile)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// pruneQueryLog removes the entries older than maxDays and, if the files are larger than maxSizeMB, the oldest entries
+func (l *queryLog) pruneQueryLog() error {
+	if enableGzip {
+		return errors.New("pruning compressed query log files is not supported")
+	}
+	conf := l.getConfig()
+
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
+
+	files := l.existingFiles()
+	oldest := time.Now().Add(-time.Duration(conf.maxDays) * queryLogRotationPeriod)
+	var total int64
+	for _, file := range files {
+		removed, err := filterFile(file, func(entry *logEntry, size int) bool {
+			return entry.Time.Before(oldest)
+		})
+		if err != nil {
+			return err
+		}
+		if removed > 0 {
+			log.Printf("Removed %d entries older than %d days from %s", removed, conf.maxDays, file)
+		}
+
+		fi, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		total += fi.Size()
+	}
+
+	excess := total - int64(conf.maxSizeMB)*1024*1024
+	for _, file := range files {
+		if excess <= 0 {
+			break
+		}
+		fi, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		if fi.Size() <= excess {
+			err = os.Remove(file)
+			if err != nil {
+				return err
+			}
+			log.Printf("Removed %s because the query log is larger than %d MB", file, conf.maxSizeMB)
+			excess -= fi.Size()
+			continue
+		}
+
+		// entries in the file are in oldest->newest order
+		removed, err := filterFile(file, func(entry *logEntry, size int) bool {
+			if excess <= 0 {
+				return false
+			}
+			excess -= int64(size)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Removed %d oldest entries from %s because the query log is larger than %d MB", removed, file, conf.maxSizeMB)
+	}
+	return nil
+}
+
+// periodicQueryLogPrune prunes the query log files every day at midnight
+func (l *queryLog) periodicQueryLogPrune() {
+	for {
+		now := time.Now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		time.Sleep(midnight.Sub(now))
+
+		err := l.pruneQueryLog()
+		if err != nil {
+			log.Printf("Failed to prune querylog: %s", err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package dnsforward
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hmage/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// query log syslog protocols
+const (
+	SyslogProtocolLocal = "local" // the local syslog daemon
+	SyslogProtocolUDP   = "udp"
+	SyslogProtocolTCP   = "tcp"
+)
+
+// query log syslog message formats, they're used for the remote servers only
+const (
+	SyslogFormatRFC5424 = "rfc5424"
+	SyslogFormatRFC3164 = "rfc3164"
+)
+
+const (
+	syslogTag         = "AdGuardHome"
+	syslogQueueSize   = 1000 // entries that are waiting to be sent, new entries are dropped if it's full
+	syslogDialTimeout = 5 * time.Second
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// QueryLogSyslog is the settings of sending the query log entries to a syslog server
+type QueryLogSyslog struct {
+	Enabled  bool   `yaml:"enabled" json:"enabled"`
+	Protocol string `yaml:"protocol" json:"protocol"` // one of the SyslogProtocol* values
+	Address  string `yaml:"address" json:"address"`   // host:port of the remote server, not used for SyslogProtocolLocal
+	Facility string `yaml:"facility" json:"facility"` // e.g. "daemon" or "local0"
+	Severity string `yaml:"severity" json:"severity"` // e.g. "info"
+	Format   string `yaml:"format" json:"format"`     // one of the SyslogFormat* values
+}
+
+// NormalizeQueryLogSyslog validates the settings and sets the default values of the empty fields
+func NormalizeQueryLogSyslog(c *QueryLogSyslog) error {
+	c.Protocol = strings.ToLower(c.Protocol)
+	c.Facility = strings.ToLower(c.Facility)
+	c.Severity = strings.ToLower(c.Severity)
+	c.Format = strings.ToLower(c.Format)
+	if c.Protocol == "" {
+		c.Protocol = SyslogProtocolUDP
+	}
+	if c.Facility == "" {
+		c.Facility = "daemon"
+	}
+	if c.Severity == "" {
+		c.Severity = "info"
+	}
+	if c.Format == "" {
+		c.Format = SyslogFormatRFC5424
+	}
+
+	switch c.Protocol {
+	case SyslogProtocolLocal:
+	case SyslogProtocolUDP, SyslogProtocolTCP:
+		_, port, err := net.SplitHostPort(c.Address)
+		if err != nil {
+			return fmt.Errorf("invalid address %s: %s", c.Address, err)
+		}
+		if port == "" {
+			return fmt.Errorf("invalid address %s: port is required", c.Address)
+		}
+	default:
+		return fmt.Errorf("invalid protocol: %s", c.Protocol)
+	}
+	if _, ok := syslogFacilities[c.Facility]; !ok {
+		return fmt.Errorf("invalid facility: %s", c.Facility)
+	}
+	if _, ok := syslogSeverities[c.Severity]; !ok {
+		return fmt.Errorf("invalid severity: %s", c.Severity)
+	}
+	if c.Format != SyslogFormatRFC5424 && c.Format != SyslogFormatRFC3164 {
+		return fmt.Errorf("invalid format: %s", c.Format)
+	}
+	return nil
+}
+
+// querySyslog sends the query log entries to syslog in the background
+type querySyslog struct {
+	conf     QueryLogSyslog
+	priority int
+	hostname string
+	queue    chan string
+	done     chan struct{}  // closed when sending must be stopped
+	w        io.WriteCloser // nil until connected
+	lastErr  string         // the last error is logged only once
+}
+
+func newQuerySyslog(conf QueryLogSyslog) (*querySyslog, error) {
+	err := NormalizeQueryLogSyslog(&conf)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	l := &querySyslog{
+		conf:     conf,
+		priority: syslogFacilities[conf.Facility]*8 + syslogSeverities[conf.Severity],
+		hostname: hostname,
+		queue:    make(chan string, syslogQueueSize),
+		done:     make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+// close stops sending, the entries that are still in the queue are dropped
+func (l *querySyslog) close() {
+	close(l.done)
+}
+
+// send queues the entry, it doesn't block if the syslog server is slow
+func (l *querySyslog) send(entry *logEntry, question *dns.Msg, answer *dns.Msg) {
+	msg := formatSyslogEntry(entry, question, answer)
+	select {
+	case l.queue <- msg:
+	default:
+		log.Tracef("Syslog queue is full, dropping the query log entry")
+	}
+}
+
+func (l *querySyslog) run() {
+	for {
+		select {
+		case msg := <-l.queue:
+			err := l.write(msg)
+			if err == nil {
+				l.lastErr = ""
+			} else if err.Error() != l.lastErr {
+				l.lastErr = err.Error()
+				log.Printf("Couldn't send the query log entry to syslog: %s", err)
+			}
+		case <-l.done:
+			if l.w != nil {
+				l.w.Close()
+			}
+			return
+		}
+	}
+}
+
+// write sends the message, the connection is reopened if it was broken
+func (l *querySyslog) write(msg string) error {
+	if l.w == nil {
+		w, err := l.dial()
+		if err != nil {
+			return err
+		}
+		l.w = w
+	}
+
+	_, err := io.WriteString(l.w, l.format(msg))
+	if err != nil {
+		l.w.Close()
+		l.w = nil
+	}
+	return err
+}
+
+func (l *querySyslog) dial() (io.WriteCloser, error) {
+	if l.conf.Protocol == SyslogProtocolLocal {
+		return dialLocalSyslog(l.priority, syslogTag)
+	}
+	return net.DialTimeout(l.conf.Protocol, l.conf.Address, syslogDialTimeout)
+}
+
+// format adds the syslog header to the message, the local syslog writer adds its own header
+func (l *querySyslog) format(msg string) string {
+	if l.conf.Protocol == SyslogProtocolLocal {
+		return msg
+	}
+
+	now := time.Now()
+	var line string
+	if l.conf.Format == SyslogFormatRFC3164 {
+		line = fmt.Sprintf("<%d>%s %s %s[%d]: %s", l.priority, now.Format(time.Stamp), l.hostname, syslogTag, os.Getpid(), msg)
+	} else {
+		line = fmt.Sprintf("<%d>1 %s %s %s %d - - %s", l.priority, now.Format(time.RFC3339Nano), l.hostname, syslogTag, os.Getpid(), msg)
+	}
+	// messages are separated by the newlines in TCP streams (RFC 6587 non-transparent framing)
+	if l.conf.Protocol == SyslogProtocolTCP {
+		line += "\n"
+	}
+	return line
+}
+
+// formatSyslogEntry returns the query log entry as key=value pairs
+func formatSyslogEntry(entry *logEntry, question *dns.Msg, answer *dns.Msg) string {
+	qname, qtype := "", ""
+	if question != nil && len(question.Question) != 0 {
+		qname = strings.TrimSuffix(question.Question[0].Name, ".")
+		qtype = dns.TypeToString[question.Question[0].Qtype]
+	}
+	rcode := ""
+	if answer != nil {
+		rcode = dns.RcodeToString[answer.Rcode]
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "client=%s qname=%s qtype=%s rcode=%s elapsed_ms=%d", entry.IP, qname, qtype, rcode, entry.Elapsed.Nanoseconds()/int64(time.Millisecond))
+	if entry.Result.IsFiltered {
+		fmt.Fprintf(b, " reason=%s", entry.Result.Reason.String())
+		if entry.Result.Rule != "" {
+			fmt.Fprintf(b, " rule=%q", entry.Result.Rule)
+		}
+	}
+	if entry.Upstream != "" {
+		fmt.Fprintf(b, " upstream=%s", entry.Upstream)
+	}
+	return b.String()
+}
@@ -0,0 +1,13 @@
+// +build windows nacl plan9
+
+package dnsforward
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+func dialLocalSyslog(priority int, tag string) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("local syslog is not supported on %s", runtime.GOOS)
+}
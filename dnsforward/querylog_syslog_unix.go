@@ -0,0 +1,13 @@
+// +build !windows,!nacl,!plan9
+
+package dnsforward
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// dialLocalSyslog connects to the local syslog daemon
+func dialLocalSyslog(priority int, tag string) (io.WriteCloser, error) {
+	return syslog.New(syslog.Priority(priority), tag)
+}
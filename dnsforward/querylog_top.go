@@ -15,9 +15,14 @@ import (
 )
 
 type hourTop struct {
-	domains gcache.Cache
-	blocked gcache.Cache
-	clients gcache.Cache
+	domains        gcache.Cache
+	blocked        gcache.Cache
+	clients        gcache.Cache
+	blockedClients gcache.Cache
+
+	upstreams       gcache.Cache // number of queries answered by the upstream
+	upstreamErrors  gcache.Cache // number of SERVFAIL responses and unanswered queries
+	upstreamElapsed gcache.Cache // total processing time of the answered queries in microseconds
 
 	mutex sync.RWMutex
 }
@@ -26,6 +31,10 @@ func (h *hourTop) init() {
 	h.domains = gcache.New(queryLogTopSize).LRU().Build()
 	h.blocked = gcache.New(queryLogTopSize).LRU().Build()
 	h.clients = gcache.New(queryLogTopSize).LRU().Build()
+	h.blockedClients = gcache.New(queryLogTopSize).LRU().Build()
+	h.upstreams = gcache.New(queryLogTopSize).LRU().Build()
+	h.upstreamErrors = gcache.New(queryLogTopSize).LRU().Build()
+	h.upstreamElapsed = gcache.New(queryLogTopSize).LRU().Build()
 }
 
 type dayTop struct {
@@ -64,12 +73,16 @@ func (d *dayTop) periodicHourlyTopRotate() {
 }
 
 func (h *hourTop) incrementValue(key string, cache gcache.Cache) error {
+	return h.addValue(key, 1, cache)
+}
+
+func (h *hourTop) addValue(key string, n int, cache gcache.Cache) error {
 	h.Lock()
 	defer h.Unlock()
 	ivalue, err := cache.Get(key)
 	if err == gcache.KeyNotFoundError {
 		// we just set it and we're done
-		err = cache.Set(key, 1)
+		err = cache.Set(key, n)
 		if err != nil {
 			log.Printf("Failed to set hourly top value: %s", err)
 			return err
@@ -89,7 +102,7 @@ func (h *hourTop) incrementValue(key string, cache gcache.Cache) error {
 		return err
 	}
 
-	err = cache.Set(key, cachedValue+1)
+	err = cache.Set(key, cachedValue+n)
 	if err != nil {
 		log.Printf("Failed to set hourly top value: %s", err)
 		return err
@@ -109,6 +122,22 @@ func (h *hourTop) incrementClients(key string) error {
 	return h.incrementValue(key, h.clients)
 }
 
+func (h *hourTop) incrementBlockedClients(key string) error {
+	return h.incrementValue(key, h.blockedClients)
+}
+
+func (h *hourTop) incrementUpstreams(key string) error {
+	return h.incrementValue(key, h.upstreams)
+}
+
+func (h *hourTop) incrementUpstreamErrors(key string) error {
+	return h.incrementValue(key, h.upstreamErrors)
+}
+
+func (h *hourTop) addUpstreamElapsed(key string, us int) error {
+	return h.addValue(key, us, h.upstreamElapsed)
+}
+
 // if does not exist -- return 0
 func (h *hourTop) lockedGetValue(key string, cache gcache.Cache) (int, error) {
 	ivalue, err := cache.Get(key)
@@ -143,6 +172,22 @@ func (h *hourTop) lockedGetClients(key string) (int, error) {
 	return h.lockedGetValue(key, h.clients)
 }
 
+func (h *hourTop) lockedGetBlockedClients(key string) (int, error) {
+	return h.lockedGetValue(key, h.blockedClients)
+}
+
+func (h *hourTop) lockedGetUpstreams(key string) (int, error) {
+	return h.lockedGetValue(key, h.upstreams)
+}
+
+func (h *hourTop) lockedGetUpstreamErrors(key string) (int, error) {
+	return h.lockedGetValue(key, h.upstreamErrors)
+}
+
+func (h *hourTop) lockedGetUpstreamElapsed(key string) (int, error) {
+	return h.lockedGetValue(key, h.upstreamElapsed)
+}
+
 func (d *dayTop) addEntry(entry *logEntry, q *dns.Msg, now time.Time) error {
 	// figure out which hour bucket it belongs to
 	hour := int(now.Sub(entry.Time).Hours())
@@ -181,11 +226,55 @@ func (d *dayTop) addEntry(entry *logEntry, q *dns.Msg, now time.Time) error {
 			log.Printf("Failed to increment value: %s", err)
 			return err
 		}
+
+		if entry.Result.IsFiltered {
+			err := d.hours[hour].incrementBlockedClients(entry.IP)
+			if err != nil {
+				log.Printf("Failed to increment value: %s", err)
+				return err
+			}
+		}
+	}
+
+	// cached responses don't have the upstream
+	if entry.Upstream != "" {
+		err := d.hours[hour].incrementUpstreams(entry.Upstream)
+		if err != nil {
+			log.Printf("Failed to increment value: %s", err)
+			return err
+		}
+		err = d.hours[hour].addUpstreamElapsed(entry.Upstream, int(entry.Elapsed/time.Microsecond))
+		if err != nil {
+			log.Printf("Failed to increment value: %s", err)
+			return err
+		}
+
+		a := new(dns.Msg)
+		if a.Unpack(entry.Answer) == nil && a.Rcode == dns.RcodeServerFailure {
+			err = d.hours[hour].incrementUpstreamErrors(entry.Upstream)
+			if err != nil {
+				log.Printf("Failed to increment value: %s", err)
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
+// addUpstreamErrors counts a query that none of the upstreams could answer as an error of each of them
+func (d *dayTop) addUpstreamErrors(upstreams []string) {
+	d.hoursReadLock()
+	defer d.hoursReadUnlock()
+	for _, u := range upstreams {
+		err := d.hours[0].incrementUpstreamErrors(u)
+		if err != nil {
+			log.Printf("Failed to increment value: %s", err)
+			return
+		}
+	}
+}
+
 func (l *queryLog) fillStatsFromQueryLog(s *stats) error {
 	now := time.Now()
 	l.runningTop.loadedWriteLock()
@@ -244,11 +333,29 @@ func (l *queryLog) fillStatsFromQueryLog(s *stats) error {
 	return nil
 }
 
+// removeClient removes the client from the top clients charts
+func (d *dayTop) removeClient(ip string) {
+	d.hoursReadLock()
+	for hour := 0; hour < 24; hour++ {
+		d.hours[hour].Lock()
+		d.hours[hour].clients.Remove(ip)
+		d.hours[hour].blockedClients.Remove(ip)
+		d.hours[hour].Unlock()
+	}
+	d.hoursReadUnlock()
+}
+
 // StatsTop represents top stat charts
 type StatsTop struct {
 	Domains map[string]int // Domains - top requested domains
 	Blocked map[string]int // Blocked - top blocked domains
 	Clients map[string]int // Clients - top DNS clients
+
+	BlockedClients map[string]int // BlockedClients - DNS clients with the most blocked queries
+
+	Upstreams       map[string]int // Upstreams - number of queries answered by each upstream
+	UpstreamErrors  map[string]int // UpstreamErrors - SERVFAIL responses and queries that none of the upstreams answered
+	UpstreamElapsed map[string]int // UpstreamElapsed - total processing time of the answered queries in microseconds
 }
 
 // getStatsTop returns the current top stats
@@ -257,6 +364,12 @@ func (d *dayTop) getStatsTop() *StatsTop {
 		Domains: map[string]int{},
 		Blocked: map[string]int{},
 		Clients: map[string]int{},
+
+		BlockedClients: map[string]int{},
+
+		Upstreams:       map[string]int{},
+		UpstreamErrors:  map[string]int{},
+		UpstreamElapsed: map[string]int{},
 	}
 
 	do := func(keys []interface{}, getter func(key string) (int, error), result map[string]int) {
@@ -280,6 +393,10 @@ func (d *dayTop) getStatsTop() *StatsTop {
 		do(d.hours[hour].domains.Keys(), d.hours[hour].lockedGetDomains, s.Domains)
 		do(d.hours[hour].blocked.Keys(), d.hours[hour].lockedGetBlocked, s.Blocked)
 		do(d.hours[hour].clients.Keys(), d.hours[hour].lockedGetClients, s.Clients)
+		do(d.hours[hour].blockedClients.Keys(), d.hours[hour].lockedGetBlockedClients, s.BlockedClients)
+		do(d.hours[hour].upstreams.Keys(), d.hours[hour].lockedGetUpstreams, s.Upstreams)
+		do(d.hours[hour].upstreamErrors.Keys(), d.hours[hour].lockedGetUpstreamErrors, s.UpstreamErrors)
+		do(d.hours[hour].upstreamElapsed.Keys(), d.hours[hour].lockedGetUpstreamElapsed, s.UpstreamElapsed)
 		d.hours[hour].RUnlock()
 	}
 	d.hoursReadUnlock()
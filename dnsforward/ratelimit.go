@@ -0,0 +1,74 @@
+package dnsforward
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the number of queries from each client IP with a token bucket
+// the bucket holds one second of queries, so short bursts up to the rate are allowed
+type rateLimiter struct {
+	rate      float64         // queries per second
+	whitelist map[string]bool // IPs that are never limited
+	buckets   map[string]*tokenBucket
+	lastPurge time.Time
+
+	sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // when tokens was updated
+}
+
+func newRateLimiter(rate int, whitelist []string) *rateLimiter {
+	l := &rateLimiter{
+		rate:      float64(rate),
+		whitelist: map[string]bool{},
+		buckets:   map[string]*tokenBucket{},
+		lastPurge: time.Now(),
+	}
+	for _, ip := range whitelist {
+		l.whitelist[ip] = true
+	}
+	return l
+}
+
+// allow takes a token from the client's bucket, it returns false if the bucket is empty
+func (l *rateLimiter) allow(ip string, now time.Time) bool {
+	if l.whitelist[ip] {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if now.Sub(l.lastPurge) >= time.Minute {
+		l.purge(now)
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.rate, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.rate {
+		b.tokens = l.rate
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// purge removes the buckets that are full again, they're the same as the new ones
+func (l *rateLimiter) purge(now time.Time) {
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.rate {
+			delete(l.buckets, ip)
+		}
+	}
+	l.lastPurge = now
+}
@@ -0,0 +1,94 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// ResponseFilterRemoveRecord removes the A and AAAA records with the matched address from the answer
+const ResponseFilterRemoveRecord = "remove_record"
+
+// ResponseFilter is applied to the upstream answers before they're cached and sent to the clients
+type ResponseFilter struct {
+	Name    string `yaml:"name" json:"name"`
+	Action  string `yaml:"action" json:"action"` // only ResponseFilterRemoveRecord is supported
+	MatchIP string `yaml:"match_ip" json:"match_ip"`
+}
+
+// NormalizeResponseFilter validates the filter and converts the address to the canonical form
+func NormalizeResponseFilter(f *ResponseFilter) error {
+	f.Name = strings.TrimSpace(f.Name)
+	if f.Name == "" {
+		return fmt.Errorf("name must not be empty")
+	}
+	if f.Action != ResponseFilterRemoveRecord {
+		return fmt.Errorf("invalid action: %s, must be %s", f.Action, ResponseFilterRemoveRecord)
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(f.MatchIP))
+	if ip == nil {
+		return fmt.Errorf("invalid match_ip: %s", f.MatchIP)
+	}
+	f.MatchIP = ip.String()
+	return nil
+}
+
+// applyResponseFilters removes the answer records matched by the filters
+func applyResponseFilters(filters []ResponseFilter, resp *dns.Msg) {
+	ips := make([]net.IP, 0, len(filters))
+	for _, f := range filters {
+		ip := net.ParseIP(f.MatchIP)
+		if f.Action == ResponseFilterRemoveRecord && ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return
+	}
+
+	answer := resp.Answer[:0:0]
+	for _, rr := range resp.Answer {
+		var addr net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			addr = v.A
+		case *dns.AAAA:
+			addr = v.AAAA
+		}
+		if addr != nil && ipInList(addr, ips) {
+			continue
+		}
+		answer = append(answer, rr)
+	}
+	resp.Answer = answer
+}
+
+func ipInList(ip net.IP, list []net.IP) bool {
+	for _, v := range list {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filteredUpstream applies the response filters to the answers of the upstream
+// it's placed below the caches so that the filtered records are never cached
+type filteredUpstream struct {
+	upstream.Upstream
+	filters []ResponseFilter
+}
+
+// Exchange queries the upstream and removes the matched records from the answer
+func (u *filteredUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	res, err := u.Upstream.Exchange(req)
+	if err != nil {
+		return nil, err
+	}
+	applyResponseFilters(u.filters, res)
+	return res, nil
+}
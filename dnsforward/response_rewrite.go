@@ -0,0 +1,87 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ResponseRewrite replaces the IP address in the A or AAAA answers to the queries for the domain
+type ResponseRewrite struct {
+	Domain        string `yaml:"domain" json:"domain"` // e.g. "cdn.example.com", "*.example.com" matches the subdomains
+	OriginalIP    string `yaml:"original_ip" json:"original_ip"`
+	ReplacementIP string `yaml:"replacement_ip" json:"replacement_ip"`
+}
+
+// NormalizeResponseRewrite validates the rule and converts the domain and the addresses to the canonical form
+func NormalizeResponseRewrite(rw *ResponseRewrite) error {
+	rw.Domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(rw.Domain), "."))
+	name := strings.TrimPrefix(rw.Domain, "*.")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return fmt.Errorf("invalid domain: %s", rw.Domain)
+	}
+
+	orig := net.ParseIP(strings.TrimSpace(rw.OriginalIP))
+	if orig == nil {
+		return fmt.Errorf("invalid original_ip: %s", rw.OriginalIP)
+	}
+	repl := net.ParseIP(strings.TrimSpace(rw.ReplacementIP))
+	if repl == nil {
+		return fmt.Errorf("invalid replacement_ip: %s", rw.ReplacementIP)
+	}
+	if (orig.To4() == nil) != (repl.To4() == nil) {
+		return fmt.Errorf("original_ip and replacement_ip must be of the same address family")
+	}
+
+	rw.OriginalIP = orig.String()
+	rw.ReplacementIP = repl.String()
+	return nil
+}
+
+// matches returns true if the rule applies to the queried name
+func (rw *ResponseRewrite) matches(qname string) bool {
+	qname = strings.ToLower(strings.TrimSuffix(qname, "."))
+	domain := strings.ToLower(strings.TrimSuffix(rw.Domain, "."))
+	if strings.HasPrefix(domain, "*.") {
+		return strings.HasSuffix(qname, domain[1:])
+	}
+	return qname == domain
+}
+
+// applyResponseRewrites replaces the addresses in the A and AAAA answers according to ResponseRewrites
+func (s *Server) applyResponseRewrites(resp *dns.Msg) {
+	if len(resp.Question) != 1 {
+		return
+	}
+	qname := resp.Question[0].Name
+
+	for _, rw := range s.ResponseRewrites {
+		if !rw.matches(qname) {
+			continue
+		}
+		orig := net.ParseIP(rw.OriginalIP)
+		repl := net.ParseIP(rw.ReplacementIP)
+		if orig == nil || repl == nil {
+			continue
+		}
+
+		for i, rr := range resp.Answer {
+			switch v := rr.(type) {
+			case *dns.A:
+				if v.A.Equal(orig) && repl.To4() != nil {
+					a := dns.Copy(v).(*dns.A)
+					a.A = repl.To4()
+					resp.Answer[i] = a
+				}
+			case *dns.AAAA:
+				if v.AAAA.Equal(orig) && repl.To4() == nil {
+					aaaa := dns.Copy(v).(*dns.AAAA)
+					aaaa.AAAA = repl
+					resp.Answer[i] = aaaa
+				}
+			}
+		}
+	}
+}
@@ -2,14 +2,23 @@ package dnsforward
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/miekg/dns"
 )
 
 // how far back to keep the stats
-const statsHistoryElements = 60 + 1 // +1 for calculating delta
+// 7 days of the hourly stats are needed for /control/stats/hourly_breakdown
+const statsHistoryElements = 7*24 + 1 // +1 for calculating delta
+
+// prefix of the periodic stats names of the per-type query counters, e.g. "query_type_AAAA"
+const statsQueryTypePrefix = "query_type_"
+
+// prefix of the periodic stats names of the per-rcode response counters, e.g. "response_code_NXDOMAIN"
+const statsResponseCodePrefix = "response_code_"
 
 // entries for single time period (for example all per-second entries)
 type statsEntries map[string][statsHistoryElements]float64
@@ -38,7 +47,32 @@ type stats struct {
 	whitelisted          *counter   // total number of requests whitelisted by filter lists
 	safesearch           *counter   // total number of requests for which safe search rules were applied
 	errorsTotal          *counter   // total number of errors
+	dnssecFailures       *counter   // total number of requests that failed DNSSEC validation
+	dnssecUnvalidated    *counter   // total number of signed responses without the AD bit
+	droppedRequests      *counter   // total number of requests dropped because of the concurrency limit
+	upstreamRetries      *counter   // total number of repeated upstream requests
+	staleServed          *counter   // total number of expired responses served from the cache
+	prefetchRefreshed    *counter   // total number of responses refreshed before they expired
+	rateLimited          *counter   // total number of requests refused because of the rate limit
+	nsecSynthesised      *counter   // total number of negative responses synthesised from the cached NSEC records
 	elapsedTime          *histogram // requests duration histogram
+
+	clients     map[string]*clientStats // contribution of each client to the counters above, so that it can be removed
+	clientsLock sync.Mutex
+
+	uniqueClients *uniqueClients // approximate number of distinct clients, removed clients are still counted
+}
+
+// clientStats is the part of the stats that was caused by a single client's requests
+type clientStats struct {
+	perSecond periodicStats
+	perMinute periodicStats
+	perHour   periodicStats
+	perDay    periodicStats
+
+	counters     map[string]int64 // counter name -> value
+	elapsedCount int64
+	elapsedTotal float64
 }
 
 // initializes an empty stats structure
@@ -52,6 +86,14 @@ func newStats() *stats {
 		whitelisted:          newDNSCounter("whitelisted_total"),
 		safesearch:           newDNSCounter("safesearch_total"),
 		errorsTotal:          newDNSCounter("errors_total"),
+		dnssecFailures:       newDNSCounter("dnssec_failures_total"),
+		dnssecUnvalidated:    newDNSCounter("dnssec_unvalidated_total"),
+		droppedRequests:      newDNSCounter("dropped_requests_total"),
+		upstreamRetries:      newDNSCounter("upstream_retries_total"),
+		staleServed:          newDNSCounter("stale_served_total"),
+		prefetchRefreshed:    newDNSCounter("prefetch_refreshed_total"),
+		rateLimited:          newDNSCounter("rate_limited_total"),
+		nsecSynthesised:      newDNSCounter("nsec_synthesised_total"),
 		elapsedTime:          newDNSHistogram("request_duration"),
 	}
 
@@ -73,6 +115,89 @@ func (s *stats) purgeStats() {
 	initPeriodicStats(&s.perMinute, time.Minute)
 	initPeriodicStats(&s.perHour, time.Hour)
 	initPeriodicStats(&s.perDay, time.Hour*24)
+
+	s.clientsLock.Lock()
+	s.clients = map[string]*clientStats{}
+	s.uniqueClients = newUniqueClients()
+	s.clientsLock.Unlock()
+}
+
+// initClientPeriodicStats initializes the client's periodic stats so that they're rotated at the same time as the global ones
+func initClientPeriodicStats(periodic *periodicStats, global *periodicStats) {
+	global.RLock()
+	periodic.entries = statsEntries{}
+	periodic.lastRotate = global.lastRotate
+	periodic.period = global.period
+	global.RUnlock()
+}
+
+// getClientStats returns the client's stats, creating them if necessary
+// clientsLock must be held by the caller
+func (s *stats) getClientStats(ip string) *clientStats {
+	cs, ok := s.clients[ip]
+	if !ok {
+		cs = &clientStats{counters: map[string]int64{}}
+		initClientPeriodicStats(&cs.perSecond, &s.perSecond)
+		initClientPeriodicStats(&cs.perMinute, &s.perMinute)
+		initClientPeriodicStats(&cs.perHour, &s.perHour)
+		initClientPeriodicStats(&cs.perDay, &s.perDay)
+		s.clients[ip] = cs
+	}
+	return cs
+}
+
+// subtract removes the values of another periodic stats that are rotated at the same time
+func (p *periodicStats) subtract(o *periodicStats) {
+	p.Lock()
+	o.RLock()
+	for name, values := range o.entries {
+		currentValues := p.entries[name]
+		for i, v := range values {
+			currentValues[i] -= v
+			if currentValues[i] < 0 {
+				currentValues[i] = 0
+			}
+		}
+		p.entries[name] = currentValues
+	}
+	o.RUnlock()
+	p.Unlock()
+}
+
+// removeClient removes the client's contribution from the counters
+func (s *stats) removeClient(ip string) bool {
+	s.clientsLock.Lock()
+	cs, ok := s.clients[ip]
+	delete(s.clients, ip)
+	s.clientsLock.Unlock()
+	if !ok {
+		return false
+	}
+
+	s.perSecond.subtract(&cs.perSecond)
+	s.perMinute.subtract(&cs.perMinute)
+	s.perHour.subtract(&cs.perHour)
+	s.perDay.subtract(&cs.perDay)
+
+	for _, c := range s.counters() {
+		c.Lock()
+		c.value -= cs.counters[c.name]
+		c.Unlock()
+	}
+	s.elapsedTime.Lock()
+	s.elapsedTime.count -= cs.elapsedCount
+	s.elapsedTime.total -= cs.elapsedTotal
+	s.elapsedTime.Unlock()
+	return true
+}
+
+// counters returns all counters of the stats
+func (s *stats) counters() []*counter {
+	return []*counter{
+		s.requests, s.filtered, s.filteredLists, s.filteredSafebrowsing, s.filteredParental, s.whitelisted,
+		s.safesearch, s.errorsTotal, s.dnssecFailures, s.dnssecUnvalidated, s.droppedRequests, s.upstreamRetries, s.staleServed,
+		s.prefetchRefreshed, s.rateLimited, s.nsecSynthesised,
+	}
 }
 
 func (p *periodicStats) Inc(name string, when time.Time) {
@@ -144,9 +269,37 @@ func (s *stats) statsRotator() {
 		s.perMinute.statsRotate(now)
 		s.perHour.statsRotate(now)
 		s.perDay.statsRotate(now)
+
+		s.clientsLock.Lock()
+		s.uniqueClients.rotate(now)
+		for ip, cs := range s.clients {
+			cs.perSecond.statsRotate(now)
+			cs.perMinute.statsRotate(now)
+			cs.perHour.statsRotate(now)
+			cs.perDay.statsRotate(now)
+			if cs.perDay.isEmpty() {
+				// the client's requests are out of our timeframe already
+				delete(s.clients, ip)
+			}
+		}
+		s.clientsLock.Unlock()
 	}
 }
 
+// isEmpty returns true if there are no non-zero values
+func (p *periodicStats) isEmpty() bool {
+	p.RLock()
+	defer p.RUnlock()
+	for _, values := range p.entries {
+		for _, v := range values {
+			if v != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // counter that wraps around prometheus Counter but also adds to periodic stats
 type counter struct {
 	name  string // used as key in periodic stats
@@ -201,28 +354,118 @@ func (s *stats) observeWithTime(h *histogram, value float64, when time.Time) {
 // stats
 // -----
 func (s *stats) incrementCounters(entry *logEntry) {
-	s.incWithTime(s.requests, entry.Time)
+	s.clientsLock.Lock()
+	cs := s.getClientStats(entry.IP)
+	unique := s.uniqueClients
+	s.clientsLock.Unlock()
+
+	if entry.IP != "" {
+		unique.add(entry.IP, entry.Time)
+	}
+	s.incClientWithTime(cs, s.requests, entry.Time)
+	q := new(dns.Msg)
+	if q.Unpack(entry.Question) == nil && len(q.Question) != 0 {
+		s.incClientPeriodic(cs, statsQueryTypePrefix+typeToString(q.Question[0].Qtype), entry.Time)
+	}
+	a := new(dns.Msg)
+	if len(entry.Answer) != 0 && a.Unpack(entry.Answer) == nil {
+		s.incClientPeriodic(cs, statsResponseCodePrefix+rcodeToString(a.Rcode), entry.Time)
+	}
 	if entry.Result.IsFiltered {
-		s.incWithTime(s.filtered, entry.Time)
+		s.incClientWithTime(cs, s.filtered, entry.Time)
 	}
 
 	switch entry.Result.Reason {
 	case dnsfilter.NotFilteredWhiteList:
-		s.incWithTime(s.whitelisted, entry.Time)
+		s.incClientWithTime(cs, s.whitelisted, entry.Time)
 	case dnsfilter.NotFilteredError:
-		s.incWithTime(s.errorsTotal, entry.Time)
+		s.incClientWithTime(cs, s.errorsTotal, entry.Time)
 	case dnsfilter.FilteredBlackList:
-		s.incWithTime(s.filteredLists, entry.Time)
+		s.incClientWithTime(cs, s.filteredLists, entry.Time)
 	case dnsfilter.FilteredSafeBrowsing:
-		s.incWithTime(s.filteredSafebrowsing, entry.Time)
+		s.incClientWithTime(cs, s.filteredSafebrowsing, entry.Time)
 	case dnsfilter.FilteredParental:
-		s.incWithTime(s.filteredParental, entry.Time)
+		s.incClientWithTime(cs, s.filteredParental, entry.Time)
 	case dnsfilter.FilteredInvalid:
 		// do nothing
 	case dnsfilter.FilteredSafeSearch:
-		s.incWithTime(s.safesearch, entry.Time)
+		s.incClientWithTime(cs, s.safesearch, entry.Time)
 	}
-	s.observeWithTime(s.elapsedTime, entry.Elapsed.Seconds(), entry.Time)
+
+	value := entry.Elapsed.Seconds()
+	s.observeWithTime(s.elapsedTime, value, entry.Time)
+	cs.perSecond.Observe(s.elapsedTime.name, entry.Time, value)
+	cs.perMinute.Observe(s.elapsedTime.name, entry.Time, value)
+	cs.perHour.Observe(s.elapsedTime.name, entry.Time, value)
+	cs.perDay.Observe(s.elapsedTime.name, entry.Time, value)
+	s.clientsLock.Lock()
+	cs.elapsedCount++
+	cs.elapsedTotal += value
+	s.clientsLock.Unlock()
+}
+
+// incClientWithTime increments the counter and remembers that it was caused by the client
+func (s *stats) incClientWithTime(cs *clientStats, c *counter, when time.Time) {
+	s.incWithTime(c, when)
+	cs.perSecond.Inc(c.name, when)
+	cs.perMinute.Inc(c.name, when)
+	cs.perHour.Inc(c.name, when)
+	cs.perDay.Inc(c.name, when)
+	s.clientsLock.Lock()
+	cs.counters[c.name]++
+	s.clientsLock.Unlock()
+}
+
+// incClientPeriodic increments the periodic stats value that has no total counter and remembers that it was caused by the client
+func (s *stats) incClientPeriodic(cs *clientStats, name string, when time.Time) {
+	s.perSecond.Inc(name, when)
+	s.perMinute.Inc(name, when)
+	s.perHour.Inc(name, when)
+	s.perDay.Inc(name, when)
+	cs.perSecond.Inc(name, when)
+	cs.perMinute.Inc(name, when)
+	cs.perHour.Inc(name, when)
+	cs.perDay.Inc(name, when)
+}
+
+// typeToString returns the name of the DNS record type or TYPEnnn for the unknown ones
+func typeToString(t uint16) string {
+	if name, ok := dns.TypeToString[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// rcodeToString returns the name of the DNS response code or RCODEnnn for the unknown ones
+func rcodeToString(rcode int) string {
+	if name, ok := dns.RcodeToString[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// getAggregatedByPrefix sums the periodic stats values which names start with the prefix for the 24 hours
+// the result is keyed by the rest of the name
+func (s *stats) getAggregatedByPrefix(prefix string) map[string]int64 {
+	const numHours = 24
+	s.perHour.RLock()
+	defer s.perHour.RUnlock()
+
+	result := map[string]int64{}
+	for name, values := range s.perHour.entries {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		// the same range as in getAggregatedStats()
+		sum := 0.0
+		for i := 0; i <= numHours; i++ {
+			sum += values[i]
+		}
+		if sum != 0 {
+			result[strings.TrimPrefix(name, prefix)] = int64(sum)
+		}
+	}
+	return result
 }
 
 // getAggregatedStats returns aggregated stats data for the 24 hours
@@ -276,12 +519,21 @@ func (s *stats) generateMapFromStats(stats *periodicStats, start int, end int) m
 	}
 
 	result := map[string]interface{}{
-		"dns_queries":           getReversedSlice(stats.entries[s.requests.name], start, end),
-		"blocked_filtering":     getReversedSlice(stats.entries[s.filtered.name], start, end),
-		"replaced_safebrowsing": getReversedSlice(stats.entries[s.filteredSafebrowsing.name], start, end),
-		"replaced_safesearch":   getReversedSlice(stats.entries[s.safesearch.name], start, end),
-		"replaced_parental":     getReversedSlice(stats.entries[s.filteredParental.name], start, end),
-		"avg_processing_time":   avgProcessingTime,
+		"dns_queries":            getReversedSlice(stats.entries[s.requests.name], start, end),
+		"blocked_filtering":      getReversedSlice(stats.entries[s.filtered.name], start, end),
+		"replaced_safebrowsing":  getReversedSlice(stats.entries[s.filteredSafebrowsing.name], start, end),
+		"replaced_safesearch":    getReversedSlice(stats.entries[s.safesearch.name], start, end),
+		"replaced_parental":      getReversedSlice(stats.entries[s.filteredParental.name], start, end),
+		"dnssec_failures":        getReversedSlice(stats.entries[s.dnssecFailures.name], start, end),
+		"dnssec_unvalidated":     getReversedSlice(stats.entries[s.dnssecUnvalidated.name], start, end),
+		"dns_goroutines_dropped": getReversedSlice(stats.entries[s.droppedRequests.name], start, end),
+
+		"upstream_retry_count_total": getReversedSlice(stats.entries[s.upstreamRetries.name], start, end),
+		"stale_served_count":         getReversedSlice(stats.entries[s.staleServed.name], start, end),
+		"prefetch_refreshed_count":   getReversedSlice(stats.entries[s.prefetchRefreshed.name], start, end),
+		"rate_limited_queries_count": getReversedSlice(stats.entries[s.rateLimited.name], start, end),
+		"nsec_synthesised_count":     getReversedSlice(stats.entries[s.nsecSynthesised.name], start, end),
+		"avg_processing_time":        avgProcessingTime,
 	}
 	return result
 }
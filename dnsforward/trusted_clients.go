@@ -0,0 +1,68 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// NormalizeTrustedClient validates the TrustedClients entry, an IP address or a CIDR
+// it returns the address or the network in the canonical form, e.g. "10.0.0.0/8" for "10.1.2.3/8"
+func NormalizeTrustedClient(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid CIDR: %s", s)
+		}
+		return ipnet.String(), nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address: %s", s)
+	}
+	return ip.String(), nil
+}
+
+// trustedClients matches the client IPs against TrustedClients
+type trustedClients struct {
+	ips  map[string]bool
+	nets []*net.IPNet
+}
+
+func newTrustedClients(list []string) *trustedClients {
+	t := &trustedClients{ips: map[string]bool{}}
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			_, ipnet, err := net.ParseCIDR(s)
+			if err == nil {
+				t.nets = append(t.nets, ipnet)
+			}
+			continue
+		}
+		if ip := net.ParseIP(s); ip != nil {
+			t.ips[ip.String()] = true
+		}
+	}
+	return t
+}
+
+// contains returns true if the client is trusted, t may be nil
+func (t *trustedClients) contains(ip string) bool {
+	if t == nil {
+		return false
+	}
+	if t.ips[ip] {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, ipnet := range t.nets {
+		if ipnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,411 @@
+package dnsforward
+
+import (
+	"container/list"
+	"encoding/binary"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/hmage/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// DefaultUpstreamCacheSize is the number of responses cached for each upstream if UpstreamCacheSize is 0
+const DefaultUpstreamCacheSize = 1000
+
+// DefaultServeStaleMaxAge is how long the expired responses are served if ServeStaleMaxAge is 0, in seconds
+const DefaultServeStaleMaxAge = 86400
+
+// TTL of the expired records that are served because the upstreams are unreachable (RFC 8767 recommends 30 seconds)
+const staleResponseTTL = 30
+
+// number of responses kept for serving stale
+const staleCacheSize = 10000
+
+// number of responses in the cache shared by all upstreams
+const sharedCacheSize = 10000
+
+// cachedUpstream is an upstream with its own response cache
+// it's used instead of the proxy cache so that different upstreams don't share cached answers
+type cachedUpstream struct {
+	upstream.Upstream
+	cache *upstreamCache
+}
+
+func newCachedUpstream(u upstream.Upstream, size int) *cachedUpstream {
+	return &cachedUpstream{
+		Upstream: u,
+		cache:    newUpstreamCache(size),
+	}
+}
+
+// Exchange returns the cached response if there is one, otherwise it queries the upstream
+func (u *cachedUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	res := u.cache.get(req)
+	if res != nil {
+		return res, nil
+	}
+
+	res, err := u.Upstream.Exchange(req)
+	if err != nil {
+		return nil, err
+	}
+	u.cache.set(req, res)
+	return res, nil
+}
+
+type upstreamCacheItem struct {
+	key  string
+	m    *dns.Msg
+	ttl  uint32
+	when time.Time
+}
+
+// upstreamCache is a fixed-size cache of DNS responses, the least recently used responses are evicted first
+type upstreamCache struct {
+	size  int
+	items map[string]*list.Element
+	order *list.List // front is the most recently used item
+
+	sync.Mutex
+}
+
+func newUpstreamCache(size int) *upstreamCache {
+	return &upstreamCache{
+		size:  size,
+		items: map[string]*list.Element{},
+		order: list.New(),
+	}
+}
+
+// upstreamCacheKey is qtype, qclass, CD bit, DO bit and lowercased name
+// CD bit is a part of the key because responses to the DNSSEC checks must not be served to other clients
+// DO bit is a part of the key because only the responses to DO requests have the DNSSEC records
+func upstreamCacheKey(m *dns.Msg) (string, bool) {
+	if len(m.Question) != 1 {
+		return "", false
+	}
+	q := m.Question[0]
+	b := make([]byte, 6)
+	binary.LittleEndian.PutUint16(b, q.Qtype)
+	binary.LittleEndian.PutUint16(b[2:], q.Qclass)
+	if m.CheckingDisabled {
+		b[4] = 1
+	}
+	if opt := m.IsEdns0(); opt != nil && opt.Do() {
+		b[5] = 1
+	}
+	return string(b) + strings.ToLower(q.Name), true
+}
+
+func (c *upstreamCache) get(req *dns.Msg) *dns.Msg {
+	key, ok := upstreamCacheKey(req)
+	if !ok {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	item := e.Value.(*upstreamCacheItem)
+	elapsed := time.Since(item.when)
+	if elapsed >= time.Duration(item.ttl)*time.Second {
+		c.order.Remove(e)
+		delete(c.items, key)
+		return nil
+	}
+	c.order.MoveToFront(e)
+	return item.response(req, uint32(math.Round(float64(item.ttl)-elapsed.Seconds())))
+}
+
+// staleCacheKey is upstreamCacheKey followed by the addresses of the upstreams
+// the responses of one set of upstreams aren't served when the other ones are used, the same as with the per-upstream caches
+func staleCacheKey(req *dns.Msg, upstreams []upstream.Upstream) (string, bool) {
+	key, ok := upstreamCacheKey(req)
+	if !ok {
+		return "", false
+	}
+	return key + "\x00" + strings.Join(upstreamAddresses(upstreams), " "), true
+}
+
+// getStale returns the response cached with the key even if it has expired, but not more than maxStaleness ago
+// records of the expired response get staleResponseTTL, the second return value is true if it has expired
+func (c *upstreamCache) getStale(key string, req *dns.Msg, maxStaleness time.Duration) (*dns.Msg, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := e.Value.(*upstreamCacheItem)
+	elapsed := time.Since(item.when)
+	expired := time.Duration(item.ttl) * time.Second
+	if elapsed >= expired+maxStaleness {
+		c.order.Remove(e)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+
+	if elapsed >= expired {
+		return item.response(req, staleResponseTTL), true
+	}
+	return item.response(req, uint32(math.Round(float64(item.ttl)-elapsed.Seconds()))), false
+}
+
+// response returns a copy of the cached response to req with the specified TTL of all records
+func (item *upstreamCacheItem) response(req *dns.Msg, ttl uint32) *dns.Msg {
+	res := item.m.Copy()
+	res.Id = req.Id
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+	return res
+}
+
+func (c *upstreamCache) set(req *dns.Msg, res *dns.Msg) {
+	key, ok := upstreamCacheKey(req)
+	if !ok {
+		return
+	}
+	c.setWithKey(key, res)
+}
+
+// setWithKey caches the response with the key instead of the one made from the request
+func (c *upstreamCache) setWithKey(key string, res *dns.Msg) {
+	if res.Truncated || (res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError) {
+		return
+	}
+	ttl := lowestTTL(res)
+	if ttl == 0 {
+		return
+	}
+
+	item := &upstreamCacheItem{key: key, m: res.Copy(), ttl: ttl, when: time.Now()}
+
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.Value = item
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(item)
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*upstreamCacheItem).key)
+	}
+}
+
+// CacheEntry is a cached response
+type CacheEntry struct {
+	QName     string    `json:"qname"`
+	QType     string    `json:"qtype"`
+	Cache     string    `json:"cache"`              // one of the CacheName* values
+	Upstream  string    `json:"upstream,omitempty"` // set only for the per-upstream caches
+	CachedAt  time.Time `json:"cached_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Answers   []string  `json:"answers"` // records of the answer section in the zone file format
+}
+
+// names of the caches that the CacheEntry is from
+const (
+	CacheNameShared   = "shared"   // the cache of all upstreams
+	CacheNameUpstream = "upstream" // the cache of one upstream, PerUpstreamCache is enabled
+	CacheNameStale    = "stale"    // the responses kept for serving stale
+)
+
+// entries returns the cached responses, the most recently used first
+func (c *upstreamCache) entries(cache string, upstream string) []CacheEntry {
+	c.Lock()
+	defer c.Unlock()
+	result := make([]CacheEntry, 0, c.order.Len())
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		item := e.Value.(*upstreamCacheItem)
+		if len(item.m.Question) == 0 {
+			continue
+		}
+		entry := CacheEntry{
+			QName:     item.m.Question[0].Name,
+			QType:     dns.TypeToString[item.m.Question[0].Qtype],
+			Cache:     cache,
+			Upstream:  upstream,
+			CachedAt:  item.when,
+			ExpiresAt: item.when.Add(time.Duration(item.ttl) * time.Second),
+			Answers:   []string{},
+		}
+		for _, rr := range item.m.Answer {
+			entry.Answers = append(entry.Answers, rr.String())
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// GetCacheEntries returns the responses of the shared or the per-upstream caches and the ones kept for serving stale
+func (s *Server) GetCacheEntries() []CacheEntry {
+	s.RLock()
+	shared := s.cache
+	stale := s.staleCache
+	var upstreams []upstream.Upstream
+	if s.dnsProxy != nil {
+		upstreams = s.dnsProxy.Upstreams
+	}
+	s.RUnlock()
+
+	result := []CacheEntry{}
+	if shared != nil {
+		result = append(result, shared.entries(CacheNameShared, "")...)
+	}
+	if len(upstreams) == 1 {
+		if w, ok := upstreams[0].(*weightedUpstreams); ok {
+			upstreams = w.upstreams
+		}
+	}
+	for _, u := range upstreams {
+		if cached, ok := u.(*cachedUpstream); ok {
+			result = append(result, cached.cache.entries(CacheNameUpstream, cached.Address())...)
+		}
+	}
+	if stale != nil {
+		result = append(result, stale.entries(CacheNameStale, "")...)
+	}
+	return result
+}
+
+// saveStale keeps the upstream response so that it can be served after it expires
+func (s *Server) saveStale(p *proxy.Proxy, d *proxy.DNSContext) {
+	s.RLock()
+	cache := s.staleCache
+	s.RUnlock()
+	if cache == nil || d.Res == nil {
+		return
+	}
+	key, ok := staleCacheKey(d.Req, p.Upstreams)
+	if !ok {
+		return
+	}
+	cache.setWithKey(key, d.Res)
+}
+
+// maxStaleness returns how long after expiration the cached responses may be served
+func (s *Server) maxStaleness() time.Duration {
+	maxStaleness := s.ServeStaleMaxAge
+	if maxStaleness == 0 {
+		maxStaleness = DefaultServeStaleMaxAge
+	}
+	return time.Duration(maxStaleness) * time.Second
+}
+
+// serveStale sets the expired cached response when the upstreams are unreachable
+// returns false if serving stale is disabled or there is no response that is fresh enough
+func (s *Server) serveStale(p *proxy.Proxy, d *proxy.DNSContext) bool {
+	s.RLock()
+	cache := s.staleCache
+	s.RUnlock()
+	if cache == nil || !s.ServeStale {
+		return false
+	}
+	key, ok := staleCacheKey(d.Req, p.Upstreams)
+	if !ok {
+		return false
+	}
+
+	res, _ := cache.getStale(key, d.Req, s.maxStaleness())
+	if res == nil {
+		return false
+	}
+
+	log.Tracef("Upstreams are unreachable, serving stale response for %s", d.Req.Question[0].Name)
+	d.Res = res
+	s.stats.incWithTime(s.stats.staleServed, time.Now())
+	return true
+}
+
+// serveCachedAndRevalidate sets the cached response if there is one, if it has expired,
+// it's served anyway and refreshed in the background, so the next request gets the fresh response
+// returns false if PrefetchOnExpired is disabled or the response isn't cached
+func (s *Server) serveCachedAndRevalidate(p *proxy.Proxy, d *proxy.DNSContext) bool {
+	s.RLock()
+	cache := s.staleCache
+	s.RUnlock()
+	if cache == nil || !s.PrefetchOnExpired {
+		return false
+	}
+	key, ok := staleCacheKey(d.Req, p.Upstreams)
+	if !ok {
+		return false
+	}
+
+	res, expired := cache.getStale(key, d.Req, s.maxStaleness())
+	if res == nil {
+		return false
+	}
+	d.Res = res
+	if !expired {
+		return true
+	}
+
+	s.revalidating.Lock()
+	if s.revalidating.keys[key] {
+		s.revalidating.Unlock()
+		return true
+	}
+	if s.revalidating.keys == nil {
+		s.revalidating.keys = map[string]bool{}
+	}
+	s.revalidating.keys[key] = true
+	s.revalidating.Unlock()
+
+	log.Tracef("Serving expired response for %s and refreshing it", d.Req.Question[0].Name)
+	s.stats.incWithTime(s.stats.staleServed, time.Now())
+	go s.revalidate(p, cache, key, d.Req.Copy())
+	return true
+}
+
+// revalidate sends the request to the upstreams and replaces the expired response in the cache
+func (s *Server) revalidate(p *proxy.Proxy, cache *upstreamCache, key string, req *dns.Msg) {
+	req.Id = dns.Id()
+	res, err := exchangeUncached(p.Upstreams, req)
+	if err == nil {
+		cache.setWithKey(key, res)
+	}
+
+	s.revalidating.Lock()
+	delete(s.revalidating.keys, key)
+	s.revalidating.Unlock()
+
+	if err != nil {
+		log.Tracef("Couldn't refresh expired response for %s: %s", req.Question[0].Name, err)
+		return
+	}
+	log.Tracef("Refreshed expired response for %s", req.Question[0].Name)
+}
+
+// lowestTTL returns the lowest TTL of the response records, or 0 if there are none
+func lowestTTL(m *dns.Msg) uint32 {
+	var ttl uint32 = math.MaxUint32
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+	if ttl == math.MaxUint32 {
+		return 0
+	}
+	return ttl
+}
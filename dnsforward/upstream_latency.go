@@ -0,0 +1,154 @@
+package dnsforward
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// number of the last successful queries the latency histogram of an upstream is computed from
+const upstreamLatencySize = 1000
+
+// LatencyHistogram is the distribution of the upstream response time in milliseconds
+type LatencyHistogram struct {
+	Queries int     `json:"queries"` // number of the queries the values are computed from
+	P50     float64 `json:"p50_ms"`
+	P90     float64 `json:"p90_ms"`
+	P99     float64 `json:"p99_ms"`
+	P999    float64 `json:"p99_9_ms"`
+	Max     float64 `json:"max_ms"`
+}
+
+// latencyBuffer is a circular buffer of the last response times of an upstream
+// the values are written atomically, so that the queries never wait for each other or for the readers
+type latencyBuffer struct {
+	values [upstreamLatencySize]int64 // time.Duration
+	total  uint64                     // number of the values written, the next one goes to total % upstreamLatencySize
+}
+
+func (b *latencyBuffer) add(elapsed time.Duration) {
+	n := atomic.AddUint64(&b.total, 1)
+	atomic.StoreInt64(&b.values[(n-1)%upstreamLatencySize], int64(elapsed))
+}
+
+func (b *latencyBuffer) histogram() LatencyHistogram {
+	n := atomic.LoadUint64(&b.total)
+	if n > upstreamLatencySize {
+		n = upstreamLatencySize
+	}
+	values := make([]time.Duration, 0, n)
+	for i := uint64(0); i < n; i++ {
+		values = append(values, time.Duration(atomic.LoadInt64(&b.values[i])))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	h := LatencyHistogram{Queries: len(values)}
+	if len(values) == 0 {
+		return h
+	}
+	h.P50 = percentile(values, 0.5)
+	h.P90 = percentile(values, 0.9)
+	h.P99 = percentile(values, 0.99)
+	h.P999 = percentile(values, 0.999)
+	h.Max = durationMs(values[len(values)-1])
+	return h
+}
+
+// percentile returns the nearest-rank percentile of the sorted values in milliseconds
+func percentile(sorted []time.Duration, p float64) float64 {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return durationMs(sorted[i])
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Nanoseconds()) / float64(time.Millisecond)
+}
+
+// upstreamLatencies keeps the latency buffer of each upstream address
+type upstreamLatencies struct {
+	buffers map[string]*latencyBuffer
+	sync.RWMutex
+}
+
+func newUpstreamLatencies() *upstreamLatencies {
+	return &upstreamLatencies{buffers: map[string]*latencyBuffer{}}
+}
+
+// get returns the buffer of the upstream, it's created if needed
+func (l *upstreamLatencies) get(address string) *latencyBuffer {
+	l.RLock()
+	b := l.buffers[address]
+	l.RUnlock()
+	if b != nil {
+		return b
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	b = l.buffers[address]
+	if b == nil {
+		b = &latencyBuffer{}
+		l.buffers[address] = b
+	}
+	return b
+}
+
+// retain removes the buffers of the upstreams that are no longer used
+func (l *upstreamLatencies) retain(upstreams []upstream.Upstream) {
+	keep := map[string]bool{}
+	for _, u := range upstreams {
+		keep[u.Address()] = true
+	}
+	l.Lock()
+	for address := range l.buffers {
+		if !keep[address] {
+			delete(l.buffers, address)
+		}
+	}
+	l.Unlock()
+}
+
+func (l *upstreamLatencies) histograms() map[string]LatencyHistogram {
+	l.RLock()
+	defer l.RUnlock()
+	res := map[string]LatencyHistogram{}
+	for address, b := range l.buffers {
+		res[address] = b.histogram()
+	}
+	return res
+}
+
+// measuredUpstream records the response time of each successful query sent to the upstream
+type measuredUpstream struct {
+	upstream.Upstream
+	latency *latencyBuffer
+}
+
+// Exchange queries the upstream, the failed queries aren't measured
+func (u *measuredUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	res, err := u.Upstream.Exchange(req)
+	if err == nil {
+		u.latency.add(time.Since(start))
+	}
+	return res, err
+}
+
+// GetUpstreamLatencyHistograms returns the latency histogram of each upstream computed from its last successful queries
+func (s *Server) GetUpstreamLatencyHistograms() map[string]LatencyHistogram {
+	s.RLock()
+	l := s.upstreamLatency
+	s.RUnlock()
+	if l == nil {
+		return map[string]LatencyHistogram{}
+	}
+	return l.histograms()
+}
@@ -0,0 +1,187 @@
+package dnsforward
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// upstream selection policies
+const (
+	UpstreamPolicyFastest         = "fastest"          // the upstream with the lowest last response time is tried first, the default
+	UpstreamPolicyParallel        = "parallel"         // the request is sent to all upstreams and the first response is used
+	UpstreamPolicyLatencyWeighted = "latency_weighted" // the upstream is chosen randomly with the probability proportional to 1/latency
+)
+
+// the average latency is calculated over approximately this number of the last queries
+const latencyAverageQueries = 100
+
+// smoothing factor of the exponential moving average
+const latencyEMAAlpha = 2.0 / (latencyAverageQueries + 1)
+
+// weightedUpstreams is the upstream that passes the requests to one of its upstreams
+// the faster the upstream, the more often it's chosen, the others are tried if it fails
+type weightedUpstreams struct {
+	upstreams []upstream.Upstream
+	latency   []float64 // average latency of each upstream in milliseconds, 0 if unknown
+
+	answered map[*dns.Msg]upstream.Upstream // request -> the upstream that responded, see takeAnswered()
+
+	rand *rand.Rand
+	sync.Mutex
+}
+
+func newWeightedUpstreams(upstreams []upstream.Upstream) *weightedUpstreams {
+	return &weightedUpstreams{
+		upstreams: upstreams,
+		latency:   make([]float64, len(upstreams)),
+		answered:  map[*dns.Msg]upstream.Upstream{},
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Address returns the policy name, it's shown only if the answered upstream is unknown
+func (w *weightedUpstreams) Address() string {
+	return UpstreamPolicyLatencyWeighted
+}
+
+// order returns the indexes of the upstreams in the order they should be tried
+// each next upstream is sampled from the remaining ones proportionally to 1/latency,
+// the upstreams without measurements get the weight of the fastest one so that they're tried too
+func (w *weightedUpstreams) order() []int {
+	w.Lock()
+	defer w.Unlock()
+
+	weights := make([]float64, len(w.upstreams))
+	maxWeight := 0.0
+	for i, l := range w.latency {
+		if l > 0 {
+			weights[i] = 1 / l
+			if weights[i] > maxWeight {
+				maxWeight = weights[i]
+			}
+		}
+	}
+	if maxWeight == 0 {
+		maxWeight = 1
+	}
+	for i := range weights {
+		if weights[i] == 0 {
+			weights[i] = maxWeight
+		}
+	}
+
+	left := make([]int, len(w.upstreams))
+	for i := range left {
+		left[i] = i
+	}
+	res := make([]int, 0, len(left))
+	for len(left) != 0 {
+		total := 0.0
+		for _, i := range left {
+			total += weights[i]
+		}
+		r := w.rand.Float64() * total
+		k := len(left) - 1
+		for j, i := range left {
+			r -= weights[i]
+			if r < 0 {
+				k = j
+				break
+			}
+		}
+		res = append(res, left[k])
+		left = append(left[:k], left[k+1:]...)
+	}
+	return res
+}
+
+// addLatency updates the moving average of the upstream latency
+func (w *weightedUpstreams) addLatency(i int, elapsed time.Duration) {
+	ms := float64(elapsed.Nanoseconds()) / float64(time.Millisecond)
+	w.Lock()
+	if w.latency[i] == 0 {
+		w.latency[i] = ms
+	} else {
+		w.latency[i] += latencyEMAAlpha * (ms - w.latency[i])
+	}
+	w.Unlock()
+}
+
+// Exchange sends the request to the upstreams in the weighted random order until one of them responds
+// failures count as DefaultTimeout so that the failing upstreams are chosen less often
+func (w *weightedUpstreams) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	err := errors.New("no upstreams")
+	for _, i := range w.order() {
+		u := w.upstreams[i]
+		if cached, ok := u.(*cachedUpstream); ok {
+			if res := cached.cache.get(req); res != nil {
+				w.setAnswered(req, u)
+				return res, nil
+			}
+		}
+
+		start := time.Now()
+		var res *dns.Msg
+		res, err = u.Exchange(req)
+		elapsed := time.Since(start)
+		if err != nil {
+			if elapsed < DefaultTimeout {
+				elapsed = DefaultTimeout
+			}
+			w.addLatency(i, elapsed)
+			continue
+		}
+		w.addLatency(i, elapsed)
+		w.setAnswered(req, u)
+		return res, nil
+	}
+	return nil, err
+}
+
+func (w *weightedUpstreams) setAnswered(req *dns.Msg, u upstream.Upstream) {
+	w.Lock()
+	w.answered[req] = u
+	w.Unlock()
+}
+
+// takeAnswered returns the upstream that responded to the request and forgets it
+func (w *weightedUpstreams) takeAnswered(req *dns.Msg) upstream.Upstream {
+	w.Lock()
+	defer w.Unlock()
+	u, ok := w.answered[req]
+	if !ok {
+		return w
+	}
+	delete(w.answered, req)
+	return u
+}
+
+// latencies returns the average latency of each upstream in milliseconds, the unused upstreams are omitted
+func (w *weightedUpstreams) latencies() map[string]float64 {
+	w.Lock()
+	defer w.Unlock()
+	res := map[string]float64{}
+	for i, u := range w.upstreams {
+		if w.latency[i] > 0 {
+			res[u.Address()] = w.latency[i]
+		}
+	}
+	return res
+}
+
+// GetUpstreamLatencies returns the average latency of each upstream in milliseconds
+// it's measured only when UpstreamPolicy is UpstreamPolicyLatencyWeighted
+func (s *Server) GetUpstreamLatencies() map[string]float64 {
+	s.RLock()
+	w := s.weighted
+	s.RUnlock()
+	if w == nil {
+		return map[string]float64{}
+	}
+	return w.latencies()
+}
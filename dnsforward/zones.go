@@ -0,0 +1,225 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// default SOA values that are used if they're not specified
+const (
+	defaultZoneTTL     = 3600
+	defaultZoneRefresh = 3600
+	defaultZoneRetry   = 600
+	defaultZoneExpire  = 86400
+	defaultZoneMinimum = 60
+)
+
+// ZoneSOA is the SOA record of an authoritative zone, zero values are replaced with defaults
+type ZoneSOA struct {
+	MName   string `yaml:"mname" json:"mname"` // primary name server, "ns1.<zone>" by default
+	RName   string `yaml:"rname" json:"rname"` // administrator's mailbox, "hostmaster.<zone>" by default
+	Serial  uint32 `yaml:"serial" json:"serial"`
+	Refresh uint32 `yaml:"refresh" json:"refresh"`
+	Retry   uint32 `yaml:"retry" json:"retry"`
+	Expire  uint32 `yaml:"expire" json:"expire"`
+	Minimum uint32 `yaml:"minimum" json:"minimum"` // TTL of the negative responses
+}
+
+// ZoneRecord is a resource record of an authoritative zone
+type ZoneRecord struct {
+	Name  string `yaml:"name" json:"name"`   // "@" or empty for the zone apex, names without the trailing dot are relative to the zone
+	Type  string `yaml:"type" json:"type"`   // e.g. "A", "AAAA", "CNAME", "MX", "TXT"
+	TTL   uint32 `yaml:"ttl" json:"ttl"`     // if 0, then defaultZoneTTL is used
+	Value string `yaml:"value" json:"value"` // RDATA in the zone file format, e.g. "10 mail.local.lan." for MX
+}
+
+// Zone is a simple authoritative zone that is answered by us instead of the upstreams
+type Zone struct {
+	Name    string       `yaml:"name" json:"name"` // e.g. "local.lan"
+	SOA     ZoneSOA      `yaml:"soa" json:"soa"`
+	Records []ZoneRecord `yaml:"records" json:"records"`
+}
+
+// compiledZone is a Zone with parsed records, indexed by lowercase owner name
+type compiledZone struct {
+	name    string // lowercase FQDN
+	soa     *dns.SOA
+	records map[string][]dns.RR
+}
+
+// NormalizeZoneName returns the lowercase zone name without the trailing dot
+func NormalizeZoneName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+// SOARecord returns the SOA record of the zone
+func (z *Zone) SOARecord() *dns.SOA {
+	origin := dns.Fqdn(NormalizeZoneName(z.Name))
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: defaultZoneTTL},
+		Ns:      z.absName(z.SOA.MName),
+		Mbox:    z.absName(z.SOA.RName),
+		Serial:  z.SOA.Serial,
+		Refresh: z.SOA.Refresh,
+		Retry:   z.SOA.Retry,
+		Expire:  z.SOA.Expire,
+		Minttl:  z.SOA.Minimum,
+	}
+	if z.SOA.MName == "" {
+		soa.Ns = "ns1." + origin
+	}
+	if z.SOA.RName == "" {
+		soa.Mbox = "hostmaster." + origin
+	}
+	if soa.Refresh == 0 {
+		soa.Refresh = defaultZoneRefresh
+	}
+	if soa.Retry == 0 {
+		soa.Retry = defaultZoneRetry
+	}
+	if soa.Expire == 0 {
+		soa.Expire = defaultZoneExpire
+	}
+	if soa.Minttl == 0 {
+		soa.Minttl = defaultZoneMinimum
+	}
+	return soa
+}
+
+// absName converts the name relative to the zone to FQDN
+func (z *Zone) absName(name string) string {
+	origin := dns.Fqdn(NormalizeZoneName(z.Name))
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "" || name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return name
+	default:
+		return name + "." + origin
+	}
+}
+
+// RRs parses the zone records, the SOA record goes first
+// it returns an error if a record is invalid or doesn't belong to the zone
+func (z *Zone) RRs() ([]dns.RR, error) {
+	name := NormalizeZoneName(z.Name)
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return nil, fmt.Errorf("invalid zone name: %s", z.Name)
+	}
+	origin := dns.Fqdn(name)
+
+	rrs := []dns.RR{z.SOARecord()}
+	for _, r := range z.Records {
+		owner := z.absName(r.Name)
+		if !dns.IsSubDomain(origin, strings.ToLower(owner)) {
+			return nil, fmt.Errorf("record %s doesn't belong to zone %s", owner, name)
+		}
+		rrType := strings.ToUpper(strings.TrimSpace(r.Type))
+		if rrType == "SOA" {
+			return nil, fmt.Errorf("SOA record must be specified in the soa field")
+		}
+		if _, ok := dns.StringToType[rrType]; !ok {
+			return nil, fmt.Errorf("unknown record type: %s", r.Type)
+		}
+		ttl := r.TTL
+		if ttl == 0 {
+			ttl = defaultZoneTTL
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("$ORIGIN %s\n%s %d IN %s %s", origin, owner, ttl, rrType, r.Value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s record %s: %s", rrType, owner, err)
+		}
+		if rr == nil {
+			return nil, fmt.Errorf("empty %s record %s", rrType, owner)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+func compileZones(zones []Zone) ([]*compiledZone, error) {
+	result := []*compiledZone{}
+	for i := range zones {
+		rrs, err := zones[i].RRs()
+		if err != nil {
+			return nil, err
+		}
+		z := &compiledZone{
+			name:    dns.Fqdn(NormalizeZoneName(zones[i].Name)),
+			soa:     rrs[0].(*dns.SOA),
+			records: map[string][]dns.RR{},
+		}
+		for _, rr := range rrs {
+			owner := strings.ToLower(rr.Header().Name)
+			z.records[owner] = append(z.records[owner], rr)
+		}
+		result = append(result, z)
+	}
+	return result, nil
+}
+
+// findZone returns the most specific zone the name belongs to, or nil
+func (s *Server) findZone(name string) *compiledZone {
+	var found *compiledZone
+	for _, z := range s.zones {
+		if dns.IsSubDomain(z.name, name) && (found == nil || len(z.name) > len(found.name)) {
+			found = z
+		}
+	}
+	return found
+}
+
+// answerFromZones returns the authoritative response if the question belongs to one of our zones, or nil
+func (s *Server) answerFromZones(req *dns.Msg) *dns.Msg {
+	if len(req.Question) != 1 {
+		return nil
+	}
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	s.RLock()
+	z := s.findZone(name)
+	s.RUnlock()
+	if z == nil {
+		return nil
+	}
+
+	resp := dns.Msg{}
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+
+	rrs, exists := z.records[name]
+	for _, rr := range rrs {
+		t := rr.Header().Rrtype
+		if t == q.Qtype || q.Qtype == dns.TypeANY || t == dns.TypeCNAME {
+			resp.Answer = append(resp.Answer, dns.Copy(rr))
+		}
+	}
+	if len(resp.Answer) != 0 {
+		return &resp
+	}
+
+	if !exists {
+		// the name may still exist if it has subdomains (empty non-terminal)
+		for owner := range z.records {
+			if dns.IsSubDomain(name, owner) {
+				exists = true
+				break
+			}
+		}
+	}
+	if !exists {
+		resp.Rcode = dns.RcodeNameError
+	}
+
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	resp.Ns = []dns.RR{soa}
+	return &resp
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hmage/golibs/log"
+	govalidator "gopkg.in/asaskevich/govalidator.v4"
+)
+
+const falsePositivesFileName = "false_positives.json" // it's under dataDir
+
+// falsePositive is a domain reported as wrongly blocked
+type falsePositive struct {
+	Domain   string    `json:"domain"`
+	Reporter string    `json:"reporter"` // IP address of the user who reported it
+	Time     time.Time `json:"time"`
+}
+
+var falsePositivesLock sync.Mutex
+
+func falsePositivesPath() string {
+	return filepath.Join(config.ourWorkingDir, dataDir, falsePositivesFileName)
+}
+
+// appendFalsePositive appends the report to the false positives log, one JSON object per line
+func appendFalsePositive(fp falsePositive) error {
+	falsePositivesLock.Lock()
+	defer falsePositivesLock.Unlock()
+
+	path := falsePositivesPath()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(fp)
+}
+
+// loadFalsePositives reads the false positives log, oldest first
+func loadFalsePositives() ([]falsePositive, error) {
+	falsePositivesLock.Lock()
+	defer falsePositivesLock.Unlock()
+
+	result := []falsePositive{}
+	f, err := os.Open(falsePositivesPath())
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d := json.NewDecoder(f)
+	for d.More() {
+		fp := falsePositive{}
+		err = d.Decode(&fp)
+		if err != nil {
+			log.Printf("Failed to decode false positive entry: %s", err)
+			break
+		}
+		result = append(result, fp)
+	}
+	return result, nil
+}
+
+func handleQueryLogFalsePositive(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Domain string `json:"domain"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse false positive json: %s", err)
+		return
+	}
+
+	domain := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(req.Domain), "."))
+	if !govalidator.IsDNSName(domain) {
+		httpError(w, http.StatusBadRequest, "%s is not a valid domain name", req.Domain)
+		return
+	}
+
+	rule := fmt.Sprintf("@@||%s^", domain)
+	exists := false
+	for _, line := range config.UserRules {
+		if strings.TrimSpace(line) == rule {
+			exists = true
+			break
+		}
+	}
+	if !exists {
+		config.UserRules = append(config.UserRules, rule)
+		err = writeAllConfigsAndReloadDNS()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+			return
+		}
+	}
+
+	reporter, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		reporter = r.RemoteAddr
+	}
+	err = appendFalsePositive(falsePositive{Domain: domain, Reporter: reporter, Time: time.Now()})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't save false positive report: %s", err)
+		return
+	}
+
+	returnOK(w)
+}
+
+func handleQueryLogFalsePositives(w http.ResponseWriter, r *http.Request) {
+	data, err := loadFalsePositives()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't read false positive reports: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal false positives json: %s", err)
+		return
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -152,6 +153,87 @@ func parseFilterContents(contents []byte) (int, string, []string) {
 	return rulesCount, name, lines
 }
 
+// downloadFilter returns the filter contents from the URL
+// if limit isn't 0, only the first limit bytes are read and the second value is true if there's more
+func downloadFilter(url string, limit int64) ([]byte, bool, error) {
+	resp, err := client.Get(url)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		log.Printf("Couldn't request filter from URL %s, skipping: %s", url, err)
+		return nil, false, err
+	}
+
+	if resp.StatusCode != 200 {
+		log.Printf("Got status code %d from URL %s, skipping", resp.StatusCode, url)
+		return nil, false, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
+	}
+
+	contentType := strings.ToLower(resp.Header.Get("content-type"))
+	if !strings.HasPrefix(contentType, "text/plain") {
+		log.Printf("Non-text response %s from %s, skipping", contentType, url)
+		return nil, false, fmt.Errorf("non-text response %s", contentType)
+	}
+
+	var reader io.Reader = resp.Body
+	if limit != 0 {
+		reader = io.LimitReader(resp.Body, limit+1)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		log.Printf("Couldn't fetch filter contents from URL %s, skipping: %s", url, err)
+		return nil, false, err
+	}
+	if limit != 0 && int64(len(body)) > limit {
+		return body[:limit], true, nil
+	}
+	return body, false, nil
+}
+
+// maxValidateFilterSize is the number of bytes of the filter checked by validateFilterURL
+const maxValidateFilterSize = 512 * 1024
+
+type filterValidationJSON struct {
+	Valid      bool     `json:"valid"`
+	RulesCount int      `json:"rules_count"`
+	Title      string   `json:"title"`
+	Warnings   []string `json:"warnings"`
+}
+
+// validateFilterURL downloads the beginning of the filter and checks its rules, the filter isn't added
+func validateFilterURL(url string) filterValidationJSON {
+	result := filterValidationJSON{Warnings: []string{}}
+	body, truncated, err := downloadFilter(url, maxValidateFilterSize)
+	if err != nil {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("Couldn't fetch filter: %s", err))
+		return result
+	}
+	if truncated {
+		// the last line may be cut in the middle
+		if pos := strings.LastIndexByte(string(body), '\n'); pos != -1 {
+			body = body[:pos]
+		}
+		result.Warnings = append(result.Warnings, fmt.Sprintf("Only the first %d KB of the filter were checked", maxValidateFilterSize/1024))
+	}
+
+	rulesCount, name, lines := parseFilterContents(body)
+	result.RulesCount = rulesCount
+	result.Title = name
+	if rulesCount == 0 {
+		result.Warnings = append(result.Warnings, "Filter has no rules (maybe it points to blank page?)")
+		return result
+	}
+	result.Valid = true
+
+	d := dnsfilter.New(nil)
+	_ = d.AddRules([]dnsfilter.Filter{{Rules: lines}})
+	for _, e := range d.ParseErrors(0) {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("Invalid rule at line %d: %s: %s", e.Line, e.Rule, e.Error))
+	}
+	return result
+}
+
 // Checks for filters updates
 // If "force" is true -- does not check the filter's LastUpdated field
 // Call "save" to persist the filter contents
@@ -168,29 +250,8 @@ func (filter *filter) update(force bool) (bool, error) {
 
 	log.Tracef("Downloading update for filter %d from %s", filter.ID, filter.URL)
 
-	resp, err := client.Get(filter.URL)
-	if resp != nil && resp.Body != nil {
-		defer resp.Body.Close()
-	}
-	if err != nil {
-		log.Printf("Couldn't request filter from URL %s, skipping: %s", filter.URL, err)
-		return false, err
-	}
-
-	if resp.StatusCode != 200 {
-		log.Printf("Got status code %d from URL %s, skipping", resp.StatusCode, filter.URL)
-		return false, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
-	}
-
-	contentType := strings.ToLower(resp.Header.Get("content-type"))
-	if !strings.HasPrefix(contentType, "text/plain") {
-		log.Printf("Non-text response %s from %s, skipping", contentType, filter.URL)
-		return false, fmt.Errorf("non-text response %s", contentType)
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
+	body, _, err := downloadFilter(filter.URL, 0)
 	if err != nil {
-		log.Printf("Couldn't fetch filter contents from URL %s, skipping: %s", filter.URL, err)
 		return false, err
 	}
 
@@ -279,3 +340,48 @@ func (filter *filter) LastTimeUpdated() time.Time {
 	// filter file modified time
 	return s.ModTime()
 }
+
+// isDomainBlockRule returns true if the line is a blocking rule, not a comment or an exception
+func isDomainBlockRule(line string) bool {
+	return line != "" && line[0] != '!' && line[0] != '#' && !strings.HasPrefix(line, "@@")
+}
+
+// deduplicateUserRules removes the blocking rules from the user rules that are already in the enabled filters or earlier in the user rules
+// it returns the number of the duplicate rules in all lists and the number of the rules removed
+// config must be locked by the caller
+func deduplicateUserRules() (int, int) {
+	seen := map[string]bool{}
+	found := 0
+	for _, filter := range config.Filters {
+		if !filter.Enabled {
+			continue
+		}
+		for _, line := range filter.Rules {
+			line = strings.TrimSpace(line)
+			if !isDomainBlockRule(line) {
+				continue
+			}
+			if seen[line] {
+				found++
+			}
+			seen[line] = true
+		}
+	}
+
+	rules := []string{}
+	removed := 0
+	for _, rule := range config.UserRules {
+		line := strings.TrimSpace(rule)
+		if isDomainBlockRule(line) {
+			if seen[line] {
+				found++
+				removed++
+				continue
+			}
+			seen[line] = true
+		}
+		rules = append(rules, rule)
+	}
+	config.UserRules = rules
+	return found, removed
+}
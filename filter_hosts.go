@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const maxHostsImportSize = 10 * 1024 * 1024
+
+// the host names of the loopback entries in the hosts files, they're never converted to the rules
+var hostsLoopbackNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+type convertHostsResult struct {
+	Converted       int `json:"converted"`        // number of the rules added to the user rules
+	SkippedLoopback int `json:"skipped_loopback"` // localhost and the like
+	SkippedComments int `json:"skipped_comments"`
+	SkippedInvalid  int `json:"skipped_invalid"` // lines that aren't hosts entries and the addresses other than 0.0.0.0 and loopback
+}
+
+// isHostsBlockingIP returns true if the hosts entry with the address blocks the host
+func isHostsBlockingIP(ip net.IP) bool {
+	return ip.IsUnspecified() || ip.IsLoopback()
+}
+
+// convertHosts appends the rule "||host^" to the user rules for each host of the hosts file entries with 0.0.0.0 or loopback addresses
+// config must be locked by the caller
+func convertHosts(r io.Reader) (convertHostsResult, error) {
+	result := convertHostsResult{}
+	existing := map[string]bool{}
+	for _, rule := range config.UserRules {
+		existing[strings.TrimSpace(rule)] = true
+	}
+
+	rules := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line[0] == '#' {
+			result.SkippedComments++
+			continue
+		}
+		if pos := strings.IndexByte(line, '#'); pos != -1 {
+			line = line[:pos]
+		}
+
+		fields := strings.Fields(line)
+		ip := net.ParseIP(fields[0])
+		if len(fields) < 2 || ip == nil || !isHostsBlockingIP(ip) {
+			result.SkippedInvalid++
+			continue
+		}
+		for _, host := range fields[1:] {
+			host = strings.ToLower(strings.TrimSuffix(host, "."))
+			if hostsLoopbackNames[host] {
+				result.SkippedLoopback++
+				continue
+			}
+			if _, ok := dns.IsDomainName(host); !ok {
+				result.SkippedInvalid++
+				continue
+			}
+			rule := "||" + host + "^"
+			if existing[rule] {
+				continue
+			}
+			existing[rule] = true
+			rules = append(rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+
+	config.UserRules = append(config.UserRules, rules...)
+	result.Converted = len(rules)
+	return result, nil
+}
+
+// handleFilteringConvertHosts converts the hosts file uploaded in the "file" field of the multipart form to the user rules
+func handleFilteringConvertHosts(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseMultipartForm(maxHostsImportSize)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse multipart form: %s", err)
+		return
+	}
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Couldn't get the uploaded file: %s", err)
+		return
+	}
+	defer f.Close()
+
+	config.Lock()
+	result, err := convertHosts(f)
+	config.Unlock()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Couldn't convert hosts file: %s", err)
+		return
+	}
+
+	if result.Converted > 0 {
+		err = writeAllConfigsAndReloadDNS()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal convert hosts json: %s", err)
+		return
+	}
+}
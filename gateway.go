@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/hmage/golibs/log"
+)
+
+type gatewayInfo struct {
+	Gateway   string `json:"gateway"`
+	Interface string `json:"interface"`
+	Reachable bool   `json:"reachable"` // whether the gateway responds to ICMP ping
+}
+
+// readDefaultGateway returns the default gateway and its interface
+// it reads /proc/net/route on Linux and runs "route" on other OSes
+func readDefaultGateway() (gatewayInfo, error) {
+	f, err := os.Open("/proc/net/route")
+	if err == nil {
+		defer f.Close()
+		return parseProcNetRoute(f)
+	}
+
+	if runtime.GOOS == "windows" {
+		out, err := exec.Command("route", "print", "0.0.0.0").Output()
+		if err != nil {
+			return gatewayInfo{}, err
+		}
+		return parseWindowsRoutePrint(out)
+	}
+
+	out, err := exec.Command("route", "-n", "get", "default").Output()
+	if err != nil {
+		return gatewayInfo{}, err
+	}
+	return parseRouteGetOutput(out)
+}
+
+// parseProcNetRoute parses /proc/net/route, addresses are little-endian hex numbers:
+// Iface   Destination  Gateway   Flags  RefCnt  Use  Metric  Mask      MTU  Window  IRTT
+// eth0    00000000     0101A8C0  0003   0       0    0       00000000  0    0       0
+func parseProcNetRoute(r io.Reader) (gatewayInfo, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // skip the header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != net.IPv4len {
+			continue
+		}
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+		return gatewayInfo{Gateway: ip.String(), Interface: fields[0]}, nil
+	}
+	return gatewayInfo{}, fmt.Errorf("no default route")
+}
+
+// parseRouteGetOutput parses the output of "route -n get default" on BSD and macOS,
+// it contains "gateway: 192.168.1.1" and "interface: en0" lines
+func parseRouteGetOutput(out []byte) (gatewayInfo, error) {
+	info := gatewayInfo{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "gateway:":
+			info.Gateway = fields[1]
+		case "interface:":
+			info.Interface = fields[1]
+		}
+	}
+	if net.ParseIP(info.Gateway) == nil {
+		return gatewayInfo{}, fmt.Errorf("no default route")
+	}
+	return info, nil
+}
+
+// parseWindowsRoutePrint parses the output of "route print 0.0.0.0" on Windows,
+// the default route line is "0.0.0.0 0.0.0.0 <gateway> <interface address> <metric>"
+// the interface is specified by its address, so it's converted to the name
+func parseWindowsRoutePrint(out []byte) (gatewayInfo, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != "0.0.0.0" || fields[1] != "0.0.0.0" || net.ParseIP(fields[2]) == nil {
+			continue
+		}
+		return gatewayInfo{Gateway: fields[2], Interface: interfaceNameByIP(fields[3])}, nil
+	}
+	return gatewayInfo{}, fmt.Errorf("no default route")
+}
+
+// interfaceNameByIP returns the name of the interface with the address, or the address itself if it isn't found
+func interfaceNameByIP(addr string) string {
+	ip := net.ParseIP(addr)
+	ifaces, err := net.Interfaces()
+	if ip == nil || err != nil {
+		return addr
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return iface.Name
+			}
+		}
+	}
+	return addr
+}
+
+// pingHost sends a single ICMP echo request using the system ping utility, it doesn't require root privileges
+func pingHost(ip string) bool {
+	var args []string
+	switch runtime.GOOS {
+	case "windows":
+		args = []string{"-n", "1", "-w", "1000", ip}
+	case "darwin", "freebsd", "openbsd", "netbsd":
+		args = []string{"-c", "1", "-t", "1", ip}
+	default:
+		args = []string{"-c", "1", "-W", "1", ip}
+	}
+	err := exec.Command("ping", args...).Run()
+	if err != nil {
+		log.Tracef("Ping of %s failed: %s", ip, err)
+		return false
+	}
+	return true
+}
+
+// ---------------
+// network/gateway
+// ---------------
+func handleNetworkGateway(w http.ResponseWriter, r *http.Request) {
+	info, err := readDefaultGateway()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't find the default gateway: %s", err)
+		return
+	}
+	info.Reachable = pingHost(info.Gateway)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(info)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal gateway json: %s", err)
+		return
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"github.com/hmage/golibs/log"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoipRecord is the part of the MaxMind GeoIP2/GeoLite2 City record that we use
+type geoipRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+type geoInfo struct {
+	City    string  `json:"city"`
+	Country string  `json:"country"`
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+}
+
+// geoipDB is the opened GeoIP database, it's reopened if the path in the config changes
+var geoipDB struct {
+	path   string
+	reader *maxminddb.Reader
+	sync.Mutex
+}
+
+// getGeoIPReader returns the reader of the configured database, or nil if it's not configured
+func getGeoIPReader() (*maxminddb.Reader, error) {
+	path := config.GeoIPDatabasePath
+	if path == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(config.ourWorkingDir, path)
+	}
+
+	geoipDB.Lock()
+	defer geoipDB.Unlock()
+	if geoipDB.reader != nil && geoipDB.path == path {
+		return geoipDB.reader, nil
+	}
+
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if geoipDB.reader != nil {
+		geoipDB.reader.Close()
+	}
+	geoipDB.reader = reader
+	geoipDB.path = path
+	return reader, nil
+}
+
+// lookupGeo returns the location of the IP address, ok is false if the database isn't configured
+func lookupGeo(ip net.IP) (info geoInfo, ok bool, err error) {
+	reader, err := getGeoIPReader()
+	if err != nil || reader == nil {
+		return info, false, err
+	}
+
+	record := geoipRecord{}
+	err = reader.Lookup(ip, &record)
+	if err != nil {
+		return info, true, err
+	}
+
+	info = geoInfo{
+		City:    record.City.Names["en"],
+		Country: record.Country.ISOCode,
+		Lat:     record.Location.Latitude,
+		Lon:     record.Location.Longitude,
+	}
+	return info, true, nil
+}
+
+// addCountryCodes adds country_code field to the query log entries if the GeoIP database is configured
+func addCountryCodes(entries []map[string]interface{}) {
+	reader, err := getGeoIPReader()
+	if err != nil {
+		log.Printf("Couldn't open GeoIP database: %s", err)
+		return
+	}
+	if reader == nil {
+		return
+	}
+
+	codes := map[string]string{}
+	for _, entry := range entries {
+		client, _ := entry["client"].(string)
+		code, ok := codes[client]
+		if !ok {
+			record := geoipRecord{}
+			ip := net.ParseIP(client)
+			if ip != nil && reader.Lookup(ip, &record) == nil {
+				code = record.Country.ISOCode
+			}
+			codes[client] = code
+		}
+		if code != "" {
+			entry["country_code"] = code
+		}
+	}
+}
+
+func handleQueryLogGeo(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.URL.Query().Get("ip"))
+	if ip == nil {
+		httpError(w, http.StatusBadRequest, "ip parameter must be a valid IP address")
+		return
+	}
+
+	info, ok, err := lookupGeo(ip)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't look up %s in GeoIP database: %s", ip, err)
+		return
+	}
+	if !ok {
+		httpError(w, http.StatusNotImplemented, "GeoIP database is not configured")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(info)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal geo json: %s", err)
+		return
+	}
+}
@@ -3,6 +3,7 @@ module github.com/AdguardTeam/AdGuardHome
 require (
 	github.com/AdguardTeam/dnsproxy v0.11.1
 	github.com/StackExchange/wmi v0.0.0-20180725035823-b12b22c5341f // indirect
+	github.com/ameshkov/dnsstamps v1.0.1
 	github.com/bluele/gcache v0.0.0-20171010155617-472614239ac7
 	github.com/go-ole/go-ole v1.2.1 // indirect
 	github.com/go-test/deep v1.0.1
@@ -13,10 +14,12 @@ require (
 	github.com/kardianos/service v0.0.0-20181115005516-4c239ee84e7b
 	github.com/krolaw/dhcp4 v0.0.0-20180925202202-7cead472c414
 	github.com/miekg/dns v1.1.1
+	github.com/oschwald/maxminddb-golang v1.3.1
 	github.com/shirou/gopsutil v2.18.10+incompatible
 	github.com/shirou/w32 v0.0.0-20160930032740-bb4de0191aa4 // indirect
 	github.com/stretchr/testify v1.2.2
 	go.uber.org/goleak v0.10.0
+	golang.org/x/crypto v0.0.0-20190122013713-64072686203f
 	golang.org/x/net v0.0.0-20190119204137-ed066c81e75e
 	golang.org/x/sys v0.0.0-20190122071731-054c452bb702
 	gopkg.in/asaskevich/govalidator.v4 v4.0.0-20160518190739-766470278477
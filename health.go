@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type healthJSON struct {
+	Status      string `json:"status"` // "ok" or "unavailable"
+	DNSRunning  bool   `json:"dns_running"`
+	DHCPRunning bool   `json:"dhcp_running"`
+}
+
+type readyJSON struct {
+	healthJSON
+	UpstreamReachable bool `json:"upstream_reachable"`
+}
+
+// writeProbeResponse writes the probe result with 200 if ok is true and 503 otherwise
+func writeProbeResponse(w http.ResponseWriter, ok bool, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal health json: %s", err)
+		return
+	}
+}
+
+// getHealth returns whether the DNS and DHCP servers are running
+func getHealth() healthJSON {
+	h := healthJSON{
+		Status:      "ok",
+		DNSRunning:  isRunning(),
+		DHCPRunning: dhcpServer.IsRunning(),
+	}
+	if !h.DNSRunning {
+		h.Status = "unavailable"
+	}
+	return h
+}
+
+// -------------
+// system/health
+// -------------
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	h := getHealth()
+	writeProbeResponse(w, h.DNSRunning, h)
+}
+
+// ------------
+// system/ready
+// ------------
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	data := readyJSON{healthJSON: getHealth()}
+	if data.DNSRunning {
+		for _, c := range getConnectivity() {
+			if c.Reachable {
+				data.UpstreamReachable = true
+				break
+			}
+		}
+	}
+	if !data.UpstreamReachable {
+		data.Status = "unavailable"
+	}
+	writeProbeResponse(w, data.UpstreamReachable, data)
+}
@@ -13,6 +13,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -68,6 +69,23 @@ func ensureDELETE(handler func(http.ResponseWriter, *http.Request)) func(http.Re
 	return ensure("DELETE", handler)
 }
 
+// ensureMethods dispatches the request to the handler registered for its method
+func ensureMethods(handlers map[string]func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[r.Method]
+		if !ok {
+			methods := []string{}
+			for method := range handlers {
+				methods = append(methods, method)
+			}
+			sort.Strings(methods)
+			http.Error(w, "This request must be "+strings.Join(methods, " or "), http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	}
+}
+
 func optionalAuth(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if config.AuthName == "" || config.AuthPass == "" {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/hmage/golibs/log"
@@ -23,3 +24,42 @@ func TestGetValidNetInterfacesForWeb(t *testing.T) {
 		log.Printf("%v", iface)
 	}
 }
+
+func TestImportClients(t *testing.T) {
+	oldClients := config.Clients
+	defer func() { config.Clients = oldClients }()
+	config.Clients = []clientObject{{Name: "existing", IP: "192.168.0.1"}}
+
+	data := "IP,Name,use_global_settings,parental_enabled,parental_sensitivity\n" +
+		"192.168.0.2,laptop,true,false,\n" + // added
+		"192.168.0.1,phone,true,false,\n" + // the same IP address
+		"192.168.0.3,existing,true,false,\n" + // the same name
+		"192.168.0.300,tv,true,false,\n" + // invalid IP address
+		"192.168.0.4,tablet,yes please,false,\n" + // invalid boolean
+		"192.168.0.5,console,false,true,5\n" + // invalid sensitivity
+		"192.168.0.6,printer\n" + // wrong number of fields
+		"FD00:0:0::1,nas,false,true,13\n" // added with the normalized address
+	result, err := importClients(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to import clients: %s", err)
+	}
+	if result.Added != 2 || result.SkippedDuplicates != 2 {
+		t.Fatalf("Expected 2 added and 2 duplicate clients, got %+v", result)
+	}
+	rows := []int{}
+	for _, r := range result.InvalidRows {
+		rows = append(rows, r.Row)
+	}
+	if len(rows) != 4 || rows[0] != 5 || rows[1] != 6 || rows[2] != 7 || rows[3] != 8 {
+		t.Fatalf("Expected invalid rows 5-8, got %+v", result.InvalidRows)
+	}
+	if len(config.Clients) != 3 || config.Clients[1].Name != "laptop" || config.Clients[2].IP != "fd00::1" ||
+		config.Clients[2].ParentalSensitivity != 13 {
+		t.Fatalf("Unexpected clients after the import: %+v", config.Clients)
+	}
+
+	_, err = importClients(strings.NewReader("name,tags\nlaptop,\n"))
+	if err == nil {
+		t.Fatalf("Expected an error for the missing ip column")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hmage/golibs/log"
+)
+
+// hostsTable is the parsed system hosts file, it's reloaded when the file is modified
+var hostsTable struct {
+	sync.Mutex
+	modTime time.Time
+	hosts   map[string][]net.IP // lowercase host name -> addresses
+}
+
+// hostsFilePath returns the path of the system hosts file
+func hostsFilePath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("SystemRoot"), "System32", "drivers", "etc", "hosts")
+	}
+	return "/etc/hosts"
+}
+
+// parseHostsFile reads "IP name [aliases...]" lines, comments and invalid lines are skipped
+func parseHostsFile(r io.Reader) map[string][]net.IP {
+	hosts := map[string][]net.IP{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return hosts
+}
+
+// lookupHostsFile returns the addresses of the host from the system hosts file
+func lookupHostsFile(host string) []net.IP {
+	path := hostsFilePath()
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	hostsTable.Lock()
+	defer hostsTable.Unlock()
+	if hostsTable.hosts == nil || !fi.ModTime().Equal(hostsTable.modTime) {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("Couldn't open hosts file %s: %s", path, err)
+			return nil
+		}
+		hostsTable.hosts = parseHostsFile(f)
+		hostsTable.modTime = fi.ModTime()
+		f.Close()
+	}
+	return hostsTable.hosts[host]
+}
+
+// resolveLocalHost returns the addresses of the local host from the DHCP leases or the system hosts file
+func resolveLocalHost(host string) []net.IP {
+	ips := []net.IP{}
+	for _, l := range dhcpServer.Leases() {
+		if strings.EqualFold(l.Hostname, host) {
+			ips = append(ips, l.IP)
+		}
+	}
+	if len(ips) != 0 {
+		return ips
+	}
+	return lookupHostsFile(host)
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 
 	"github.com/hmage/golibs/log"
+	"golang.org/x/text/language"
 )
 
 // --------------------
@@ -41,6 +44,42 @@ func handleI18nCurrentLanguage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleI18nDetectLanguage returns the allowed language that is the best match for the Accept-Language header
+// available is false if the browser languages aren't allowed and the closest one is returned, English if there's none
+func handleI18nDetectLanguage(w http.ResponseWriter, r *http.Request) {
+	// English goes first, it's the default of the matcher
+	languages := []string{}
+	for l := range allowedLanguages {
+		if l != "en" {
+			languages = append(languages, l)
+		}
+	}
+	sort.Strings(languages)
+	languages = append([]string{"en"}, languages...)
+
+	tags := []language.Tag{}
+	for _, l := range languages {
+		tags = append(tags, language.Make(l))
+	}
+
+	preferred, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if err != nil {
+		log.Tracef("Couldn't parse Accept-Language: %s", err)
+	}
+	_, index, confidence := language.NewMatcher(tags).Match(preferred...)
+
+	data := map[string]interface{}{
+		"detected":  languages[index],
+		"available": confidence >= language.High,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal detected language json: %s", err)
+		return
+	}
+}
+
 func handleI18nChangeLanguage(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -68,3 +107,71 @@ func handleI18nChangeLanguage(w http.ResponseWriter, r *http.Request) {
 
 	httpUpdateConfigReloadDNSReturnOK(w, r)
 }
+
+// CLDR cardinal plural rules of the allowed languages, category -> condition
+// "other" has no condition, it's used when none of the other conditions match
+var pluralRules = map[string]map[string]string{
+	"en": {
+		"one":   "i = 1 and v = 0",
+		"other": "",
+	},
+	"ru": {
+		"one":   "v = 0 and i % 10 = 1 and i % 100 != 11",
+		"few":   "v = 0 and i % 10 = 2..4 and i % 100 != 12..14",
+		"many":  "v = 0 and i % 10 = 0 or v = 0 and i % 10 = 5..9 or v = 0 and i % 100 = 11..14",
+		"other": "",
+	},
+	"vi": {
+		"other": "",
+	},
+	"es": {
+		"one":   "n = 1",
+		"other": "",
+	},
+	"fr": {
+		"one":   "i = 0,1",
+		"other": "",
+	},
+	"ja": {
+		"other": "",
+	},
+	"sv": {
+		"one":   "i = 1 and v = 0",
+		"other": "",
+	},
+	"pt-br": {
+		"one":   "i = 0..1",
+		"other": "",
+	},
+	"zh-tw": {
+		"other": "",
+	},
+}
+
+// handleI18nPlurals returns the plural rules of the language from the lang parameter, or of the current language
+func handleI18nPlurals(w http.ResponseWriter, r *http.Request) {
+	language := strings.ToLower(r.URL.Query().Get("lang"))
+	if language == "" {
+		language = strings.ToLower(config.Language)
+	}
+	if language == "" {
+		language = "en"
+	}
+
+	rules, ok := pluralRules[language]
+	if !ok {
+		httpError(w, http.StatusBadRequest, "unknown language specified: %s", language)
+		return
+	}
+
+	data := map[string]interface{}{
+		"lang":  language,
+		"rules": rules,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal plurals json: %s", err)
+		return
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hmage/golibs/log"
+)
+
+// Possible values of logSettings.LogFormat
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logger is the structured logging interface, messages are written with their severity level
+type logger interface {
+	Debugf(format string, args ...interface{}) // written only if verbose logging is enabled
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// apiLog is the logger used by the HTTP API handlers
+var apiLog logger = levelLogger{}
+
+// jsonLog is not nil if the log format is json, all log output goes through it
+var jsonLog *jsonLogWriter
+
+// levelLogger writes to the standard logger in text mode and to jsonLog in json mode
+type levelLogger struct{}
+
+func (l levelLogger) Debugf(format string, args ...interface{}) {
+	if log.Verbose {
+		l.output("debug", format, args...)
+	}
+}
+
+func (l levelLogger) Infof(format string, args ...interface{}) {
+	l.output("info", format, args...)
+}
+
+func (l levelLogger) Errorf(format string, args ...interface{}) {
+	l.output("error", format, args...)
+}
+
+func (l levelLogger) output(level string, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if jsonLog != nil {
+		jsonLog.writeEntry(level, msg)
+		return
+	}
+	_ = stdlog.Output(3, msg)
+}
+
+// jsonLogWriter converts the standard logger output into JSON objects, one per line
+type jsonLogWriter struct {
+	out io.Writer
+	sync.Mutex
+}
+
+type jsonLogEntry struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+}
+
+// log.Tracef() output starts with goroutine ID and function name, for example "[42] main.run(): "
+var traceLinePattern = regexp.MustCompile(`^\[\d+\] \S+\(\): `)
+
+// Write is called by the standard logger, p is a single log message
+// the standard logger flags must be 0 so that p has no date prefix
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	level := "info"
+	if traceLinePattern.MatchString(msg) {
+		level = "debug"
+	}
+	err := w.writeEntry(level, msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *jsonLogWriter) writeEntry(level string, msg string) error {
+	entry := jsonLogEntry{
+		Time:  time.Now().Format(time.RFC3339Nano),
+		Level: level,
+		Msg:   msg,
+	}
+	w.Lock()
+	defer w.Unlock()
+	return json.NewEncoder(w.out).Encode(entry)
+}
+
+// enableJSONLogging makes the standard logger and apiLog write JSON objects to the current log output
+func enableJSONLogging() {
+	jsonLog = &jsonLogWriter{out: stdlog.Writer()}
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(jsonLog)
+}
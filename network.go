@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// usedByUs returns true if host:port may be taken by our own listener on curHost:curPort
+// such port can't be checked with checkPortAvailable() until we release it
+func usedByUs(host string, port int, curHost string, curPort int) bool {
+	if port != curPort {
+		return false
+	}
+	return host == curHost || net.ParseIP(host).IsUnspecified() || net.ParseIP(curHost).IsUnspecified()
+}
+
+// restartHTTPServer makes the HTTP server listen on the current config.BindHost and config.BindPort
+// this needs to be done in a goroutine because Shutdown() is a blocking call, and it will block
+// until all requests are finished, and _we_ are inside a request right now, so it will block indefinitely
+func restartHTTPServer() {
+	go func() {
+		httpServer.Shutdown(context.TODO())
+	}()
+}
+
+// restartHTTPSServer makes the HTTPS server use the current config, it's called in a goroutine for the same reason
+func restartHTTPSServer() {
+	go func() {
+		time.Sleep(time.Second) // TODO: could not find a way to reliably know that data was fully sent to client by https server, so we wait a bit to let response through before closing the server
+		httpsServer.cond.L.Lock()
+		httpsServer.cond.Broadcast()
+		if httpsServer.server != nil {
+			httpsServer.server.Shutdown(context.TODO())
+		}
+		httpsServer.cond.L.Unlock()
+	}()
+}
+
+// -------
+// network
+// -------
+type listenInterfacesJSON struct {
+	DNSHost  string `json:"dns_host"`
+	HTTPHost string `json:"http_host"`
+}
+
+func handleSetListenInterfaces(w http.ResponseWriter, r *http.Request) {
+	data := listenInterfacesJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse listen interfaces json: %s", err)
+		return
+	}
+
+	for _, host := range []string{data.DNSHost, data.HTTPHost} {
+		if net.ParseIP(host) == nil {
+			httpError(w, http.StatusBadRequest, "%s is not a valid IP address", host)
+			return
+		}
+	}
+
+	restartHTTP := data.HTTPHost != config.BindHost
+	if restartHTTP && !usedByUs(data.HTTPHost, config.BindPort, config.BindHost, config.BindPort) {
+		err = checkPortAvailable(data.HTTPHost, config.BindPort)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "Impossible to listen on IP:port %s due to %s", net.JoinHostPort(data.HTTPHost, strconv.Itoa(config.BindPort)), err)
+			return
+		}
+	}
+
+	if data.DNSHost != config.DNS.BindHost && !usedByUs(data.DNSHost, config.DNS.Port, config.DNS.BindHost, config.DNS.Port) {
+		err = checkPacketPortAvailable(data.DNSHost, config.DNS.Port)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "Impossible to listen on IP:port %s due to %s", net.JoinHostPort(data.DNSHost, strconv.Itoa(config.DNS.Port)), err)
+			return
+		}
+	}
+
+	config.BindHost = data.HTTPHost
+	config.DNS.BindHost = data.DNSHost
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+
+	if restartHTTP {
+		restartHTTPServer()
+		if httpsServer.server != nil {
+			restartHTTPSServer()
+		}
+	}
+}
+
+type listenPortsJSON struct {
+	DNSPort   int `json:"dns_port"`
+	HTTPPort  int `json:"http_port"`
+	HTTPSPort int `json:"https_port"` // 0 disables HTTPS
+	DOTPort   int `json:"dot_port"`   // 0 disables DNS-over-TLS
+}
+
+// listenAddressesJSON is the effective listen addresses, empty if the server is disabled
+type listenAddressesJSON struct {
+	DNS   string `json:"dns"`
+	HTTP  string `json:"http"`
+	HTTPS string `json:"https"`
+	DOT   string `json:"dot"`
+}
+
+func listenAddress(host string, port int) string {
+	if port == 0 {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func handleSetListenPorts(w http.ResponseWriter, r *http.Request) {
+	// the ports missing in the request are not changed
+	data := listenPortsJSON{
+		DNSPort:   config.DNS.Port,
+		HTTPPort:  config.BindPort,
+		HTTPSPort: config.TLS.PortHTTPS,
+		DOTPort:   config.TLS.PortDNSOverTLS,
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse listen ports json: %s", err)
+		return
+	}
+
+	ports := []struct {
+		name     string
+		port     int
+		cur      int
+		host     string
+		optional bool
+		check    func(host string, port int) error
+	}{
+		{"dns_port", data.DNSPort, config.DNS.Port, config.DNS.BindHost, false, checkPacketPortAvailable},
+		{"http_port", data.HTTPPort, config.BindPort, config.BindHost, false, checkPortAvailable},
+		{"https_port", data.HTTPSPort, config.TLS.PortHTTPS, config.BindHost, true, checkPortAvailable},
+		{"dot_port", data.DOTPort, config.TLS.PortDNSOverTLS, config.DNS.BindHost, true, checkPortAvailable},
+	}
+	for _, p := range ports {
+		if p.port < 0 || p.port > 65535 || (p.port == 0 && !p.optional) {
+			httpError(w, http.StatusBadRequest, "%s must be between 1 and 65535", p.name)
+			return
+		}
+	}
+	// all of them listen on TCP, the DNS server too
+	for i, p := range ports {
+		for _, other := range ports[i+1:] {
+			if p.port != 0 && usedByUs(p.host, p.port, other.host, other.port) {
+				httpError(w, http.StatusBadRequest, "%s and %s can't be the same port %d", p.name, other.name, p.port)
+				return
+			}
+		}
+	}
+	for _, p := range ports {
+		if p.port == p.cur || p.port == 0 {
+			continue
+		}
+		err = p.check(p.host, p.port)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "Impossible to listen on IP:port %s due to %s", net.JoinHostPort(p.host, strconv.Itoa(p.port)), err)
+			return
+		}
+	}
+
+	restartHTTP := data.HTTPPort != config.BindPort
+	restartHTTPS := data.HTTPSPort != config.TLS.PortHTTPS
+	restartDNS := data.DNSPort != config.DNS.Port || data.DOTPort != config.TLS.PortDNSOverTLS
+
+	config.DNS.Port = data.DNSPort
+	config.BindPort = data.HTTPPort
+	config.TLS.PortHTTPS = data.HTTPSPort
+	config.TLS.PortDNSOverTLS = data.DOTPort
+	if restartDNS {
+		err = writeAllConfigsAndReloadDNS()
+	} else {
+		err = writeAllConfigs()
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+
+	addresses := listenAddressesJSON{
+		DNS:  listenAddress(config.DNS.BindHost, config.DNS.Port),
+		HTTP: listenAddress(config.BindHost, config.BindPort),
+	}
+	if config.TLS.Enabled {
+		addresses.HTTPS = listenAddress(config.BindHost, config.TLS.PortHTTPS)
+		addresses.DOT = listenAddress(config.DNS.BindHost, config.TLS.PortDNSOverTLS)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(addresses)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal listen addresses json: %s", err)
+		return
+	}
+
+	if restartHTTP {
+		restartHTTPServer()
+	}
+	if restartHTTPS {
+		restartHTTPSServer()
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetListenPortsDuplicates(t *testing.T) {
+	oldDNS := config.DNS
+	oldTLS := config.TLS
+	oldHost := config.BindHost
+	oldPort := config.BindPort
+	defer func() {
+		config.DNS = oldDNS
+		config.TLS = oldTLS
+		config.BindHost = oldHost
+		config.BindPort = oldPort
+	}()
+	config.DNS.BindHost = "0.0.0.0"
+	config.DNS.Port = 53
+	config.BindHost = "0.0.0.0"
+	config.BindPort = 3000
+	config.TLS.PortHTTPS = 443
+	config.TLS.PortDNSOverTLS = 853
+
+	for body, want := range map[string]string{
+		// the missing ports are the current ones
+		`{"https_port": 3000}`: "http_port and https_port",
+		`{"dot_port": 443}`:    "https_port and dot_port",
+		`{"http_port": 53}`:    "dns_port and http_port",
+		`{"dns_port": 0}`:      "dns_port must be between 1 and 65535",
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/control/network/listen_ports", strings.NewReader(body))
+		handleSetListenPorts(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		assert.Contains(t, w.Body.String(), want, body)
+	}
+}
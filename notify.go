@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hmage/golibs/log"
+)
+
+// events that can be sent to the admin
+const (
+	notifyProtectionDisabled = "protection_disabled"
+	notifyUpstreamError      = "upstream_error"
+	notifyCertExpiring       = "cert_expiring"
+)
+
+var notifyEvents = []string{notifyProtectionDisabled, notifyUpstreamError, notifyCertExpiring}
+
+const (
+	notifyProviderTelegram = "telegram"
+	notifyProviderWebhook  = "webhook"
+)
+
+const telegramAPIURL = "https://api.telegram.org/bot%s/sendMessage"
+
+// the same event is not sent more often than this, upstream errors may happen on every request
+const notifyThrottle = 10 * time.Minute
+
+// cert_expiring is sent when the TLS certificate expires in less than this
+const certExpiryWarning = 7 * 24 * time.Hour
+
+// notifyConfig is the settings of the admin notifications
+type notifyConfig struct {
+	Provider string   `yaml:"provider" json:"provider"` // "telegram" or "webhook", notifications are disabled if empty
+	Token    string   `yaml:"token" json:"token"`       // Telegram bot token
+	ChatID   string   `yaml:"chat_id" json:"chat_id"`   // Telegram chat ID
+	URL      string   `yaml:"url" json:"url"`           // webhook URL
+	Events   []string `yaml:"events" json:"events"`     // events to send
+}
+
+// notifyWebhookJSON is posted to the webhook URL
+type notifyWebhookJSON struct {
+	Event   string    `json:"event"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+type telegramMessageJSON struct {
+	ChatID string `json:"chat_id"`
+	Text   string `json:"text"`
+}
+
+var notifier = struct {
+	lastSent map[string]time.Time // event -> the time it was last sent
+	sync.Mutex
+}{lastSent: map[string]time.Time{}}
+
+// containsString returns true if the list has the string s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// notify sends the event to the configured provider in the background
+// it does nothing if the event isn't enabled or it was already sent recently
+func notify(event, message string) {
+	go func() {
+		config.RLock()
+		c := config.Notify
+		config.RUnlock()
+
+		if c.Provider == "" || !containsString(c.Events, event) {
+			return
+		}
+
+		notifier.Lock()
+		last, ok := notifier.lastSent[event]
+		if ok && time.Since(last) < notifyThrottle {
+			notifier.Unlock()
+			return
+		}
+		notifier.lastSent[event] = time.Now()
+		notifier.Unlock()
+
+		err := sendNotification(c, event, message)
+		if err != nil {
+			log.Printf("Couldn't send %s notification: %s", event, err)
+		}
+	}()
+}
+
+// sendNotification posts the event to the Telegram Bot API or to the webhook
+func sendNotification(c notifyConfig, event, message string) error {
+	var addr string
+	var data interface{}
+	switch c.Provider {
+	case notifyProviderTelegram:
+		addr = fmt.Sprintf(telegramAPIURL, c.Token)
+		data = telegramMessageJSON{ChatID: c.ChatID, Text: "AdGuard Home: " + message}
+	case notifyProviderWebhook:
+		addr = c.URL
+		data = notifyWebhookJSON{Event: event, Message: message, Time: time.Now()}
+	default:
+		return fmt.Errorf("unknown provider %q", c.Provider)
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(addr, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return redactURLError(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// redactURLError removes the path and the query of the URL from the error so that they don't get to the log
+// the Telegram bot token is in the path, the webhook URL may have secrets too
+func redactURLError(err error) error {
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+	redacted := ""
+	u, parseErr := url.Parse(urlErr.URL)
+	if parseErr == nil {
+		redacted = u.Scheme + "://" + u.Host
+	}
+	return &url.Error{Op: urlErr.Op, URL: redacted, Err: urlErr.Err}
+}
+
+// onUpstreamError is called by the DNS server when none of the upstreams could answer a request
+func onUpstreamError(err error) {
+	notify(notifyUpstreamError, fmt.Sprintf("upstream DNS servers are unreachable: %s", err))
+}
+
+// checkCertExpiry logs a warning if the configured TLS certificate expires in fewer than certExpiryWarningDays
+// cert_expiring is sent if it expires in less than certExpiryWarning
+func checkCertExpiry() {
+	config.RLock()
+	data := config.TLS
+	config.RUnlock()
+	if !data.Enabled || data.CertificateChain == "" {
+		return
+	}
+
+	expiry, err := getCertExpiry(data)
+	if err != nil {
+		return
+	}
+	if expiry.Warning != "" {
+		log.Printf("Warning: TLS certificate for %s: %s", data.ServerName, expiry.Warning)
+	}
+	if time.Until(expiry.NotAfter) < certExpiryWarning {
+		notify(notifyCertExpiring, fmt.Sprintf("TLS certificate for %s expires on %s", data.ServerName, expiry.NotAfter.Format(time.RFC1123)))
+	}
+}
+
+// periodicallyCheckCertExpiry checks the certificate on startup and then daily at midnight
+func periodicallyCheckCertExpiry() {
+	checkCertExpiry()
+	for {
+		now := time.Now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		time.Sleep(midnight.Sub(now))
+		checkCertExpiry()
+	}
+}
+
+// ----------------
+// notify/configure
+// ----------------
+func handleNotifyConfigure(w http.ResponseWriter, r *http.Request) {
+	data := notifyConfig{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse notify json: %s", err)
+		return
+	}
+
+	switch data.Provider {
+	case "":
+	case notifyProviderTelegram:
+		if data.Token == "" || data.ChatID == "" {
+			httpError(w, http.StatusBadRequest, "token and chat_id are required for telegram")
+			return
+		}
+	case notifyProviderWebhook:
+		u, err := url.Parse(data.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			httpError(w, http.StatusBadRequest, "url must be a valid http or https URL")
+			return
+		}
+	default:
+		httpError(w, http.StatusBadRequest, "provider must be one of: telegram, webhook")
+		return
+	}
+	for _, e := range data.Events {
+		if !containsString(notifyEvents, e) {
+			httpError(w, http.StatusBadRequest, "unknown event %s", e)
+			return
+		}
+	}
+
+	config.Lock()
+	config.Notify = data
+	config.Unlock()
+
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
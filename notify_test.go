@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendNotificationRedactsToken(t *testing.T) {
+	// nothing listens on the closed server, so the request fails with the URL in the error
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	c := notifyConfig{Provider: notifyProviderWebhook, URL: srv.URL + "/bot123456:secret-token/sendMessage?key=secret"}
+	err := sendNotification(c, notifyUpstreamError, "test")
+	if assert.NotNil(t, err) {
+		assert.False(t, strings.Contains(err.Error(), "secret"), err.Error())
+		assert.True(t, strings.Contains(err.Error(), srv.URL), err.Error())
+	}
+
+	other := redactURLError(http.ErrHandlerTimeout)
+	assert.Equal(t, http.ErrHandlerTimeout, other)
+}
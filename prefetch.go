@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hmage/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// URLs of the popular domains lists, each is a zipped CSV file of "rank,domain" lines
+var popularLists = map[string]string{
+	"tranco":   "https://tranco-list.eu/top-1m.csv.zip",
+	"umbrella": "http://s3-us-west-1.amazonaws.com/umbrella-static/top-1m.csv.zip",
+}
+
+const (
+	prefetchDefaultCount = 1000
+	prefetchMaxCount     = 100000
+	prefetchWorkers      = 10
+	prefetchMaxListSize  = 64 * 1024 * 1024
+)
+
+var prefetchClient = &http.Client{
+	Timeout: time.Minute * 5,
+}
+
+type prefetchStatus struct {
+	Running     bool   `json:"running"`
+	Downloading bool   `json:"downloading"` // the list is being downloaded, the domains aren't queued yet
+	Queued      int    `json:"queued"`
+	Completed   int    `json:"completed"`
+	Failed      int    `json:"failed"`
+	Error       string `json:"error,omitempty"` // why the list couldn't be downloaded
+}
+
+// prefetch is the state of the currently running (or the last) prefetch operation
+var prefetch struct {
+	sync.Mutex
+	status prefetchStatus
+	cancel chan struct{}
+}
+
+// downloadPopularList downloads the list and returns up to count domains from it
+// the download is stopped when the context is cancelled
+func downloadPopularList(ctx context.Context, url string, count int) ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := prefetchClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status code %d from %s", resp.StatusCode, url)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, prefetchMaxListSize))
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	if len(zr.File) == 0 {
+		return nil, fmt.Errorf("%s is an empty archive", url)
+	}
+
+	f, err := zr.File[0].Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	domains := []string{}
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	for len(domains) < count {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, strings.TrimSpace(record[1]))
+	}
+	return domains, nil
+}
+
+// prefetchPopular downloads the list and prefetches its domains, it runs in the background until it's finished or cancelled
+func prefetchPopular(name string, url string, count int, cancel chan struct{}) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		select {
+		case <-cancel:
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+
+	domains, err := downloadPopularList(ctx, url, count)
+	prefetch.Lock()
+	prefetch.status.Downloading = false
+	if err != nil {
+		prefetch.status.Running = false
+		if ctx.Err() != nil {
+			log.Printf("Prefetching of popular domains was cancelled")
+		} else {
+			prefetch.status.Error = fmt.Sprintf("couldn't download the %s list: %s", name, err)
+			log.Printf("Prefetching of popular domains failed: %s", prefetch.status.Error)
+		}
+		prefetch.Unlock()
+		return
+	}
+	prefetch.status.Queued = len(domains)
+	prefetch.Unlock()
+
+	prefetchDomains(domains, cancel)
+}
+
+// prefetchDomains resolves A and AAAA records of the domains so that they get into the cache
+func prefetchDomains(domains []string, cancel chan struct{}) {
+	jobs := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < prefetchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domain := range jobs {
+				failed := false
+				for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+					req := dns.Msg{}
+					req.SetQuestion(dns.Fqdn(domain), qtype)
+					req.RecursionDesired = true
+					_, err := dnsServer.Resolve(&req)
+					if err != nil {
+						log.Tracef("Couldn't prefetch %s: %s", domain, err)
+						failed = true
+					}
+				}
+
+				prefetch.Lock()
+				if failed {
+					prefetch.status.Failed++
+				} else {
+					prefetch.status.Completed++
+				}
+				prefetch.Unlock()
+			}
+		}()
+	}
+
+loop:
+	for _, domain := range domains {
+		select {
+		case jobs <- domain:
+		case <-cancel:
+			log.Printf("Prefetching of popular domains was cancelled")
+			break loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	prefetch.Lock()
+	prefetch.status.Running = false
+	log.Printf("Prefetched popular domains: %d completed, %d failed", prefetch.status.Completed, prefetch.status.Failed)
+	prefetch.Unlock()
+}
+
+func handlePrefetchPopular(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		List  string `json:"list"`
+		Count int    `json:"count"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse prefetch json: %s", err)
+		return
+	}
+
+	url, ok := popularLists[req.List]
+	if !ok {
+		httpError(w, http.StatusBadRequest, "Unknown list: %s", req.List)
+		return
+	}
+	if req.Count == 0 {
+		req.Count = prefetchDefaultCount
+	}
+	if req.Count < 0 || req.Count > prefetchMaxCount {
+		httpError(w, http.StatusBadRequest, "count must be between 1 and %d", prefetchMaxCount)
+		return
+	}
+	if !isRunning() {
+		httpError(w, http.StatusBadRequest, "DNS server is not running")
+		return
+	}
+
+	prefetch.Lock()
+	if prefetch.status.Running {
+		prefetch.Unlock()
+		httpError(w, http.StatusConflict, "Prefetching is already running")
+		return
+	}
+	// the list is downloaded in the background too, so that it can be cancelled and its progress is seen in the status
+	prefetch.status = prefetchStatus{Running: true, Downloading: true}
+	prefetch.cancel = make(chan struct{})
+	go prefetchPopular(req.List, url, req.Count, prefetch.cancel)
+	status := prefetch.status
+	prefetch.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(status)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal prefetch status json: %s", err)
+		return
+	}
+}
+
+func handlePrefetchStatus(w http.ResponseWriter, r *http.Request) {
+	prefetch.Lock()
+	status := prefetch.status
+	prefetch.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal prefetch status json: %s", err)
+		return
+	}
+}
+
+func handlePrefetchCancel(w http.ResponseWriter, r *http.Request) {
+	prefetch.Lock()
+	if prefetch.status.Running && prefetch.cancel != nil {
+		close(prefetch.cancel)
+		prefetch.cancel = nil
+	}
+	prefetch.Unlock()
+	returnOK(w)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// waitPrefetch waits until the prefetching is finished and returns its status
+func waitPrefetch(t *testing.T) prefetchStatus {
+	for i := 0; i < 100; i++ {
+		prefetch.Lock()
+		status := prefetch.status
+		prefetch.Unlock()
+		if !status.Running {
+			return status
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatalf("Prefetching is still running")
+	return prefetchStatus{}
+}
+
+func TestPrefetchPopularCancel(t *testing.T) {
+	started := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	cancel := make(chan struct{})
+	prefetch.Lock()
+	prefetch.status = prefetchStatus{Running: true, Downloading: true}
+	prefetch.Unlock()
+	go prefetchPopular("test", srv.URL, 10, cancel)
+
+	<-started
+	close(cancel)
+	status := waitPrefetch(t)
+	assert.False(t, status.Downloading)
+	assert.Equal(t, "", status.Error)
+	assert.Equal(t, 0, status.Queued)
+}
+
+func TestPrefetchPopularError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	prefetch.Lock()
+	prefetch.status = prefetchStatus{Running: true, Downloading: true}
+	prefetch.Unlock()
+	go prefetchPopular("test", srv.URL, 10, make(chan struct{}))
+
+	status := waitPrefetch(t)
+	assert.False(t, status.Downloading)
+	assert.Contains(t, status.Error, "got status code 404")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/hmage/golibs/log"
+)
+
+// the limit of open files below which AdGuard Home may run out of them under load
+const minRecommendedOpenFiles = 1024
+
+// rlimitJSON is a resource limit, -1 means unlimited
+type rlimitJSON struct {
+	Current int64 `json:"current"`
+	Max     int64 `json:"max"`
+}
+
+type resourceLimitsJSON struct {
+	Limits       map[string]rlimitJSON `json:"limits"`         // keyed by the lowercase resource name, e.g. "nofile"
+	MaxOpenFiles uint64                `json:"max_open_files"` // the configured limit, 0 if it's not set
+	Warnings     []string              `json:"warnings"`
+}
+
+type setResourceLimitsJSON struct {
+	MaxOpenFiles uint64 `json:"max_open_files"`
+}
+
+// resourceLimitsWarnings returns the warnings about the limits being too low
+func resourceLimitsWarnings(limits map[string]rlimitJSON) []string {
+	warnings := []string{}
+	nofile, ok := limits["nofile"]
+	if ok && nofile.Current != -1 && nofile.Current < minRecommendedOpenFiles {
+		warnings = append(warnings, fmt.Sprintf("The limit of open files %d is below the recommended minimum %d",
+			nofile.Current, minRecommendedOpenFiles))
+	}
+	return warnings
+}
+
+// applyResourceLimits sets the limits from the configuration file on startup
+func applyResourceLimits() {
+	if config.MaxOpenFiles != 0 {
+		err := setMaxOpenFiles(config.MaxOpenFiles)
+		if err != nil {
+			log.Printf("Couldn't set the limit of open files to %d: %s", config.MaxOpenFiles, err)
+		}
+	}
+
+	limits, err := getResourceLimits()
+	if err != nil {
+		log.Tracef("Couldn't get resource limits: %s", err)
+		return
+	}
+	for _, w := range resourceLimitsWarnings(limits) {
+		log.Printf("Warning: %s", w)
+	}
+}
+
+// ----------------------
+// system/resource_limits
+// ----------------------
+func handleGetResourceLimits(w http.ResponseWriter, r *http.Request) {
+	limits, err := getResourceLimits()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't get resource limits: %s", err)
+		return
+	}
+
+	data := resourceLimitsJSON{
+		Limits:       limits,
+		MaxOpenFiles: config.MaxOpenFiles,
+		Warnings:     resourceLimitsWarnings(limits),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal resource limits json: %s", err)
+		return
+	}
+}
+
+func handleSetResourceLimits(w http.ResponseWriter, r *http.Request) {
+	data := setResourceLimitsJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse resource limits json: %s", err)
+		return
+	}
+	if data.MaxOpenFiles == 0 {
+		httpError(w, http.StatusBadRequest, "max_open_files must be greater than 0")
+		return
+	}
+
+	err = setMaxOpenFiles(data.MaxOpenFiles)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Couldn't set the limit of open files to %d: %s", data.MaxOpenFiles, err)
+		return
+	}
+
+	config.MaxOpenFiles = data.MaxOpenFiles
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
@@ -0,0 +1,16 @@
+// +build !linux,!darwin
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func getResourceLimits() (map[string]rlimitJSON, error) {
+	return nil, fmt.Errorf("resource limits are not supported on %s", runtime.GOOS)
+}
+
+func setMaxOpenFiles(n uint64) error {
+	return fmt.Errorf("resource limits are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,57 @@
+// +build linux darwin
+
+package main
+
+import (
+	"math"
+	"syscall"
+)
+
+// resources returned by /control/system/resource_limits
+var rlimitResources = map[string]int{
+	"nofile": syscall.RLIMIT_NOFILE,
+	"as":     syscall.RLIMIT_AS,
+	"data":   syscall.RLIMIT_DATA,
+	"stack":  syscall.RLIMIT_STACK,
+	"core":   syscall.RLIMIT_CORE,
+	"cpu":    syscall.RLIMIT_CPU,
+	"fsize":  syscall.RLIMIT_FSIZE,
+}
+
+// rlimitValue converts the limit to int64, -1 means unlimited
+// RLIM_INFINITY is the maximum uint64 on Linux and the maximum int64 on macOS
+func rlimitValue(v uint64) int64 {
+	if v >= math.MaxInt64 {
+		return -1
+	}
+	return int64(v)
+}
+
+// getResourceLimits returns the limits of the AdGuard Home process
+func getResourceLimits() (map[string]rlimitJSON, error) {
+	limits := map[string]rlimitJSON{}
+	for name, resource := range rlimitResources {
+		rl := syscall.Rlimit{}
+		err := syscall.Getrlimit(resource, &rl)
+		if err != nil {
+			return nil, err
+		}
+		limits[name] = rlimitJSON{Current: rlimitValue(rl.Cur), Max: rlimitValue(rl.Max)}
+	}
+	return limits, nil
+}
+
+// setMaxOpenFiles sets the soft limit of open files
+// the hard limit is raised too if it's lower, it requires root privileges
+func setMaxOpenFiles(n uint64) error {
+	rl := syscall.Rlimit{}
+	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl)
+	if err != nil {
+		return err
+	}
+	rl.Cur = n
+	if rl.Max < n {
+		rl.Max = n
+	}
+	return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rl)
+}
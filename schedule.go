@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/hmage/golibs/log"
+)
+
+// scheduleDays are the day names accepted in schedule.Days, indexed by time.Weekday
+var scheduleDays = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// scheduleSettings are the filtering settings applied while the schedule is active
+// nil fields aren't changed
+type scheduleSettings struct {
+	ParentalEnabled     *bool `yaml:"parental_enabled,omitempty" json:"parental_enabled,omitempty"`
+	ParentalSensitivity int   `yaml:"parental_sensitivity,omitempty" json:"parental_sensitivity,omitempty"` // if 0, the global value is used
+	SafeSearchEnabled   *bool `yaml:"safesearch_enabled,omitempty" json:"safesearch_enabled,omitempty"`
+	SafeBrowsingEnabled *bool `yaml:"safebrowsing_enabled,omitempty" json:"safebrowsing_enabled,omitempty"`
+}
+
+// schedule is a time range on the specified days of week when the settings are applied
+// if EndTime is before StartTime, the range ends on the next day
+type schedule struct {
+	Name      string           `yaml:"name" json:"name"`
+	Days      []string         `yaml:"days" json:"days"`             // e.g. "Mon"
+	StartTime string           `yaml:"start_time" json:"start_time"` // "HH:MM" in the local time
+	EndTime   string           `yaml:"end_time" json:"end_time"`     // "HH:MM" in the local time
+	Config    scheduleSettings `yaml:"config" json:"config"`
+}
+
+// clientSchedule associates the schedule with the client, such schedule is applied only to this client
+// schedules without clients are applied to all clients
+type clientSchedule struct {
+	ClientIP     string `yaml:"client_ip" json:"client_ip"`
+	ScheduleName string `yaml:"schedule_name" json:"schedule_name"`
+}
+
+// how the settings of several active schedules are combined
+const (
+	scheduleConflictLastWins        = "last_wins"        // the schedule added last overrides the others
+	scheduleConflictMostRestrictive = "most_restrictive" // a feature is enabled if any schedule enables it
+)
+
+// activeSchedule is a schedule that matches the current time
+type activeSchedule struct {
+	schedule
+	clients []string // IP addresses of the clients the schedule applies to, all clients if empty
+}
+
+// activeSchedules are the schedules that match the current time, updated by the scheduler
+var activeSchedules = struct {
+	list            []activeSchedule
+	mostRestrictive bool
+	sync.RWMutex
+}{}
+
+// parseScheduleTime returns the minutes since midnight for "HH:MM"
+func parseScheduleTime(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, must be HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (sc schedule) hasDay(d time.Weekday) bool {
+	return containsString(sc.Days, scheduleDays[d])
+}
+
+// isActive returns true if the time is within the schedule
+// if the start and the end are the same, the schedule lasts the whole day
+func (sc schedule) isActive(now time.Time) bool {
+	start, err := parseScheduleTime(sc.StartTime)
+	if err != nil {
+		return false
+	}
+	end, err := parseScheduleTime(sc.EndTime)
+	if err != nil {
+		return false
+	}
+
+	m := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	yesterday := (today + 6) % 7
+	switch {
+	case start == end:
+		return sc.hasDay(today)
+	case start < end:
+		return sc.hasDay(today) && m >= start && m < end
+	default:
+		return (sc.hasDay(today) && m >= start) || (sc.hasDay(yesterday) && m < end)
+	}
+}
+
+// validate checks the schedule fields
+// config must be locked by the caller
+func (sc schedule) validate() error {
+	if sc.Name == "" {
+		return fmt.Errorf("schedule name must not be empty")
+	}
+	if len(sc.Days) == 0 {
+		return fmt.Errorf("days must not be empty")
+	}
+	for _, d := range sc.Days {
+		if !containsString(scheduleDays, d) {
+			return fmt.Errorf("invalid day %q, must be one of Mon, Tue, Wed, Thu, Fri, Sat, Sun", d)
+		}
+	}
+	if _, err := parseScheduleTime(sc.StartTime); err != nil {
+		return err
+	}
+	if _, err := parseScheduleTime(sc.EndTime); err != nil {
+		return err
+	}
+
+	if sc.Config.ParentalEnabled != nil && *sc.Config.ParentalEnabled {
+		sensitivity := sc.Config.ParentalSensitivity
+		if sensitivity == 0 {
+			sensitivity = config.DNS.ParentalSensitivity
+		}
+		switch sensitivity {
+		case 3, 10, 13, 17:
+		default:
+			return fmt.Errorf("parental_sensitivity must be set to valid value")
+		}
+	}
+	return nil
+}
+
+// apply overrides the filtering settings with the schedule ones
+func (s scheduleSettings) apply(settings *dnsfilter.Config) {
+	if s.ParentalEnabled != nil {
+		settings.ParentalEnabled = *s.ParentalEnabled
+		if s.ParentalSensitivity != 0 {
+			settings.ParentalSensitivity = s.ParentalSensitivity
+		}
+	}
+	if s.SafeSearchEnabled != nil {
+		settings.SafeSearchEnabled = *s.SafeSearchEnabled
+	}
+	if s.SafeBrowsingEnabled != nil {
+		settings.SafeBrowsingEnabled = *s.SafeBrowsingEnabled
+	}
+}
+
+// merge combines the settings so that a feature is enabled if it's enabled in either of them
+// the lowest parental sensitivity, i.e. the youngest age, wins
+func (s scheduleSettings) merge(other scheduleSettings) scheduleSettings {
+	mergeBool := func(a, b *bool) *bool {
+		if a == nil {
+			return b
+		}
+		if b == nil || *a {
+			return a
+		}
+		return b
+	}
+
+	enabled := s.ParentalEnabled != nil && *s.ParentalEnabled
+	otherEnabled := other.ParentalEnabled != nil && *other.ParentalEnabled
+	switch {
+	case enabled && otherEnabled:
+		if other.ParentalSensitivity != 0 && (s.ParentalSensitivity == 0 || other.ParentalSensitivity < s.ParentalSensitivity) {
+			s.ParentalSensitivity = other.ParentalSensitivity
+		}
+	case otherEnabled:
+		s.ParentalSensitivity = other.ParentalSensitivity
+	}
+	s.ParentalEnabled = mergeBool(s.ParentalEnabled, other.ParentalEnabled)
+	s.SafeSearchEnabled = mergeBool(s.SafeSearchEnabled, other.SafeSearchEnabled)
+	s.SafeBrowsingEnabled = mergeBool(s.SafeBrowsingEnabled, other.SafeBrowsingEnabled)
+	return s
+}
+
+// appliesTo returns true if the schedule applies to the client
+func (sc activeSchedule) appliesTo(clientAddr string) bool {
+	if len(sc.clients) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientAddr)
+	if ip == nil {
+		return false
+	}
+	return containsString(sc.clients, ip.String())
+}
+
+// applySchedules applies the settings of the currently active schedules for the client
+// the global schedules are applied first, then the ones associated with the client
+func applySchedules(clientAddr string, settings *dnsfilter.Config) {
+	activeSchedules.RLock()
+	defer activeSchedules.RUnlock()
+
+	matched := []scheduleSettings{}
+	for _, sc := range activeSchedules.list {
+		if len(sc.clients) == 0 {
+			matched = append(matched, sc.Config)
+		}
+	}
+	for _, sc := range activeSchedules.list {
+		if len(sc.clients) != 0 && sc.appliesTo(clientAddr) {
+			matched = append(matched, sc.Config)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+
+	if activeSchedules.mostRestrictive {
+		merged := matched[0]
+		for _, s := range matched[1:] {
+			merged = merged.merge(s)
+		}
+		merged.apply(settings)
+		return
+	}
+	for _, s := range matched {
+		s.apply(settings)
+	}
+}
+
+// findSchedule returns the index of the schedule with the specified name, or -1
+// config must be locked by the caller
+func findSchedule(name string) int {
+	for i := range config.Schedules {
+		if config.Schedules[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// updateActiveSchedules checks the current time against all schedules
+func updateActiveSchedules() {
+	now := time.Now()
+	active := []activeSchedule{}
+	config.RLock()
+	for _, sc := range config.Schedules {
+		if !sc.isActive(now) {
+			continue
+		}
+		a := activeSchedule{schedule: sc}
+		for _, cs := range config.ClientSchedules {
+			if cs.ScheduleName == sc.Name {
+				a.clients = append(a.clients, cs.ClientIP)
+			}
+		}
+		active = append(active, a)
+	}
+	mostRestrictive := config.ScheduleConflict == scheduleConflictMostRestrictive
+	config.RUnlock()
+
+	activeSchedules.Lock()
+	old := activeSchedules.list
+	activeSchedules.list = active
+	activeSchedules.mostRestrictive = mostRestrictive
+	activeSchedules.Unlock()
+
+	for _, sc := range active {
+		if !scheduleListHas(old, sc.Name) {
+			log.Printf("Schedule %s is active now", sc.Name)
+		}
+	}
+	for _, sc := range old {
+		if !scheduleListHas(active, sc.Name) {
+			log.Printf("Schedule %s is not active anymore", sc.Name)
+		}
+	}
+}
+
+func scheduleListHas(list []activeSchedule, name string) bool {
+	for _, sc := range list {
+		if sc.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runScheduler updates the active schedules every minute
+func runScheduler() {
+	updateActiveSchedules()
+	for range time.Tick(time.Minute) {
+		updateActiveSchedules()
+	}
+}
+
+// --------------
+// dns/schedule/*
+// --------------
+func handleGetSchedules(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	schedules := make([]schedule, len(config.Schedules))
+	copy(schedules, config.Schedules)
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(schedules)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal schedules json: %s", err)
+		return
+	}
+}
+
+// handleAddSchedule adds the schedule or replaces the existing one with the same name
+func handleAddSchedule(w http.ResponseWriter, r *http.Request) {
+	sc := schedule{}
+	err := json.NewDecoder(r.Body).Decode(&sc)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse schedule json: %s", err)
+		return
+	}
+
+	config.Lock()
+	err = sc.validate()
+	if err == nil {
+		i := findSchedule(sc.Name)
+		if i >= 0 {
+			config.Schedules[i] = sc
+		} else {
+			config.Schedules = append(config.Schedules, sc)
+		}
+	}
+	config.Unlock()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	updateActiveSchedules()
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
+
+// handleDeleteSchedule removes the schedule with the name from the request body, it's removed from all clients too
+func handleDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name string `json:"name"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse schedule json: %s", err)
+		return
+	}
+
+	config.Lock()
+	i := findSchedule(req.Name)
+	if i >= 0 {
+		config.Schedules = append(config.Schedules[:i], config.Schedules[i+1:]...)
+		clientSchedules := []clientSchedule{}
+		for _, cs := range config.ClientSchedules {
+			if cs.ScheduleName != req.Name {
+				clientSchedules = append(clientSchedules, cs)
+			}
+		}
+		config.ClientSchedules = clientSchedules
+	}
+	config.Unlock()
+	if i < 0 {
+		httpError(w, http.StatusNotFound, "Schedule %s not found", req.Name)
+		return
+	}
+
+	updateActiveSchedules()
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
+
+// findClientSchedule returns the index of the association of the schedule with the client, or -1
+// config must be locked by the caller
+func findClientSchedule(cs clientSchedule) int {
+	for i := range config.ClientSchedules {
+		if config.ClientSchedules[i] == cs {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseClientScheduleJSON reads the association from the request body and normalizes the client IP
+func parseClientScheduleJSON(r *http.Request) (clientSchedule, error) {
+	cs := clientSchedule{}
+	err := json.NewDecoder(r.Body).Decode(&cs)
+	if err != nil {
+		return cs, fmt.Errorf("failed to parse client schedule json: %s", err)
+	}
+	ip := net.ParseIP(cs.ClientIP)
+	if ip == nil {
+		return cs, fmt.Errorf("%s is not a valid IP address", cs.ClientIP)
+	}
+	cs.ClientIP = ip.String()
+	return cs, nil
+}
+
+// ---------------------
+// dns/client_schedule/*
+// ---------------------
+func handleGetClientSchedules(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	clientSchedules := make([]clientSchedule, len(config.ClientSchedules))
+	copy(clientSchedules, config.ClientSchedules)
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(clientSchedules)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal client schedules json: %s", err)
+		return
+	}
+}
+
+// handleAddClientSchedule associates the schedule with the client
+// from now on the schedule is applied only to its clients
+func handleAddClientSchedule(w http.ResponseWriter, r *http.Request) {
+	cs, err := parseClientScheduleJSON(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	found := findSchedule(cs.ScheduleName) >= 0
+	if found && findClientSchedule(cs) < 0 {
+		config.ClientSchedules = append(config.ClientSchedules, cs)
+	}
+	config.Unlock()
+	if !found {
+		httpError(w, http.StatusBadRequest, "Schedule %s not found", cs.ScheduleName)
+		return
+	}
+
+	updateActiveSchedules()
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
+
+// handleDeleteClientSchedule removes the association of the schedule with the client
+// if it was the last client of the schedule, the schedule is applied to all clients again
+func handleDeleteClientSchedule(w http.ResponseWriter, r *http.Request) {
+	cs, err := parseClientScheduleJSON(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	i := findClientSchedule(cs)
+	if i >= 0 {
+		config.ClientSchedules = append(config.ClientSchedules[:i], config.ClientSchedules[i+1:]...)
+	}
+	config.Unlock()
+	if i < 0 {
+		httpError(w, http.StatusNotFound, "Schedule %s is not associated with %s", cs.ScheduleName, cs.ClientIP)
+		return
+	}
+
+	updateActiveSchedules()
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
+
+// --------------------------------
+// dns/schedule/conflict_resolution
+// --------------------------------
+type scheduleConflictJSON struct {
+	Mode string `json:"mode"`
+}
+
+func handleGetScheduleConflict(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	data := scheduleConflictJSON{Mode: config.ScheduleConflict}
+	config.RUnlock()
+	if data.Mode == "" {
+		data.Mode = scheduleConflictLastWins
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal schedule conflict resolution json: %s", err)
+		return
+	}
+}
+
+func handleSetScheduleConflict(w http.ResponseWriter, r *http.Request) {
+	data := scheduleConflictJSON{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse schedule conflict resolution json: %s", err)
+		return
+	}
+	if data.Mode != scheduleConflictLastWins && data.Mode != scheduleConflictMostRestrictive {
+		httpError(w, http.StatusBadRequest, "mode must be either %s or %s", scheduleConflictLastWins, scheduleConflictMostRestrictive)
+		return
+	}
+
+	config.Lock()
+	config.ScheduleConflict = data.Mode
+	config.Unlock()
+
+	updateActiveSchedules()
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScheduleTime(t *testing.T) {
+	m, err := parseScheduleTime("00:00")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, m)
+	m, err = parseScheduleTime("21:30")
+	assert.Nil(t, err)
+	assert.Equal(t, 21*60+30, m)
+
+	for _, s := range []string{"", "24:00", "9:60", "21.30", "bedtime"} {
+		_, err = parseScheduleTime(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestScheduleIsActive(t *testing.T) {
+	// 2019-01-07 is Monday
+	at := func(day int, hour int, min int) time.Time {
+		return time.Date(2019, 1, day, hour, min, 0, 0, time.Local)
+	}
+	bedtime := schedule{Days: []string{"Mon"}, StartTime: "21:00", EndTime: "07:00"}
+	assert.False(t, bedtime.isActive(at(7, 20, 59)))
+	assert.True(t, bedtime.isActive(at(7, 21, 0)))
+	// the range ends on the next day
+	assert.True(t, bedtime.isActive(at(8, 6, 59)))
+	assert.False(t, bedtime.isActive(at(8, 7, 0)))
+	assert.False(t, bedtime.isActive(at(8, 21, 0)))
+	assert.False(t, bedtime.isActive(at(7, 6, 0)))
+
+	school := schedule{Days: []string{"Mon", "Fri"}, StartTime: "08:00", EndTime: "15:00"}
+	assert.True(t, school.isActive(at(7, 8, 0)))
+	assert.False(t, school.isActive(at(7, 15, 0)))
+	assert.True(t, school.isActive(at(11, 12, 0)))
+	assert.False(t, school.isActive(at(9, 12, 0)))
+
+	weekend := schedule{Days: []string{"Sat", "Sun"}, StartTime: "00:00", EndTime: "00:00"}
+	assert.True(t, weekend.isActive(at(12, 0, 0)))
+	assert.True(t, weekend.isActive(at(13, 23, 59)))
+	assert.False(t, weekend.isActive(at(14, 0, 0)))
+
+	invalid := schedule{Days: []string{"Mon"}, StartTime: "21:00", EndTime: "bedtime"}
+	assert.False(t, invalid.isActive(at(7, 22, 0)))
+}
+
+func TestScheduleValidate(t *testing.T) {
+	oldSensitivity := config.DNS.ParentalSensitivity
+	defer func() { config.DNS.ParentalSensitivity = oldSensitivity }()
+	config.DNS.ParentalSensitivity = 0
+
+	enabled := true
+	valid := schedule{Name: "bedtime", Days: []string{"Mon", "Sun"}, StartTime: "21:00", EndTime: "07:00"}
+	assert.Nil(t, valid.validate())
+
+	for _, sc := range []schedule{
+		{Days: []string{"Mon"}, StartTime: "21:00", EndTime: "07:00"},
+		{Name: "bedtime", StartTime: "21:00", EndTime: "07:00"},
+		{Name: "bedtime", Days: []string{"Monday"}, StartTime: "21:00", EndTime: "07:00"},
+		{Name: "bedtime", Days: []string{"Mon"}, StartTime: "9pm", EndTime: "07:00"},
+		{Name: "bedtime", Days: []string{"Mon"}, StartTime: "21:00", EndTime: ""},
+		// the global sensitivity isn't set
+		{Name: "bedtime", Days: []string{"Mon"}, StartTime: "21:00", EndTime: "07:00", Config: scheduleSettings{ParentalEnabled: &enabled}},
+		{Name: "bedtime", Days: []string{"Mon"}, StartTime: "21:00", EndTime: "07:00", Config: scheduleSettings{ParentalEnabled: &enabled, ParentalSensitivity: 5}},
+	} {
+		assert.NotNil(t, sc.validate(), "%+v", sc)
+	}
+
+	valid.Config = scheduleSettings{ParentalEnabled: &enabled, ParentalSensitivity: 13}
+	assert.Nil(t, valid.validate())
+	config.DNS.ParentalSensitivity = 13
+	valid.Config.ParentalSensitivity = 0
+	assert.Nil(t, valid.validate())
+}
+
+func TestScheduleSettingsApply(t *testing.T) {
+	enabled := true
+	disabled := false
+	settings := dnsfilter.Config{ParentalSensitivity: 13, SafeSearchEnabled: true, SafeBrowsingEnabled: true}
+
+	scheduleSettings{ParentalEnabled: &enabled, SafeSearchEnabled: &disabled}.apply(&settings)
+	assert.True(t, settings.ParentalEnabled)
+	assert.Equal(t, 13, settings.ParentalSensitivity)
+	assert.False(t, settings.SafeSearchEnabled)
+	// nil fields aren't changed
+	assert.True(t, settings.SafeBrowsingEnabled)
+
+	scheduleSettings{ParentalEnabled: &enabled, ParentalSensitivity: 3}.apply(&settings)
+	assert.Equal(t, 3, settings.ParentalSensitivity)
+}
+
+func TestScheduleSettingsMerge(t *testing.T) {
+	enabled := true
+	disabled := false
+
+	merged := scheduleSettings{ParentalEnabled: &disabled, SafeSearchEnabled: &enabled}.merge(
+		scheduleSettings{ParentalEnabled: &enabled, ParentalSensitivity: 13, SafeSearchEnabled: &disabled, SafeBrowsingEnabled: &disabled})
+	assert.True(t, *merged.ParentalEnabled)
+	assert.Equal(t, 13, merged.ParentalSensitivity)
+	assert.True(t, *merged.SafeSearchEnabled)
+	assert.False(t, *merged.SafeBrowsingEnabled)
+
+	// the youngest age wins
+	merged = scheduleSettings{ParentalEnabled: &enabled, ParentalSensitivity: 13}.merge(
+		scheduleSettings{ParentalEnabled: &enabled, ParentalSensitivity: 3})
+	assert.Equal(t, 3, merged.ParentalSensitivity)
+	merged = scheduleSettings{ParentalEnabled: &enabled, ParentalSensitivity: 3}.merge(
+		scheduleSettings{ParentalEnabled: &enabled})
+	assert.Equal(t, 3, merged.ParentalSensitivity)
+
+	// the sensitivity of the disabled parental control is ignored
+	merged = scheduleSettings{ParentalEnabled: &enabled, ParentalSensitivity: 13}.merge(
+		scheduleSettings{ParentalEnabled: &disabled, ParentalSensitivity: 3})
+	assert.True(t, *merged.ParentalEnabled)
+	assert.Equal(t, 13, merged.ParentalSensitivity)
+
+	merged = scheduleSettings{}.merge(scheduleSettings{})
+	assert.Nil(t, merged.ParentalEnabled)
+	assert.Nil(t, merged.SafeSearchEnabled)
+	assert.Nil(t, merged.SafeBrowsingEnabled)
+}
+
+func TestActiveScheduleAppliesTo(t *testing.T) {
+	global := activeSchedule{}
+	assert.True(t, global.appliesTo("192.168.1.15"))
+	assert.True(t, global.appliesTo(""))
+
+	sc := activeSchedule{clients: []string{"192.168.1.15", "2001:db8::1"}}
+	assert.True(t, sc.appliesTo("192.168.1.15"))
+	assert.True(t, sc.appliesTo("2001:DB8:0::1"))
+	assert.False(t, sc.appliesTo("192.168.1.16"))
+	assert.False(t, sc.appliesTo("not an IP"))
+}
+
+func TestApplySchedules(t *testing.T) {
+	oldList := activeSchedules.list
+	oldMostRestrictive := activeSchedules.mostRestrictive
+	defer func() {
+		activeSchedules.list = oldList
+		activeSchedules.mostRestrictive = oldMostRestrictive
+	}()
+
+	enabled := true
+	disabled := false
+	// the client schedule is listed first, but the global ones are applied before it
+	activeSchedules.list = []activeSchedule{
+		{schedule: schedule{Name: "kid", Config: scheduleSettings{SafeSearchEnabled: &disabled}}, clients: []string{"192.168.1.15"}},
+		{schedule: schedule{Name: "bedtime", Config: scheduleSettings{SafeSearchEnabled: &enabled, ParentalEnabled: &enabled}}},
+	}
+	activeSchedules.mostRestrictive = false
+
+	settings := dnsfilter.Config{}
+	applySchedules("192.168.1.15", &settings)
+	assert.False(t, settings.SafeSearchEnabled)
+	assert.True(t, settings.ParentalEnabled)
+
+	settings = dnsfilter.Config{}
+	applySchedules("192.168.1.16", &settings)
+	assert.True(t, settings.SafeSearchEnabled)
+	assert.True(t, settings.ParentalEnabled)
+
+	activeSchedules.mostRestrictive = true
+	settings = dnsfilter.Config{}
+	applySchedules("192.168.1.15", &settings)
+	assert.True(t, settings.SafeSearchEnabled)
+	assert.True(t, settings.ParentalEnabled)
+
+	activeSchedules.list = nil
+	settings = dnsfilter.Config{SafeBrowsingEnabled: true}
+	applySchedules("192.168.1.15", &settings)
+	assert.Equal(t, dnsfilter.Config{SafeBrowsingEnabled: true}, settings)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hmage/golibs/log"
+)
+
+// the file downloaded by the speed test if speed_test_url isn't set
+const defaultSpeedTestURL = "https://adguardteam.github.io/AdGuardSDNSFilter/Filters/filter.txt"
+
+const (
+	defaultSpeedTestTimeout = 30 // in seconds
+	maxSpeedTestTimeout     = 60 // in seconds
+)
+
+type speedTestRequestJSON struct {
+	TimeoutSeconds int `json:"timeout_seconds"`
+}
+
+type speedTestJSON struct {
+	DownloadMbps float64 `json:"download_mbps"`
+	ElapsedMs    int64   `json:"elapsed_ms"`
+	Bytes        int64   `json:"bytes"`
+}
+
+// runSpeedTest downloads the file and measures the download rate
+// if the timeout expires, the rate of the part downloaded so far is returned
+func runSpeedTest(url string, timeout time.Duration) (speedTestJSON, error) {
+	c := &http.Client{Timeout: timeout}
+	start := time.Now()
+	resp, err := c.Get(url)
+	if err != nil {
+		return speedTestJSON{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return speedTestJSON{}, fmt.Errorf("got status code %d from %s", resp.StatusCode, url)
+	}
+
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		netErr, ok := err.(net.Error)
+		if !ok || !netErr.Timeout() || n == 0 {
+			return speedTestJSON{}, err
+		}
+		log.Printf("Speed test timed out after %d bytes", n)
+	}
+	elapsed := time.Since(start)
+
+	result := speedTestJSON{
+		ElapsedMs: elapsed.Nanoseconds() / int64(time.Millisecond),
+		Bytes:     n,
+	}
+	if elapsed > 0 {
+		result.DownloadMbps = float64(n) * 8 / elapsed.Seconds() / 1000000
+	}
+	return result, nil
+}
+
+// ------------------
+// network/speed_test
+// ------------------
+func handleSpeedTest(w http.ResponseWriter, r *http.Request) {
+	req := speedTestRequestJSON{}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "Failed to parse speed test json: %s", err)
+			return
+		}
+	}
+	if req.TimeoutSeconds < 0 || req.TimeoutSeconds > maxSpeedTestTimeout {
+		httpError(w, http.StatusBadRequest, "timeout_seconds must be between 1 and %d", maxSpeedTestTimeout)
+		return
+	}
+	if req.TimeoutSeconds == 0 {
+		req.TimeoutSeconds = defaultSpeedTestTimeout
+	}
+
+	config.RLock()
+	url := config.SpeedTestURL
+	config.RUnlock()
+	if url == "" {
+		url = defaultSpeedTestURL
+	}
+
+	result, err := runSpeedTest(url, time.Duration(req.TimeoutSeconds)*time.Second)
+	if err != nil {
+		httpError(w, http.StatusBadGateway, "Speed test failed: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal speed test json: %s", err)
+		return
+	}
+}
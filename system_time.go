@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/hmage/golibs/log"
+)
+
+// the clock offset above which TLS certificates validation may fail
+const maxNTPOffset = 30 * time.Second
+
+type systemTimeJSON struct {
+	ServerTime  time.Time `json:"server_time"`
+	Timezone    string    `json:"timezone"`
+	NTPSynced   bool      `json:"ntp_synced"`
+	NTPOffsetMs int64     `json:"ntp_offset_ms"`
+}
+
+// ntpStatus is the state of the system clock synchronization
+type ntpStatus struct {
+	synced bool
+	offset time.Duration // the estimated offset from the NTP time
+}
+
+// isTimeOffsetTooLarge returns true if the system clock is known to be more than maxNTPOffset off
+func isTimeOffsetTooLarge() bool {
+	st, err := getNTPStatus()
+	if err != nil {
+		return false
+	}
+	return st.offset > maxNTPOffset || st.offset < -maxNTPOffset
+}
+
+// -----------
+// system/time
+// -----------
+func handleSystemTime(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	zone, _ := now.Zone()
+	data := systemTimeJSON{
+		ServerTime: now,
+		Timezone:   zone,
+	}
+
+	st, err := getNTPStatus()
+	if err != nil {
+		log.Tracef("Couldn't get NTP status: %s", err)
+	} else {
+		data.NTPSynced = st.synced
+		data.NTPOffsetMs = st.offset.Nanoseconds() / int64(time.Millisecond)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal system time json: %s", err)
+		return
+	}
+}
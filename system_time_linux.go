@@ -0,0 +1,33 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// kernel clock status bits, see adjtimex(2)
+const (
+	staUnsync = 0x0040 // the clock is not synchronized
+	staNano   = 0x2000 // the offset is in nanoseconds instead of microseconds
+)
+
+// the adjtimex return value when the clock is not synchronized
+const timeError = 5
+
+// getNTPStatus reads the clock synchronization state from the kernel, it's what timedatectl shows too
+func getNTPStatus() (ntpStatus, error) {
+	tx := syscall.Timex{}
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return ntpStatus{}, err
+	}
+
+	st := ntpStatus{
+		synced: state != timeError && tx.Status&staUnsync == 0,
+		offset: time.Duration(tx.Offset) * time.Microsecond,
+	}
+	if tx.Status&staNano != 0 {
+		st.offset = time.Duration(tx.Offset)
+	}
+	return st, nil
+}
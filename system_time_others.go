@@ -0,0 +1,12 @@
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func getNTPStatus() (ntpStatus, error) {
+	return ntpStatus{}, fmt.Errorf("NTP status is not supported on %s", runtime.GOOS)
+}
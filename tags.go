@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// clientTag is a label that can be assigned to clients, e.g. "kids" or "iot"
+type clientTag struct {
+	Name        string `yaml:"name" json:"name"`
+	Description string `yaml:"description" json:"description"`
+}
+
+// tag names are separated by spaces in the clients CSV, so they can't contain whitespace
+var tagNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// findTag returns the index of the tag with the specified name, or -1
+// config must be locked by the caller
+func findTag(name string) int {
+	for i := range config.Tags {
+		if config.Tags[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// validateClientTags checks that all tags of the client are defined
+// config must be locked by the caller
+func validateClientTags(tags []string) error {
+	for _, name := range tags {
+		if findTag(name) < 0 {
+			return fmt.Errorf("tag %s is not defined", name)
+		}
+	}
+	return nil
+}
+
+// ----
+// tags
+// ----
+func handleGetTags(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	tags := make([]clientTag, len(config.Tags))
+	copy(tags, config.Tags)
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(tags)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal tags json: %s", err)
+		return
+	}
+}
+
+func handleAddTag(w http.ResponseWriter, r *http.Request) {
+	t := clientTag{}
+	err := json.NewDecoder(r.Body).Decode(&t)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse tag json: %s", err)
+		return
+	}
+
+	if !tagNamePattern.MatchString(t.Name) {
+		httpError(w, http.StatusBadRequest, "Tag name must consist of letters, digits, '_', '.' or '-'")
+		return
+	}
+
+	config.Lock()
+	exists := findTag(t.Name) >= 0
+	if !exists {
+		config.Tags = append(config.Tags, t)
+	}
+	config.Unlock()
+	if exists {
+		httpError(w, http.StatusBadRequest, "Tag %s already exists", t.Name)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleDeleteTag removes the tag specified in the URL path, it's removed from all clients too
+func handleDeleteTag(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/control/tags/")
+
+	config.Lock()
+	i := findTag(name)
+	if i >= 0 {
+		config.Tags = append(config.Tags[:i], config.Tags[i+1:]...)
+		for j := range config.Clients {
+			c := &config.Clients[j]
+			tags := []string{}
+			for _, t := range c.Tags {
+				if t != name {
+					tags = append(tags, t)
+				}
+			}
+			c.Tags = tags
+		}
+	}
+	config.Unlock()
+	if i < 0 {
+		httpError(w, http.StatusNotFound, "Tag %s not found", name)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/hmage/golibs/log"
+)
+
+// maximum number of the certificates downloaded while building the chain
+const maxChainDownloads = 10
+
+// maximum size of a downloaded certificate
+const maxCertificateSize = 64 * 1024
+
+type downloadChainJSON struct {
+	Certificate string `json:"certificate"` // base64-encoded PEM
+}
+
+// downloadIssuer downloads the certificate from the caIssuers URL of the Authority Information Access extension
+// both DER and PEM certificates are accepted
+func downloadIssuer(url string) (*x509.Certificate, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("unsupported issuer URL %s", url)
+	}
+	resp, err := client.Get(url)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got status code %d from %s", resp.StatusCode, url)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCertificateSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(body); block != nil && block.Type == "CERTIFICATE" {
+		body = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(body)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse the certificate from %s: %s", url, err)
+	}
+	return cert, nil
+}
+
+// buildChain follows the caIssuers URLs starting from the first certificate until it gets to a self-signed one
+// the certificates of the input that follow the first one are used instead of downloading them
+func buildChain(certs []*x509.Certificate) ([]*x509.Certificate, error) {
+	chain := []*x509.Certificate{certs[0]}
+	downloads := 0
+	for {
+		cert := chain[len(chain)-1]
+		if bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(cert) == nil {
+			return chain, nil
+		}
+
+		var issuer *x509.Certificate
+		for _, c := range certs[1:] {
+			if cert.CheckSignatureFrom(c) == nil {
+				issuer = c
+				break
+			}
+		}
+		if issuer == nil {
+			if len(cert.IssuingCertificateURL) == 0 {
+				if len(chain) == 1 {
+					return nil, fmt.Errorf("the certificate has no issuer URL")
+				}
+				// the issuer is expected to be in the system root store
+				return chain, nil
+			}
+			if downloads == maxChainDownloads {
+				return nil, fmt.Errorf("the chain is too long")
+			}
+			downloads++
+
+			url := cert.IssuingCertificateURL[0]
+			log.Tracef("Downloading the issuer of %s from %s", cert.Subject, url)
+			var err error
+			issuer, err = downloadIssuer(url)
+			if err != nil {
+				return nil, err
+			}
+			err = cert.CheckSignatureFrom(issuer)
+			if err != nil {
+				return nil, fmt.Errorf("the certificate from %s is not the issuer of %s: %s", url, cert.Subject, err)
+			}
+		}
+		for _, c := range chain {
+			if c.Equal(issuer) {
+				return nil, fmt.Errorf("the chain has a loop at %s", issuer.Subject)
+			}
+		}
+		chain = append(chain, issuer)
+	}
+}
+
+// ------------------
+// tls/download_chain
+// ------------------
+func handleTLSDownloadChain(w http.ResponseWriter, r *http.Request) {
+	req := downloadChainJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse download chain json: %s", err)
+		return
+	}
+	certPEM, err := base64.StdEncoding.DecodeString(req.Certificate)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to base64-decode certificate: %s", err)
+		return
+	}
+
+	certs := []*x509.Certificate{}
+	for rest := certPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "Failed to parse certificate: %s", err)
+			return
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		httpError(w, http.StatusBadRequest, "No certificates found")
+		return
+	}
+
+	chain, err := buildChain(certs)
+	if err != nil {
+		httpError(w, http.StatusBadGateway, "Couldn't build the certificate chain: %s", err)
+		return
+	}
+
+	buf := bytes.Buffer{}
+	for _, cert := range chain {
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	data := downloadChainJSON{Certificate: base64.StdEncoding.EncodeToString(buf.Bytes())}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal certificate chain json: %s", err)
+		return
+	}
+}
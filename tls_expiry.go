@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// the certificate expiration is warned about in the log and the API when fewer days than this are left
+const certExpiryWarningDays = 30
+
+type certExpiryJSON struct {
+	NotAfter      time.Time `json:"not_after"`
+	DaysRemaining int       `json:"days_remaining"` // negative if the certificate has expired
+	Expired       bool      `json:"expired"`
+	Warning       string    `json:"warning"` // empty unless fewer than certExpiryWarningDays are left
+}
+
+// getCertExpiry returns the expiration status of the first certificate of the configured chain
+func getCertExpiry(data tlsConfig) (certExpiryJSON, error) {
+	if data.CertificateChain == "" {
+		return certExpiryJSON{}, fmt.Errorf("TLS certificate is not configured")
+	}
+	data = validateCertificates(data)
+	if !data.ValidCert || data.NotAfter.IsZero() {
+		return certExpiryJSON{}, fmt.Errorf("invalid TLS certificate: %s", data.WarningValidation)
+	}
+
+	left := time.Until(data.NotAfter)
+	result := certExpiryJSON{
+		NotAfter:      data.NotAfter,
+		DaysRemaining: int(left / (24 * time.Hour)),
+		Expired:       left <= 0,
+	}
+	switch {
+	case result.Expired:
+		result.Warning = fmt.Sprintf("Certificate expired on %s", data.NotAfter.Format(time.RFC1123))
+	case result.DaysRemaining < certExpiryWarningDays:
+		result.Warning = fmt.Sprintf("Certificate expires in %d days", result.DaysRemaining)
+	}
+	return result, nil
+}
+
+// ----------------
+// tls/check_expiry
+// ----------------
+func handleTLSCheckExpiry(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	data := config.TLS
+	config.RUnlock()
+
+	result, err := getCertExpiry(data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal certificate expiry json: %s", err)
+		return
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hmage/golibs/log"
+)
+
+// auto-update schedules
+const (
+	autoUpdateDaily  = "daily"
+	autoUpdateWeekly = "weekly"
+)
+
+// version.json is published only for the stable channel
+const autoUpdateChannelStable = "stable"
+
+const (
+	updateDirName         = "agh-update" // the package is unpacked here, relative to the working directory
+	updateBackupDirName   = "agh-backup" // the binary and the config file are copied here before the update
+	updateMaxPackageSize  = 100 * 1024 * 1024
+	updateDownloadTimeout = 10 * time.Minute
+)
+
+// autoUpdateConfig is the settings of the automatic updates
+type autoUpdateConfig struct {
+	Enabled            bool   `yaml:"enabled" json:"enabled"`
+	Schedule           string `yaml:"schedule" json:"schedule"`                         // "daily" or "weekly"
+	Channel            string `yaml:"channel" json:"channel"`                           // only "stable" is supported
+	BackupBeforeUpdate bool   `yaml:"backup_before_update" json:"backup_before_update"` // copy the binary and the config file before replacing them
+}
+
+type autoUpdateStatusJSON struct {
+	autoUpdateConfig
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error"`
+}
+
+// versionInfo is the part of version.json used for the updates
+type versionInfo struct {
+	Version              string `json:"version"`
+	SelfUpdateMinVersion string `json:"selfupdate_min_version"`
+	downloads            map[string]string
+	checksums            map[string]string // hex-encoded SHA-256 of the packages
+}
+
+var updater = struct {
+	lastCheck time.Time
+	lastError string
+	sync.Mutex
+}{}
+
+// updateLock prevents running several updates at once
+var updateLock sync.Mutex
+
+// parseVersionInfo parses version.json, download URLs and package checksums are stored by "<os>_<arch>"
+func parseVersionInfo(data []byte) (versionInfo, error) {
+	info := versionInfo{}
+	err := json.Unmarshal(data, &info)
+	if err != nil {
+		return info, err
+	}
+
+	all := map[string]interface{}{}
+	err = json.Unmarshal(data, &all)
+	if err != nil {
+		return info, err
+	}
+	info.downloads = map[string]string{}
+	info.checksums = map[string]string{}
+	for k, v := range all {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(k, "download_") {
+			info.downloads[strings.TrimPrefix(k, "download_")] = s
+		} else if strings.HasPrefix(k, "checksum_") {
+			info.checksums[strings.TrimPrefix(k, "checksum_")] = strings.ToLower(s)
+		}
+	}
+	return info, nil
+}
+
+// parseVersion converts "v0.98.1" to [0 98 1], the suffix after "-" is ignored
+func parseVersion(v string) ([]int, error) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexByte(v, '-'); i != -1 {
+		v = v[:i]
+	}
+	res := []int{}
+	for _, p := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", v)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// compareVersions returns -1, 0 or 1 if a is older, the same or newer than b
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		x, y := 0, 0
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkAndUpdate downloads version.json and updates AdGuard Home if there's a newer version
+// it returns false if there's nothing to update, it doesn't return if the update was applied
+func checkAndUpdate(backup bool) (bool, error) {
+	current, err := parseVersion(VersionString)
+	if err != nil {
+		return false, fmt.Errorf("current version %s is not a release version", VersionString)
+	}
+
+	data, err := getVersionJSON(true)
+	if err != nil {
+		return false, err
+	}
+	info, err := parseVersionInfo(data)
+	if err != nil {
+		return false, fmt.Errorf("couldn't parse version.json: %s", err)
+	}
+	latest, err := parseVersion(info.Version)
+	if err != nil {
+		return false, err
+	}
+	if compareVersions(latest, current) <= 0 {
+		return false, nil
+	}
+	if info.SelfUpdateMinVersion != "" {
+		min, err := parseVersion(info.SelfUpdateMinVersion)
+		if err == nil && compareVersions(current, min) < 0 {
+			return false, fmt.Errorf("%s can't be updated automatically to %s, the minimum version is %s", VersionString, info.Version, info.SelfUpdateMinVersion)
+		}
+	}
+
+	return true, performUpdate(info, backup)
+}
+
+// performUpdate downloads the package for this platform, verifies it, replaces the binary and restarts
+// it doesn't return if the update was successful
+func performUpdate(info versionInfo, backup bool) error {
+	updateLock.Lock()
+	defer updateLock.Unlock()
+
+	platform := runtime.GOOS + "_" + runtime.GOARCH
+	pkgURL, ok := info.downloads[platform]
+	if !ok || pkgURL == "" {
+		return fmt.Errorf("there's no package for %s in version.json", platform)
+	}
+	checksum, ok := info.checksums[platform]
+	if !ok || checksum == "" {
+		return fmt.Errorf("there's no checksum for %s in version.json", platform)
+	}
+	execPath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("couldn't find the current binary: %s", err)
+	}
+	execPath, err = filepath.EvalSymlinks(execPath)
+	if err != nil {
+		return fmt.Errorf("couldn't find the current binary: %s", err)
+	}
+
+	log.Printf("Updating AdGuard Home from %s to %s using %s", VersionString, info.Version, pkgURL)
+	pkg, err := downloadPackage(pkgURL)
+	if err != nil {
+		return err
+	}
+	err = verifyChecksum(pkg, checksum)
+	if err != nil {
+		return fmt.Errorf("invalid package %s: %s", pkgURL, err)
+	}
+	bin, err := unpackBinary(pkgURL, pkg)
+	if err != nil {
+		return fmt.Errorf("invalid package %s: %s", pkgURL, err)
+	}
+
+	updateDir := filepath.Join(config.ourWorkingDir, updateDirName)
+	err = os.MkdirAll(updateDir, 0755)
+	if err != nil {
+		return err
+	}
+	newPath := filepath.Join(updateDir, filepath.Base(execPath))
+	err = ioutil.WriteFile(newPath, bin, 0755)
+	if err != nil {
+		return fmt.Errorf("couldn't write the new binary: %s", err)
+	}
+
+	if backup {
+		err = backupBeforeUpdate(execPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the running binary can be renamed but not always overwritten
+	oldPath := filepath.Join(updateDir, filepath.Base(execPath)+".old")
+	os.Remove(oldPath)
+	err = os.Rename(execPath, oldPath)
+	if err != nil {
+		return fmt.Errorf("couldn't move the current binary: %s", err)
+	}
+	err = copyFile(newPath, execPath, 0755)
+	if err != nil {
+		// put the old binary back so that AdGuard Home can start again
+		os.Rename(oldPath, execPath)
+		return fmt.Errorf("couldn't install the new binary: %s", err)
+	}
+
+	log.Printf("AdGuard Home was updated to %s, restarting", info.Version)
+	stopServersForRestart()
+	err = restartProcess(execPath)
+
+	// we're still running, so put the old binary back to start the same version next time
+	log.Printf("Couldn't restart AdGuard Home, restoring %s", VersionString)
+	os.Remove(execPath)
+	os.Rename(oldPath, execPath)
+	startServersAfterFailedRestart()
+	return fmt.Errorf("couldn't start the new binary: %s", err)
+}
+
+// webServersHold is locked while the new binary is being started, the web servers don't listen again until it's unlocked
+var webServersHold sync.Mutex
+
+// stopServersForRestart frees the ports for the new binary and flushes the query log
+func stopServersForRestart() {
+	webServersHold.Lock()
+	if httpServer != nil {
+		httpServer.Close()
+	}
+	httpsServer.cond.L.Lock()
+	if httpsServer.server != nil {
+		httpsServer.server.Close()
+	}
+	httpsServer.cond.L.Unlock()
+
+	stopBlockPageServer()
+	stopDNSCryptServer()
+	cleanup()
+}
+
+// startServersAfterFailedRestart starts the servers stopped by stopServersForRestart again
+func startServersAfterFailedRestart() {
+	webServersHold.Unlock()
+
+	err := startDNSServer()
+	if err != nil {
+		log.Printf("Couldn't start the DNS server: %s", err)
+	}
+	err = startDHCPServer()
+	if err != nil {
+		log.Printf("Couldn't start the DHCP server: %s", err)
+	}
+	err = startBlockPageServer()
+	if err != nil {
+		log.Printf("Couldn't start the block page server: %s", err)
+	}
+	err = startDNSCryptServer()
+	if err != nil {
+		log.Printf("Couldn't start the DNSCrypt server: %s", err)
+	}
+}
+
+// verifyChecksum compares the SHA-256 of the package with the hex-encoded checksum from version.json
+func verifyChecksum(pkg []byte, checksum string) error {
+	sum := sha256.Sum256(pkg)
+	if hex.EncodeToString(sum[:]) != checksum {
+		return fmt.Errorf("checksum mismatch")
+	}
+	return nil
+}
+
+func downloadPackage(url string) ([]byte, error) {
+	c := &http.Client{Timeout: updateDownloadTimeout}
+	resp, err := c.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't download %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("couldn't download %s: got status code %d", url, resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, updateMaxPackageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't download %s: %s", url, err)
+	}
+	if len(data) > updateMaxPackageSize {
+		return nil, fmt.Errorf("package %s is too large", url)
+	}
+	if resp.ContentLength > 0 && int64(len(data)) != resp.ContentLength {
+		return nil, fmt.Errorf("package %s is truncated: got %d bytes of %d", url, len(data), resp.ContentLength)
+	}
+	return data, nil
+}
+
+// unpackBinary checks that the package is a valid .zip or .tar.gz archive and returns the AdGuardHome binary from it
+func unpackBinary(name string, pkg []byte) ([]byte, error) {
+	binName := "AdGuardHome"
+	if runtime.GOOS == "windows" {
+		binName += ".exe"
+	}
+
+	var bin []byte
+	if strings.HasSuffix(name, ".zip") {
+		r, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range r.File {
+			if f.FileInfo().IsDir() || filepath.Base(f.Name) != binName {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			// the checksum of the file is verified when it's read till the end
+			bin, err = ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	} else if strings.HasSuffix(name, ".tar.gz") {
+		gz, err := gzip.NewReader(bytes.NewReader(pkg))
+		if err != nil {
+			return nil, err
+		}
+		r := tar.NewReader(gz)
+		for {
+			h, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if h.Typeflag != tar.TypeReg || filepath.Base(h.Name) != binName {
+				continue
+			}
+			bin, err = ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// the gzip checksum is verified at the end of the stream
+		_, err = io.Copy(ioutil.Discard, gz)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("unknown archive format")
+	}
+
+	if len(bin) == 0 {
+		return nil, fmt.Errorf("%s is not found in the archive", binName)
+	}
+	return bin, nil
+}
+
+// backupBeforeUpdate copies the binary and the config file to agh-backup/<current version>
+func backupBeforeUpdate(execPath string) error {
+	dir := filepath.Join(config.ourWorkingDir, updateBackupDirName, VersionString)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("couldn't create backup directory: %s", err)
+	}
+	err = copyFile(execPath, filepath.Join(dir, filepath.Base(execPath)), 0755)
+	if err != nil {
+		return fmt.Errorf("couldn't back up the binary: %s", err)
+	}
+	configPath := config.getConfigFilename()
+	err = copyFile(configPath, filepath.Join(dir, filepath.Base(configPath)), 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't back up the config file: %s", err)
+	}
+	log.Printf("Backed up the binary and the config file to %s", dir)
+	return nil
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, perm)
+}
+
+func autoUpdatePeriod(schedule string) time.Duration {
+	if schedule == autoUpdateWeekly {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// runAutoUpdate checks for the updates according to the configured schedule
+func runAutoUpdate() {
+	for range time.Tick(time.Hour) {
+		config.RLock()
+		c := config.AutoUpdate
+		config.RUnlock()
+		if !c.Enabled {
+			continue
+		}
+
+		updater.Lock()
+		due := time.Since(updater.lastCheck) >= autoUpdatePeriod(c.Schedule)
+		if due {
+			updater.lastCheck = time.Now()
+		}
+		updater.Unlock()
+		if !due {
+			continue
+		}
+
+		_, err := checkAndUpdate(c.BackupBeforeUpdate)
+		errText := ""
+		if err != nil {
+			errText = err.Error()
+			log.Printf("Auto-update failed: %s", err)
+		}
+		updater.Lock()
+		updater.lastError = errText
+		updater.Unlock()
+	}
+}
+
+// -------------------
+// updates/auto_update
+// -------------------
+func handleGetAutoUpdate(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	data := autoUpdateStatusJSON{autoUpdateConfig: config.AutoUpdate}
+	config.RUnlock()
+	updater.Lock()
+	data.LastCheck = updater.lastCheck
+	data.LastError = updater.lastError
+	updater.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal auto-update settings: %s", err)
+		return
+	}
+}
+
+func handleSetAutoUpdate(w http.ResponseWriter, r *http.Request) {
+	data := autoUpdateConfig{}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse auto-update json: %s", err)
+		return
+	}
+	if data.Schedule == "" {
+		data.Schedule = autoUpdateDaily
+	}
+	if data.Channel == "" {
+		data.Channel = autoUpdateChannelStable
+	}
+	if data.Schedule != autoUpdateDaily && data.Schedule != autoUpdateWeekly {
+		httpError(w, http.StatusBadRequest, "schedule must be one of: daily, weekly")
+		return
+	}
+	if data.Channel != autoUpdateChannelStable {
+		httpError(w, http.StatusBadRequest, "channel must be: stable")
+		return
+	}
+
+	config.Lock()
+	config.AutoUpdate = data
+	config.Unlock()
+
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
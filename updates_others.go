@@ -0,0 +1,22 @@
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// restartProcess starts the new binary with the same arguments and exits
+// the servers must be already stopped so that it can listen on the same ports, it returns only if starting it has failed
+func restartProcess(execPath string) error {
+	cmd := exec.Command(execPath, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
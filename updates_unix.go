@@ -0,0 +1,14 @@
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartProcess replaces the current process with the new binary keeping the same PID and arguments
+// the servers must be already stopped so that the unsaved data isn't lost, it returns only if exec has failed
+func restartProcess(execPath string) error {
+	return syscall.Exec(execPath, os.Args, os.Environ())
+}
@@ -10,7 +10,7 @@ import (
 	yaml "gopkg.in/yaml.v2"
 )
 
-const currentSchemaVersion = 2 // used for upgrading from old configs to new config
+const currentSchemaVersion = 3 // used for upgrading from old configs to new config
 
 // Performs necessary upgrade operations if needed
 func upgradeConfig() error {
@@ -59,12 +59,17 @@ func upgradeConfig() error {
 func upgradeConfigSchema(oldVersion int, diskConfig *map[string]interface{}) error {
 	switch oldVersion {
 	case 0:
-		err := upgradeSchema0to2(diskConfig)
+		err := upgradeSchema0to3(diskConfig)
 		if err != nil {
 			return err
 		}
 	case 1:
-		err := upgradeSchema1to2(diskConfig)
+		err := upgradeSchema1to3(diskConfig)
+		if err != nil {
+			return err
+		}
+	case 2:
+		err := upgradeSchema2to3(diskConfig)
 		if err != nil {
 			return err
 		}
@@ -144,3 +149,38 @@ func upgradeSchema0to2(diskConfig *map[string]interface{}) error {
 
 	return upgradeSchema1to2(diskConfig)
 }
+
+// Third schema upgrade:
+// dns.anonymize_client_ip is replaced with dns.anonymization_level
+func upgradeSchema2to3(diskConfig *map[string]interface{}) error {
+	log.Printf("%s(): called", _Func())
+
+	dns, ok := (*diskConfig)["dns"].(map[interface{}]interface{})
+	if ok {
+		if anonymize, ok := dns["anonymize_client_ip"].(bool); ok && anonymize {
+			dns["anonymization_level"] = "partial"
+		}
+		delete(dns, "anonymize_client_ip")
+	}
+	(*diskConfig)["schema_version"] = 3
+
+	return nil
+}
+
+func upgradeSchema1to3(diskConfig *map[string]interface{}) error {
+	err := upgradeSchema1to2(diskConfig)
+	if err != nil {
+		return err
+	}
+
+	return upgradeSchema2to3(diskConfig)
+}
+
+func upgradeSchema0to3(diskConfig *map[string]interface{}) error {
+	err := upgradeSchema0to2(diskConfig)
+	if err != nil {
+		return err
+	}
+
+	return upgradeSchema2to3(diskConfig)
+}
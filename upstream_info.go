@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+)
+
+// upstream protocols returned by /control/dns/upstream_info
+const (
+	upstreamProtoPlain    = "dns"
+	upstreamProtoTCP      = "dns-over-tcp"
+	upstreamProtoTLS      = "dns-over-tls"
+	upstreamProtoHTTPS    = "dns-over-https"
+	upstreamProtoDNSCrypt = "dnscrypt"
+)
+
+type upstreamInfoJSON struct {
+	Protocol   string `json:"protocol"`
+	TLSVersion string `json:"tls_version,omitempty"`
+	ALPN       string `json:"alpn,omitempty"`
+	DNSSECOK   bool   `json:"dnssec_ok"`
+	LatencyMs  int64  `json:"latency_ms"`
+	ServerName string `json:"server_name,omitempty"`
+}
+
+type upstreamSchemeJSON struct {
+	Scheme      string `json:"scheme"`
+	Description string `json:"description"`
+	Example     string `json:"example"`
+}
+
+// upstreamSchemes are the URL schemes supported by upstream.AddressToUpstream
+// an address without a scheme is plain DNS too
+var upstreamSchemes = []upstreamSchemeJSON{
+	{Scheme: "dns", Description: "Plain DNS over UDP", Example: "dns://8.8.8.8"},
+	{Scheme: "tcp", Description: "Plain DNS over TCP", Example: "tcp://8.8.8.8"},
+	{Scheme: "tls", Description: "DNS-over-TLS", Example: "tls://dns.google"},
+	{Scheme: "https", Description: "DNS-over-HTTPS", Example: "https://dns.google/dns-query"},
+	{Scheme: "sdns", Description: "DNS stamp, DNSCrypt or any protocol above", Example: "sdns://AQIAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20"},
+}
+
+// upstreamProtocol returns the protocol of the upstream address as it's understood by upstream.AddressToUpstream
+func upstreamProtocol(address string) (string, error) {
+	if !strings.Contains(address, "://") {
+		return upstreamProtoPlain, nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "tcp":
+		return upstreamProtoTCP, nil
+	case "tls":
+		return upstreamProtoTLS, nil
+	case "https":
+		return upstreamProtoHTTPS, nil
+	case "sdns":
+		stamp, err := dnsstamps.NewServerStampFromString(address)
+		if err != nil {
+			return "", err
+		}
+		switch stamp.Proto {
+		case dnsstamps.StampProtoTypeDNSCrypt:
+			return upstreamProtoDNSCrypt, nil
+		case dnsstamps.StampProtoTypeDoH:
+			return upstreamProtoHTTPS, nil
+		case dnsstamps.StampProtoTypeTLS:
+			return upstreamProtoTLS, nil
+		}
+		return upstreamProtoPlain, nil
+	default:
+		return upstreamProtoPlain, nil
+	}
+}
+
+func tlsVersionString(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+	return fmt.Sprintf("unknown (0x%04x)", version)
+}
+
+// probeUpstreamTLS performs the TLS handshake with the upstream the same way the DNS client does
+// hostPort is the upstream address, the host is resolved with the bootstrap DNS
+func probeUpstreamTLS(info *upstreamInfoJSON, hostPort string, alpn []string, timeout time.Duration) error {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return err
+	}
+
+	addr := hostPort
+	if net.ParseIP(host) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		resolver := upstream.NewResolver(config.DNS.BootstrapDNS, timeout)
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("couldn't resolve %s: %s", host, err)
+		}
+		if len(addrs) == 0 {
+			return fmt.Errorf("couldn't resolve %s", host)
+		}
+		addr = net.JoinHostPort(addrs[0].String(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host, NextProtos: alpn})
+	if err != nil {
+		return fmt.Errorf("TLS handshake with %s failed: %s", hostPort, err)
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	info.TLSVersion = tlsVersionString(state.Version)
+	info.ALPN = state.NegotiatedProtocol
+	info.ServerName = host
+	return nil
+}
+
+// -----------------
+// dns/upstream_info
+// -----------------
+func handleUpstreamInfo(w http.ResponseWriter, r *http.Request) {
+	address := strings.TrimSpace(r.URL.Query().Get("upstream"))
+	if address == "" {
+		httpError(w, http.StatusBadRequest, "upstream parameter is required")
+		return
+	}
+
+	info := upstreamInfoJSON{}
+	var err error
+	info.Protocol, err = upstreamProtocol(address)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse upstream %s: %s", address, err)
+		return
+	}
+
+	timeout := upstreamTimeout(address)
+	u, err := upstream.AddressToUpstream(address, upstream.Options{
+		Timeout:   timeout,
+		Bootstrap: []string{config.DNS.BootstrapDNS},
+	})
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to choose upstream for %s: %s", address, err)
+		return
+	}
+
+	// ask for the signed root SOA, DNSSEC-aware upstreams return it with RRSIG
+	req := dns.Msg{}
+	req.SetQuestion(".", dns.TypeSOA)
+	req.SetEdns0(4096, true)
+	start := time.Now()
+	reply, err := u.Exchange(&req)
+	if err != nil {
+		httpError(w, http.StatusBadGateway, "Couldn't communicate with DNS server %s: %s", address, err)
+		return
+	}
+	info.LatencyMs = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+
+	info.DNSSECOK = reply.AuthenticatedData
+	for _, rr := range reply.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			info.DNSSECOK = true
+			break
+		}
+	}
+
+	switch info.Protocol {
+	case upstreamProtoTLS:
+		err = probeUpstreamTLS(&info, u.Address(), []string{"dot"}, timeout)
+	case upstreamProtoHTTPS:
+		var parsed *url.URL
+		parsed, err = url.Parse(u.Address())
+		if err == nil {
+			err = probeUpstreamTLS(&info, parsed.Host, []string{"h2", "http/1.1"}, timeout)
+		}
+	}
+	if err != nil {
+		httpError(w, http.StatusBadGateway, "Couldn't probe TLS of %s: %s", address, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(info)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal upstream info json: %s", err)
+		return
+	}
+}
+
+// ----------------------
+// dns/upstream_protocols
+// ----------------------
+func handleUpstreamProtocols(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(upstreamSchemes)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal upstream protocols json: %s", err)
+		return
+	}
+}
+
+type upstreamTestExtendedRequestJSON struct {
+	Upstreams []string `json:"upstreams"`
+}
+
+type upstreamTestResultJSON struct {
+	Name           string `json:"name"`
+	OK             bool   `json:"ok"`
+	Error          string `json:"error,omitempty"`
+	Rcode          string `json:"rcode,omitempty"`
+	ResponseTimeMs int64  `json:"response_time_ms"`
+	TTL            uint32 `json:"ttl"` // minimum TTL of the answer records
+	EDNS           bool   `json:"edns"`
+}
+
+type upstreamTestExtendedJSON struct {
+	OK    bool                     `json:"ok"` // all tests passed
+	Error string                   `json:"error,omitempty"`
+	Tests []upstreamTestResultJSON `json:"tests"`
+}
+
+// upstreamTest is a query sent to the upstream and the check of its response
+type upstreamTest struct {
+	name  string
+	qname string
+	qtype uint16
+	check func(reply *dns.Msg) error
+}
+
+var upstreamTests = []upstreamTest{
+	{
+		name:  "nxdomain",
+		qname: "adguardhome-upstream-test.invalid.", // RFC 6761, must never resolve
+		qtype: dns.TypeA,
+		check: func(reply *dns.Msg) error {
+			if reply.Rcode != dns.RcodeNameError {
+				return fmt.Errorf("expected NXDOMAIN, got %s", dns.RcodeToString[reply.Rcode])
+			}
+			return nil
+		},
+	},
+	{
+		name:  "tld",
+		qname: "com.",
+		qtype: dns.TypeNS,
+		check: func(reply *dns.Msg) error {
+			if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) == 0 {
+				return fmt.Errorf("no NS records for com")
+			}
+			return nil
+		},
+	},
+	{
+		name:  "a_record",
+		qname: "google-public-dns-a.google.com.",
+		qtype: dns.TypeA,
+		check: func(reply *dns.Msg) error {
+			for _, rr := range reply.Answer {
+				if a, ok := rr.(*dns.A); ok && a.A.Equal(net.IPv4(8, 8, 8, 8)) {
+					return nil
+				}
+			}
+			return fmt.Errorf("wrong answer, expected 8.8.8.8")
+		},
+	},
+}
+
+// runUpstreamTest sends the test query and checks the response
+func runUpstreamTest(u upstream.Upstream, test upstreamTest) upstreamTestResultJSON {
+	result := upstreamTestResultJSON{Name: test.name}
+
+	req := dns.Msg{}
+	req.SetQuestion(test.qname, test.qtype)
+	req.SetEdns0(4096, false)
+	start := time.Now()
+	reply, err := u.Exchange(&req)
+	result.ResponseTimeMs = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Rcode = dns.RcodeToString[reply.Rcode]
+	result.EDNS = reply.IsEdns0() != nil
+	if len(reply.Answer) != 0 {
+		result.TTL = minAnswerTTL(reply.Answer)
+	}
+	err = test.check(reply)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.OK = true
+	return result
+}
+
+// minAnswerTTL returns the minimum TTL of the records
+func minAnswerTTL(rrs []dns.RR) uint32 {
+	ttl := rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+// testUpstreamExtended runs all upstreamTests against the upstream
+func testUpstreamExtended(address string) upstreamTestExtendedJSON {
+	result := upstreamTestExtendedJSON{Tests: []upstreamTestResultJSON{}}
+	u, err := upstream.AddressToUpstream(address, upstream.Options{
+		Timeout:   upstreamTimeout(address),
+		Bootstrap: []string{config.DNS.BootstrapDNS},
+	})
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to choose upstream for %s: %s", address, err)
+		return result
+	}
+
+	result.OK = true
+	for _, test := range upstreamTests {
+		t := runUpstreamTest(u, test)
+		result.OK = result.OK && t.OK
+		result.Tests = append(result.Tests, t)
+	}
+	return result
+}
+
+// --------------------------
+// dns/upstream_test_extended
+// --------------------------
+func handleUpstreamTestExtended(w http.ResponseWriter, r *http.Request) {
+	req := upstreamTestExtendedRequestJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse upstream test json: %s", err)
+		return
+	}
+	if len(req.Upstreams) == 0 {
+		httpError(w, http.StatusBadRequest, "No servers specified")
+		return
+	}
+
+	results := map[string]upstreamTestExtendedJSON{}
+	for _, address := range req.Upstreams {
+		address = strings.TrimSpace(address)
+		results[address] = testUpstreamExtended(address)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(results)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal upstream test json: %s", err)
+		return
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	whoisDefaultServer = "whois.iana.org"
+	whoisTimeout       = 5 * time.Second
+	whoisCacheTTL      = time.Hour
+	whoisMaxResponse   = 64 * 1024
+	whoisMaxRedirects  = 3
+)
+
+type whoisInfo struct {
+	IP      string `json:"ip"`
+	Org     string `json:"org"`
+	Country string `json:"country"`
+	ASN     string `json:"asn"`
+}
+
+type whoisCacheItem struct {
+	info whoisInfo
+	when time.Time
+}
+
+var whoisCache = struct {
+	items map[string]whoisCacheItem
+	sync.Mutex
+}{items: map[string]whoisCacheItem{}}
+
+// whoisQuery sends the query to the WHOIS server and returns the response
+func whoisQuery(server string, query string) (string, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(server, "43"), whoisTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(whoisTimeout))
+
+	_, err = fmt.Fprintf(conn, "%s\r\n", query)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(conn, whoisMaxResponse))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// parseWhois returns the "key: value" pairs of the WHOIS response, keys are lowercased
+// only the first value of each key is kept
+func parseWhois(data string) map[string]string {
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '%' || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		if _, ok := fields[key]; !ok && value != "" {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// firstField returns the first non-empty value of the keys
+func firstField(fields map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v := fields[k]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// lookupWhois asks IANA which registry is responsible for the IP and then queries that registry
+func lookupWhois(ip string) (whoisInfo, error) {
+	server := whoisDefaultServer
+	var fields map[string]string
+	for i := 0; i < whoisMaxRedirects; i++ {
+		data, err := whoisQuery(server, ip)
+		if err != nil {
+			return whoisInfo{}, err
+		}
+		fields = parseWhois(data)
+		refer := firstField(fields, "refer", "whois")
+		if refer == "" || refer == server {
+			break
+		}
+		server = strings.TrimPrefix(refer, "whois://")
+	}
+
+	asn := firstField(fields, "originas", "origin", "aut-num")
+	if asn != "" && !strings.HasPrefix(strings.ToUpper(asn), "AS") {
+		asn = "AS" + asn
+	}
+	return whoisInfo{
+		IP:      ip,
+		Org:     firstField(fields, "orgname", "org-name", "organization", "owner", "descr", "netname"),
+		Country: strings.ToUpper(firstField(fields, "country")),
+		ASN:     strings.ToUpper(asn),
+	}, nil
+}
+
+// getWhois returns the cached WHOIS info if it's not older than whoisCacheTTL, otherwise it looks it up
+func getWhois(ip string) (whoisInfo, error) {
+	whoisCache.Lock()
+	item, ok := whoisCache.items[ip]
+	whoisCache.Unlock()
+	if ok && time.Since(item.when) < whoisCacheTTL {
+		return item.info, nil
+	}
+
+	info, err := lookupWhois(ip)
+	if err != nil {
+		return info, err
+	}
+
+	whoisCache.Lock()
+	for k, v := range whoisCache.items {
+		if time.Since(v.when) >= whoisCacheTTL {
+			delete(whoisCache.items, k)
+		}
+	}
+	whoisCache.items[ip] = whoisCacheItem{info: info, when: time.Now()}
+	whoisCache.Unlock()
+	return info, nil
+}
+
+func handleQueryLogWhois(w http.ResponseWriter, r *http.Request) {
+	addr := net.ParseIP(r.URL.Query().Get("ip"))
+	if addr == nil {
+		httpError(w, http.StatusBadRequest, "ip parameter must be a valid IP address")
+		return
+	}
+
+	info, err := getWhois(addr.String())
+	if err != nil {
+		httpError(w, http.StatusBadGateway, "Couldn't get WHOIS info for %s: %s", addr, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(info)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal whois json: %s", err)
+		return
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/miekg/dns"
+)
+
+// findZone returns the index of the zone with the specified name, or -1
+// config must be locked by the caller
+func findZone(name string) int {
+	name = dnsforward.NormalizeZoneName(name)
+	for i := range config.DNS.Zones {
+		if dnsforward.NormalizeZoneName(config.DNS.Zones[i].Name) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// -----
+// zones
+// -----
+func handleGetZones(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	zones := make([]dnsforward.Zone, len(config.DNS.Zones))
+	copy(zones, config.DNS.Zones)
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(zones)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal zones json: %s", err)
+		return
+	}
+}
+
+func handleAddZone(w http.ResponseWriter, r *http.Request) {
+	z := dnsforward.Zone{}
+	err := json.NewDecoder(r.Body).Decode(&z)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse zone json: %s", err)
+		return
+	}
+
+	z.Name = dnsforward.NormalizeZoneName(z.Name)
+	if z.SOA.Serial == 0 {
+		z.SOA.Serial = 1
+	}
+	_, err = z.RRs()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Invalid zone: %s", err)
+		return
+	}
+
+	config.Lock()
+	exists := findZone(z.Name) >= 0
+	if !exists {
+		config.DNS.Zones = append(config.DNS.Zones, z)
+	}
+	config.Unlock()
+	if exists {
+		httpError(w, http.StatusBadRequest, "Zone %s already exists", z.Name)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleUpdateZone replaces the records of the zone specified in the URL path
+// SOA is replaced too if it's specified, the serial number is incremented unless it's specified explicitly
+func handleUpdateZone(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/control/dns/zones/")
+
+	req := struct {
+		SOA     *dnsforward.ZoneSOA     `json:"soa"`
+		Records []dnsforward.ZoneRecord `json:"records"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse zone json: %s", err)
+		return
+	}
+
+	config.Lock()
+	i := findZone(name)
+	if i < 0 {
+		config.Unlock()
+		httpError(w, http.StatusNotFound, "Zone %s not found", name)
+		return
+	}
+
+	z := config.DNS.Zones[i]
+	serial := z.SOA.Serial + 1
+	if req.SOA != nil {
+		z.SOA = *req.SOA
+		if z.SOA.Serial != 0 {
+			serial = z.SOA.Serial
+		}
+	}
+	z.SOA.Serial = serial
+	z.Records = req.Records
+
+	_, err = z.RRs()
+	if err == nil {
+		config.DNS.Zones[i] = z
+	}
+	config.Unlock()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Invalid zone: %s", err)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleDeleteZone removes the zone specified in the URL path
+func handleDeleteZone(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/control/dns/zones/")
+
+	config.Lock()
+	i := findZone(name)
+	if i >= 0 {
+		config.DNS.Zones = append(config.DNS.Zones[:i], config.DNS.Zones[i+1:]...)
+	}
+	config.Unlock()
+	if i < 0 {
+		httpError(w, http.StatusNotFound, "Zone %s not found", name)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleZoneTransfer exports the zone specified in the URL path
+// the zone file format (RFC 1035) is used by default, format=json returns the records with absolute names
+func handleZoneTransfer(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/control/dns/zone_transfer/")
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "zone" {
+		httpError(w, http.StatusBadRequest, "Unknown format: %s", format)
+		return
+	}
+
+	config.RLock()
+	i := findZone(name)
+	z := dnsforward.Zone{}
+	if i >= 0 {
+		z = config.DNS.Zones[i]
+	}
+	config.RUnlock()
+	if i < 0 {
+		httpError(w, http.StatusNotFound, "Zone %s not found", name)
+		return
+	}
+
+	rrs, err := z.RRs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Invalid zone %s: %s", name, err)
+		return
+	}
+
+	if format == "json" {
+		data := dnsforward.Zone{Name: dnsforward.NormalizeZoneName(z.Name)}
+		soa := rrs[0].(*dns.SOA)
+		data.SOA = dnsforward.ZoneSOA{
+			MName:   soa.Ns,
+			RName:   soa.Mbox,
+			Serial:  soa.Serial,
+			Refresh: soa.Refresh,
+			Retry:   soa.Retry,
+			Expire:  soa.Expire,
+			Minimum: soa.Minttl,
+		}
+		data.Records = []dnsforward.ZoneRecord{}
+		for _, rr := range rrs[1:] {
+			hdr := rr.Header()
+			data.Records = append(data.Records, dnsforward.ZoneRecord{
+				Name:  hdr.Name,
+				Type:  dns.TypeToString[hdr.Rrtype],
+				TTL:   hdr.Ttl,
+				Value: strings.TrimPrefix(rr.String(), hdr.String()),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(data)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Unable to marshal zone json: %s", err)
+			return
+		}
+		return
+	}
+
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "$ORIGIN %s\n", rrs[0].Header().Name)
+	for _, rr := range rrs {
+		sb.WriteString(rr.String())
+		sb.WriteString("\n")
+	}
+
+	w.Header().Set("Content-Type", "text/dns")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", dnsforward.NormalizeZoneName(z.Name)+".zone"))
+	_, err = w.Write([]byte(sb.String()))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write body: %s", err)
+	}
+}